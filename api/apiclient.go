@@ -18,15 +18,21 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
 
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Client interface
 type Client interface {
 	NewClient() (*ClientService, error)
+	GetSystemSerial() (serial string, err error)
 	CreateVolume(volume *VolumeParam, storagePoolName string) (*Volume, error)
 	GetStoragePoolIDByName(name string) (id int64, err error)
 	FindStoragePool(id int64, name string) (StoragePool, error)
@@ -50,6 +56,7 @@ type Client interface {
 	UnMapVolumeFromHost(hostID, volumeID int) (err error)
 	GetFCPorts() (fcNodes []FCNode, err error)
 	GetHostPort(hostID int, portAddress string) (hostPort HostPort, err error)
+	GetAllHosts() (hosts []Host, err error)
 
 	// for nfs
 	OneTimeValidation(poolname string, networkspace string) (list string, err error)
@@ -75,6 +82,7 @@ type Client interface {
 	UpdateFilesystem(fileSystemID int64, fileSystem FileSystem) (*FileSystem, error)
 	GetSnapshotByName(snapshotName string) (*[]FileSystemSnapshotResponce, error)
 	RestoreFileSystemFromSnapShot(parentID, srcSnapShotID int64) (bool, error)
+	GetFileSystemSnapshotsByParentID(fileSystemID int64) (*[]FileSystem, error)
 
 	GetFileSystemsByPoolID(poolID int64, page int) (*FSMetadata, error)
 	GetFilesytemTreeqCount(fileSystemID int64) (treeqCnt int, err error)
@@ -85,12 +93,28 @@ type Client interface {
 	GetTreeqSizeByFileSystemID(filesystemID int64) (int64, error)
 	GetFileSystemCountByPoolID(poolID int64) (int, error)
 	GetTreeqByName(fileSystemID int64, treeqName string) (*Treeq, error)
+	GetTreeqsByFileSystemID(fileSystemID int64) (*[]Treeq, error)
+
+	// for smb
+	CreateSMBShare(share SMBShare) (*SMBShare, error)
+	GetSMBSharesByFileSystem(fileSystemID int64) (*[]SMBShare, error)
+	DeleteSMBShare(shareID int64) error
+	AddSMBSharePermission(shareID int64, sid, access string) (*SMBSharePermission, error)
+	UpdateSMBSharePermission(shareID, permissionID int64, access string) error
+	DeleteSMBSharePermission(shareID, permissionID int64) error
+
+	// for metadata inventory
+	GetMetadataByKey(key string) (*[]Metadata, error)
+	GetObjectMetadata(objectID int64) (*[]Metadata, error)
+	DetachMetadataKeyFromObject(objectID int64, key string) (*[]Metadata, error)
 }
 
 //ClientService : struct having reference of rest client and will host methods which need rest operations
 type ClientService struct {
 	api        client.RestClient
 	SecretsMap map[string]string
+	// Context of CSI request, api calls are traced as its children
+	Context context.Context
 }
 
 //NewClient : Create New Client
@@ -374,6 +398,30 @@ func (c *ClientService) GetVolume(volumeid int) (*Volume, error) {
 	return &volume, nil
 }
 
+//GetSystemSerial : serial number of the InfiniBox system
+func (c *ClientService) GetSystemSerial() (serial string, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetSystemSerial Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	var systemSerial int64
+	resp, err := c.getJSONResponse(http.MethodGet, "/api/rest/system/serial", nil, &systemSerial)
+	if err != nil {
+		return "", err
+	}
+	if systemSerial == 0 {
+		apiresp := resp.(client.ApiResponse)
+		if result, ok := apiresp.Result.(float64); ok {
+			systemSerial = int64(result)
+		}
+	}
+	if systemSerial == 0 {
+		return "", errors.New("system serial not found in response")
+	}
+	return strconv.FormatInt(systemSerial, 10), nil
+}
+
 //CreateSnapshotVolume : Create volume from snapshot
 func (c *ClientService) CreateSnapshotVolume(snapshotParam *VolumeSnapshot) (*SnapshotVolumesResp, error) {
 	var err error
@@ -536,6 +584,35 @@ func (c *ClientService) GetHostByName(hostName string) (host Host, err error) {
 	return host, nil
 }
 
+//GetAllHosts - get all hosts defined on infinibox
+func (c *ClientService) GetAllHosts() (hosts []Host, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetAllHosts Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Info("get all hosts")
+	for page := 1; ; page++ {
+		uri := "api/rest/hosts?page=" + strconv.Itoa(page) + "&page_size=1000"
+		pageHosts := []Host{}
+		resp, err := c.getJSONResponse(http.MethodGet, uri, nil, &pageHosts)
+		if err != nil {
+			log.Errorf("error occured while fetching hosts %v", err)
+			return hosts, err
+		}
+		apiresp := resp.(client.ApiResponse)
+		if len(pageHosts) == 0 {
+			pageHosts, _ = apiresp.Result.([]Host)
+		}
+		hosts = append(hosts, pageHosts...)
+		if page >= apiresp.MetaData.TotalPages {
+			break
+		}
+	}
+	log.Infof("fetched %d hosts", len(hosts))
+	return hosts, nil
+}
+
 //GetFCPorts - get fc ports details
 func (c *ClientService) GetFCPorts() (fcNodes []FCNode, err error) {
 	defer func() {
@@ -723,19 +800,21 @@ func (c *ClientService) getJSONResponse(method, apiuri string, body, expectedRes
 			err = errors.New("error in getJSONResponse " + fmt.Sprint(res))
 		}
 	}()
+	ctx, span := c.startSpan(apiuri)
+	defer func() { tracing.EndSpan(span, err) }()
 	hostsecret, err := c.getAPIConfig()
 	if err != nil {
 		log.Errorf("Error occured: %v ", err)
 		return nil, err
 	}
 	if method == http.MethodPost {
-		resp, err = c.api.Post(context.Background(), apiuri, hostsecret, body, expectedResp)
+		resp, err = c.api.Post(ctx, apiuri, hostsecret, body, expectedResp)
 	} else if method == http.MethodGet {
-		resp, err = c.api.Get(context.Background(), apiuri, hostsecret, expectedResp)
+		resp, err = c.api.Get(ctx, apiuri, hostsecret, expectedResp)
 	} else if method == http.MethodDelete {
-		resp, err = c.api.Delete(context.Background(), apiuri, hostsecret)
+		resp, err = c.api.Delete(ctx, apiuri, hostsecret)
 	} else if method == http.MethodPut {
-		resp, err = c.api.Put(context.Background(), apiuri, hostsecret, body, expectedResp)
+		resp, err = c.api.Put(ctx, apiuri, hostsecret, body, expectedResp)
 	}
 	if err != nil {
 		log.Errorf("Error occured: %v ", err)
@@ -755,6 +834,8 @@ func (c *ClientService) getResponseWithQueryString(apiuri string, queryParam map
 			err = errors.New("error in getResponseWithQueryString " + fmt.Sprint(res))
 		}
 	}()
+	ctx, span := c.startSpan(apiuri)
+	defer func() { tracing.EndSpan(span, err) }()
 	hostsecret, err := c.getAPIConfig()
 	if err != nil {
 		log.Errorf("Error occured: %v ", err)
@@ -768,10 +849,21 @@ func (c *ClientService) getResponseWithQueryString(apiuri string, queryParam map
 		}
 		queryString = key + "=" + fmt.Sprintf("%v", val)
 	}
-	resp, err = c.api.GetWithQueryString(context.Background(), apiuri, hostsecret, queryString, expectedResp)
+	resp, err = c.api.GetWithQueryString(ctx, apiuri, hostsecret, queryString, expectedResp)
 	return resp, err
 }
 
+//startSpan start span named after exported Client method making the request, e.g. api.GetVolumeByName
+func (c *ClientService) startSpan(apiuri string) (context.Context, trace.Span) {
+	name := "api"
+	if pc, _, _, ok := runtime.Caller(2); ok {
+		if fn := runtime.FuncForPC(pc); fn != nil {
+			name = "api." + fn.Name()[strings.LastIndex(fn.Name(), ".")+1:]
+		}
+	}
+	return tracing.StartSpan(c.Context, name, attribute.String("infinibox.uri", apiuri))
+}
+
 func (c *ClientService) getAPIConfig() (hostconfig client.HostConfig, err error) {
 	defer func() {
 		if res := recover(); res != nil && err == nil {
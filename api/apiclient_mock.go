@@ -26,6 +26,7 @@ type MockApiService struct {
 
 type MockApiClient struct {
 	mock.Mock
+	putBody interface{}
 }
 
 //Get : mock for get request
@@ -46,6 +47,7 @@ func (m *MockApiClient) Post(ctx context.Context, url string, hostconfig client.
 
 //Put : mock for put request
 func (m *MockApiClient) Put(ctx context.Context, url string, hostconfig client.HostConfig, body, expectedResp interface{}) (interface{}, error) {
+	m.putBody = body
 	args := m.Called()
 	response, _ := args.Get(0).(interface{})
 	err, _ := args.Get(1).(error)
@@ -247,6 +249,14 @@ func (m *MockApiService) GetParentID(fileSystemID int64) int64 {
 	return resp
 }
 
+//DeleteFileSystem mock
+func (m *MockApiService) DeleteFileSystem(fileSystemID int64) (*FileSystem, error) {
+	args := m.Called(fileSystemID)
+	resp, _ := args.Get(0).(FileSystem)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
 //DeleteFileSystemComplete
 func (m *MockApiService) DeleteFileSystemComplete(fileSystemID int64) (err error) {
 	args := m.Called(fileSystemID)
@@ -260,6 +270,14 @@ func (m *MockApiService) DeleteParentFileSystem(fileSystemID int64) (err error)
 	err, _ = args.Get(0).(error)
 	return err
 }
+//GetSystemSerial mock
+func (m *MockApiService) GetSystemSerial() (string, error) {
+	args := m.Called()
+	resp, _ := args.Get(0).(string)
+	err, _ := args.Get(1).(error)
+	return resp, err
+}
+
 func (m *MockApiService) GetVolume(volumeid int) (*Volume, error) {
 	args := m.Called(volumeid)
 	resp, _ := args.Get(0).(Volume)
@@ -396,6 +414,13 @@ func (m *MockApiService)MapVolumeToHost(hostID, volumeID, lun int) ( LunInfo, er
 	return lunInfo, err
 }
 
+func (m *MockApiService) AddHostPort(portType, portAddress string, hostID int) (HostPort, error) {
+	args := m.Called(portType, portAddress, hostID)
+	hostPort, _ := args.Get(0).(HostPort)
+	err, _ := args.Get(1).(error)
+	return hostPort, err
+}
+
 func (m *MockApiService)GetLunByHostVolume(hostID, volumeID int) ( LunInfo,  error){
 	args := m.Called(hostID)
 	lunInfo, _ := args.Get(0).(LunInfo)
@@ -417,4 +442,104 @@ func (m *MockApiService)UpdateVolume(volumeID int, volume Volume) (*Volume, erro
 	vol, _ := args.Get(0).(Volume)
 	err, _ := args.Get(1).(error)
 	return &vol, err
-}
\ No newline at end of file
+}
+//GetAllHosts mock
+func (m *MockApiService) GetAllHosts() ([]Host, error) {
+	args := m.Called()
+	hosts, _ := args.Get(0).([]Host)
+	err, _ := args.Get(1).(error)
+	return hosts, err
+}
+
+//GetMetadataByKey mock
+func (m *MockApiService) GetMetadataByKey(key string) (*[]Metadata, error) {
+	args := m.Called(key)
+	resp, _ := args.Get(0).([]Metadata)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
+//GetObjectMetadata mock
+func (m *MockApiService) GetObjectMetadata(objectID int64) (*[]Metadata, error) {
+	args := m.Called(objectID)
+	resp, _ := args.Get(0).([]Metadata)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
+//DetachMetadataKeyFromObject mock
+func (m *MockApiService) DetachMetadataKeyFromObject(objectID int64, key string) (*[]Metadata, error) {
+	args := m.Called(objectID, key)
+	resp, _ := args.Get(0).([]Metadata)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
+//GetFileSystemSnapshotsByParentID mock
+func (m *MockApiService) GetFileSystemSnapshotsByParentID(fileSystemID int64) (*[]FileSystem, error) {
+	args := m.Called(fileSystemID)
+	resp, _ := args.Get(0).([]FileSystem)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
+//GetTreeqsByFileSystemID mock
+func (m *MockApiService) GetTreeqsByFileSystemID(fileSystemID int64) (*[]Treeq, error) {
+	args := m.Called(fileSystemID)
+	resp, _ := args.Get(0).([]Treeq)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
+//DeleteExportPath mock
+func (m *MockApiService) DeleteExportPath(exportID int64) (*ExportResponse, error) {
+	args := m.Called(exportID)
+	resp, _ := args.Get(0).(ExportResponse)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
+//CreateSMBShare mock
+func (m *MockApiService) CreateSMBShare(share SMBShare) (*SMBShare, error) {
+	args := m.Called(share)
+	resp, _ := args.Get(0).(SMBShare)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
+//GetSMBSharesByFileSystem mock
+func (m *MockApiService) GetSMBSharesByFileSystem(fileSystemID int64) (*[]SMBShare, error) {
+	args := m.Called(fileSystemID)
+	resp, _ := args.Get(0).([]SMBShare)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
+//DeleteSMBShare mock
+func (m *MockApiService) DeleteSMBShare(shareID int64) error {
+	args := m.Called(shareID)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
+//AddSMBSharePermission mock
+func (m *MockApiService) AddSMBSharePermission(shareID int64, sid, access string) (*SMBSharePermission, error) {
+	args := m.Called(shareID, sid, access)
+	resp, _ := args.Get(0).(SMBSharePermission)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
+//UpdateSMBSharePermission mock
+func (m *MockApiService) UpdateSMBSharePermission(shareID, permissionID int64, access string) error {
+	args := m.Called(shareID, permissionID, access)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
+//DeleteSMBSharePermission mock
+func (m *MockApiService) DeleteSMBSharePermission(shareID, permissionID int64) error {
+	args := m.Called(shareID, permissionID)
+	err, _ := args.Get(0).(error)
+	return err
+}
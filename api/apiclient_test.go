@@ -11,12 +11,19 @@ limitations under the License.*/
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"infinibox-csi-driver/api/client"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (suite *ApiTestSuite) SetupTest() {
@@ -145,6 +152,28 @@ func (suite *ApiTestSuite) Test_GetStoragePoolIDByName_Success() {
 	assert.Equal(suite.T(), poolID, response, "Response not returned as expected")
 }
 
+func (suite *ApiTestSuite) Test_GetVolume_Traced() {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "csi.ControllerPublishVolume")
+
+	suite.clientMock.On("Get").Return(nil, errors.New("VOLUME_NOT_FOUND"))
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret(), Context: ctx}
+
+	// Act
+	_, err := service.GetVolume(101)
+
+	// Assert
+	assert.NotNil(suite.T(), err, "Error should not be nil")
+	spans := exporter.GetSpans()
+	assert.Equal(suite.T(), 1, len(spans))
+	assert.Equal(suite.T(), "api.GetVolume", spans[0].Name)
+	assert.Equal(suite.T(), parent.SpanContext().SpanID(), spans[0].Parent.SpanID(), "api span should be child of request span")
+	assert.Equal(suite.T(), codes.Error, spans[0].Status.Code)
+}
+
 func (suite *ApiTestSuite) Test_GetVolumeByName_Fail() {
 	expectedError := errors.New("Unable to get given volume by name")
 	suite.clientMock.On("GetWithQueryString").Return(nil, expectedError)
@@ -230,6 +259,29 @@ func (suite *ApiTestSuite) Test_GetVolume_Success() {
 	assert.Equal(suite.T(), expectedResponse.Result, response, "Response not returned as expected")
 }
 
+func (suite *ApiTestSuite) Test_GetSystemSerial_Success() {
+	suite.clientMock.On("Get").Return(client.ApiResponse{Result: float64(2810)}, nil)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+
+	// Act
+	serial, err := service.GetSystemSerial()
+
+	// Assert
+	assert.Nil(suite.T(), err, "Error should be nil")
+	assert.Equal(suite.T(), "2810", serial)
+}
+
+func (suite *ApiTestSuite) Test_GetSystemSerial_Fail() {
+	suite.clientMock.On("Get").Return(client.ApiResponse{}, nil)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+
+	// Act
+	_, err := service.GetSystemSerial()
+
+	// Assert
+	assert.NotNil(suite.T(), err, "Error should not be nil")
+}
+
 func (suite *ApiTestSuite) Test_GetNetworkSpaceByName_Fail() {
 	expectedError := errors.New("Unable to get given network space by name")
 	suite.clientMock.On("GetWithQueryString").Return(nil, expectedError)
@@ -1196,6 +1248,28 @@ func (suite *ApiTestSuite) Test_ExportFileSystem_Success() {
 	assert.Nil(suite.T(), err, "Error should not be nil")
 }
 
+func (suite *ApiTestSuite) Test_CreateSMBShare() {
+	share := SMBShare{ID: 10, Name: "pvc-1", FilesystemID: 100, Permissions: []SMBSharePermission{{ID: 7, SID: "S-1-1-0", Access: "FULLCONTROL"}}}
+	suite.clientMock.On("Post").Return(client.ApiResponse{Result: share}, nil)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+	created, err := service.CreateSMBShare(SMBShare{Name: "pvc-1", FilesystemID: 100, InnerPath: "/"})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), share, *created)
+}
+
+func (suite *ApiTestSuite) Test_GetSMBSharesByFileSystem_Error() {
+	suite.clientMock.On("Get").Return(nil, errors.New("some error"))
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+	_, err := service.GetSMBSharesByFileSystem(100)
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *ApiTestSuite) Test_DeleteSMBShare() {
+	suite.clientMock.On("Delete").Return(client.ApiResponse{}, nil)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+	assert.Nil(suite.T(), service.DeleteSMBShare(10))
+}
+
 func (suite *ApiTestSuite) Test_AddNodeInExport_Error() {
 	expectedErr := errors.New("some error")
 	suite.clientMock.On("Get").Return(nil, expectedErr)
@@ -1255,6 +1329,27 @@ func (suite *ApiTestSuite) Test_AddNodeInExport_IP_not_exist_success() {
 	assert.Nil(suite.T(), err, "Error should not be nil")
 }
 
+func (suite *ApiTestSuite) Test_AddNodeInExport_ReadOnlyToReadWrite() {
+	exportResp := ExportResponse{ID: 1009}
+	exportResp.Permissions = []Permissions{{Access: "RO", Client: "10.20.30.40", NoRootSquash: true}, {Access: "RO", Client: "10.20.30.41", NoRootSquash: true}}
+	suite.clientMock.On("Get").Return(client.ApiResponse{Result: exportResp}, nil)
+	suite.clientMock.On("Put").Return(client.ApiResponse{Result: ExportResponse{}}, nil)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+	_, err := service.AddNodeInExport(1009, "RW", true, "10.20.30.40")
+	assert.Nil(suite.T(), err)
+	suite.clientMock.AssertCalled(suite.T(), "Put")
+}
+
+func (suite *ApiTestSuite) Test_AddNodeInExport_ReadWriteKept() {
+	exportResp := ExportResponse{ID: 1009}
+	exportResp.Permissions = []Permissions{{Access: "RW", Client: "10.20.30.40", NoRootSquash: true}}
+	suite.clientMock.On("Get").Return(client.ApiResponse{Result: exportResp}, nil)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+	_, err := service.AddNodeInExport(1009, "RO", true, "10.20.30.40")
+	assert.Nil(suite.T(), err)
+	suite.clientMock.AssertNotCalled(suite.T(), "Put")
+}
+
 func (suite *ApiTestSuite) Test_AddNodeInExport_update_error() {
 	//expectedErr := errors.New("some error")
 	exportResp := ExportResponse{}
@@ -1280,6 +1375,30 @@ func (suite *ApiTestSuite) Test_AddNodeInExport_update_error() {
 	assert.NotNil(suite.T(), err, "Error should not be nil")
 }
 
+func (suite *ApiTestSuite) Test_compareClientIP() {
+	assert.True(suite.T(), compareClientIP("10.20.30.40", "10.20.30.40"))
+	assert.True(suite.T(), compareClientIP("10.20.30.30-10.20.30.41", "10.20.30.40"))
+	assert.False(suite.T(), compareClientIP("10.20.30.30-10.20.30.39", "10.20.30.40"))
+	assert.True(suite.T(), compareClientIP("fd00:10:0:0:0:0:0:51", "fd00:10::51"), "IPv6 in any form")
+	assert.True(suite.T(), compareClientIP("[fd00:10::51]", "fd00:10::51"))
+	assert.True(suite.T(), compareClientIP("fd00:10::1-fd00:10::ff", "fd00:10::51"))
+	assert.False(suite.T(), compareClientIP("fd00:10::1-fd00:10::ff", "fd00:11::51"))
+	assert.False(suite.T(), compareClientIP("::-::ffff:ffff", "10.20.30.40"), "range of other family")
+	assert.False(suite.T(), compareClientIP("10.20.30.30-10.20.30.41", "fd00:10::51"))
+	assert.True(suite.T(), ClientMatches("*", "fd00:10::51"))
+}
+
+func (suite *ApiTestSuite) Test_DeleteNodeFromExport_IPv6() {
+	exportResp := ExportResponse{ID: 1009}
+	exportResp.Permissions = []Permissions{{Access: "RW", Client: "fd00:10:0:0:0:0:0:51"}, {Access: "RW", Client: "10.20.30.41"}}
+	suite.clientMock.On("Get").Return(client.ApiResponse{Result: exportResp}, nil)
+	suite.clientMock.On("Put").Return(client.ApiResponse{Result: ExportResponse{}}, nil)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+	_, err := service.DeleteNodeFromExport(1009, "RW", false, "fd00:10::51")
+	assert.Nil(suite.T(), err)
+	suite.clientMock.AssertCalled(suite.T(), "Put")
+}
+
 func (suite *ApiTestSuite) Test_DeleteExportRule_Error() {
 	expectedErr := errors.New("some error")
 	suite.clientMock.On("Get").Return(nil, expectedErr)
@@ -1390,6 +1509,20 @@ func (suite *ApiTestSuite) Test_DeleteNodeFromExport_update_success() {
 	assert.Nil(suite.T(), err, "Error should not be nil")
 }
 
+func (suite *ApiTestSuite) Test_DeleteNodeFromExport_last_rule() {
+	exportResp := ExportResponse{ID: 1009}
+	exportResp.Permissions = []Permissions{{Access: "RO", Client: "10.20.30.40"}}
+	suite.clientMock.On("Get").Return(client.ApiResponse{Result: exportResp}, nil)
+	suite.clientMock.On("Put").Return(client.ApiResponse{Result: ExportResponse{}}, nil)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+	_, err := service.DeleteNodeFromExport(1009, "RO", false, "10.20.30.40")
+	assert.Nil(suite.T(), err)
+	// no rule is left, in particular no read write rule for every client
+	assert.Equal(suite.T(), ExportPermissionsRef{Permissions: []Permissions{}}, suite.clientMock.putBody)
+	body, _ := json.Marshal(suite.clientMock.putBody)
+	assert.Equal(suite.T(), `{"permissions":[]}`, string(body))
+}
+
 func (suite *ApiTestSuite) Test_GetFileSystemCountByPoolID_success() {
 	expectedResponse := client.ApiResponse{Result: getFilesystemArry(), MetaData: client.Resultmetadata{NoOfObject: 100}}
 	suite.clientMock.On("Get").Return(expectedResponse, nil)
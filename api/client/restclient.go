@@ -17,11 +17,17 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
+	"infinibox-csi-driver/helper/driverconfig"
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
+	"infinibox-csi-driver/helper/tracing"
 
 	resty "github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type HostConfig struct {
@@ -43,18 +49,62 @@ type ApiResponse struct {
 
 var rClient *resty.Client
 
+//clientSettings timeout and retries of rClient, follow driver configuration when it is reloaded
+type clientSettings struct {
+	timeout  time.Duration
+	attempts int
+	wait     time.Duration
+}
+
+var (
+	appliedSettings clientSettings
+	//clientMutex guards creation of rClient and changes of its settings by concurrent RPCs
+	clientMutex sync.Mutex
+)
+
 //NewRestClient : Initialize http client
 func NewRestClient() (*restclient, error) {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
 	if rClient == nil {
 		rClient = resty.New()
 		rClient.SetHeader("Content-Type", "application/json")
 		rClient.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
 		rClient.SetDisableWarn(true)
-		rClient.SetTimeout(60 * time.Second)
+		rClient.AddRetryCondition(retryIdempotent)
 	}
+	applySettings(driverconfig.Get())
 	return &restclient{}, nil
 }
 
+//applySettings change timeout and retries of rClient when configuration changed, caller holds clientMutex
+func applySettings(c driverconfig.Config) {
+	settings := clientSettings{timeout: c.Timeouts.APIRequest.Duration, attempts: c.Retry.APIAttempts, wait: c.Retry.APIWait.Duration}
+	if settings == appliedSettings {
+		return
+	}
+	rClient.SetTimeout(settings.timeout).
+		SetRetryCount(settings.attempts).
+		SetRetryWaitTime(settings.wait).
+		SetRetryMaxWaitTime(4 * settings.wait)
+	appliedSettings = settings
+}
+
+//retryIdempotent retry GET requests failing to connect or with gateway errors, other requests may have been applied
+func retryIdempotent(resp *resty.Response, err error) bool {
+	if resp == nil || resp.Request == nil || resp.Request.Method != http.MethodGet {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode() {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
 //RestClient : implement to make rest client
 type RestClient interface {
 	Get(ctx context.Context, url string, hostconfig HostConfig, expectedResp interface{}) (interface{}, error)
@@ -83,9 +133,11 @@ func (rc *restclient) Get(ctx context.Context, url string, hostconfig HostConfig
 		log.Errorf("checkHttpClient returned err %v ", err)
 		return nil, err
 	}
+	span := startRequestSpan(ctx, http.MethodGet, url)
 	response, err := rClient.SetHostURL(hostconfig.ApiHost).
 	SetBasicAuth(hostconfig.UserName, hostconfig.Password).R().Get(url)
 	resp, err := rc.checkResponse(response, err, expectedResp)
+	endRequestSpan(span, response, err)
 	if err != nil {
 		log.Errorf("error in validating response %v", err)
 		return nil, err
@@ -107,11 +159,13 @@ func (rc *restclient) GetWithQueryString(ctx context.Context, url string, hostco
 		log.Errorf("checkHttpClient returned err %v  ", err)
 		return nil, err
 	}
+	span := startRequestSpan(ctx, http.MethodGet, url)
 	response, err := rClient.SetHostURL(hostconfig.ApiHost).
 		SetBasicAuth(hostconfig.UserName, hostconfig.Password).
 		R().SetQueryString(queryString).Get(url)
 
 	res, err := rc.checkResponse(response, err, expectedResp)
+	endRequestSpan(span, response, err)
 	if err != nil {
 		log.Errorf("error in validating response %v ", err)
 		return nil, err
@@ -133,11 +187,13 @@ func (rc *restclient) Post(ctx context.Context, url string, hostconfig HostConfi
 		log.Errorf("checkHttpClient returned err %v  ", err)
 		return nil, err
 	}
+	span := startRequestSpan(ctx, http.MethodPost, url)
 	response, err := rClient.SetHostURL(hostconfig.ApiHost).
 		SetBasicAuth(hostconfig.UserName, hostconfig.Password).R().
 		SetBody(body).
 		Post(url)
 	res, err := rc.checkResponse(response, err, expectedResp)
+	endRequestSpan(span, response, err)
 	if err != nil {
 		log.Errorf("error in validating response %v ", err)
 		return nil, err
@@ -159,10 +215,12 @@ func (rc *restclient) Put(ctx context.Context, url string, hostconfig HostConfig
 		log.Errorf("checkHttpClient returned err %v ", err)
 		return nil, err
 	}
+	span := startRequestSpan(ctx, http.MethodPut, url)
 	response, err := rClient.SetHostURL(hostconfig.ApiHost).
 		SetBasicAuth(hostconfig.UserName, hostconfig.Password).
 		R().SetBody(body).Put(url)
 	res, err := rc.checkResponse(response, err, expectedResp)
+	endRequestSpan(span, response, err)
 	if err != nil {
 		log.Errorf("error in validating response %v ", err)
 		return nil, err
@@ -184,10 +242,12 @@ func (rc *restclient) Delete(ctx context.Context, url string, hostconfig HostCon
 		log.Errorf("checkHttpClient returned err %v ", err)
 		return nil, err
 	}
+	span := startRequestSpan(ctx, http.MethodDelete, url)
 	response, err := rClient.SetHostURL(hostconfig.ApiHost).
 		SetBasicAuth(hostconfig.UserName, hostconfig.Password).
 		R().Delete(url)
 	res, err := rc.checkResponse(response, err, nil)
+	endRequestSpan(span, response, err)
 	if err != nil {
 		log.Errorf("error in validating response %v ", err)
 		return nil, err
@@ -204,6 +264,22 @@ func checkHttpClient() error {
 	return nil
 }
 
+//startRequestSpan start span for InfiniBox REST request, child of span in ctx
+func startRequestSpan(ctx context.Context, method, url string) trace.Span {
+	_, span := tracing.StartClientSpan(ctx, "HTTP "+method,
+		attribute.String("http.method", method),
+		attribute.String("http.target", url))
+	return span
+}
+
+//endRequestSpan record InfiniBox status code and error on span and end it
+func endRequestSpan(span trace.Span, response *resty.Response, err error) {
+	if response != nil && response.RawResponse != nil {
+		span.SetAttributes(attribute.Int("http.status_code", response.StatusCode()))
+	}
+	tracing.EndSpan(span, err)
+}
+
 //Method to check the response is valid or not
 func (rc *restclient) checkResponse(res *resty.Response, err error, resptpye interface{}) (result ApiResponse, er error) {
 	defer func() {
@@ -212,6 +288,10 @@ func (rc *restclient) checkResponse(res *resty.Response, err error, resptpye int
 		}
 	}()
 
+	if res != nil && res.Request != nil {
+		metrics.ObserveInfiniboxRequest(res.Request.Method, res.Request.URL, res.StatusCode(), res.Time())
+	}
+
 	if res.StatusCode() == http.StatusUnauthorized {
 		return result, errors.New("Request authentication failed for : " + res.Request.URL)
 	}
@@ -15,21 +15,47 @@ import (
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	coordinationv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 type KubeClient interface {
 	GetSecret(secretName, nameSpace string) (map[string]string, error)
 	GetClusterVerion() (string, error)
+	GetAllPersistentVolumes() ([]v1.PersistentVolume, error)
+	GetAllNodes() ([]v1.Node, error)
+	GetVolumeSnapshotContentHandles(driverName string) ([]string, error)
+	GetPersistentVolumeClaimUID(claimName, nameSpace string) (string, error)
+	GetClusterID() (string, error)
 }
 
 type kubeclient struct {
-	client kubernetes.Interface
+	client        kubernetes.Interface
+	dynamicClient dynamic.Interface
 }
 
+//volumeSnapshotContentResources snapshot.storage.k8s.io versions, newest first
+var volumeSnapshotContentResources = []schema.GroupVersionResource{
+	{Group: "snapshot.storage.k8s.io", Version: "v1beta1", Resource: "volumesnapshotcontents"},
+	{Group: "snapshot.storage.k8s.io", Version: "v1alpha1", Resource: "volumesnapshotcontents"},
+}
+
+//driverConfigResource InfiniboxDriverConfig custom resource
+var driverConfigResource = schema.GroupVersionResource{Group: "csi.infinidat.com", Version: "v1alpha1", Resource: "infiniboxdriverconfigs"}
+
 var clientapi kubeclient
 
+//Leases return lease client of namespace, used for operation locks shared by controller replicas
+func (kc *kubeclient) Leases(namespace string) coordinationv1.LeaseInterface {
+	return kc.client.CoordinationV1().Leases(namespace)
+}
+
 //BuildClient
 func BuildClient() (kc *kubeclient, err error) {
 	log.Debug("BuildClient called.")
@@ -39,17 +65,44 @@ func BuildClient() (kc *kubeclient, err error) {
 			log.Error("BuildClient Error while getting cluster config", err)
 			return nil, err
 		}
-		// creates the clientset
-		clientset, err := kubernetes.NewForConfig(config)
+		return buildClientForConfig(config)
+	}
+	return &clientapi, err
+}
+
+//BuildClientFromKubeconfig build client from kubeconfig file, falls back to in cluster config when path is empty
+func BuildClientFromKubeconfig(kubeconfig string) (kc *kubeclient, err error) {
+	log.Debug("BuildClientFromKubeconfig called.")
+	if kubeconfig == "" {
+		return BuildClient()
+	}
+	if clientapi.client == nil {
+		config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
 		if err != nil {
-			log.Error("BuildClient Error while creating client", err)
+			log.Errorf("BuildClientFromKubeconfig Error while loading kubeconfig %s %v", kubeconfig, err)
 			return nil, err
 		}
-		clientapi = kubeclient{clientset}
+		return buildClientForConfig(config)
 	}
 	return &clientapi, err
 }
 
+func buildClientForConfig(config *rest.Config) (*kubeclient, error) {
+	// creates the clientset
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Error("BuildClient Error while creating client", err)
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Error("BuildClient Error while creating dynamic client", err)
+		return nil, err
+	}
+	clientapi = kubeclient{client: clientset, dynamicClient: dynamicClient}
+	return &clientapi, nil
+}
+
 func (kc *kubeclient) GetSecret(secretName, nameSpace string) (map[string]string, error) {
 	log.Debugf("get request for secret with namespace %s and secretname %s", nameSpace, secretName)
 	secretMap := make(map[string]string)
@@ -118,6 +171,23 @@ func (kc *kubeclient) GetNodeIdByNodeName(nodeName string) (InternalIp string, e
 	return nodeip, err
 }
 
+//GetNodeAddresses return internal and external IP addresses of node, internal first
+func (kc *kubeclient) GetNodeAddresses(nodeName string) ([]string, error) {
+	node, err := kc.client.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	addresses := []string{}
+	for _, addressType := range []v1.NodeAddressType{v1.NodeInternalIP, v1.NodeExternalIP} {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == addressType {
+				addresses = append(addresses, addr.Address)
+			}
+		}
+	}
+	return addresses, nil
+}
+
 func (kc *kubeclient) GetClusterVerion() (string, error) {
 	info, err := kc.client.Discovery().ServerVersion()
 	if err != nil {
@@ -126,3 +196,93 @@ func (kc *kubeclient) GetClusterVerion() (string, error) {
 	}
 	return info.GitVersion, nil
 }
+
+//GetPersistentVolumeClaimUID return UID of persistent volume claim
+func (kc *kubeclient) GetPersistentVolumeClaimUID(claimName, nameSpace string) (string, error) {
+	claim, err := kc.client.CoreV1().PersistentVolumeClaims(nameSpace).Get(claimName, metav1.GetOptions{})
+	if err != nil {
+		log.Errorf("Error Getting persistent volume claim %s/%s Error: %v", nameSpace, claimName, err)
+		return "", err
+	}
+	return string(claim.UID), nil
+}
+
+//GetClusterID return UID of kube-system namespace, which identifies the cluster
+func (kc *kubeclient) GetClusterID() (string, error) {
+	namespace, err := kc.client.CoreV1().Namespaces().Get("kube-system", metav1.GetOptions{})
+	if err != nil {
+		log.Error("Error Getting kube-system namespace ", err)
+		return "", err
+	}
+	return string(namespace.UID), nil
+}
+
+//GetAllPersistentVolumes return all persistent volumes of cluster
+func (kc *kubeclient) GetAllPersistentVolumes() ([]v1.PersistentVolume, error) {
+	pvList, err := kc.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		log.Error("Error while listing persistent volumes ", err)
+		return nil, err
+	}
+	return pvList.Items, nil
+}
+
+//GetAllNodes return all nodes of cluster
+func (kc *kubeclient) GetAllNodes() ([]v1.Node, error) {
+	nodeList, err := kc.client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		log.Error("Error while listing nodes ", err)
+		return nil, err
+	}
+	return nodeList.Items, nil
+}
+
+//GetVolumeSnapshotContentHandles return snapshot handles of all VolumeSnapshotContents of given driver
+func (kc *kubeclient) GetVolumeSnapshotContentHandles(driverName string) ([]string, error) {
+	var lastErr error
+	for _, gvr := range volumeSnapshotContentResources {
+		contentList, err := kc.dynamicClient.Resource(gvr).List(metav1.ListOptions{})
+		if err != nil {
+			log.Debugf("unable to list %s: %v", gvr.String(), err)
+			lastErr = err
+			continue
+		}
+		handles := []string{}
+		for _, content := range contentList.Items {
+			if handle := snapshotHandleOf(content, driverName); handle != "" {
+				handles = append(handles, handle)
+			}
+		}
+		return handles, nil
+	}
+	log.Error("Error while listing volume snapshot contents ", lastErr)
+	return nil, lastErr
+}
+
+//WatchDriverConfig watch InfiniboxDriverConfig name in namespace
+func (kc *kubeclient) WatchDriverConfig(namespace, name string) (watch.Interface, error) {
+	return kc.dynamicClient.Resource(driverConfigResource).Namespace(namespace).Watch(metav1.ListOptions{
+		FieldSelector: "metadata.name=" + name,
+	})
+}
+
+//snapshotHandleOf read the snapshot handle of v1beta1 and v1alpha1 VolumeSnapshotContent objects
+func snapshotHandleOf(content unstructured.Unstructured, driverName string) string {
+	driver, _, _ := unstructured.NestedString(content.Object, "spec", "driver")
+	if driver == "" {
+		driver, _, _ = unstructured.NestedString(content.Object, "spec", "csiVolumeSnapshotSource", "driver")
+	}
+	if driverName != "" && driver != "" && driver != driverName {
+		return ""
+	}
+	for _, fields := range [][]string{
+		{"status", "snapshotHandle"},
+		{"spec", "source", "snapshotHandle"},
+		{"spec", "csiVolumeSnapshotSource", "snapshotHandle"},
+	} {
+		if handle, found, _ := unstructured.NestedString(content.Object, fields...); found && handle != "" {
+			return handle
+		}
+	}
+	return ""
+}
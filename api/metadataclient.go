@@ -0,0 +1,101 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package api
+
+import (
+	"errors"
+	"fmt"
+	"infinibox-csi-driver/api/client"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	log "infinibox-csi-driver/helper/logger"
+)
+
+const metadataPageSize = 1000
+
+//GetMetadataByKey return every metadata entry having given key, across all objects
+func (c *ClientService) GetMetadataByKey(key string) (*[]Metadata, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetMetadataByKey Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Info("Get metadata by key : ", key)
+	allMetadata := []Metadata{}
+	for page := 1; ; page++ {
+		uri := "/api/rest/metadata?key=" + url.QueryEscape(key) + "&page=" + strconv.Itoa(page) + "&page_size=" + strconv.Itoa(metadataPageSize)
+		metadata := []Metadata{}
+		resp, err := c.getJSONResponse(http.MethodGet, uri, nil, &metadata)
+		if err != nil {
+			log.Errorf("Error occured while getting metadata by key %s : %s", key, err)
+			return nil, err
+		}
+		apiresp := resp.(client.ApiResponse)
+		if len(metadata) == 0 {
+			metadata, _ = apiresp.Result.([]Metadata)
+		}
+		allMetadata = append(allMetadata, metadata...)
+		if page >= apiresp.MetaData.TotalPages {
+			break
+		}
+	}
+	log.Infof("Got %d metadata entries with key %s", len(allMetadata), key)
+	return &allMetadata, nil
+}
+
+//GetObjectMetadata return all metadata attached to given object
+func (c *ClientService) GetObjectMetadata(objectID int64) (*[]Metadata, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetObjectMetadata Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Info("Get metadata of object : ", objectID)
+	uri := "/api/rest/metadata/" + strconv.FormatInt(objectID, 10)
+	metadata := []Metadata{}
+	resp, err := c.getJSONResponse(http.MethodGet, uri, nil, &metadata)
+	if err != nil {
+		log.Errorf("Error occured while getting metadata of object %d : %s", objectID, err)
+		return nil, err
+	}
+	if len(metadata) == 0 {
+		apiresp := resp.(client.ApiResponse)
+		metadata, _ = apiresp.Result.([]Metadata)
+	}
+	return &metadata, nil
+}
+
+//DetachMetadataKeyFromObject remove single metadata key from given object
+func (c *ClientService) DetachMetadataKeyFromObject(objectID int64, key string) (*[]Metadata, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("DetachMetadataKeyFromObject Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Infof("Detach metadata key %s from object : %d", key, objectID)
+	uri := "api/rest/metadata/" + strconv.FormatInt(objectID, 10) + "/" + url.PathEscape(key) + "?approved=true"
+	metadata := []Metadata{}
+	resp, err := c.getJSONResponse(http.MethodDelete, uri, nil, &metadata)
+	if err != nil {
+		log.Errorf("Error occured while detaching metadata key %s from object %d : %s", key, objectID, err)
+		return nil, err
+	}
+	if len(metadata) == 0 {
+		apiresp := resp.(client.ApiResponse)
+		metadata, _ = apiresp.Result.([]Metadata)
+	}
+	return &metadata, nil
+}
@@ -258,20 +258,43 @@ func (c *ClientService) GetExportByFileSystem(fileSystemID int64) (*[]ExportResp
 	return &eResp, nil
 }
 
+//parseClientIP parse IPv4 or IPv6 address of export rule client, IPv6 may be in brackets
+func parseClientIP(ip string) net.IP {
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(ip), "["), "]"))
+}
+
+//sameClientIP whether export rule client is address ip, IPv6 written in any form
+func sameClientIP(client, ip string) bool {
+	clientIP := parseClientIP(client)
+	nodeIP := parseClientIP(ip)
+	if clientIP == nil || nodeIP == nil {
+		return client == ip
+	}
+	return clientIP.Equal(nodeIP)
+}
+
+//ClientMatches whether export rule client, *, an address or an address range, covers address ip
+func ClientMatches(client, ip string) bool {
+	return strings.TrimSpace(client) == "*" || compareClientIP(client, ip)
+}
+
+//compareClientIP whether export rule client, an address or an address range first-last, covers address ip
 func compareClientIP(permissionIP, ip string) bool {
-	flag := false
-	if strings.Contains(permissionIP, "-") {
-		iprange := strings.Split(permissionIP, "-")
-		ip1 := net.ParseIP(iprange[0])
-		ip2 := net.ParseIP(iprange[1])
-		clientIP := net.ParseIP(ip)
-		if bytes.Compare(clientIP, ip1) >= 0 && bytes.Compare(clientIP, ip2) <= 0 {
-			flag = true
-		}
-	} else if permissionIP == ip {
-		flag = true
+	if !strings.Contains(permissionIP, "-") {
+		return sameClientIP(permissionIP, ip)
+	}
+	iprange := strings.SplitN(permissionIP, "-", 2)
+	ip1 := parseClientIP(iprange[0])
+	ip2 := parseClientIP(iprange[1])
+	clientIP := parseClientIP(ip)
+	if ip1 == nil || ip2 == nil || clientIP == nil {
+		return false
+	}
+	// a range covers addresses of its own family only
+	if (ip1.To4() == nil) != (clientIP.To4() == nil) || (ip2.To4() == nil) != (clientIP.To4() == nil) {
+		return false
 	}
-	return flag
+	return bytes.Compare(clientIP.To16(), ip1.To16()) >= 0 && bytes.Compare(clientIP.To16(), ip2.To16()) <= 0
 }
 
 //AddNodeInExport : Export should be updated in case of node addition in k8s cluster
@@ -297,11 +320,17 @@ func (c *ClientService) AddNodeInExport(exportID int, access string, noRootSquas
 		eResp, _ = apiresp.Result.(ExportResponse)
 	}
 	index := -1
+	upgrade := false
 	permissionList := eResp.Permissions
 	for i, permission := range permissionList {
 		if compareClientIP(permission.Client, ip) {
 			flag = true
 			log.Debug("Node IP address already added in export rule")
+			// a node rule made read only by an earlier publish is widened when the node now writes, never narrowed
+			if sameClientIP(permission.Client, ip) && strings.EqualFold(permission.Access, "RO") && strings.EqualFold(access, "RW") {
+				permissionList[i].Access = access
+				upgrade = true
+			}
 		}
 		if permission.Client == "*" {
 			index = i
@@ -310,13 +339,15 @@ func (c *ClientService) AddNodeInExport(exportID int, access string, noRootSquas
 	if index != -1 {
 		permissionList = removeIndex(permissionList, index)
 	}
-	if flag == false {
-		newPermission := Permissions{
-			Access:       access,
-			NoRootSquash: noRootSquash,
-			Client:       ip,
+	if flag == false || upgrade {
+		if flag == false {
+			newPermission := Permissions{
+				Access:       access,
+				NoRootSquash: noRootSquash,
+				Client:       ip,
+			}
+			permissionList = append(permissionList, newPermission)
 		}
-		permissionList = append(permissionList, newPermission)
 		exportPathRef.Permissions = permissionList
 		resp, err = c.getJSONResponse(http.MethodPut, uri, exportPathRef, &eResp)
 		if err != nil {
@@ -359,8 +390,8 @@ func (c *ClientService) DeleteExportRule(fileSystemID int64, ipAddress string) e
 		}
 		permissionList := eResp.Permissions
 		for _, permission := range permissionList {
-			if permission.Client == ipAddress {
-				_, err = c.DeleteNodeFromExport(export.ID, permission.Access, permission.NoRootSquash, ipAddress)
+			if sameClientIP(permission.Client, ipAddress) {
+				_, err = c.DeleteNodeFromExport(export.ID, permission.Access, permission.NoRootSquash, permission.Client)
 				if err != nil {
 					log.Errorf("Error occured while getting export path : %s", err)
 					return err
@@ -383,7 +414,7 @@ func (c *ClientService) DeleteNodeFromExport(exportID int64, access string, noRo
 	log.Info("Delete node from export : ", exportID)
 	flag := false
 	var index int
-	exportPathRef := ExportPathRef{}
+	exportPermissions := ExportPermissionsRef{}
 	uri := "api/rest/exports/" + strconv.FormatInt(exportID, 10)
 	eResp := ExportResponse{}
 	resp, err := c.getJSONResponse(http.MethodGet, uri, nil, &eResp)
@@ -397,23 +428,16 @@ func (c *ClientService) DeleteNodeFromExport(exportID int64, access string, noRo
 	}
 	permissionList := eResp.Permissions
 	for i, permission := range permissionList {
-		if permission.Client == ip {
+		if sameClientIP(permission.Client, ip) {
 			flag = true
 			index = i
 		}
 	}
 
 	if flag == true {
-		permissionList = removeIndex(permissionList, index)
-		if len(permissionList) == 0 {
-			defaultPermission := Permissions{}
-			defaultPermission.Access = "RW"
-			defaultPermission.Client = "*"
-			defaultPermission.NoRootSquash = true
-			permissionList = append(permissionList, defaultPermission)
-		}
-		exportPathRef.Permissions = permissionList
-		resp, err = c.getJSONResponse(http.MethodPut, uri, exportPathRef, &eResp)
+		// the export of the last node removed is left without rules, no other host gains access to it
+		exportPermissions.Permissions = append([]Permissions{}, removeIndex(permissionList, index)...)
+		resp, err = c.getJSONResponse(http.MethodPut, uri, exportPermissions, &eResp)
 		if err != nil {
 			log.Errorf("Error occured while updating permission : %s", err)
 			return nil, err
@@ -480,6 +504,30 @@ func (c *ClientService) FileSystemHasChild(fileSystemID int64) bool {
 	return hasChild
 }
 
+//GetFileSystemSnapshotsByParentID method return snapshots having given filesystem as parent
+func (c *ClientService) GetFileSystemSnapshotsByParentID(fileSystemID int64) (*[]FileSystem, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetFileSystemSnapshotsByParentID Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	voluri := "/api/rest/filesystems/"
+	filesystem := []FileSystem{}
+	queryParam := make(map[string]interface{})
+	queryParam["parent_id"] = fileSystemID
+	resp, err := c.getResponseWithQueryString(voluri, queryParam, &filesystem)
+	if err != nil {
+		log.Errorf("fail to get snapshots of filesystem %d %v", fileSystemID, err)
+		return &filesystem, err
+	}
+	if len(filesystem) == 0 {
+		apiresp := resp.(client.ApiResponse)
+		filesystem, _ = apiresp.Result.([]FileSystem)
+	}
+	return &filesystem, nil
+}
+
 //
 const (
 	//TOBEDELETED status
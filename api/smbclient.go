@@ -0,0 +1,150 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package api
+
+import (
+	"errors"
+	"fmt"
+	"infinibox-csi-driver/api/client"
+	"net/http"
+	"strconv"
+
+	log "infinibox-csi-driver/helper/logger"
+)
+
+//SMBShare SMB share of a filesystem
+type SMBShare struct {
+	ID           int64                `json:"id,omitempty"`
+	Name         string               `json:"name,omitempty"`
+	FilesystemID int64                `json:"filesystem_id,omitempty"`
+	InnerPath    string               `json:"inner_path,omitempty"`
+	Permissions  []SMBSharePermission `json:"permissions,omitempty"`
+}
+
+//SMBSharePermission access of a windows account or group, by SID, to a share: FULLCONTROL, CHANGE, READ or NONE
+type SMBSharePermission struct {
+	ID     int64  `json:"id,omitempty"`
+	SID    string `json:"sid,omitempty"`
+	Access string `json:"access,omitempty"`
+}
+
+//CreateSMBShare create share
+func (c *ClientService) CreateSMBShare(share SMBShare) (*SMBShare, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("CreateSMBShare Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Info("Create SMB share of filesystem : ", share.FilesystemID)
+	shareResp := SMBShare{}
+	resp, err := c.getJSONResponse(http.MethodPost, "api/rest/shares", share, &shareResp)
+	if err != nil {
+		log.Errorf("Error occured while creating SMB share : %s", err)
+		return nil, err
+	}
+	if shareResp.ID == 0 {
+		apiresp := resp.(client.ApiResponse)
+		shareResp, _ = apiresp.Result.(SMBShare)
+	}
+	log.Info("Created SMB share : ", shareResp.ID)
+	return &shareResp, nil
+}
+
+//GetSMBSharesByFileSystem shares of filesystem
+func (c *ClientService) GetSMBSharesByFileSystem(fileSystemID int64) (*[]SMBShare, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetSMBSharesByFileSystem Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	uri := "api/rest/shares?filesystem_id=" + strconv.FormatInt(fileSystemID, 10)
+	shares := []SMBShare{}
+	resp, err := c.getJSONResponse(http.MethodGet, uri, nil, &shares)
+	if err != nil {
+		log.Errorf("Error occured while getting SMB shares : %s", err)
+		return nil, err
+	}
+	if len(shares) == 0 {
+		apiresp := resp.(client.ApiResponse)
+		shares, _ = apiresp.Result.([]SMBShare)
+	}
+	return &shares, nil
+}
+
+//DeleteSMBShare delete share, the filesystem is kept
+func (c *ClientService) DeleteSMBShare(shareID int64) (err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("DeleteSMBShare Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Info("Delete SMB share : ", shareID)
+	uri := "api/rest/shares/" + strconv.FormatInt(shareID, 10) + "?approved=true"
+	_, err = c.getJSONResponse(http.MethodDelete, uri, nil, &SMBShare{})
+	if err != nil {
+		log.Errorf("Error occured while deleting SMB share : %s", err)
+	}
+	return err
+}
+
+//AddSMBSharePermission give sid access to share
+func (c *ClientService) AddSMBSharePermission(shareID int64, sid, access string) (*SMBSharePermission, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("AddSMBSharePermission Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	uri := "api/rest/shares/" + strconv.FormatInt(shareID, 10) + "/permissions"
+	permission := SMBSharePermission{}
+	resp, err := c.getJSONResponse(http.MethodPost, uri, SMBSharePermission{SID: sid, Access: access}, &permission)
+	if err != nil {
+		log.Errorf("Error occured while adding SMB share permission : %s", err)
+		return nil, err
+	}
+	if permission.ID == 0 {
+		apiresp := resp.(client.ApiResponse)
+		permission, _ = apiresp.Result.(SMBSharePermission)
+	}
+	return &permission, nil
+}
+
+//UpdateSMBSharePermission change access of permission of share
+func (c *ClientService) UpdateSMBSharePermission(shareID, permissionID int64, access string) (err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("UpdateSMBSharePermission Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	uri := "api/rest/shares/" + strconv.FormatInt(shareID, 10) + "/permissions/" + strconv.FormatInt(permissionID, 10)
+	_, err = c.getJSONResponse(http.MethodPut, uri, map[string]interface{}{"access": access}, &SMBSharePermission{})
+	if err != nil {
+		log.Errorf("Error occured while updating SMB share permission : %s", err)
+	}
+	return err
+}
+
+//DeleteSMBSharePermission remove permission of share
+func (c *ClientService) DeleteSMBSharePermission(shareID, permissionID int64) (err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("DeleteSMBSharePermission Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	uri := "api/rest/shares/" + strconv.FormatInt(shareID, 10) + "/permissions/" + strconv.FormatInt(permissionID, 10) + "?approved=true"
+	_, err = c.getJSONResponse(http.MethodDelete, uri, nil, &SMBSharePermission{})
+	if err != nil {
+		log.Errorf("Error occured while deleting SMB share permission : %s", err)
+	}
+	return err
+}
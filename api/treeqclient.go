@@ -242,3 +242,33 @@ func (c *ClientService) GetTreeqByName(fileSystemID int64, treeqName string) (*T
 	}
 	return nil, errors.New("treeq with given name not found")
 }
+
+//GetTreeqsByFileSystemID method return all treeqs of filesystem
+func (c *ClientService) GetTreeqsByFileSystemID(fileSystemID int64) (*[]Treeq, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetTreeqsByFileSystemID Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	treeqs := []Treeq{}
+	for page := 1; ; page++ {
+		uri := "api/rest/filesystems/" + strconv.FormatInt(fileSystemID, 10) + "/treeqs?page=" + strconv.Itoa(page) + "&page_size=1000"
+		pageTreeqs := []Treeq{}
+		resp, err := c.getJSONResponse(http.MethodGet, uri, nil, &pageTreeqs)
+		if err != nil {
+			log.Errorf("Error occured while getting treeqs of filesystem %d : %s", fileSystemID, err)
+			return nil, err
+		}
+		apiresp := resp.(client.ApiResponse)
+		if len(pageTreeqs) == 0 {
+			pageTreeqs, _ = apiresp.Result.([]Treeq)
+		}
+		treeqs = append(treeqs, pageTreeqs...)
+		if page >= apiresp.MetaData.TotalPages {
+			break
+		}
+	}
+	log.Infof("Got %d treeqs of filesystem %d", len(treeqs), fileSystemID)
+	return &treeqs, nil
+}
@@ -115,7 +115,7 @@ type NetworkSpace struct {
 	ID                  int                  `json:"id,omitempty"`
 	Portals             []Portal             `json:"ips,omitempty"`
 	Mtu                 int                  `json:"mtu,omitempty"`
-	NetworkConfig       NetworkConfigDetails `json:""network_config,omitempty"`
+	NetworkConfig       NetworkConfigDetails `json:"network_config,omitempty"`
 	Name                string               `json:"name,omitempty"`
 	Vmac_Addresses      []VmacAddress        `json:"vmac_addresses,omitempty"`
 	Routes              []Route              `json:"routes,omitempty"`
@@ -152,6 +152,8 @@ type NetworkSpaceProperty struct {
 	IscsiIqn            string      `json:"iscsi_iqn,omitempty"`
 	IscsiTcpPort        int         `json:"iscsi_tcp_port,omitempty"`
 	IscsiSecurityMethod string      `json:"iscsi_default_security_method,omitempty"`
+	NvmeNqn             string      `json:"nvme_nqn,omitempty"`
+	NvmeTcpPort         int         `json:"nvme_tcp_port,omitempty"`
 }
 
 type HostCluster struct {
@@ -189,6 +191,7 @@ type ExportFileSys struct {
 	Privileged_port     bool                     `json:"privileged_port,omitempty"`
 	Export_path         string                   `json:"export_path,omitempty"`
 	Permissionsput      []map[string]interface{} `json:"permissions,omitempty"`
+	NfsVersions         []string                 `json:"nfs_versions,omitempty"`
 }
 
 type ExportResponse struct {
@@ -213,6 +216,7 @@ type ExportResponse struct {
 	PrivilegedPort        bool          `json:"privileged_port,omitempty"`
 	ID                    int64         `json:"id,omitempty"`
 	ExportPath            string        `json:"export_path,omitempty"`
+	NfsVersions           []string      `json:"nfs_versions,omitempty"`
 }
 
 type Permissions struct {
@@ -264,6 +268,11 @@ type ExportPathRef struct {
 	Permissions        []Permissions `json:"permissions,omitempty"`
 }
 
+//ExportPermissionsRef permissions of export update, an empty list is sent to remove every rule
+type ExportPermissionsRef struct {
+	Permissions []Permissions `json:"permissions"`
+}
+
 type Metadata struct {
 	ID         int    `json:"id,omitempty"`
 	ObjectId   int    `json:"object_id,omitempty"`
@@ -289,12 +298,6 @@ type FileSystemSnapshotResponce struct {
 	CreatedAt   int64  `json:"created_at,omitempty"`
 }
 
-type VolumeProtocolConfig struct {
-	VolumeID      string
-	StorageType   string
-	ChildVolumeID string
-}
-
 //VolumeSnapshot volume snapshot request parameter
 type VolumeSnapshot struct {
 	ParentID       int    `json:"parent_id"`
@@ -0,0 +1,373 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinibox-csi-driver/api"
+	"strconv"
+	"strings"
+
+	"infinibox-csi-driver/helper/csiid"
+	log "infinibox-csi-driver/helper/logger"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	fsTypeKey    = "host.filesystem_type"
+	createdByKey = "host.created_by"
+
+	defaultFsType            = "ext4"
+	defaultMaxVolsPerHost    = "100"
+	defaultExportPermissions = "[{'access':'RW','client':'*','no_root_squash':true}]"
+)
+
+//importRequest describe infinibox object to adopt and the PV to generate for it
+type importRequest struct {
+	objectName        string
+	protocol          string
+	pvName            string
+	fsType            string
+	networkSpace      string
+	useCHAP           string
+	maxVolsPerHost    string
+	mountOptions      string
+	exportPermissions string
+	storageClass      string
+	accessMode        string
+	reclaimPolicy     string
+	claimName         string
+	claimNamespace    string
+	secretName        string
+	secretNamespace   string
+	driverName        string
+	createdBy         string
+}
+
+//validate check request and fill defaults
+func (req *importRequest) validate() error {
+	if req.objectName == "" {
+		return errors.New("name of InfiniBox volume or filesystem is required")
+	}
+	if req.pvName == "" {
+		req.pvName = strings.ToLower(strings.Replace(req.objectName, "_", "-", -1))
+	}
+	if errs := validation.IsDNS1123Subdomain(req.pvName); len(errs) > 0 {
+		return fmt.Errorf("invalid PV name %s: %s", req.pvName, strings.Join(errs, ", "))
+	}
+	switch req.protocol {
+	case "iscsi":
+		if req.networkSpace == "" {
+			return errors.New("network space is required for iscsi")
+		}
+		if req.useCHAP == "" {
+			req.useCHAP = "none"
+		}
+	case "fc":
+	case "nfs":
+		if req.networkSpace == "" {
+			return errors.New("network space is required for nfs")
+		}
+		if req.exportPermissions == "" {
+			req.exportPermissions = defaultExportPermissions
+		}
+		if req.accessMode == "" {
+			req.accessMode = string(v1.ReadWriteMany)
+		}
+	default:
+		return fmt.Errorf("unsupported storage protocol %s, expected iscsi, fc or nfs", req.protocol)
+	}
+	if req.maxVolsPerHost == "" {
+		req.maxVolsPerHost = defaultMaxVolsPerHost
+	}
+	if _, err := strconv.Atoi(req.maxVolsPerHost); err != nil {
+		return fmt.Errorf("invalid max_vols_per_host %s", req.maxVolsPerHost)
+	}
+	if req.accessMode == "" {
+		req.accessMode = string(v1.ReadWriteOnce)
+	}
+	if req.reclaimPolicy == "" {
+		req.reclaimPolicy = string(v1.PersistentVolumeReclaimRetain)
+	}
+	if (req.claimName == "") != (req.claimNamespace == "") {
+		return errors.New("claim name and claim namespace must be given together")
+	}
+	return nil
+}
+
+//importer adopt existing infinibox objects by attaching CSI metadata
+type importer struct {
+	client api.Client
+	// serial of the InfiniBox, embedded in volume handles when known
+	arraySerial string
+}
+
+//importObject validate infinibox object, attach CSI metadata and return PV for it
+func (im *importer) importObject(req importRequest) (pv *v1.PersistentVolume, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("importObject Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	if err = req.validate(); err != nil {
+		return nil, err
+	}
+	if req.protocol == "nfs" {
+		return im.importFileSystem(req)
+	}
+	return im.importBlockVolume(req)
+}
+
+func (im *importer) importBlockVolume(req importRequest) (*v1.PersistentVolume, error) {
+	vol, err := im.client.GetVolumeByName(req.objectName)
+	if err != nil {
+		return nil, fmt.Errorf("volume %s: %v", req.objectName, err)
+	}
+	if strings.EqualFold(vol.Type, "SNAPSHOT") {
+		return nil, fmt.Errorf("volume %s is a snapshot, import a writable clone instead", vol.Name)
+	}
+	metadata, err := im.getMetadata(int64(vol.ID), req.pvName)
+	if err != nil {
+		return nil, err
+	}
+	fsType := req.fsType
+	if existing := metadata[fsTypeKey]; existing != "" {
+		if fsType != "" && fsType != existing {
+			return nil, fmt.Errorf("volume %s is recorded with filesystem type %s, not %s", vol.Name, existing, fsType)
+		}
+		fsType = existing
+	}
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+
+	volumeContext := map[string]string{
+		"ID":                strconv.Itoa(vol.ID),
+		"Name":              vol.Name,
+		"StoragePoolID":     strconv.FormatInt(vol.PoolId, 10),
+		"StoragePoolName":   vol.PoolName,
+		"fstype":            fsType,
+		"storage_protocol":  req.protocol,
+		"max_vols_per_host": req.maxVolsPerHost,
+	}
+	if req.protocol == "iscsi" {
+		nspace, err := im.client.GetNetworkSpaceByName(req.networkSpace)
+		if err != nil {
+			return nil, fmt.Errorf("network space %s: %v", req.networkSpace, err)
+		}
+		portals := []string{}
+		for _, p := range nspace.Portals {
+			portals = append(portals, p.IpAdress)
+		}
+		if len(portals) == 0 {
+			return nil, fmt.Errorf("network space %s has no portals", req.networkSpace)
+		}
+		volumeContext["iqn"] = nspace.Properties.IscsiIqn
+		volumeContext["portals"] = strings.Join(portals, ",")
+		volumeContext["useCHAP"] = req.useCHAP
+		volumeContext["network_space"] = req.networkSpace
+	}
+
+	_, err = im.client.AttachMetadataToObject(int64(vol.ID), map[string]interface{}{
+		pvNameKey:    req.pvName,
+		fsTypeKey:    fsType,
+		createdByKey: req.createdBy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach metadata to volume %s: %v", vol.Name, err)
+	}
+	log.Infof("volume %s imported as %s", vol.Name, req.pvName)
+	return buildPV(req, im.volumeHandle(req.protocol, csiid.Volume, int64(vol.ID)), vol.Size, fsType, volumeContext), nil
+}
+
+func (im *importer) importFileSystem(req importRequest) (pv *v1.PersistentVolume, err error) {
+	fs, err := im.client.GetFileSystemByName(req.objectName)
+	if err != nil {
+		return nil, fmt.Errorf("filesystem %s: %v", req.objectName, err)
+	}
+	metadata, err := im.getMetadata(fs.ID, req.pvName)
+	if err != nil {
+		return nil, err
+	}
+	if _, isTreeqFileSystem := metadata[api.TREEQCOUNT]; isTreeqFileSystem {
+		return nil, fmt.Errorf("filesystem %s hosts treeqs and cannot be imported as nfs volume", fs.Name)
+	}
+	nspace, err := im.client.GetNetworkSpaceByName(req.networkSpace)
+	if err != nil {
+		return nil, fmt.Errorf("network space %s: %v", req.networkSpace, err)
+	}
+	ipAddress := ""
+	for _, p := range nspace.Portals {
+		if p.Enabled {
+			ipAddress = p.IpAdress
+			break
+		}
+	}
+	if ipAddress == "" {
+		return nil, fmt.Errorf("network space %s has no enabled portals", req.networkSpace)
+	}
+
+	exports, err := im.client.GetExportByFileSystem(fs.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get exports of filesystem %s: %v", fs.Name, err)
+	}
+	var export api.ExportResponse
+	createdExport := false
+	if len(*exports) > 0 {
+		export = (*exports)[0]
+	} else {
+		exportResp, err := im.createExport(fs.ID, "/"+req.pvName, req.exportPermissions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export filesystem %s: %v", fs.Name, err)
+		}
+		export = *exportResp
+		createdExport = true
+	}
+	if export.ExportPath == "" {
+		export.ExportPath = "/" + req.pvName
+	}
+	defer func() {
+		if err != nil && createdExport {
+			log.Infoln("Seemes to be some problem reverting created export id:", export.ID)
+			im.client.DeleteExportPath(export.ID)
+		}
+	}()
+
+	_, err = im.client.AttachMetadataToObject(fs.ID, map[string]interface{}{
+		pvNameKey:    req.pvName,
+		createdByKey: req.createdBy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach metadata to filesystem %s: %v", fs.Name, err)
+	}
+
+	volumeContext := map[string]string{
+		"ID":               strconv.FormatInt(fs.ID, 10),
+		"ipAddress":        ipAddress,
+		"volPathd":         export.ExportPath,
+		"exportID":         strconv.FormatInt(export.ID, 10),
+		"storage_protocol": req.protocol,
+	}
+	if req.mountOptions != "" {
+		volumeContext["nfs_mount_options"] = req.mountOptions
+	}
+	log.Infof("filesystem %s imported as %s", fs.Name, req.pvName)
+	return buildPV(req, im.volumeHandle(req.protocol, csiid.FileSystem, fs.ID), fs.Size, "", volumeContext), nil
+}
+
+//volumeHandle CSI volume ID of imported object, as the driver would have created it
+func (im *importer) volumeHandle(protocol string, objectType csiid.ObjectType, objectID int64) string {
+	id := csiid.New(protocol, objectType, objectID)
+	if im.arraySerial != "" {
+		id = id.WithArray(im.arraySerial)
+	}
+	return id.String()
+}
+
+//getMetadata return object metadata, failing when object already belongs to another PV
+func (im *importer) getMetadata(objectID int64, pvName string) (map[string]string, error) {
+	metadataList, err := im.client.GetObjectMetadata(objectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata of object %d: %v", objectID, err)
+	}
+	metadata := make(map[string]string)
+	for _, m := range *metadataList {
+		metadata[m.Key] = m.Value
+	}
+	if owner := metadata[pvNameKey]; owner != "" && owner != pvName {
+		return nil, fmt.Errorf("object %d is already managed by CSI as %s", objectID, owner)
+	}
+	if strings.EqualFold(metadata[toBeDeleteKey], "true") {
+		return nil, fmt.Errorf("object %d is marked %s", objectID, toBeDeleteKey)
+	}
+	return metadata, nil
+}
+
+func (im *importer) createExport(fileSystemID int64, exportPath, permissions string) (*api.ExportResponse, error) {
+	permissionList := []map[string]interface{}{}
+	if err := json.Unmarshal([]byte(strings.Replace(permissions, "'", "\"", -1)), &permissionList); err != nil {
+		return nil, fmt.Errorf("invalid export permissions %s: %v", permissions, err)
+	}
+	var exportFileSystem api.ExportFileSys
+	exportFileSystem.FilesystemID = fileSystemID
+	exportFileSystem.Transport_protocols = "TCP"
+	exportFileSystem.Privileged_port = true
+	exportFileSystem.Export_path = exportPath
+	exportFileSystem.Permissionsput = append(exportFileSystem.Permissionsput, permissionList...)
+	return im.client.ExportFileSystem(exportFileSystem)
+}
+
+//buildPV generate static PV pointing to imported object
+func buildPV(req importRequest, volumeHandle string, size int64, fsType string, volumeContext map[string]string) *v1.PersistentVolume {
+	volumeMode := v1.PersistentVolumeFilesystem
+	pv := &v1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        req.pvName,
+			Annotations: map[string]string{"pv.kubernetes.io/provisioned-by": req.driverName},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			AccessModes:                   []v1.PersistentVolumeAccessMode{v1.PersistentVolumeAccessMode(req.accessMode)},
+			Capacity:                      v1.ResourceList{v1.ResourceStorage: *resource.NewQuantity(size, resource.BinarySI)},
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimPolicy(req.reclaimPolicy),
+			StorageClassName:              req.storageClass,
+			VolumeMode:                    &volumeMode,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:           req.driverName,
+					VolumeHandle:     volumeHandle,
+					FSType:           fsType,
+					VolumeAttributes: volumeContext,
+				},
+			},
+		},
+	}
+	if req.secretName != "" {
+		secretRef := &v1.SecretReference{Name: req.secretName, Namespace: req.secretNamespace}
+		pv.Spec.CSI.ControllerPublishSecretRef = secretRef
+		pv.Spec.CSI.NodeStageSecretRef = secretRef
+		pv.Spec.CSI.NodePublishSecretRef = secretRef
+	}
+	if req.claimName != "" {
+		pv.Spec.ClaimRef = &v1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1",
+			Name: req.claimName, Namespace: req.claimNamespace}
+	}
+	return pv
+}
+
+//pvManifest render PV, adding controllerExpandSecretRef which is newer than vendored core/v1 types
+func pvManifest(pv *v1.PersistentVolume, format string) ([]byte, error) {
+	pvJSON, err := json.Marshal(pv)
+	if err != nil {
+		return nil, err
+	}
+	manifest := map[string]interface{}{}
+	if err = json.Unmarshal(pvJSON, &manifest); err != nil {
+		return nil, err
+	}
+	if secretRef := pv.Spec.CSI.ControllerPublishSecretRef; secretRef != nil {
+		csiSource := manifest["spec"].(map[string]interface{})["csi"].(map[string]interface{})
+		csiSource["controllerExpandSecretRef"] = map[string]string{"name": secretRef.Name, "namespace": secretRef.Namespace}
+	}
+	delete(manifest, "status")
+	delete(manifest["metadata"].(map[string]interface{}), "creationTimestamp")
+	if format == "json" {
+		return json.MarshalIndent(manifest, "", "  ")
+	}
+	return yaml.Marshal(manifest)
+}
@@ -0,0 +1,122 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package main
+
+import (
+	"errors"
+	"infinibox-csi-driver/api"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type ImporterSuite struct {
+	suite.Suite
+	api *api.MockApiService
+}
+
+func (suite *ImporterSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+}
+
+func TestImporterSuite(t *testing.T) {
+	suite.Run(t, new(ImporterSuite))
+}
+
+func (suite *ImporterSuite) Test_importObject_Validation() {
+	im := &importer{client: suite.api}
+	_, err := im.importObject(importRequest{objectName: "vol1", protocol: "smb"})
+	assert.NotNil(suite.T(), err, "unsupported protocol")
+	_, err = im.importObject(importRequest{objectName: "vol1", protocol: "iscsi"})
+	assert.NotNil(suite.T(), err, "network space required")
+	_, err = im.importObject(importRequest{objectName: "Vol 1", protocol: "fc"})
+	assert.NotNil(suite.T(), err, "invalid PV name")
+}
+
+func (suite *ImporterSuite) Test_importObject_iSCSI() {
+	suite.api.On("GetVolumeByName", "legacy_vol").Return(api.Volume{ID: 100, Name: "legacy_vol", Size: 1073741824, PoolName: "pool1", Type: "MASTER"}, nil)
+	suite.api.On("GetObjectMetadata", int64(100)).Return([]api.Metadata{{Key: fsTypeKey, Value: "xfs"}}, nil)
+	suite.api.On("GetNetworkSpaceByName", "iscsi1").Return(api.NetworkSpace{
+		Properties: api.NetworkSpaceProperty{IscsiIqn: "iqn.2009-11.com.infinidat:storage"},
+		Portals:    []api.Portal{{IpAdress: "10.0.0.1"}, {IpAdress: "10.0.0.2"}}}, nil)
+	suite.api.On("AttachMetadataToObject", int64(100), mock.Anything).Return(nil, nil)
+
+	im := &importer{client: suite.api}
+	pv, err := im.importObject(importRequest{objectName: "legacy_vol", protocol: "iscsi", networkSpace: "iscsi1", driverName: "infinibox-csi-driver"})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "legacy-vol", pv.Name)
+	assert.Equal(suite.T(), "100$$iscsi", pv.Spec.CSI.VolumeHandle)
+	assert.Equal(suite.T(), "xfs", pv.Spec.CSI.FSType, "recorded filesystem type should be kept")
+	assert.Equal(suite.T(), "10.0.0.1,10.0.0.2", pv.Spec.CSI.VolumeAttributes["portals"])
+	assert.Equal(suite.T(), "100", pv.Spec.CSI.VolumeAttributes["max_vols_per_host"])
+	suite.api.AssertCalled(suite.T(), "AttachMetadataToObject", int64(100), map[string]interface{}{
+		pvNameKey: "legacy-vol", fsTypeKey: "xfs", createdByKey: ""})
+}
+
+func (suite *ImporterSuite) Test_importObject_ArraySerial() {
+	suite.api.On("GetVolumeByName", "legacy_vol").Return(api.Volume{ID: 100, Name: "legacy_vol", Size: 1073741824}, nil)
+	suite.api.On("GetObjectMetadata", int64(100)).Return([]api.Metadata{}, nil)
+	suite.api.On("AttachMetadataToObject", int64(100), mock.Anything).Return(nil, nil)
+
+	im := &importer{client: suite.api, arraySerial: "2810"}
+	pv, err := im.importObject(importRequest{objectName: "legacy_vol", protocol: "fc", driverName: "infinibox-csi-driver"})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "v2:2810:fc:vol:100", pv.Spec.CSI.VolumeHandle)
+}
+
+func (suite *ImporterSuite) Test_importObject_AlreadyManaged() {
+	suite.api.On("GetVolumeByName", "legacy_vol").Return(api.Volume{ID: 100, Name: "legacy_vol"}, nil)
+	suite.api.On("GetObjectMetadata", int64(100)).Return([]api.Metadata{{Key: pvNameKey, Value: "csi-other"}}, nil)
+
+	im := &importer{client: suite.api}
+	_, err := im.importObject(importRequest{objectName: "legacy_vol", protocol: "fc"})
+	assert.NotNil(suite.T(), err, "volume owned by other PV should not be imported")
+	suite.api.AssertNotCalled(suite.T(), "AttachMetadataToObject", mock.Anything, mock.Anything)
+}
+
+func (suite *ImporterSuite) Test_importObject_NFS_CreateExport() {
+	suite.api.On("GetFileSystemByName", "legacy_fs").Return(api.FileSystem{ID: 200, Name: "legacy_fs", Size: 1073741824}, nil)
+	suite.api.On("GetObjectMetadata", int64(200)).Return([]api.Metadata{}, nil)
+	suite.api.On("GetNetworkSpaceByName", "nas1").Return(api.NetworkSpace{Portals: []api.Portal{{IpAdress: "10.0.0.5", Enabled: true}}}, nil)
+	suite.api.On("GetExportByFileSystem", int64(200)).Return([]api.ExportResponse{}, nil)
+	suite.api.On("ExportFileSystem", mock.Anything).Return(api.ExportResponse{ID: 300, ExportPath: "/legacy-fs"}, nil)
+	suite.api.On("AttachMetadataToObject", int64(200), mock.Anything).Return(nil, nil)
+
+	im := &importer{client: suite.api}
+	pv, err := im.importObject(importRequest{objectName: "legacy_fs", protocol: "nfs", networkSpace: "nas1"})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "200$$nfs", pv.Spec.CSI.VolumeHandle)
+	assert.Equal(suite.T(), "300", pv.Spec.CSI.VolumeAttributes["exportID"])
+	assert.Equal(suite.T(), "/legacy-fs", pv.Spec.CSI.VolumeAttributes["volPathd"])
+	assert.Equal(suite.T(), "10.0.0.5", pv.Spec.CSI.VolumeAttributes["ipAddress"])
+	assert.Equal(suite.T(), "ReadWriteMany", string(pv.Spec.AccessModes[0]))
+
+	manifest, err := pvManifest(pv, "yaml")
+	assert.Nil(suite.T(), err)
+	assert.Contains(suite.T(), string(manifest), "volumeHandle: 200$$nfs")
+}
+
+func (suite *ImporterSuite) Test_importObject_NFS_MetadataError() {
+	suite.api.On("GetFileSystemByName", "legacy_fs").Return(api.FileSystem{ID: 200, Name: "legacy_fs"}, nil)
+	suite.api.On("GetObjectMetadata", int64(200)).Return([]api.Metadata{}, nil)
+	suite.api.On("GetNetworkSpaceByName", "nas1").Return(api.NetworkSpace{Portals: []api.Portal{{IpAdress: "10.0.0.5", Enabled: true}}}, nil)
+	suite.api.On("GetExportByFileSystem", int64(200)).Return([]api.ExportResponse{}, nil)
+	suite.api.On("ExportFileSystem", mock.Anything).Return(api.ExportResponse{ID: 300}, nil)
+	suite.api.On("AttachMetadataToObject", int64(200), mock.Anything).Return(nil, errors.New("some error"))
+	suite.api.On("DeleteExportPath", int64(300)).Return(nil, nil)
+
+	im := &importer{client: suite.api}
+	_, err := im.importObject(importRequest{objectName: "legacy_fs", protocol: "nfs", networkSpace: "nas1"})
+	assert.NotNil(suite.T(), err)
+	suite.api.AssertCalled(suite.T(), "DeleteExportPath", int64(300))
+}
@@ -0,0 +1,311 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/api/clientgo"
+	log "infinibox-csi-driver/helper/logger"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const usage = `infinibox-csi-ctl - maintenance tool for the InfiniBox CSI driver
+
+Usage:
+  infinibox-csi-ctl orphans list   [flags]
+  infinibox-csi-ctl orphans delete [flags]
+  infinibox-csi-ctl import -name <volume or filesystem> -protocol <iscsi|fc|nfs> [flags]
+
+InfiniBox credentials are read from -secret/-namespace, or from flags,
+or from INFINIBOX_HOSTNAME, INFINIBOX_USERNAME and INFINIBOX_PASSWORD.
+
+Flags:
+`
+
+//options command line options shared by subcommands
+type options struct {
+	kubeconfig string
+	secret     string
+	namespace  string
+	hostname   string
+	username   string
+	password   string
+	driverName string
+	output     string
+	kinds      string
+	yes        bool
+	importReq  importRequest
+}
+
+func main() {
+	// keep driver logging quiet unless asked for
+	logLevel := os.Getenv("APP_LOG_LEVEL")
+	if logLevel == "" {
+		logLevel = "error"
+	}
+	log.Configure(logLevel, "text")
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, in io.Reader, out io.Writer) error {
+	opts := options{}
+	fs := flag.NewFlagSet("infinibox-csi-ctl", flag.ContinueOnError)
+	fs.StringVar(&opts.kubeconfig, "kubeconfig", os.Getenv("KUBECONFIG"), "path to kubeconfig, in-cluster config is used when empty")
+	fs.StringVar(&opts.secret, "secret", "", "name of kubernetes secret holding InfiniBox credentials")
+	fs.StringVar(&opts.namespace, "namespace", "infi", "namespace of the credentials secret")
+	fs.StringVar(&opts.hostname, "hostname", os.Getenv("INFINIBOX_HOSTNAME"), "InfiniBox management address")
+	fs.StringVar(&opts.username, "username", os.Getenv("INFINIBOX_USERNAME"), "InfiniBox user")
+	fs.StringVar(&opts.password, "password", os.Getenv("INFINIBOX_PASSWORD"), "InfiniBox password")
+	fs.StringVar(&opts.driverName, "driver-name", "infinibox-csi-driver", "CSI driver name used by PersistentVolumes")
+	fs.StringVar(&opts.output, "o", "", "output format: table or json for orphans, yaml or json for import")
+	fs.StringVar(&opts.kinds, "kinds", "", "comma separated orphan kinds to include, all when empty")
+	fs.BoolVar(&opts.yes, "yes", false, "delete without asking for confirmation")
+	req := &opts.importReq
+	fs.StringVar(&req.objectName, "name", "", "import: name of InfiniBox volume or filesystem")
+	fs.StringVar(&req.protocol, "protocol", "", "import: storage protocol iscsi, fc or nfs")
+	fs.StringVar(&req.pvName, "pv-name", "", "import: name of generated PersistentVolume, derived from object name when empty")
+	fs.StringVar(&req.fsType, "fstype", "", "import: filesystem type of block volume, ext4 when not recorded on volume")
+	fs.StringVar(&req.networkSpace, "network-space", "", "import: InfiniBox network space for iscsi and nfs")
+	fs.StringVar(&req.useCHAP, "use-chap", "", "import: iscsi CHAP mode none, chap or mutual_chap")
+	fs.StringVar(&req.maxVolsPerHost, "max-vols-per-host", "", "import: max_vols_per_host of block volume")
+	fs.StringVar(&req.mountOptions, "nfs-mount-options", "", "import: nfs mount options")
+	fs.StringVar(&req.exportPermissions, "nfs-export-permissions", "", "import: permissions of export created for unexported filesystem")
+	fs.StringVar(&req.storageClass, "storage-class", "", "import: storageClassName of generated PV")
+	fs.StringVar(&req.accessMode, "access-mode", "", "import: access mode of generated PV")
+	fs.StringVar(&req.reclaimPolicy, "reclaim-policy", "", "import: reclaim policy of generated PV, Retain when empty")
+	fs.StringVar(&req.claimName, "claim-name", "", "import: pre-bind PV to this PersistentVolumeClaim")
+	fs.StringVar(&req.claimNamespace, "claim-namespace", "", "import: namespace of claim to pre-bind")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+
+	if len(args) < 1 {
+		fs.Usage()
+		return errors.New("command is required")
+	}
+	switch args[0] {
+	case "orphans":
+		if len(args) < 2 {
+			fs.Usage()
+			return errors.New("orphans action is required")
+		}
+		if err := fs.Parse(args[2:]); err != nil {
+			return err
+		}
+		return runOrphans(args[1], opts, fs, in, out)
+	case "import":
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return runImport(opts, out)
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown command %s", strings.Join(args, " "))
+}
+
+func runOrphans(action string, opts options, fs *flag.FlagSet, in io.Reader, out io.Writer) error {
+	if opts.output == "" {
+		opts.output = "table"
+	}
+	if opts.output != "table" && opts.output != "json" {
+		return fmt.Errorf("unsupported output format %s", opts.output)
+	}
+
+	switch action {
+	case "list":
+		_, orphans, err := scanOrphans(opts)
+		if err != nil {
+			return err
+		}
+		return printOrphans(out, opts.output, orphans)
+	case "delete":
+		client, orphans, err := scanOrphans(opts)
+		if err != nil {
+			return err
+		}
+		return deleteOrphans(client, orphans, opts, in, out)
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown action %s", action)
+}
+
+func runImport(opts options, out io.Writer) error {
+	if opts.output == "" {
+		opts.output = "yaml"
+	}
+	if opts.output != "yaml" && opts.output != "json" {
+		return fmt.Errorf("unsupported output format %s", opts.output)
+	}
+	kc, client, err := buildClients(opts)
+	if err != nil {
+		return err
+	}
+	req := opts.importReq
+	req.driverName = opts.driverName
+	req.secretName = opts.secret
+	req.secretNamespace = opts.namespace
+	req.createdBy = "CSI/infinibox-csi-ctl"
+	if k8sVersion, err := kc.GetClusterVerion(); err == nil {
+		req.createdBy = "CSI/" + k8sVersion + "/infinibox-csi-ctl"
+	}
+	im := &importer{client: client, arraySerial: systemSerial(client)}
+	pv, err := im.importObject(req)
+	if err != nil {
+		return err
+	}
+	manifest, err := pvManifest(pv, opts.output)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(manifest))
+	return err
+}
+
+//buildClients build kubernetes client and infinibox client using credentials from secret or flags
+func buildClients(opts options) (clientgo.KubeClient, api.Client, error) {
+	kc, err := clientgo.BuildClientFromKubeconfig(opts.kubeconfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build kubernetes client: %v", err)
+	}
+	secrets := map[string]string{"hostname": opts.hostname, "username": opts.username, "password": opts.password}
+	if opts.secret != "" {
+		if secrets, err = kc.GetSecret(opts.secret, opts.namespace); err != nil {
+			return nil, nil, fmt.Errorf("failed to read secret %s/%s: %v", opts.namespace, opts.secret, err)
+		}
+	}
+	log.RegisterSecrets(secrets)
+	clientsvc := &api.ClientService{SecretsMap: secrets}
+	client, err := clientsvc.NewClient()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build InfiniBox client: %v", err)
+	}
+	return kc, client, nil
+}
+
+//scanOrphans build kubernetes inventory and cross reference it with infinibox objects
+func scanOrphans(opts options) (api.Client, []orphan, error) {
+	kc, client, err := buildClients(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pvs, err := kc.GetAllPersistentVolumes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list PersistentVolumes: %v", err)
+	}
+	snapshotHandles, err := kc.GetVolumeSnapshotContentHandles(opts.driverName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list VolumeSnapshotContents: %v", err)
+	}
+	nodes, err := kc.GetAllNodes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list Nodes: %v", err)
+	}
+
+	finder := &orphanFinder{client: client, inv: buildInventory(pvs, snapshotHandles, nodes, opts.driverName, systemSerial(client))}
+	orphans, err := finder.findOrphans()
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, filterOrphans(orphans, opts.kinds), nil
+}
+
+//systemSerial serial of the InfiniBox, empty when it can not be read
+func systemSerial(client api.Client) string {
+	serial, err := client.GetSystemSerial()
+	if err != nil {
+		log.Warnf("failed to get InfiniBox serial: %v", err)
+		return ""
+	}
+	return serial
+}
+
+func filterOrphans(orphans []orphan, kinds string) []orphan {
+	if kinds == "" {
+		return orphans
+	}
+	wanted := make(map[string]bool)
+	for _, kind := range strings.Split(kinds, ",") {
+		wanted[strings.TrimSpace(kind)] = true
+	}
+	filtered := []orphan{}
+	for _, o := range orphans {
+		if wanted[o.Kind] {
+			filtered = append(filtered, o)
+		}
+	}
+	return filtered
+}
+
+func printOrphans(out io.Writer, format string, orphans []orphan) error {
+	if format == "json" {
+		if orphans == nil {
+			orphans = []orphan{}
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(orphans)
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tID\tPARENT\tNAME\tREASON")
+	for _, o := range orphans {
+		parent := "-"
+		if o.ParentID != 0 {
+			parent = fmt.Sprint(o.ParentID)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", o.Kind, o.ID, parent, o.Name, o.Reason)
+	}
+	return w.Flush()
+}
+
+func deleteOrphans(client api.Client, orphans []orphan, opts options, in io.Reader, out io.Writer) error {
+	if len(orphans) == 0 {
+		fmt.Fprintln(out, "no orphans found")
+		return nil
+	}
+	if err := printOrphans(out, opts.output, orphans); err != nil {
+		return err
+	}
+	if !opts.yes {
+		fmt.Fprintf(out, "Delete %d objects from InfiniBox? [y/N]: ", len(orphans))
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Fprintln(out, "aborted")
+			return nil
+		}
+	}
+	failed := 0
+	for _, o := range orphans {
+		if err := deleteOrphan(client, o); err != nil {
+			failed++
+			fmt.Fprintf(out, "failed to delete %s %d (%s): %v\n", o.Kind, o.ID, o.Name, err)
+			continue
+		}
+		fmt.Fprintf(out, "deleted %s %d (%s)\n", o.Kind, o.ID, o.Name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deletions failed", failed, len(orphans))
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"infinibox-csi-driver/api"
+	"sort"
+	"strconv"
+	"strings"
+
+	"infinibox-csi-driver/helper/csiid"
+	log "infinibox-csi-driver/helper/logger"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	pvNameKey     = "host.k8s.pvname"
+	toBeDeleteKey = "host.k8s.to_be_deleted"
+
+	//orphan kinds, listed in the order they are deleted
+	kindLunMapping         = "lun-mapping"
+	kindHost               = "host"
+	kindExportRule         = "export-rule"
+	kindTreeq              = "treeq"
+	kindVolumeSnapshot     = "volume-snapshot"
+	kindFileSystemSnapshot = "filesystem-snapshot"
+	kindVolume             = "volume"
+	kindFileSystem         = "filesystem"
+)
+
+var deleteOrder = []string{kindLunMapping, kindHost, kindExportRule, kindTreeq,
+	kindVolumeSnapshot, kindFileSystemSnapshot, kindVolume, kindFileSystem}
+
+//orphan array object which no longer has a kubernetes owner
+type orphan struct {
+	Kind     string `json:"kind"`
+	ID       int64  `json:"id"`
+	ParentID int64  `json:"parentId,omitempty"`
+	Name     string `json:"name"`
+	Reason   string `json:"reason"`
+}
+
+//inventory kubernetes objects referencing infinibox objects
+type inventory struct {
+	blockVolumes map[int64]bool
+	fileSystems  map[int64]bool
+	treeqs       map[treeqKey]bool
+	snapshots    map[int64]bool
+	nodeNames    map[string]bool
+	nodeIPs      map[string]bool
+	// serial of the scanned InfiniBox, handles of other arrays are ignored
+	arraySerial string
+}
+
+//treeqKey filesystem and treeq id pair of treeq volume
+type treeqKey struct {
+	fileSystemID int64
+	treeqID      int64
+}
+
+func newInventory() *inventory {
+	return &inventory{
+		blockVolumes: make(map[int64]bool),
+		fileSystems:  make(map[int64]bool),
+		treeqs:       make(map[treeqKey]bool),
+		snapshots:    make(map[int64]bool),
+		nodeNames:    make(map[string]bool),
+		nodeIPs:      make(map[string]bool),
+	}
+}
+
+//buildInventory collect volume handles, snapshot handles and node identities of the cluster
+func buildInventory(pvs []v1.PersistentVolume, snapshotHandles []string, nodes []v1.Node, driverName, arraySerial string) *inventory {
+	inv := newInventory()
+	inv.arraySerial = arraySerial
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		inv.addVolumeHandle(pv.Spec.CSI.VolumeHandle)
+	}
+	for _, handle := range snapshotHandles {
+		if id, err := csiid.ParseSnapshot(handle); err == nil && inv.onArray(id) {
+			inv.snapshots[id.ObjectID] = true
+		}
+	}
+	for _, node := range nodes {
+		inv.nodeNames[strings.ToLower(node.Name)] = true
+		for _, addr := range node.Status.Addresses {
+			switch addr.Type {
+			case v1.NodeHostName:
+				inv.nodeNames[strings.ToLower(addr.Address)] = true
+			case v1.NodeInternalIP, v1.NodeExternalIP:
+				inv.nodeIPs[addr.Address] = true
+			}
+		}
+	}
+	return inv
+}
+
+func (inv *inventory) addVolumeHandle(handle string) {
+	id, err := csiid.Parse(handle)
+	if err != nil {
+		log.Debugf("skipping volume handle %s: %v", handle, err)
+		return
+	}
+	if !inv.onArray(id) {
+		return
+	}
+	switch id.Type {
+	case csiid.Treeq:
+		inv.treeqs[treeqKey{id.ObjectID, id.SubID}] = true
+		inv.fileSystems[id.ObjectID] = true
+	case csiid.FileSystem:
+		inv.fileSystems[id.ObjectID] = true
+	default:
+		inv.blockVolumes[id.ObjectID] = true
+	}
+}
+
+//onArray false when id is bound to another array than the scanned one
+func (inv *inventory) onArray(id csiid.ID) bool {
+	return id.ArraySerial == "" || inv.arraySerial == "" || id.ArraySerial == inv.arraySerial
+}
+
+//hasNode infinibox hosts are named after node fqdn, while kubernetes node may use short name
+func (inv *inventory) hasNode(hostName string) bool {
+	hostName = strings.ToLower(hostName)
+	if inv.nodeNames[hostName] {
+		return true
+	}
+	shortName := strings.Split(hostName, ".")[0]
+	for nodeName := range inv.nodeNames {
+		if strings.Split(nodeName, ".")[0] == shortName {
+			return true
+		}
+	}
+	return false
+}
+
+//csiObject infinibox object carrying CSI metadata
+type csiObject struct {
+	id         int64
+	objectType string
+	metadata   map[string]string
+}
+
+func (o csiObject) isFileSystem() bool {
+	return strings.Contains(strings.ToLower(o.objectType), "filesystem")
+}
+
+//orphanFinder cross reference infinibox objects with kubernetes inventory
+type orphanFinder struct {
+	client     api.Client
+	inv        *inventory
+	csiObjects map[int64]bool
+}
+
+//findOrphans return all orphan objects, sorted in deletion order
+func (f *orphanFinder) findOrphans() (orphans []orphan, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("findOrphans Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	objects, err := f.getCSIObjects()
+	if err != nil {
+		return nil, err
+	}
+	csiVolumes := make(map[int64]bool)
+	f.csiObjects = make(map[int64]bool)
+	for _, obj := range objects {
+		f.csiObjects[obj.id] = true
+		if !obj.isFileSystem() {
+			csiVolumes[obj.id] = true
+		}
+	}
+	for _, obj := range objects {
+		var found []orphan
+		if obj.isFileSystem() {
+			found, err = f.fileSystemOrphans(obj)
+		} else {
+			found, err = f.volumeOrphans(obj)
+		}
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, found...)
+	}
+	hostOrphans, err := f.hostOrphans(csiVolumes)
+	if err != nil {
+		return nil, err
+	}
+	orphans = append(orphans, hostOrphans...)
+	sortOrphans(orphans)
+	return orphans, nil
+}
+
+func (f *orphanFinder) getCSIObjects() ([]csiObject, error) {
+	entries, err := f.client.GetMetadataByKey(pvNameKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects with %s metadata: %v", pvNameKey, err)
+	}
+	objects := []csiObject{}
+	for _, entry := range *entries {
+		objectID := int64(entry.ObjectId)
+		metadataList, err := f.client.GetObjectMetadata(objectID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get metadata of object %d: %v", objectID, err)
+		}
+		metadata := make(map[string]string)
+		for _, m := range *metadataList {
+			metadata[m.Key] = m.Value
+		}
+		objects = append(objects, csiObject{id: objectID, objectType: entry.ObjectType, metadata: metadata})
+	}
+	return objects, nil
+}
+
+func (f *orphanFinder) volumeOrphans(obj csiObject) ([]orphan, error) {
+	orphans := []orphan{}
+	snapshots, err := f.client.GetVolumeSnapshotByParentID(int(obj.id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshots of volume %d: %v", obj.id, err)
+	}
+	liveChildren := 0
+	for _, snapshot := range *snapshots {
+		snapshotID := int64(snapshot.ID)
+		// clones carry their own metadata and are checked as volumes
+		if f.inv.snapshots[snapshotID] || f.csiObjects[snapshotID] {
+			liveChildren++
+			continue
+		}
+		orphans = append(orphans, orphan{Kind: kindVolumeSnapshot, ID: snapshotID, ParentID: obj.id,
+			Name: snapshot.Name, Reason: "no VolumeSnapshotContent references snapshot"})
+	}
+	if !f.inv.blockVolumes[obj.id] && liveChildren == 0 {
+		orphans = append(orphans, orphan{Kind: kindVolume, ID: obj.id, Name: obj.metadata[pvNameKey],
+			Reason: orphanReason(obj, "no PersistentVolume references volume")})
+	}
+	return orphans, nil
+}
+
+func (f *orphanFinder) fileSystemOrphans(obj csiObject) ([]orphan, error) {
+	orphans := []orphan{}
+	snapshots, err := f.client.GetFileSystemSnapshotsByParentID(obj.id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshots of filesystem %d: %v", obj.id, err)
+	}
+	liveChildren := 0
+	for _, snapshot := range *snapshots {
+		if f.inv.snapshots[snapshot.ID] || f.csiObjects[snapshot.ID] {
+			liveChildren++
+			continue
+		}
+		orphans = append(orphans, orphan{Kind: kindFileSystemSnapshot, ID: snapshot.ID, ParentID: obj.id,
+			Name: snapshot.Name, Reason: "no VolumeSnapshotContent references snapshot"})
+	}
+
+	if _, isTreeqFileSystem := obj.metadata[api.TREEQCOUNT]; isTreeqFileSystem {
+		treeqs, err := f.client.GetTreeqsByFileSystemID(obj.id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get treeqs of filesystem %d: %v", obj.id, err)
+		}
+		for _, treeq := range *treeqs {
+			if f.inv.treeqs[treeqKey{obj.id, treeq.ID}] {
+				liveChildren++
+				continue
+			}
+			orphans = append(orphans, orphan{Kind: kindTreeq, ID: treeq.ID, ParentID: obj.id,
+				Name: treeq.Name, Reason: "no PersistentVolume references treeq"})
+		}
+	}
+
+	if !f.inv.fileSystems[obj.id] && liveChildren == 0 {
+		orphans = append(orphans, orphan{Kind: kindFileSystem, ID: obj.id, Name: obj.metadata[pvNameKey],
+			Reason: orphanReason(obj, "no PersistentVolume references filesystem")})
+		return orphans, nil
+	}
+
+	exports, err := f.client.GetExportByFileSystem(obj.id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get exports of filesystem %d: %v", obj.id, err)
+	}
+	for _, export := range *exports {
+		for _, permission := range export.Permissions {
+			if permission.Client == "*" || strings.Contains(permission.Client, "-") || f.inv.nodeIPs[permission.Client] {
+				continue
+			}
+			orphans = append(orphans, orphan{Kind: kindExportRule, ID: export.ID, ParentID: obj.id,
+				Name: permission.Client, Reason: "export rule client is not a kubernetes node address"})
+		}
+	}
+	return orphans, nil
+}
+
+//hostOrphans hosts of removed nodes, only hosts created by the driver or holding mappings of CSI volumes are considered
+func (f *orphanFinder) hostOrphans(csiVolumes map[int64]bool) ([]orphan, error) {
+	orphans := []orphan{}
+	hosts, err := f.client.GetAllHosts()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list hosts: %v", err)
+	}
+	for _, host := range hosts {
+		if f.inv.hasNode(host.Name) {
+			continue
+		}
+		luns, err := f.client.GetAllLunByHost(host.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get luns of host %s: %v", host.Name, err)
+		}
+		foreignLuns := 0
+		csiLuns := []orphan{}
+		for _, lun := range luns {
+			if !csiVolumes[int64(lun.VolumeID)] {
+				foreignLuns++
+				continue
+			}
+			csiLuns = append(csiLuns, orphan{Kind: kindLunMapping, ID: int64(lun.VolumeID), ParentID: int64(host.ID),
+				Name: host.Name + "/lun-" + strconv.Itoa(lun.Lun), Reason: "host is not a kubernetes node"})
+		}
+		if len(csiLuns) == 0 {
+			createdByDriver, err := f.createdByDriver(int64(host.ID))
+			if err != nil {
+				return nil, err
+			}
+			if !createdByDriver {
+				continue
+			}
+		}
+		orphans = append(orphans, csiLuns...)
+		if foreignLuns == 0 {
+			orphans = append(orphans, orphan{Kind: kindHost, ID: int64(host.ID), Name: host.Name,
+				Reason: "host is not a kubernetes node and has no other mappings"})
+		}
+	}
+	return orphans, nil
+}
+
+//createdByDriver true when object carries the created_by metadata the driver attaches
+func (f *orphanFinder) createdByDriver(objectID int64) (bool, error) {
+	metadataList, err := f.client.GetObjectMetadata(objectID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get metadata of object %d: %v", objectID, err)
+	}
+	for _, m := range *metadataList {
+		if m.Key == createdByKey && strings.HasPrefix(m.Value, "CSI/") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func orphanReason(obj csiObject, reason string) string {
+	if strings.EqualFold(obj.metadata[toBeDeleteKey], "true") {
+		return reason + ", marked " + toBeDeleteKey
+	}
+	return reason
+}
+
+func sortOrphans(orphans []orphan) {
+	rank := make(map[string]int)
+	for i, kind := range deleteOrder {
+		rank[kind] = i
+	}
+	sort.SliceStable(orphans, func(i, j int) bool {
+		if rank[orphans[i].Kind] != rank[orphans[j].Kind] {
+			return rank[orphans[i].Kind] < rank[orphans[j].Kind]
+		}
+		return orphans[i].ID < orphans[j].ID
+	})
+}
+
+//deleteOrphan remove single orphan object from infinibox
+func deleteOrphan(client api.Client, o orphan) (err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("deleteOrphan Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Infof("deleting %s %d (%s)", o.Kind, o.ID, o.Name)
+	switch o.Kind {
+	case kindLunMapping:
+		return client.UnMapVolumeFromHost(int(o.ParentID), int(o.ID))
+	case kindHost:
+		luns, err := client.GetAllLunByHost(int(o.ID))
+		if err != nil {
+			return err
+		}
+		if len(luns) > 0 {
+			return fmt.Errorf("host %s still has %d lun mappings", o.Name, len(luns))
+		}
+		return client.DeleteHost(int(o.ID))
+	case kindExportRule:
+		return client.DeleteExportRule(o.ParentID, o.Name)
+	case kindTreeq:
+		if _, err = client.DeleteTreeq(o.ParentID, o.ID); err != nil {
+			return err
+		}
+		treeqCnt, err := client.GetFilesytemTreeqCount(o.ParentID)
+		if err != nil {
+			return err
+		}
+		_, err = client.AttachMetadataToObject(o.ParentID, map[string]interface{}{api.TREEQCOUNT: treeqCnt})
+		return err
+	case kindVolumeSnapshot, kindVolume:
+		return client.DeleteVolume(int(o.ID))
+	case kindFileSystemSnapshot, kindFileSystem:
+		return client.DeleteFileSystemComplete(o.ID)
+	}
+	return fmt.Errorf("unknown orphan kind %s", o.Kind)
+}
@@ -0,0 +1,147 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"infinibox-csi-driver/api"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type OrphanSuite struct {
+	suite.Suite
+	api *api.MockApiService
+}
+
+func (suite *OrphanSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+}
+
+func TestOrphanSuite(t *testing.T) {
+	suite.Run(t, new(OrphanSuite))
+}
+
+func (suite *OrphanSuite) Test_findOrphans() {
+	suite.api.On("GetMetadataByKey", pvNameKey).Return([]api.Metadata{
+		{ObjectId: 10, ObjectType: "VOLUME", Key: pvNameKey, Value: "pvc-live"},
+		{ObjectId: 11, ObjectType: "VOLUME", Key: pvNameKey, Value: "pvc-gone"},
+		{ObjectId: 20, ObjectType: "FILESYSTEM", Key: pvNameKey, Value: "pvc-nfs"},
+		{ObjectId: 30, ObjectType: "FILESYSTEM", Key: pvNameKey, Value: "pvc-treeq"},
+	}, nil)
+	suite.api.On("GetObjectMetadata", int64(10)).Return([]api.Metadata{{Key: pvNameKey, Value: "pvc-live"}}, nil)
+	suite.api.On("GetObjectMetadata", int64(11)).Return([]api.Metadata{{Key: pvNameKey, Value: "pvc-gone"}}, nil)
+	suite.api.On("GetObjectMetadata", int64(20)).Return([]api.Metadata{{Key: pvNameKey, Value: "pvc-nfs"}}, nil)
+	suite.api.On("GetObjectMetadata", int64(30)).Return([]api.Metadata{{Key: pvNameKey, Value: "pvc-treeq"}, {Key: api.TREEQCOUNT, Value: "2"}}, nil)
+
+	suite.api.On("GetVolumeSnapshotByParentID", 10).Return([]api.Volume{{ID: 12, Name: "snapshot-live"}, {ID: 13, Name: "snapshot-gone"}}, nil)
+	suite.api.On("GetVolumeSnapshotByParentID", 11).Return([]api.Volume{}, nil)
+	suite.api.On("GetFileSystemSnapshotsByParentID", int64(20)).Return([]api.FileSystem{}, nil)
+	suite.api.On("GetFileSystemSnapshotsByParentID", int64(30)).Return([]api.FileSystem{}, nil)
+	suite.api.On("GetTreeqsByFileSystemID", int64(30)).Return([]api.Treeq{{ID: 1, Name: "pvc-treeq"}, {ID: 2, Name: "pvc-treeq-gone"}}, nil)
+	suite.api.On("GetExportByFileSystem", int64(20)).Return([]api.ExportResponse{{ID: 200, Permissions: []api.Permissions{
+		{Client: "10.0.0.1"}, {Client: "10.0.0.9"}, {Client: "*"}}}}, nil)
+	suite.api.On("GetExportByFileSystem", int64(30)).Return([]api.ExportResponse{}, nil)
+
+	suite.api.On("GetAllHosts").Return([]api.Host{{ID: 1, Name: "worker1.example.com"}, {ID: 2, Name: "worker9.example.com"}}, nil)
+	suite.api.On("GetAllLunByHost", 2).Return([]api.LunInfo{{VolumeID: 10, Lun: 1}}, nil)
+
+	finder := &orphanFinder{client: suite.api, inv: getTestInventory()}
+	orphans, err := finder.findOrphans()
+	assert.Nil(suite.T(), err)
+
+	kinds := []string{}
+	for _, o := range orphans {
+		kinds = append(kinds, o.Kind)
+	}
+	assert.Equal(suite.T(), []string{kindLunMapping, kindHost, kindExportRule, kindTreeq, kindVolumeSnapshot, kindVolume}, kinds)
+	assert.Equal(suite.T(), int64(11), orphans[5].ID, "volume without PV should be orphan")
+	assert.Equal(suite.T(), int64(13), orphans[4].ID, "snapshot without VolumeSnapshotContent should be orphan")
+	assert.Equal(suite.T(), int64(2), orphans[3].ID, "treeq without PV should be orphan")
+	assert.Equal(suite.T(), "10.0.0.9", orphans[2].Name, "export rule of removed node should be orphan")
+}
+
+func (suite *OrphanSuite) Test_hostOrphans_DriverHostsOnly() {
+	suite.api.On("GetAllHosts").Return([]api.Host{{ID: 3, Name: "esx1.example.com"}, {ID: 4, Name: "worker7.example.com"}}, nil)
+	suite.api.On("GetAllLunByHost", 3).Return([]api.LunInfo{}, nil)
+	suite.api.On("GetAllLunByHost", 4).Return([]api.LunInfo{}, nil)
+	suite.api.On("GetObjectMetadata", int64(3)).Return([]api.Metadata{}, nil)
+	suite.api.On("GetObjectMetadata", int64(4)).Return([]api.Metadata{{Key: createdByKey, Value: "CSI/1.2.0"}}, nil)
+
+	finder := &orphanFinder{client: suite.api, inv: getTestInventory()}
+	orphans, err := finder.hostOrphans(map[int64]bool{})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []orphan{{Kind: kindHost, ID: 4, Name: "worker7.example.com",
+		Reason: "host is not a kubernetes node and has no other mappings"}}, orphans, "empty host not created by driver is left alone")
+}
+
+func (suite *OrphanSuite) Test_findOrphans_Error() {
+	suite.api.On("GetMetadataByKey", pvNameKey).Return(nil, errors.New("some error"))
+	finder := &orphanFinder{client: suite.api, inv: getTestInventory()}
+	_, err := finder.findOrphans()
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *OrphanSuite) Test_buildInventory_ArraySerial() {
+	pvs := []v1.PersistentVolume{
+		getTestPV("infinibox-csi-driver", "v2:2810:iscsi:vol:40"),
+		getTestPV("infinibox-csi-driver", "v2:1520:iscsi:vol:41"),
+	}
+	inv := buildInventory(pvs, []string{"v2:1520:iscsi:snap:42"}, nil, "infinibox-csi-driver", "2810")
+	assert.True(suite.T(), inv.blockVolumes[40])
+	assert.False(suite.T(), inv.blockVolumes[41], "volume of other array does not protect same id on this one")
+	assert.False(suite.T(), inv.snapshots[42])
+}
+
+func (suite *OrphanSuite) Test_deleteOrphans_Aborted() {
+	orphans := []orphan{{Kind: kindVolume, ID: 11, Name: "pvc-gone"}}
+	out := &bytes.Buffer{}
+	err := deleteOrphans(suite.api, orphans, options{output: "table"}, strings.NewReader("n\n"), out)
+	assert.Nil(suite.T(), err)
+	assert.Contains(suite.T(), out.String(), "aborted")
+	suite.api.AssertNotCalled(suite.T(), "DeleteVolume", 11)
+}
+
+func (suite *OrphanSuite) Test_deleteOrphans_Confirmed() {
+	orphans := []orphan{{Kind: kindLunMapping, ID: 10, ParentID: 2}, {Kind: kindVolume, ID: 11, Name: "pvc-gone"}}
+	suite.api.On("UnMapVolumeFromHost", 2, 10).Return(nil)
+	suite.api.On("DeleteVolume", 11).Return(nil)
+	out := &bytes.Buffer{}
+	err := deleteOrphans(suite.api, orphans, options{output: "json"}, strings.NewReader("y\n"), out)
+	assert.Nil(suite.T(), err)
+	suite.api.AssertCalled(suite.T(), "UnMapVolumeFromHost", 2, 10)
+	suite.api.AssertCalled(suite.T(), "DeleteVolume", 11)
+}
+
+func getTestInventory() *inventory {
+	pvs := []v1.PersistentVolume{
+		getTestPV("infinibox-csi-driver", "10$$iscsi"),
+		getTestPV("infinibox-csi-driver", "20$$nfs"),
+		getTestPV("infinibox-csi-driver", "30#1#1099511627776$$nfs_treeq"),
+		getTestPV("other-driver", "11$$iscsi"),
+	}
+	nodes := []v1.Node{{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker1"},
+		Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}}},
+	}}
+	return buildInventory(pvs, []string{"12$$iscsi"}, nodes, "infinibox-csi-driver", "2810")
+}
+
+func getTestPV(driver, handle string) v1.PersistentVolume {
+	return v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+		CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: handle}}}}
+}
@@ -0,0 +1,222 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+//Package arrays keep InfiniBox systems the driver manages, keyed by system serial.
+package arrays
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"sigs.k8s.io/yaml"
+)
+
+//Secret keys of InfiniBox credentials, same as in CSI request secrets
+const (
+	KeyHostname = "hostname"
+	KeyUsername = "username"
+	KeyPassword = "password"
+)
+
+//ErrNoArray returned when request does not identify an array and no default is configured
+var ErrNoArray = errors.New("no InfiniBox array selected: set array_serial parameter or provide secrets")
+
+//Array InfiniBox system and its management credentials
+type Array struct {
+	Serial   string `json:"serial"`
+	Hostname string `json:"hostname"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	//Default array used by requests which select neither array nor secrets
+	Default bool `json:"default,omitempty"`
+}
+
+//Config content of registry file
+type Config struct {
+	Arrays []Array `json:"arrays"`
+}
+
+//Secrets credentials of array as CSI secrets map
+func (a Array) Secrets() map[string]string {
+	return map[string]string{
+		KeyHostname: a.Hostname,
+		KeyUsername: a.Username,
+		KeyPassword: a.Password,
+	}
+}
+
+//Registry arrays known to the driver
+type Registry struct {
+	arrays map[string]Array
+}
+
+//NewRegistry validate arrays and build registry from them
+func NewRegistry(arrays []Array) (*Registry, error) {
+	r := &Registry{arrays: make(map[string]Array, len(arrays))}
+	defaults := 0
+	for _, array := range arrays {
+		array.Serial = strings.TrimSpace(array.Serial)
+		if array.Serial == "" || array.Hostname == "" || array.Username == "" || array.Password == "" {
+			return nil, fmt.Errorf("array %q: serial, hostname, username and password are required", array.Serial)
+		}
+		if strings.Contains(array.Serial, ":") {
+			return nil, fmt.Errorf("array %q: serial must not contain ':'", array.Serial)
+		}
+		if _, ok := r.arrays[array.Serial]; ok {
+			return nil, fmt.Errorf("array %s is listed more than once", array.Serial)
+		}
+		if array.Default {
+			defaults++
+		}
+		r.arrays[array.Serial] = array
+	}
+	if defaults > 1 {
+		return nil, errors.New("only one array can be the default")
+	}
+	return r, nil
+}
+
+//Load read registry from YAML or JSON file, missing file is an empty registry
+func Load(path string) (*Registry, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return NewRegistry(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse array registry %s: %v", path, err)
+	}
+	return NewRegistry(config.Arrays)
+}
+
+//Len number of registered arrays
+func (r *Registry) Len() int {
+	return len(r.arrays)
+}
+
+//Get array with serial
+func (r *Registry) Get(serial string) (Array, bool) {
+	array, ok := r.arrays[serial]
+	return array, ok
+}
+
+//List registered arrays ordered by serial
+func (r *Registry) List() []Array {
+	list := make([]Array, 0, len(r.arrays))
+	for _, array := range r.arrays {
+		list = append(list, array)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Serial < list[j].Serial })
+	return list
+}
+
+//FindByHostname array managed at hostname
+func (r *Registry) FindByHostname(hostname string) (Array, bool) {
+	hostname = strings.TrimSpace(hostname)
+	for _, array := range r.arrays {
+		if strings.EqualFold(array.Hostname, hostname) {
+			return array, true
+		}
+	}
+	return Array{}, false
+}
+
+//defaultArray array marked default, or the only one registered
+func (r *Registry) defaultArray() (Array, bool) {
+	for _, array := range r.arrays {
+		if array.Default || len(r.arrays) == 1 {
+			return array, true
+		}
+	}
+	return Array{}, false
+}
+
+//SystemSerialFunc read serial of InfiniBox system secrets give access to
+type SystemSerialFunc func(secrets map[string]string) (string, error)
+
+//VerifySerial fail unless secrets give access to the InfiniBox system with serial
+func VerifySerial(serial string, secrets map[string]string, systemSerial SystemSerialFunc) error {
+	actual, err := systemSerial(secrets)
+	if err != nil {
+		return fmt.Errorf("failed to verify InfiniBox %s is array %s: %v", secrets[KeyHostname], serial, err)
+	}
+	if actual != serial {
+		return fmt.Errorf("InfiniBox %s is array %s, not array %s", secrets[KeyHostname], actual, serial)
+	}
+	return nil
+}
+
+//Resolve credentials and serial of array a request is for.
+//Registered array credentials replace InfiniBox credentials of secrets, other secrets (e.g. CHAP) are kept.
+//Secrets of an unregistered serial must give access to that array, systemSerial reads the serial they do.
+//Serial is empty when the array is known only from secrets of an unregistered system.
+func (r *Registry) Resolve(serial string, secrets map[string]string, systemSerial SystemSerialFunc) (map[string]string, string, error) {
+	if serial != "" {
+		if array, ok := r.Get(serial); ok {
+			return overlay(secrets, array), array.Serial, nil
+		}
+		if secrets[KeyHostname] != "" {
+			if err := VerifySerial(serial, secrets, systemSerial); err != nil {
+				return nil, "", err
+			}
+			return secrets, serial, nil
+		}
+		return nil, "", fmt.Errorf("InfiniBox array %s is not registered", serial)
+	}
+	if hostname := secrets[KeyHostname]; hostname != "" {
+		if array, ok := r.FindByHostname(hostname); ok {
+			return overlay(secrets, array), array.Serial, nil
+		}
+		return secrets, "", nil
+	}
+	if array, ok := r.defaultArray(); ok {
+		return overlay(secrets, array), array.Serial, nil
+	}
+	return nil, "", ErrNoArray
+}
+
+func overlay(secrets map[string]string, array Array) map[string]string {
+	merged := make(map[string]string, len(secrets)+3)
+	for key, value := range secrets {
+		merged[key] = value
+	}
+	for key, value := range array.Secrets() {
+		merged[key] = value
+	}
+	return merged
+}
+
+var (
+	defaultRegistry = &Registry{arrays: map[string]Array{}}
+	defaultMutex    sync.RWMutex
+)
+
+//Get return process wide registry, empty unless replaced with Set
+func Get() *Registry {
+	defaultMutex.RLock()
+	defer defaultMutex.RUnlock()
+	return defaultRegistry
+}
+
+//Set replace process wide registry
+func Set(r *Registry) {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	defaultRegistry = r
+}
@@ -0,0 +1,151 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package arrays
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ArraysSuite struct {
+	suite.Suite
+	registry *Registry
+}
+
+func TestArraysSuite(t *testing.T) {
+	suite.Run(t, new(ArraysSuite))
+}
+
+//systemSerial serials of arrays by hostname
+func systemSerial(secrets map[string]string) (string, error) {
+	serials := map[string]string{"ibox9999": "9999", "ibox3030": "3030"}
+	if serial, ok := serials[secrets[KeyHostname]]; ok {
+		return serial, nil
+	}
+	return "", errors.New("unreachable")
+}
+
+func (suite *ArraysSuite) SetupTest() {
+	registry, err := NewRegistry([]Array{
+		{Serial: "2810", Hostname: "ibox2810.example.com", Username: "admin", Password: "secret1"},
+		{Serial: "1520", Hostname: "ibox1520.example.com", Username: "admin", Password: "secret2"},
+	})
+	assert.Nil(suite.T(), err)
+	suite.registry = registry
+}
+
+func (suite *ArraysSuite) Test_Load() {
+	dir, err := ioutil.TempDir("", "arrays")
+	assert.Nil(suite.T(), err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "arrays.yaml")
+	content := "arrays:\n- serial: \"2810\"\n  hostname: ibox2810\n  username: admin\n  password: secret\n  default: true\n"
+	assert.Nil(suite.T(), ioutil.WriteFile(path, []byte(content), 0600))
+
+	registry, err := Load(path)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 1, registry.Len())
+	array, ok := registry.Get("2810")
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), "ibox2810", array.Hostname)
+
+	registry, err = Load(filepath.Join(dir, "missing.yaml"))
+	assert.Nil(suite.T(), err, "missing file is an empty registry")
+	assert.Equal(suite.T(), 0, registry.Len())
+}
+
+func (suite *ArraysSuite) Test_List() {
+	list := suite.registry.List()
+	assert.Equal(suite.T(), 2, len(list))
+	assert.Equal(suite.T(), "1520", list[0].Serial)
+	assert.Equal(suite.T(), "2810", list[1].Serial)
+}
+
+func (suite *ArraysSuite) Test_NewRegistry_Invalid() {
+	_, err := NewRegistry([]Array{{Serial: "2810", Hostname: "ibox2810"}})
+	assert.NotNil(suite.T(), err, "credentials are required")
+
+	array := Array{Serial: "2810", Hostname: "ibox2810", Username: "admin", Password: "secret"}
+	_, err = NewRegistry([]Array{array, array})
+	assert.NotNil(suite.T(), err, "duplicate serial")
+
+	array.Serial = "28:10"
+	_, err = NewRegistry([]Array{array})
+	assert.NotNil(suite.T(), err, "serial is a volume ID field")
+}
+
+func (suite *ArraysSuite) Test_Resolve_BySerial() {
+	secrets, serial, err := suite.registry.Resolve("1520", map[string]string{"node.session.auth.username": "chap"}, systemSerial)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "1520", serial)
+	assert.Equal(suite.T(), "ibox1520.example.com", secrets[KeyHostname])
+	assert.Equal(suite.T(), "secret2", secrets[KeyPassword])
+	assert.Equal(suite.T(), "chap", secrets["node.session.auth.username"], "request secrets are kept")
+}
+
+func (suite *ArraysSuite) Test_Resolve_UnregisteredSerial() {
+	requestSecrets := map[string]string{KeyHostname: "ibox9999", KeyUsername: "u", KeyPassword: "p"}
+	secrets, serial, err := suite.registry.Resolve("9999", requestSecrets, systemSerial)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "9999", serial)
+	assert.Equal(suite.T(), requestSecrets, secrets)
+
+	_, _, err = suite.registry.Resolve("9999", nil, systemSerial)
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *ArraysSuite) Test_Resolve_UnregisteredSerialMismatch() {
+	requestSecrets := map[string]string{KeyHostname: "ibox3030", KeyUsername: "u", KeyPassword: "p"}
+	_, _, err := suite.registry.Resolve("9999", requestSecrets, systemSerial)
+	assert.EqualError(suite.T(), err, "InfiniBox ibox3030 is array 3030, not array 9999")
+
+	requestSecrets[KeyHostname] = "ibox-down"
+	_, _, err = suite.registry.Resolve("9999", requestSecrets, systemSerial)
+	assert.NotNil(suite.T(), err, "serial which can not be verified is rejected")
+
+	empty, err := NewRegistry(nil)
+	assert.Nil(suite.T(), err)
+	requestSecrets[KeyHostname] = "ibox3030"
+	_, _, err = empty.Resolve("9999", requestSecrets, systemSerial)
+	assert.NotNil(suite.T(), err, "empty registry verifies serial too")
+}
+
+func (suite *ArraysSuite) Test_Resolve_ByHostname() {
+	secrets, serial, err := suite.registry.Resolve("", map[string]string{KeyHostname: "IBOX2810.example.com", KeyUsername: "old", KeyPassword: "old"}, systemSerial)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "2810", serial)
+	assert.Equal(suite.T(), "secret1", secrets[KeyPassword])
+
+	_, serial, err = suite.registry.Resolve("", map[string]string{KeyHostname: "other", KeyUsername: "u", KeyPassword: "p"}, systemSerial)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "", serial, "unregistered array has no known serial")
+}
+
+func (suite *ArraysSuite) Test_Resolve_Default() {
+	_, _, err := suite.registry.Resolve("", nil, systemSerial)
+	assert.Equal(suite.T(), ErrNoArray, err, "no default with two arrays")
+
+	registry, err := NewRegistry([]Array{
+		{Serial: "2810", Hostname: "ibox2810", Username: "admin", Password: "secret1"},
+		{Serial: "1520", Hostname: "ibox1520", Username: "admin", Password: "secret2", Default: true},
+	})
+	assert.Nil(suite.T(), err)
+	_, serial, err := registry.Resolve("", nil, systemSerial)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "1520", serial)
+}
@@ -0,0 +1,273 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+//Package csiid encode and decode CSI volume, snapshot and node IDs.
+//
+//Version 2 IDs are colon separated:
+//	v2:<array-serial>:<protocol>:<object-type>:<id>[:<sub-id>][:<key>=<value>...]
+//Version 1 IDs are the handles written by earlier driver releases:
+//	<id>$$<protocol>
+//	<filesystem-id>#<treeq-id>#<max_filesystem_size>$$nfs_treeq
+package csiid
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//ObjectType kind of InfiniBox object an ID refers to
+type ObjectType string
+
+const (
+	Volume     ObjectType = "vol"
+	FileSystem ObjectType = "fs"
+	Treeq      ObjectType = "treeq"
+	Snapshot   ObjectType = "snap"
+)
+
+const (
+	//V1 legacy "<id>$$<protocol>" encoding
+	V1 = 1
+	//V2 versioned encoding carrying array serial and object type
+	V2 = 2
+)
+
+//AttrMaxFileSystemSize max_filesystem_size storage class parameter of treeq volumes
+const AttrMaxFileSystemSize = "max_filesystem_size"
+
+const (
+	v2Prefix          = "v2"
+	fieldSeparator    = ":"
+	attrSeparator     = "="
+	protocolSeparator = "$$"
+	treeqSeparator    = "#"
+	protocolTreeq     = "nfs_treeq"
+	protocolNFS       = "nfs"
+	protocolSMB       = "smb"
+)
+
+//ErrInvalidID returned when an ID can not be decoded
+var ErrInvalidID = errors.New("volume Id and other details not found")
+
+//ID decoded volume or snapshot ID
+type ID struct {
+	Version     int
+	ArraySerial string
+	Protocol    string
+	Type        ObjectType
+	ObjectID    int64
+	SubID       int64
+	Attributes  map[string]string
+}
+
+//New ID of object created with protocol, encoded as V1 until the array serial is set
+func New(protocol string, objectType ObjectType, objectID int64) ID {
+	return ID{Version: V1, Protocol: protocol, Type: objectType, ObjectID: objectID}
+}
+
+//NewTreeq ID of treeq treeqID in filesystem filesystemID
+func NewTreeq(filesystemID, treeqID int64, maxFileSystemSize string) ID {
+	return ID{
+		Version:    V1,
+		Protocol:   protocolTreeq,
+		Type:       Treeq,
+		ObjectID:   filesystemID,
+		SubID:      treeqID,
+		Attributes: map[string]string{AttrMaxFileSystemSize: maxFileSystemSize},
+	}
+}
+
+//WithArray copy of id bound to array serial, always encoded as V2
+func (id ID) WithArray(serial string) ID {
+	id.Version = V2
+	id.ArraySerial = serial
+	return id
+}
+
+//Attribute value of attribute key, empty when not set
+func (id ID) Attribute(key string) string {
+	return id.Attributes[key]
+}
+
+//String encode id
+func (id ID) String() string {
+	if id.Version == V1 {
+		return id.legacy()
+	}
+	fields := []string{v2Prefix, id.ArraySerial, id.Protocol, string(id.Type), strconv.FormatInt(id.ObjectID, 10)}
+	if id.SubID != 0 {
+		fields = append(fields, strconv.FormatInt(id.SubID, 10))
+	}
+	keys := make([]string, 0, len(id.Attributes))
+	for key := range id.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fields = append(fields, key+attrSeparator+id.Attributes[key])
+	}
+	return strings.Join(fields, fieldSeparator)
+}
+
+func (id ID) legacy() string {
+	if id.Type == Treeq {
+		return strconv.FormatInt(id.ObjectID, 10) + treeqSeparator + strconv.FormatInt(id.SubID, 10) +
+			treeqSeparator + id.Attribute(AttrMaxFileSystemSize) + protocolSeparator + id.Protocol
+	}
+	return strconv.FormatInt(id.ObjectID, 10) + protocolSeparator + id.Protocol
+}
+
+//Parse decode volume ID of any version
+func Parse(s string) (ID, error) {
+	if strings.HasPrefix(s, v2Prefix+fieldSeparator) {
+		return parseV2(s)
+	}
+	return parseV1(s)
+}
+
+//ParseSnapshot decode snapshot ID, V1 snapshot IDs do not carry object type
+func ParseSnapshot(s string) (ID, error) {
+	id, err := Parse(s)
+	if err != nil {
+		return id, err
+	}
+	if id.Version == V1 {
+		id.Type = Snapshot
+	}
+	if id.Type != Snapshot {
+		return ID{}, fmt.Errorf("%s is not a snapshot ID", s)
+	}
+	return id, nil
+}
+
+func parseV2(s string) (ID, error) {
+	fields := strings.Split(s, fieldSeparator)
+	if len(fields) < 5 || fields[2] == "" {
+		return ID{}, ErrInvalidID
+	}
+	id := ID{Version: V2, ArraySerial: fields[1], Protocol: fields[2], Type: ObjectType(fields[3])}
+	switch id.Type {
+	case Volume, FileSystem, Treeq, Snapshot:
+	default:
+		return ID{}, fmt.Errorf("unknown object type %q in ID %s", fields[3], s)
+	}
+	objectID, err := parseObjectID(fields[4])
+	if err != nil {
+		return ID{}, err
+	}
+	id.ObjectID = objectID
+	for i, field := range fields[5:] {
+		if kv := strings.SplitN(field, attrSeparator, 2); len(kv) == 2 {
+			if id.Attributes == nil {
+				id.Attributes = make(map[string]string)
+			}
+			id.Attributes[kv[0]] = kv[1]
+			continue
+		}
+		if i != 0 {
+			return ID{}, fmt.Errorf("unexpected field %q in ID %s", field, s)
+		}
+		if id.SubID, err = parseObjectID(field); err != nil {
+			return ID{}, err
+		}
+	}
+	if id.Type == Treeq && id.SubID == 0 {
+		return ID{}, fmt.Errorf("treeq ID %s has no treeq id", s)
+	}
+	return id, nil
+}
+
+func parseV1(s string) (ID, error) {
+	volproto := strings.Split(s, protocolSeparator)
+	if len(volproto) != 2 || volproto[1] == "" {
+		return ID{}, ErrInvalidID
+	}
+	id := ID{Version: V1, Protocol: volproto[1]}
+	if strings.Contains(volproto[0], treeqSeparator) {
+		treeqIDs := strings.Split(volproto[0], treeqSeparator)
+		if len(treeqIDs) != 3 {
+			return ID{}, fmt.Errorf("invalid treeq ID %s", s)
+		}
+		filesystemID, err := parseObjectID(treeqIDs[0])
+		if err != nil {
+			return ID{}, err
+		}
+		treeqID, err := parseObjectID(treeqIDs[1])
+		if err != nil {
+			return ID{}, err
+		}
+		return NewTreeq(filesystemID, treeqID, treeqIDs[2]), nil
+	}
+	objectID, err := parseObjectID(volproto[0])
+	if err != nil {
+		return ID{}, err
+	}
+	id.ObjectID = objectID
+	id.Type = Volume
+	if id.Protocol == protocolNFS || id.Protocol == protocolSMB {
+		id.Type = FileSystem
+	}
+	return id, nil
+}
+
+func parseObjectID(s string) (int64, error) {
+	objectID, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || objectID < 0 {
+		return 0, fmt.Errorf("invalid object id %q", s)
+	}
+	return objectID, nil
+}
+
+//MaxNodeIDLength longest node ID kubernetes accepts from NodeGetInfo
+const MaxNodeIDLength = 192
+
+//addressSeparator separates the addresses of a node in its node ID
+const addressSeparator = ","
+
+//NodeID encode CSI node ID of node with fqdn and its addresses, "<fqdn>$$<ip>[,<ip>...]".
+//Addresses which would make the ID longer than MaxNodeIDLength are left out, the first is always kept.
+func NodeID(fqdn string, ips ...string) string {
+	id := fqdn + protocolSeparator
+	for i, ip := range ips {
+		if i == 0 {
+			id += ip
+		} else if len(id)+len(addressSeparator)+len(ip) <= MaxNodeIDLength {
+			id += addressSeparator + ip
+		}
+	}
+	return id
+}
+
+//ParseNodeID decode CSI node ID into node fqdn and its addresses as encoded, comma separated
+func ParseNodeID(s string) (fqdn, ip string, err error) {
+	nodeNameIP := strings.Split(s, protocolSeparator)
+	if len(nodeNameIP) != 2 {
+		return "", "", errors.New("Node ID not found")
+	}
+	return nodeNameIP[0], nodeNameIP[1], nil
+}
+
+//ParseNodeAddresses decode CSI node ID into node fqdn and its addresses
+func ParseNodeAddresses(s string) (fqdn string, ips []string, err error) {
+	fqdn, ip, err := ParseNodeID(s)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, address := range strings.Split(ip, addressSeparator) {
+		if address = strings.TrimSpace(address); address != "" {
+			ips = append(ips, address)
+		}
+	}
+	return fqdn, ips, nil
+}
@@ -0,0 +1,151 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package csiid
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type CSIIDSuite struct {
+	suite.Suite
+}
+
+func TestCSIIDSuite(t *testing.T) {
+	suite.Run(t, new(CSIIDSuite))
+}
+
+func (suite *CSIIDSuite) Test_Parse_V1() {
+	id, err := Parse("1234$$iscsi")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), ID{Version: V1, Protocol: "iscsi", Type: Volume, ObjectID: 1234}, id)
+
+	id, err = Parse("77$$nfs")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), FileSystem, id.Type)
+	assert.Equal(suite.T(), int64(77), id.ObjectID)
+
+	id, err = Parse("78$$smb")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), FileSystem, id.Type, "smb volumes are filesystems")
+
+	id, err = Parse("1$$nvme_tcp")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), Volume, id.Type, "nvme_tcp volumes are block volumes")
+
+	id, err = Parse("30#1#1099511627776$$nfs_treeq")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), Treeq, id.Type)
+	assert.Equal(suite.T(), int64(30), id.ObjectID)
+	assert.Equal(suite.T(), int64(1), id.SubID)
+	assert.Equal(suite.T(), "1099511627776", id.Attribute(AttrMaxFileSystemSize))
+
+	id, err = Parse("30#1#$$nfs_treeq")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "", id.Attribute(AttrMaxFileSystemSize))
+}
+
+func (suite *CSIIDSuite) Test_Parse_V1_Invalid() {
+	for _, s := range []string{"", "100", "100$$", "a$$nfs", "100$$nfs$$123", "1$", "100#200$$nfs_treeq", "-1$$fc"} {
+		_, err := Parse(s)
+		assert.NotNil(suite.T(), err, s)
+	}
+}
+
+func (suite *CSIIDSuite) Test_V1_RoundTrip() {
+	for _, s := range []string{"1234$$iscsi", "5$$fc", "77$$nfs", "30#1#1099511627776$$nfs_treeq", "30#1#$$nfs_treeq"} {
+		id, err := Parse(s)
+		assert.Nil(suite.T(), err, s)
+		assert.Equal(suite.T(), s, id.String())
+	}
+	assert.Equal(suite.T(), "1234$$iscsi", New("iscsi", Volume, 1234).String())
+	assert.Equal(suite.T(), "30#1#4TiB$$nfs_treeq", NewTreeq(30, 1, "4TiB").String())
+}
+
+func (suite *CSIIDSuite) Test_V2_RoundTrip() {
+	ids := []ID{
+		New("iscsi", Volume, 1234).WithArray("2810"),
+		New("nfs", FileSystem, 77).WithArray("2810"),
+		New("fc", Snapshot, 99).WithArray("2810"),
+		NewTreeq(30, 1, "4TiB").WithArray("2810"),
+	}
+	for _, id := range ids {
+		decoded, err := Parse(id.String())
+		assert.Nil(suite.T(), err, id.String())
+		assert.Equal(suite.T(), id, decoded)
+	}
+	assert.Equal(suite.T(), "v2:2810:iscsi:vol:1234", ids[0].String())
+	assert.Equal(suite.T(), "v2:2810:nfs_treeq:treeq:30:1:max_filesystem_size=4TiB", ids[3].String())
+}
+
+func (suite *CSIIDSuite) Test_Parse_V2_Invalid() {
+	for _, s := range []string{
+		"v2:2810:iscsi:vol",
+		"v2:2810::vol:1",
+		"v2:2810:iscsi:lun:1",
+		"v2:2810:iscsi:vol:x",
+		"v2:2810:nfs_treeq:treeq:30",
+		"v2:2810:nfs:fs:1:2:3",
+	} {
+		_, err := Parse(s)
+		assert.NotNil(suite.T(), err, s)
+	}
+}
+
+func (suite *CSIIDSuite) Test_ParseSnapshot() {
+	id, err := ParseSnapshot("55$$nfs")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), Snapshot, id.Type)
+	assert.Equal(suite.T(), "55$$nfs", id.String())
+
+	_, err = ParseSnapshot("v2:2810:iscsi:vol:55")
+	assert.NotNil(suite.T(), err, "volume ID is not a snapshot ID")
+
+	id, err = ParseSnapshot("v2:2810:iscsi:snap:55")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(55), id.ObjectID)
+}
+
+func (suite *CSIIDSuite) Test_NodeID() {
+	fqdn, ip, err := ParseNodeID(NodeID("worker-1.example.com", "10.0.0.5"))
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "worker-1.example.com", fqdn)
+	assert.Equal(suite.T(), "10.0.0.5", ip)
+
+	_, _, err = ParseNodeID("worker-1")
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *CSIIDSuite) Test_NodeAddresses() {
+	id := NodeID("worker-1.example.com", "10.0.0.5", "fd00:10::5")
+	assert.Equal(suite.T(), "worker-1.example.com$$10.0.0.5,fd00:10::5", id)
+	fqdn, ips, err := ParseNodeAddresses(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "worker-1.example.com", fqdn)
+	assert.Equal(suite.T(), []string{"10.0.0.5", "fd00:10::5"}, ips)
+
+	_, ips, err = ParseNodeAddresses(NodeID("worker-1", "10.0.0.5"))
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{"10.0.0.5"}, ips, "node ID of earlier releases")
+
+	ips = []string{"10.0.0.5"}
+	for i := 0; i < 20; i++ {
+		ips = append(ips, "fd00:1234:5678:9abc::"+strconv.Itoa(i))
+	}
+	id = NodeID("worker-1.example.com", ips...)
+	assert.True(suite.T(), len(id) <= MaxNodeIDLength)
+	_, parsed, _ := ParseNodeAddresses(id)
+	assert.Equal(suite.T(), ips[:len(parsed)], parsed, "addresses which do not fit are left out")
+}
@@ -0,0 +1,335 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+//Package driverconfig typed driver configuration, built from defaults, environment,
+//a YAML file and the InfiniboxDriverConfig custom resource, in that order.
+package driverconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	csictx "github.com/rexray/gocsi/context"
+	"github.com/sirupsen/logrus"
+)
+
+//Duration time.Duration read from strings such as "30s" or "2m"
+type Duration struct {
+	time.Duration
+}
+
+//UnmarshalJSON parse duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+//MarshalJSON format duration as string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+//Config driver configuration
+type Config struct {
+	LogLevel     string          `json:"logLevel,omitempty"`
+	LogFormat    string          `json:"logFormat,omitempty"`
+	ClusterName  string          `json:"clusterName,omitempty"`
+	NFS          NFSConfig       `json:"nfs"`
+	Treeq        TreeqConfig     `json:"treeq"`
+	SMB          SMBConfig       `json:"smb"`
+	Timeouts     TimeoutConfig   `json:"timeouts"`
+	Retry        RetryConfig     `json:"retry"`
+	Probe        ProbeConfig     `json:"probe"`
+	Teardown     TeardownConfig  `json:"teardown"`
+	Reconcile    ReconcileConfig `json:"reconcile"`
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+	// initiator name of the node, from ISCSI_INITIATOR_NAME only
+	ISCSIInitiatorName string `json:"-"`
+}
+
+//NFSConfig defaults of nfs volumes
+type NFSConfig struct {
+	//MountOptions used when storage class has no nfs_mount_options
+	MountOptions string `json:"mountOptions,omitempty"`
+	//MaxFileSystems filesystems allowed on the array before nfs provisioning is refused
+	MaxFileSystems int `json:"maxFileSystems,omitempty"`
+	//KubeNodeAddresses export volumes also to the internal and external addresses of the kubernetes node, not only those of its node ID
+	KubeNodeAddresses bool `json:"kubeNodeAddresses,omitempty"`
+	//PreferSameSubnet mount from portals in the subnet of the node before the other portals of the network space
+	PreferSameSubnet bool `json:"preferSameSubnet,omitempty"`
+}
+
+//SMBConfig defaults of smb volumes
+type SMBConfig struct {
+	//MountOptions used when storage class has no smb_mount_options
+	MountOptions string `json:"mountOptions,omitempty"`
+}
+
+//TreeqConfig defaults of treeq storage class parameters
+type TreeqConfig struct {
+	MaxTreeqsPerFileSystem int    `json:"maxTreeqsPerFileSystem,omitempty"`
+	MaxFileSystems         int    `json:"maxFileSystems,omitempty"`
+	MaxFileSystemSize      string `json:"maxFileSystemSize,omitempty"`
+}
+
+//TimeoutConfig timeouts of InfiniBox requests and node operations
+type TimeoutConfig struct {
+	APIRequest     Duration `json:"apiRequest,omitempty"`
+	MultipathFlush Duration `json:"multipathFlush,omitempty"`
+	DeviceAttach   Duration `json:"deviceAttach,omitempty"`
+	//ShutdownDrain time operations in progress get to finish when driver is stopped, before they are cancelled
+	ShutdownDrain Duration `json:"shutdownDrain,omitempty"`
+}
+
+//RetryConfig retries of InfiniBox GET requests failing with connection errors or 502, 503 and 504
+type RetryConfig struct {
+	APIAttempts int      `json:"apiAttempts"`
+	APIWait     Duration `json:"apiWait,omitempty"`
+}
+
+//ProbeConfig checks of Probe RPC
+type ProbeConfig struct {
+	//ArrayCacheTTL time a controller check of InfiniBox access is reused
+	ArrayCacheTTL Duration `json:"arrayCacheTTL,omitempty"`
+	//NodeProtocols protocols node prerequisites are checked for: iscsi, fc, nfs, smb and nvme_tcp
+	NodeProtocols []string `json:"nodeProtocols,omitempty"`
+}
+
+//TeardownConfig removal of multipath maps and SCSI disks when iSCSI and FC volumes are unstaged
+type TeardownConfig struct {
+	//FlushAttempts multipath -f attempts before unstage fails with the map still present
+	FlushAttempts int `json:"flushAttempts,omitempty"`
+	//Force remove paths even when the device is in use or its map cannot be flushed, only to unblock a stuck node
+	Force bool `json:"force,omitempty"`
+}
+
+//ReconcileConfig node reconciler removing stale devices, iSCSI sessions and ifaces left by crashes and failed unstages
+type ReconcileConfig struct {
+	//Interval time between reconciler passes, 0 disables the reconciler
+	Interval Duration `json:"interval"`
+	//DryRun only report what the reconciler would remove
+	DryRun bool `json:"dryRun"`
+}
+
+//Defaults configuration of a driver without configuration file or resource
+func Defaults() Config {
+	return Config{
+		LogLevel:  "info",
+		LogFormat: "text",
+		NFS: NFSConfig{
+			MountOptions:   "hard,rsize=1048576,wsize=1048576",
+			MaxFileSystems: 4000,
+		},
+		Treeq: TreeqConfig{
+			MaxTreeqsPerFileSystem: 1000,
+			MaxFileSystems:         1000,
+			MaxFileSystemSize:      "100tib",
+		},
+		SMB: SMBConfig{
+			MountOptions: "vers=3.0",
+		},
+		Timeouts: TimeoutConfig{
+			APIRequest:     Duration{60 * time.Second},
+			MultipathFlush: Duration{4 * time.Second},
+			DeviceAttach:   Duration{10 * time.Second},
+			ShutdownDrain:  Duration{20 * time.Second},
+		},
+		Retry: RetryConfig{
+			APIWait: Duration{time.Second},
+		},
+		Probe: ProbeConfig{
+			ArrayCacheTTL: Duration{30 * time.Second},
+			NodeProtocols: []string{"iscsi", "nfs"},
+		},
+		Teardown: TeardownConfig{
+			FlushAttempts: 3,
+		},
+		Reconcile: ReconcileConfig{
+			Interval: Duration{10 * time.Minute},
+			DryRun:   true,
+		},
+	}
+}
+
+//FromEnv overlay environment variables the driver has always honored on c
+func FromEnv(c Config) Config {
+	ctx := context.Background()
+	if level, ok := csictx.LookupEnv(ctx, "APP_LOG_LEVEL"); ok && level != "" {
+		c.LogLevel = level
+	}
+	if format, ok := csictx.LookupEnv(ctx, "APP_LOG_FORMAT"); ok && format != "" {
+		c.LogFormat = format
+	}
+	if clusterName, ok := csictx.LookupEnv(ctx, "CLUSTER_NAME"); ok {
+		c.ClusterName = clusterName
+	}
+	if initiatorName, ok := csictx.LookupEnv(ctx, "ISCSI_INITIATOR_NAME"); ok {
+		c.ISCSIInitiatorName = initiatorName
+	}
+	return c
+}
+
+var (
+	sizeRe        = regexp.MustCompile(`(?i)^[0-9]+(gib|tib)$`)
+	featureGateRe = regexp.MustCompile(`^[A-Z][A-Za-z0-9]*$`)
+)
+
+//Validate check every setting, all problems are reported together
+func (c Config) Validate() error {
+	problems := []string{}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("logLevel %q is not a log level", c.LogLevel))
+	}
+	if !strings.EqualFold(c.LogFormat, "text") && !strings.EqualFold(c.LogFormat, "json") {
+		problems = append(problems, fmt.Sprintf("logFormat %q must be text or json", c.LogFormat))
+	}
+	if c.NFS.MaxFileSystems <= 0 {
+		problems = append(problems, "nfs.maxFileSystems must be positive")
+	}
+	if strings.ContainsAny(c.NFS.MountOptions, " \t\n") {
+		problems = append(problems, "nfs.mountOptions must be comma separated without spaces")
+	}
+	if strings.ContainsAny(c.SMB.MountOptions, " \t\n") {
+		problems = append(problems, "smb.mountOptions must be comma separated without spaces")
+	}
+	if c.Treeq.MaxTreeqsPerFileSystem <= 0 {
+		problems = append(problems, "treeq.maxTreeqsPerFileSystem must be positive")
+	}
+	if c.Treeq.MaxFileSystems <= 0 {
+		problems = append(problems, "treeq.maxFileSystems must be positive")
+	}
+	if !sizeRe.MatchString(c.Treeq.MaxFileSystemSize) {
+		problems = append(problems, fmt.Sprintf("treeq.maxFileSystemSize %q must be a size in gib or tib", c.Treeq.MaxFileSystemSize))
+	}
+	for name, timeout := range map[string]Duration{
+		"timeouts.apiRequest":     c.Timeouts.APIRequest,
+		"timeouts.multipathFlush": c.Timeouts.MultipathFlush,
+		"timeouts.deviceAttach":   c.Timeouts.DeviceAttach,
+		"timeouts.shutdownDrain":  c.Timeouts.ShutdownDrain,
+		"probe.arrayCacheTTL":     c.Probe.ArrayCacheTTL,
+	} {
+		if timeout.Duration <= 0 {
+			problems = append(problems, name+" must be positive")
+		}
+	}
+	if c.Teardown.FlushAttempts <= 0 {
+		problems = append(problems, "teardown.flushAttempts must be positive")
+	}
+	if c.Reconcile.Interval.Duration < 0 {
+		problems = append(problems, "reconcile.interval must not be negative")
+	}
+	if c.Retry.APIAttempts < 0 || c.Retry.APIWait.Duration < 0 {
+		problems = append(problems, "retry.apiAttempts and retry.apiWait must not be negative")
+	}
+	for _, protocol := range c.Probe.NodeProtocols {
+		switch strings.ToLower(protocol) {
+		case "iscsi", "fc", "nfs", "smb", "nvme_tcp":
+		default:
+			problems = append(problems, fmt.Sprintf("probe.nodeProtocols %q must be iscsi, fc, nfs, smb or nvme_tcp", protocol))
+		}
+	}
+	for gate := range c.FeatureGates {
+		if !featureGateRe.MatchString(gate) {
+			problems = append(problems, fmt.Sprintf("feature gate %q must be a CamelCase name", gate))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid driver configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+//Enabled state of feature gate, gates not configured are disabled
+func (c Config) Enabled(gate string) bool {
+	return c.FeatureGates[gate]
+}
+
+//restartOnly copy settings which are only read at startup from c into next
+func (c Config) restartOnly(next *Config) (changed []string) {
+	if c.LogFormat != next.LogFormat {
+		changed = append(changed, "logFormat")
+		next.LogFormat = c.LogFormat
+	}
+	if c.ClusterName != next.ClusterName {
+		changed = append(changed, "clusterName")
+		next.ClusterName = c.ClusterName
+	}
+	if !reflect.DeepEqual(c.FeatureGates, next.FeatureGates) {
+		changed = append(changed, "featureGates")
+		next.FeatureGates = c.FeatureGates
+	}
+	next.ISCSIInitiatorName = c.ISCSIInitiatorName
+	return changed
+}
+
+var (
+	current      = Defaults()
+	initialized  bool
+	currentMutex sync.RWMutex
+)
+
+//Get return process wide configuration, defaults until Apply is called
+func Get() Config {
+	currentMutex.RLock()
+	defer currentMutex.RUnlock()
+	return current
+}
+
+//Apply validate and install c as process wide configuration.
+//After the first call only the hot-reloadable subset changes: log level, nfs, treeq, timeouts, retry, probe and teardown,
+//changes of other settings are logged and take effect after restart.
+func Apply(c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	currentMutex.Lock()
+	first := !initialized
+	if !first {
+		if changed := current.restartOnly(&c); len(changed) > 0 {
+			log.Warnf("driver configuration of %s changed, restart driver to apply it", strings.Join(changed, ", "))
+		}
+	}
+	current = c
+	initialized = true
+	currentMutex.Unlock()
+
+	if first {
+		log.Configure(c.LogLevel, c.LogFormat)
+	} else {
+		log.SetLevel(c.LogLevel)
+	}
+	return nil
+}
+
+//reset forget applied configuration, for tests
+func reset() {
+	currentMutex.Lock()
+	defer currentMutex.Unlock()
+	current = Defaults()
+	initialized = false
+}
@@ -0,0 +1,148 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package driverconfig
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+type DriverConfigSuite struct {
+	suite.Suite
+	dir string
+}
+
+func TestDriverConfigSuite(t *testing.T) {
+	suite.Run(t, new(DriverConfigSuite))
+}
+
+func (suite *DriverConfigSuite) SetupTest() {
+	reset()
+	dir, err := ioutil.TempDir("", "driverconfig")
+	suite.Require().NoError(err)
+	suite.dir = dir
+}
+
+func (suite *DriverConfigSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+	reset()
+}
+
+func (suite *DriverConfigSuite) writeConfig(content string) string {
+	path := filepath.Join(suite.dir, "config.yaml")
+	suite.Require().NoError(ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func (suite *DriverConfigSuite) Test_Defaults_Valid() {
+	assert.Nil(suite.T(), Defaults().Validate())
+}
+
+func (suite *DriverConfigSuite) Test_Validate() {
+	c := Defaults()
+	c.LogLevel = "loud"
+	c.NFS.MaxFileSystems = 0
+	c.Treeq.MaxFileSystemSize = "10pb"
+	c.Timeouts.APIRequest = Duration{}
+	c.FeatureGates = map[string]bool{"not a gate": true}
+	c.SMB.MountOptions = "vers=3.0, seal"
+	c.Probe.NodeProtocols = []string{"iscsi", "ceph"}
+	c.Teardown.FlushAttempts = 0
+	c.Reconcile.Interval = Duration{-time.Minute}
+	err := c.Validate()
+	assert.NotNil(suite.T(), err)
+	for _, problem := range []string{"logLevel", "nfs.maxFileSystems", "treeq.maxFileSystemSize", "timeouts.apiRequest", "feature gate", "smb.mountOptions", "probe.nodeProtocols \"ceph\"", "teardown.flushAttempts", "reconcile.interval"} {
+		assert.Contains(suite.T(), err.Error(), problem)
+	}
+}
+
+func (suite *DriverConfigSuite) Test_Load_File() {
+	path := suite.writeConfig(`
+logLevel: debug
+nfs:
+  mountOptions: hard,vers=4.1
+treeq:
+  maxTreeqsPerFileSystem: 500
+timeouts:
+  apiRequest: 2m
+retry:
+  apiAttempts: 3
+featureGates:
+  SomeGate: true
+`)
+	loader := &Loader{FilePath: path}
+	assert.Nil(suite.T(), loader.Load())
+
+	c := Get()
+	assert.Equal(suite.T(), "debug", c.LogLevel)
+	assert.Equal(suite.T(), "hard,vers=4.1", c.NFS.MountOptions)
+	assert.Equal(suite.T(), 4000, c.NFS.MaxFileSystems, "settings missing from file keep defaults")
+	assert.Equal(suite.T(), 500, c.Treeq.MaxTreeqsPerFileSystem)
+	assert.Equal(suite.T(), 2*time.Minute, c.Timeouts.APIRequest.Duration)
+	assert.Equal(suite.T(), 3, c.Retry.APIAttempts)
+	assert.True(suite.T(), c.Enabled("SomeGate"))
+	assert.False(suite.T(), c.Enabled("OtherGate"))
+}
+
+func (suite *DriverConfigSuite) Test_Load_Invalid() {
+	loader := &Loader{FilePath: suite.writeConfig("timeouts:\n  apiRequest: soon\n")}
+	assert.NotNil(suite.T(), loader.Load())
+
+	loader = &Loader{FilePath: filepath.Join(suite.dir, "missing.yaml")}
+	assert.Nil(suite.T(), loader.Load(), "missing file is no file")
+}
+
+func (suite *DriverConfigSuite) Test_ReloadFile() {
+	path := suite.writeConfig("logFormat: text\ntreeq:\n  maxFileSystems: 10\n")
+	loader := &Loader{FilePath: path}
+	suite.Require().NoError(loader.Load())
+
+	suite.writeConfig("logFormat: json\ntreeq:\n  maxFileSystems: 20\n")
+	loader.reloadFile()
+	assert.Equal(suite.T(), 20, Get().Treeq.MaxFileSystems, "treeq limits are reloaded")
+	assert.Equal(suite.T(), "text", Get().LogFormat, "log format needs restart")
+
+	suite.writeConfig("treeq:\n  maxFileSystems: -1\n")
+	loader.reloadFile()
+	assert.Equal(suite.T(), 20, Get().Treeq.MaxFileSystems, "invalid configuration is not applied")
+}
+
+func (suite *DriverConfigSuite) Test_WatchResource() {
+	loader := &Loader{FilePath: suite.writeConfig("nfs:\n  maxFileSystems: 10\n  mountOptions: hard\n")}
+	suite.Require().NoError(loader.Load())
+
+	fake := watch.NewFake()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go loader.WatchResource(ctx, func() (watch.Interface, error) { return fake, nil }, time.Hour)
+
+	fake.Add(&unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "default"},
+		"spec":     map[string]interface{}{"nfs": map[string]interface{}{"maxFileSystems": int64(50)}},
+	}})
+	assert.Eventually(suite.T(), func() bool { return Get().NFS.MaxFileSystems == 50 }, time.Second, 10*time.Millisecond,
+		"resource overrides file")
+	assert.Equal(suite.T(), "hard", Get().NFS.MountOptions, "file settings missing from resource are kept")
+
+	fake.Delete(&unstructured.Unstructured{Object: map[string]interface{}{}})
+	assert.Eventually(suite.T(), func() bool { return Get().NFS.MaxFileSystems == 10 }, time.Second, 10*time.Millisecond,
+		"file applies again when resource is deleted")
+}
@@ -0,0 +1,196 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package driverconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"sigs.k8s.io/yaml"
+)
+
+//ResourceWatcher start watch of the InfiniboxDriverConfig resource of the driver
+type ResourceWatcher func() (watch.Interface, error)
+
+//Loader keep configuration file and resource content and apply their combination
+type Loader struct {
+	//FilePath YAML configuration file, optional
+	FilePath string
+
+	mutex    sync.Mutex
+	fileData []byte
+	spec     []byte
+}
+
+//Load read configuration file and apply configuration, missing file is no file
+func (l *Loader) Load() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	data, err := l.readFile()
+	if err != nil {
+		return err
+	}
+	l.fileData = data
+	return l.apply()
+}
+
+func (l *Loader) readFile() ([]byte, error) {
+	if l.FilePath == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(l.FilePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+//build combine defaults, environment, file and resource spec
+func (l *Loader) build() (Config, error) {
+	c := FromEnv(Defaults())
+	if len(l.fileData) > 0 {
+		if err := yaml.Unmarshal(l.fileData, &c); err != nil {
+			return c, fmt.Errorf("failed to parse driver configuration %s: %v", l.FilePath, err)
+		}
+	}
+	if len(l.spec) > 0 {
+		if err := json.Unmarshal(l.spec, &c); err != nil {
+			return c, fmt.Errorf("failed to parse InfiniboxDriverConfig spec: %v", err)
+		}
+	}
+	return c, nil
+}
+
+func (l *Loader) apply() error {
+	c, err := l.build()
+	if err != nil {
+		return err
+	}
+	return Apply(c)
+}
+
+//reloadFile apply configuration again when file content changed, invalid content keeps previous configuration
+func (l *Loader) reloadFile() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	data, err := l.readFile()
+	if err != nil {
+		log.Errorf("failed to read driver configuration %s: %v", l.FilePath, err)
+		return
+	}
+	if bytes.Equal(data, l.fileData) {
+		return
+	}
+	previous := l.fileData
+	l.fileData = data
+	if err := l.apply(); err != nil {
+		log.Errorf("driver configuration %s not reloaded: %v", l.FilePath, err)
+		l.fileData = previous
+		return
+	}
+	log.Infof("driver configuration reloaded from %s", l.FilePath)
+}
+
+//setSpec apply spec of InfiniboxDriverConfig resource, nil when resource was deleted
+func (l *Loader) setSpec(spec []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if bytes.Equal(spec, l.spec) {
+		return nil
+	}
+	previous := l.spec
+	l.spec = spec
+	if err := l.apply(); err != nil {
+		l.spec = previous
+		return err
+	}
+	log.Info("driver configuration reloaded from InfiniboxDriverConfig resource")
+	return nil
+}
+
+//WatchFile poll configuration file every interval until ctx is done, mounted ConfigMaps change in place
+func (l *Loader) WatchFile(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.reloadFile()
+		}
+	}
+}
+
+//WatchResource follow InfiniboxDriverConfig resource until ctx is done, watch is restarted after retryInterval when it ends
+func (l *Loader) WatchResource(ctx context.Context, start ResourceWatcher, retryInterval time.Duration) {
+	for {
+		w, err := start()
+		if err != nil {
+			log.Debugf("failed to watch InfiniboxDriverConfig: %v", err)
+		} else {
+			l.consume(ctx, w)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+func (l *Loader) consume(ctx context.Context, w watch.Interface) {
+	defer w.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return
+			}
+			l.handleEvent(event)
+		}
+	}
+}
+
+func (l *Loader) handleEvent(event watch.Event) {
+	var spec []byte
+	switch event.Type {
+	case watch.Added, watch.Modified:
+		obj, ok := event.Object.(*unstructured.Unstructured)
+		if !ok {
+			return
+		}
+		var err error
+		if spec, err = json.Marshal(obj.Object["spec"]); err != nil {
+			log.Errorf("failed to read InfiniboxDriverConfig %s: %v", obj.GetName(), err)
+			return
+		}
+	case watch.Deleted:
+	default:
+		return
+	}
+	if err := l.setSpec(spec); err != nil {
+		log.Errorf("InfiniboxDriverConfig not applied: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+//Package hostcheck verify host prerequisites of node operations, the node pod sees the host filesystem at /host.
+package hostcheck
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//DefaultRoot where node daemonset mounts / of the host
+const DefaultRoot = "/host"
+
+//Protocols with host prerequisites
+const (
+	ProtocolISCSI   = "iscsi"
+	ProtocolFC      = "fc"
+	ProtocolNFS     = "nfs"
+	ProtocolSMB     = "smb"
+	ProtocolNVMeTCP = "nvme_tcp"
+)
+
+const commandTimeout = 5 * time.Second
+
+var sbinDirs = []string{"sbin", "usr/sbin", "bin", "usr/bin"}
+
+//Runner run command, in the container commands such as multipathd run chrooted in the host
+type Runner func(ctx context.Context, name string, args ...string) ([]byte, error)
+
+//Checker check host prerequisites below Root
+type Checker struct {
+	Root string
+	Run  Runner
+	//InitiatorName configured for the node, initiatorname.iscsi of the host is not required when set
+	InitiatorName string
+}
+
+//New checker of host mounted at root
+func New(root string) *Checker {
+	return &Checker{Root: root, Run: runCommand}
+}
+
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+//Check verify prerequisites of protocols, every problem found is returned
+func (c *Checker) Check(ctx context.Context, protocols []string) []string {
+	if err := c.checkHostMount(); err != nil {
+		// nothing else can be checked without the host filesystem
+		return []string{err.Error()}
+	}
+	var problems []string
+	add := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	multipath := false
+	for _, protocol := range protocols {
+		switch strings.ToLower(protocol) {
+		case ProtocolISCSI:
+			add(c.checkBinary("iscsiadm"))
+			add(c.checkInitiatorName())
+			multipath = true
+		case ProtocolFC:
+			add(c.checkFCPorts())
+			multipath = true
+		case ProtocolNFS:
+			add(c.checkBinary("mount.nfs"))
+		case ProtocolSMB:
+			add(c.checkBinary("mount.cifs"))
+		case ProtocolNVMeTCP:
+			add(c.checkBinary("nvme"))
+			add(c.checkHostNQN())
+			add(c.checkNVMeMultipath())
+		}
+	}
+	if multipath {
+		add(c.checkMultipathd(ctx))
+	}
+	return problems
+}
+
+func (c *Checker) checkHostMount() error {
+	for _, dir := range []string{"", "dev", "etc"} {
+		info, err := os.Stat(filepath.Join(c.Root, dir))
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("host filesystem is not mounted at %s", c.Root)
+		}
+	}
+	return nil
+}
+
+func (c *Checker) checkBinary(name string) error {
+	for _, dir := range sbinDirs {
+		if _, err := os.Stat(filepath.Join(c.Root, dir, name)); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not installed on the host", name)
+}
+
+func (c *Checker) checkInitiatorName() error {
+	if c.InitiatorName != "" {
+		return nil
+	}
+	path := filepath.Join(c.Root, "etc/iscsi/initiatorname.iscsi")
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("iSCSI initiator name is not configured: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "InitiatorName=") && strings.TrimPrefix(line, "InitiatorName=") != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("iSCSI initiator name is not configured: no InitiatorName in %s", path)
+}
+
+func (c *Checker) checkHostNQN() error {
+	content, err := ioutil.ReadFile(filepath.Join(c.Root, "etc/nvme/hostnqn"))
+	if err != nil {
+		return fmt.Errorf("NVMe host NQN is not configured: %v", err)
+	}
+	if strings.TrimSpace(string(content)) == "" {
+		return fmt.Errorf("NVMe host NQN is not configured: /etc/nvme/hostnqn is empty")
+	}
+	return nil
+}
+
+//checkNVMeMultipath native NVMe multipath, namespaces reached over several portals show as one device
+func (c *Checker) checkNVMeMultipath() error {
+	content, err := ioutil.ReadFile(filepath.Join(c.Root, "sys/module/nvme_core/parameters/multipath"))
+	if err != nil {
+		return fmt.Errorf("nvme_core module is not loaded")
+	}
+	if strings.TrimSpace(string(content)) != "Y" {
+		return fmt.Errorf("NVMe native multipath is disabled, set nvme_core.multipath=Y")
+	}
+	return nil
+}
+
+func (c *Checker) checkFCPorts() error {
+	ports, err := ioutil.ReadDir(filepath.Join(c.Root, "sys/class/fc_host"))
+	if err != nil || len(ports) == 0 {
+		return fmt.Errorf("no FC ports found in /sys/class/fc_host")
+	}
+	return nil
+}
+
+func (c *Checker) checkMultipathd(ctx context.Context) error {
+	out, err := c.Run(ctx, "multipathd", "show", "daemon")
+	if err != nil {
+		return fmt.Errorf("multipathd is not running: %v %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
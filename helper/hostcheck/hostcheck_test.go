@@ -0,0 +1,108 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package hostcheck
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type HostCheckSuite struct {
+	suite.Suite
+	checker *Checker
+}
+
+func TestHostCheckSuite(t *testing.T) {
+	suite.Run(t, new(HostCheckSuite))
+}
+
+func (suite *HostCheckSuite) SetupTest() {
+	root, err := ioutil.TempDir("", "host")
+	suite.Require().NoError(err)
+	suite.checker = &Checker{Root: root, Run: func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		return []byte("pid 42 idle"), nil
+	}}
+	suite.writeFile("dev/null", "")
+	suite.writeFile("etc/iscsi/initiatorname.iscsi", "## generated\nInitiatorName=iqn.1994-05.com.redhat:node1\n")
+	suite.writeFile("usr/sbin/iscsiadm", "")
+	suite.writeFile("sbin/mount.nfs", "")
+	suite.writeFile("sys/class/fc_host/host1/port_name", "0x21000024ff7b6c8a")
+}
+
+func (suite *HostCheckSuite) TearDownTest() {
+	os.RemoveAll(suite.checker.Root)
+}
+
+func (suite *HostCheckSuite) writeFile(name, content string) {
+	path := filepath.Join(suite.checker.Root, name)
+	suite.Require().NoError(os.MkdirAll(filepath.Dir(path), 0755))
+	suite.Require().NoError(ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func (suite *HostCheckSuite) Test_Check_Ready() {
+	problems := suite.checker.Check(context.Background(), []string{ProtocolISCSI, ProtocolFC, ProtocolNFS})
+	assert.Empty(suite.T(), problems)
+}
+
+func (suite *HostCheckSuite) Test_Check_NoHostMount() {
+	suite.checker.Root = filepath.Join(suite.checker.Root, "missing")
+	problems := suite.checker.Check(context.Background(), []string{ProtocolISCSI})
+	assert.Equal(suite.T(), 1, len(problems))
+	assert.Contains(suite.T(), problems[0], "host filesystem is not mounted")
+}
+
+func (suite *HostCheckSuite) Test_Check_Problems() {
+	os.Remove(filepath.Join(suite.checker.Root, "usr/sbin/iscsiadm"))
+	suite.writeFile("etc/iscsi/initiatorname.iscsi", "InitiatorName=\n")
+	os.RemoveAll(filepath.Join(suite.checker.Root, "sys/class/fc_host"))
+	suite.checker.Run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		return []byte("ux_socket_connect: Connection refused"), errors.New("exit status 1")
+	}
+	problems := strings.Join(suite.checker.Check(context.Background(), []string{ProtocolISCSI, ProtocolFC}), "; ")
+	for _, problem := range []string{"iscsiadm is not installed", "initiator name", "no FC ports", "multipathd is not running"} {
+		assert.Contains(suite.T(), problems, problem)
+	}
+	assert.NotContains(suite.T(), problems, "mount.nfs", "nfs is not checked")
+}
+
+func (suite *HostCheckSuite) Test_Check_SMB() {
+	assert.Equal(suite.T(), []string{"mount.cifs is not installed on the host"}, suite.checker.Check(context.Background(), []string{ProtocolSMB}))
+	suite.writeFile("sbin/mount.cifs", "")
+	assert.Empty(suite.T(), suite.checker.Check(context.Background(), []string{ProtocolSMB}))
+}
+
+func (suite *HostCheckSuite) Test_Check_NVMeTCP() {
+	problems := strings.Join(suite.checker.Check(context.Background(), []string{ProtocolNVMeTCP}), "; ")
+	for _, problem := range []string{"nvme is not installed", "host NQN", "nvme_core"} {
+		assert.Contains(suite.T(), problems, problem)
+	}
+	suite.writeFile("usr/sbin/nvme", "")
+	suite.writeFile("etc/nvme/hostnqn", "nqn.2014-08.org.nvmexpress:uuid:node1\n")
+	suite.writeFile("sys/module/nvme_core/parameters/multipath", "N\n")
+	assert.Equal(suite.T(), []string{"NVMe native multipath is disabled, set nvme_core.multipath=Y"}, suite.checker.Check(context.Background(), []string{ProtocolNVMeTCP}))
+	suite.writeFile("sys/module/nvme_core/parameters/multipath", "Y\n")
+	assert.Empty(suite.T(), suite.checker.Check(context.Background(), []string{ProtocolNVMeTCP}))
+}
+
+func (suite *HostCheckSuite) Test_Check_ConfiguredInitiatorName() {
+	os.Remove(filepath.Join(suite.checker.Root, "etc/iscsi/initiatorname.iscsi"))
+	suite.checker.InitiatorName = "iqn.2020-01.com.example:node1"
+	assert.Empty(suite.T(), suite.checker.Check(context.Background(), []string{ProtocolISCSI}))
+}
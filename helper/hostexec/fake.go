@@ -0,0 +1,138 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package hostexec
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Fake executor of tests: host files live below Root, commands are answered from a script and recorded
+type Fake struct {
+	Root string
+
+	mutex  sync.Mutex
+	script []*FakeCommand
+	calls  []string
+}
+
+//FakeCommand scripted answer to a command line, its Do is called before the answer is returned
+type FakeCommand struct {
+	Line   string
+	Output string
+	Err    error
+	Do     func()
+	//Times command is answered, 0 is any number of times
+	Times int
+	used  int
+}
+
+//NewFake fake executor with host files below root
+func NewFake(root string) *Fake {
+	return &Fake{Root: root}
+}
+
+//Expect answer command line, command and arguments joined by spaces, with output and err.
+//The first answer of a line which is not used up is returned, set Times to script several answers of a line in order.
+func (f *Fake) Expect(line, output string, err error) *FakeCommand {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	command := &FakeCommand{Line: line, Output: output, Err: err}
+	f.script = append(f.script, command)
+	return command
+}
+
+//Calls command lines run, in order
+func (f *Fake) Calls() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+//Unused command lines expected but never run
+func (f *Fake) Unused() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	unused := []string{}
+	for _, command := range f.script {
+		if command.used == 0 {
+			unused = append(unused, command.Line)
+		}
+	}
+	return unused
+}
+
+//Run answer command from script, a command which is not expected fails
+func (f *Fake) Run(ctx context.Context, timeout time.Duration, command string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{command}, args...), " ")
+	f.mutex.Lock()
+	f.calls = append(f.calls, line)
+	var answer *FakeCommand
+	for _, candidate := range f.script {
+		if candidate.Line == line && (candidate.Times == 0 || candidate.used < candidate.Times) {
+			answer = candidate
+			answer.used++
+			break
+		}
+	}
+	f.mutex.Unlock()
+	if answer == nil {
+		return nil, fmt.Errorf("unexpected command: %s", line)
+	}
+	if answer.Do != nil {
+		answer.Do()
+	}
+	return []byte(answer.Output), answer.Err
+}
+
+func (f *Fake) ReadFile(path string) ([]byte, error) {
+	return files(f.Root).ReadFile(path)
+}
+
+func (f *Fake) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return files(f.Root).WriteFile(path, data, perm)
+}
+
+func (f *Fake) Stat(path string) (os.FileInfo, error) {
+	return files(f.Root).Stat(path)
+}
+
+func (f *Fake) MkdirAll(path string, perm os.FileMode) error {
+	return files(f.Root).MkdirAll(path, perm)
+}
+
+func (f *Fake) RemoveAll(path string) error {
+	return files(f.Root).RemoveAll(path)
+}
+
+func (f *Fake) Open(path string) (*os.File, error) {
+	return files(f.Root).Open(path)
+}
+
+func (f *Fake) ReadDir(path string) ([]string, error) {
+	return files(f.Root).ReadDir(path)
+}
+
+func (f *Fake) Glob(pattern string) ([]string, error) {
+	return files(f.Root).Glob(pattern)
+}
+
+func (f *Fake) EvalSymlinks(path string) (string, error) {
+	return files(f.Root).EvalSymlinks(path)
+}
+
+func (f *Fake) Path(path string) string {
+	return files(f.Root).Path(path)
+}
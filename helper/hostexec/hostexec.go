@@ -0,0 +1,301 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+//Package hostexec run commands and access files on the host of a node plugin, from inside its container
+package hostexec
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+//Executor kinds selected with HOST_EXECUTOR
+const (
+	KindChroot  = "chroot"
+	KindNsenter = "nsenter"
+)
+
+//DefaultRoot where node daemonset mounts / of the host
+const DefaultRoot = "/host"
+
+//hostPath PATH commands run with on the host
+const hostPath = "PATH=/sbin:/bin:/usr/sbin:/usr/bin"
+
+//Executor run commands on the host and access host files. Paths are host paths, such as /etc/iscsi or /sys/block.
+type Executor interface {
+	//Run command on host with stdout and stderr combined, it is killed when ctx is done or after timeout when timeout is positive
+	Run(ctx context.Context, timeout time.Duration, command string, args ...string) ([]byte, error)
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, data []byte, perm os.FileMode) error
+	Stat(path string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	RemoveAll(path string) error
+	Open(path string) (*os.File, error)
+	//ReadDir names of directory entries, sorted
+	ReadDir(path string) ([]string, error)
+	//Glob host paths matching pattern
+	Glob(pattern string) ([]string, error)
+	//EvalSymlinks host path path resolves to
+	EvalSymlinks(path string) (string, error)
+	//Path where host path is found in the container
+	Path(path string) string
+}
+
+//New executor of kind, empty kind is chroot
+func New(kind string) (Executor, error) {
+	switch strings.ToLower(kind) {
+	case "", KindChroot:
+		return &Chroot{Root: DefaultRoot}, nil
+	case KindNsenter:
+		return &Nsenter{PID: 1}, nil
+	}
+	return nil, fmt.Errorf("host executor %q must be %s or %s", kind, KindChroot, KindNsenter)
+}
+
+var (
+	defaultExecutor Executor = &Chroot{Root: DefaultRoot}
+	defaultMutex    sync.RWMutex
+)
+
+//Get return process wide executor, chroot into /host unless replaced with Set
+func Get() Executor {
+	defaultMutex.RLock()
+	defer defaultMutex.RUnlock()
+	return defaultExecutor
+}
+
+//Set replace process wide executor, e.g. with nsenter executor or a fake in tests
+func Set(e Executor) {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	defaultExecutor = e
+}
+
+//files host files below root in the container
+type files string
+
+func (root files) Path(path string) string {
+	return filepath.Join(string(root), path)
+}
+
+func (root files) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(root.Path(path))
+}
+
+func (root files) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(root.Path(path), data, perm)
+}
+
+func (root files) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(root.Path(path))
+}
+
+func (root files) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(root.Path(path), perm)
+}
+
+func (root files) RemoveAll(path string) error {
+	return os.RemoveAll(root.Path(path))
+}
+
+func (root files) Open(path string) (*os.File, error) {
+	return os.Open(root.Path(path))
+}
+
+func (root files) ReadDir(path string) ([]string, error) {
+	dir, err := os.Open(root.Path(path))
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (root files) Glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(root.Path(pattern))
+	if err != nil {
+		return nil, err
+	}
+	for i, match := range matches {
+		matches[i] = root.hostPath(match)
+	}
+	return matches, nil
+}
+
+func (root files) EvalSymlinks(path string) (string, error) {
+	target, err := filepath.EvalSymlinks(root.Path(path))
+	if err != nil {
+		return "", err
+	}
+	return root.hostPath(target), nil
+}
+
+//hostPath host path of path found in the container below root
+func (root files) hostPath(path string) string {
+	rel, err := filepath.Rel(filepath.Join(string(root), "/"), path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path
+	}
+	return filepath.Join("/", rel)
+}
+
+//run command in the container, with timeout when positive
+func run(ctx context.Context, timeout time.Duration, command string, args ...string) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	out, err := exec.CommandContext(ctx, command, args...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out, fmt.Errorf("%s timed out after %v", command, timeout)
+	}
+	return out, err
+}
+
+//Chroot run commands chrooted into the host filesystem mounted at Root, as host-chroot.sh did
+type Chroot struct {
+	Root string
+}
+
+func (c *Chroot) Run(ctx context.Context, timeout time.Duration, command string, args ...string) ([]byte, error) {
+	return run(ctx, timeout, "chroot", append([]string{c.Root, "/usr/bin/env", "-i", hostPath, command}, args...)...)
+}
+
+func (c *Chroot) ReadFile(path string) ([]byte, error) {
+	return files(c.Root).ReadFile(path)
+}
+
+func (c *Chroot) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return files(c.Root).WriteFile(path, data, perm)
+}
+
+func (c *Chroot) Stat(path string) (os.FileInfo, error) {
+	return files(c.Root).Stat(path)
+}
+
+func (c *Chroot) MkdirAll(path string, perm os.FileMode) error {
+	return files(c.Root).MkdirAll(path, perm)
+}
+
+func (c *Chroot) RemoveAll(path string) error {
+	return files(c.Root).RemoveAll(path)
+}
+
+func (c *Chroot) Open(path string) (*os.File, error) {
+	return files(c.Root).Open(path)
+}
+
+func (c *Chroot) ReadDir(path string) ([]string, error) {
+	return files(c.Root).ReadDir(path)
+}
+
+func (c *Chroot) Glob(pattern string) ([]string, error) {
+	return files(c.Root).Glob(pattern)
+}
+
+func (c *Chroot) EvalSymlinks(path string) (string, error) {
+	return files(c.Root).EvalSymlinks(path)
+}
+
+func (c *Chroot) Path(path string) string {
+	return files(c.Root).Path(path)
+}
+
+//Nsenter run commands in the mount, network, IPC and UTS namespaces of host process PID, the pod needs hostPID.
+//Host files are reached through /proc/<PID>/root.
+type Nsenter struct {
+	PID int
+}
+
+func (n *Nsenter) root() files {
+	return files("/proc/" + strconv.Itoa(n.PID) + "/root")
+}
+
+func (n *Nsenter) Run(ctx context.Context, timeout time.Duration, command string, args ...string) ([]byte, error) {
+	nsenter := []string{"--target", strconv.Itoa(n.PID), "--mount", "--uts", "--ipc", "--net", "--", "/usr/bin/env", "-i", hostPath, command}
+	return run(ctx, timeout, "nsenter", append(nsenter, args...)...)
+}
+
+func (n *Nsenter) ReadFile(path string) ([]byte, error) {
+	return n.root().ReadFile(path)
+}
+
+func (n *Nsenter) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return n.root().WriteFile(path, data, perm)
+}
+
+func (n *Nsenter) Stat(path string) (os.FileInfo, error) {
+	return n.root().Stat(path)
+}
+
+func (n *Nsenter) MkdirAll(path string, perm os.FileMode) error {
+	return n.root().MkdirAll(path, perm)
+}
+
+func (n *Nsenter) RemoveAll(path string) error {
+	return n.root().RemoveAll(path)
+}
+
+func (n *Nsenter) Open(path string) (*os.File, error) {
+	return n.root().Open(path)
+}
+
+func (n *Nsenter) ReadDir(path string) ([]string, error) {
+	return n.root().ReadDir(path)
+}
+
+func (n *Nsenter) Glob(pattern string) ([]string, error) {
+	return n.root().Glob(pattern)
+}
+
+func (n *Nsenter) EvalSymlinks(path string) (string, error) {
+	return n.root().EvalSymlinks(path)
+}
+
+func (n *Nsenter) Path(path string) string {
+	return n.root().Path(path)
+}
+
+//MountExec executor as mount.Exec of SafeFormatAndMount and exec mounter, commands run without timeout
+func MountExec(ctx context.Context, e Executor) mount.Exec {
+	return &mountExec{ctx: ctx, executor: e}
+}
+
+type mountExec struct {
+	ctx      context.Context
+	executor Executor
+}
+
+func (m *mountExec) Run(cmd string, args ...string) ([]byte, error) {
+	return m.executor.Run(m.ctx, 0, cmd, args...)
+}
+
+//NewMounter mounter running mount and umount on the host through e
+func NewMounter(ctx context.Context, e Executor) mount.Interface {
+	return mount.NewExecMounter(MountExec(ctx, e), mount.New(""))
+}
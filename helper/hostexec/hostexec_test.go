@@ -0,0 +1,151 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package hostexec
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type HostExecSuite struct {
+	suite.Suite
+	root string
+}
+
+func TestHostExecSuite(t *testing.T) {
+	suite.Run(t, new(HostExecSuite))
+}
+
+func (suite *HostExecSuite) SetupTest() {
+	root, err := ioutil.TempDir("", "hostexec")
+	suite.Require().NoError(err)
+	suite.root = root
+}
+
+func (suite *HostExecSuite) TearDownTest() {
+	os.RemoveAll(suite.root)
+}
+
+func (suite *HostExecSuite) Test_New() {
+	executor, err := New("")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "/host/etc/iscsi", executor.Path("/etc/iscsi"), "chroot is default")
+
+	executor, err = New("nsenter")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "/proc/1/root/etc/iscsi", executor.Path("/etc/iscsi"))
+
+	_, err = New("ssh")
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *HostExecSuite) Test_Chroot_Files() {
+	executor := &Chroot{Root: suite.root}
+	assert.Nil(suite.T(), os.MkdirAll(filepath.Join(suite.root, "etc/iscsi"), 0755))
+	assert.Nil(suite.T(), executor.WriteFile("/etc/iscsi/initiatorname.iscsi", []byte("InitiatorName=iqn.1993-08.org.debian:01:node1\n"), 0644))
+
+	data, err := ioutil.ReadFile(filepath.Join(suite.root, "etc/iscsi/initiatorname.iscsi"))
+	assert.Nil(suite.T(), err)
+	assert.Contains(suite.T(), string(data), "node1", "host files are below root")
+	data, err = executor.ReadFile("/etc/iscsi/initiatorname.iscsi")
+	assert.Nil(suite.T(), err)
+	assert.Contains(suite.T(), string(data), "node1")
+	_, err = executor.Stat("/etc/multipath.conf")
+	assert.True(suite.T(), os.IsNotExist(err))
+}
+
+func (suite *HostExecSuite) Test_Chroot_Directories() {
+	executor := &Chroot{Root: suite.root}
+	target := "/var/lib/kubelet/pods/pod1/volumes/kubernetes.io~csi/pvc-1/mount"
+	assert.Nil(suite.T(), executor.MkdirAll(target, 0750))
+	_, err := os.Stat(filepath.Join(suite.root, target))
+	assert.Nil(suite.T(), err, "directories are created below root")
+
+	dir, err := executor.Open("/var/lib/kubelet/pods/pod1/volumes/kubernetes.io~csi")
+	suite.Require().NoError(err)
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{"pvc-1"}, names)
+
+	assert.Nil(suite.T(), executor.RemoveAll("/var/lib/kubelet/pods/pod1"))
+	_, err = executor.Stat("/var/lib/kubelet/pods/pod1")
+	assert.True(suite.T(), os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(suite.root, "var/lib/kubelet"))
+	assert.Nil(suite.T(), err, "only the host path is removed")
+}
+
+func (suite *HostExecSuite) Test_Chroot_Sysfs() {
+	executor := &Chroot{Root: suite.root}
+	for _, dir := range []string{"sys/block/sdc/holders", "sys/block/sdb/holders/dm-3", "dev/disk/by-id"} {
+		suite.Require().NoError(os.MkdirAll(filepath.Join(suite.root, dir), 0755))
+	}
+	suite.Require().NoError(ioutil.WriteFile(filepath.Join(suite.root, "dev/sdb"), nil, 0644))
+	suite.Require().NoError(os.Symlink("../../sdb", filepath.Join(suite.root, "dev/disk/by-id/wwn-0x6742b0f")))
+
+	names, err := executor.ReadDir("/sys/block")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{"sdb", "sdc"}, names, "names are sorted")
+	matches, err := executor.Glob("/sys/block/*/holders/dm-*")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{"/sys/block/sdb/holders/dm-3"}, matches, "matches are host paths")
+	target, err := executor.EvalSymlinks("/dev/disk/by-id/wwn-0x6742b0f")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "/dev/sdb", target, "links resolve to host paths")
+}
+
+func (suite *HostExecSuite) Test_Run_Timeout() {
+	start := time.Now()
+	_, err := run(context.Background(), 50*time.Millisecond, "sleep", "5")
+	assert.NotNil(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), "timed out")
+	assert.True(suite.T(), time.Since(start) < 5*time.Second)
+
+	out, err := run(context.Background(), 0, "echo", "ok")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "ok\n", string(out))
+}
+
+func (suite *HostExecSuite) Test_Fake_Script() {
+	fake := NewFake(suite.root)
+	fake.Expect("multipath -f /dev/dm-3", "map in use", errors.New("exit status 1")).Times = 1
+	removed := false
+	fake.Expect("multipath -f /dev/dm-3", "", nil).Do = func() { removed = true }
+
+	out, err := fake.Run(context.Background(), time.Second, "multipath", "-f", "/dev/dm-3")
+	assert.NotNil(suite.T(), err)
+	assert.Equal(suite.T(), "map in use", string(out))
+	_, err = fake.Run(context.Background(), time.Second, "multipath", "-f", "/dev/dm-3")
+	assert.Nil(suite.T(), err, "answers of a line are used in order")
+	assert.True(suite.T(), removed)
+
+	_, err = fake.Run(context.Background(), time.Second, "iscsiadm", "-m", "session")
+	assert.NotNil(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), "unexpected command: iscsiadm -m session")
+	assert.Equal(suite.T(), []string{"multipath -f /dev/dm-3", "multipath -f /dev/dm-3", "iscsiadm -m session"}, fake.Calls())
+	assert.Empty(suite.T(), fake.Unused())
+}
+
+func (suite *HostExecSuite) Test_MountExec() {
+	fake := NewFake(suite.root)
+	fake.Expect("blkid -p -s TYPE /dev/sdb", "TYPE=xfs", nil)
+	out, err := MountExec(context.Background(), fake).Run("blkid", "-p", "-s", "TYPE", "/dev/sdb")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "TYPE=xfs", string(out))
+}
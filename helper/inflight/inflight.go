@@ -0,0 +1,234 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+//Package inflight track CSI RPCs in progress, so shutdown can drain them and operations it interrupts are known at next startup.
+package inflight
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const pollInterval = 50 * time.Millisecond
+
+//Operation RPC in progress, or interrupted by a previous driver process when read from journal
+type Operation struct {
+	Method  string    `json:"method"`
+	Key     string    `json:"key"`
+	Started time.Time `json:"started"`
+	//Parameters of the request needed to roll the operation back when it is interrupted
+	Parameters map[string]string `json:"parameters,omitempty"`
+
+	id     uint64
+	cancel context.CancelFunc
+}
+
+//Tracker operations in progress
+type Tracker struct {
+	mutex       sync.Mutex
+	next        uint64
+	running     map[uint64]*Operation
+	interrupted []Operation
+	draining    bool
+	journal     *journal
+}
+
+//NewTracker tracker without journal, Open adds one
+func NewTracker() *Tracker {
+	return &Tracker{running: map[uint64]*Operation{}}
+}
+
+//Open keep operations in journal file at path and return operations the previous process left unfinished.
+//They are kept until an operation with the same method and key succeeds.
+func (t *Tracker) Open(path string) ([]Operation, error) {
+	j, interrupted, err := openJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.journal = j
+	t.interrupted = interrupted
+	for _, op := range interrupted {
+		metrics.InterruptedOperation(op.Method)
+	}
+	t.save()
+	return interrupted, nil
+}
+
+//save write interrupted and keyed running operations to journal, mutex must be held
+func (t *Tracker) save() {
+	if t.journal == nil {
+		return
+	}
+	ops := append([]Operation{}, t.interrupted...)
+	for _, op := range t.running {
+		if op.Key != "" {
+			ops = append(ops, *op)
+		}
+	}
+	if err := t.journal.write(ops); err != nil {
+		log.Errorf("failed to record operations in progress: %v", err)
+	}
+}
+
+//requestKey volume, snapshot or name the request is about, empty for requests which change nothing
+func requestKey(req interface{}) string {
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		return r.GetVolumeId()
+	}
+	if r, ok := req.(interface{ GetSnapshotId() string }); ok && r.GetSnapshotId() != "" {
+		return r.GetSnapshotId()
+	}
+	if r, ok := req.(interface{ GetName() string }); ok {
+		return r.GetName()
+	}
+	return ""
+}
+
+//requestParameters parameters of CreateVolume requests which rollback of an interrupted one needs
+func requestParameters(req interface{}) map[string]string {
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		parameters := map[string]string{}
+		for k, v := range r.GetParameters() {
+			parameters[k] = v
+		}
+		return parameters
+	}
+	return nil
+}
+
+func (t *Tracker) start(ctx context.Context, method, key string, parameters map[string]string) (context.Context, *Operation, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.draining {
+		return nil, nil, status.Error(codes.Unavailable, "driver is shutting down")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t.next++
+	op := &Operation{Method: method, Key: key, Started: time.Now(), Parameters: parameters, id: t.next, cancel: cancel}
+	t.running[op.id] = op
+	if key != "" {
+		t.save()
+	}
+	return ctx, op, nil
+}
+
+func (t *Tracker) finish(op *Operation, err error) {
+	op.cancel()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.running, op.id)
+	if op.Key == "" {
+		return
+	}
+	if err == nil {
+		for i, interrupted := range t.interrupted {
+			if interrupted.Method == op.Method && interrupted.Key == op.Key {
+				log.Infof("%s of %s interrupted at %s has completed", op.Method, op.Key, interrupted.Started.Format(time.RFC3339))
+				t.interrupted = append(t.interrupted[:i], t.interrupted[i+1:]...)
+				break
+			}
+		}
+	}
+	t.save()
+}
+
+//UnaryServerInterceptor track every RPC, new RPCs are refused with Unavailable once Drain started
+func (t *Tracker) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, op, err := t.start(ctx, path.Base(info.FullMethod), requestKey(req), requestParameters(req))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	t.finish(op, err)
+	return resp, err
+}
+
+//Running operations in progress
+func (t *Tracker) Running() []Operation {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ops := make([]Operation, 0, len(t.running))
+	for _, op := range t.running {
+		ops = append(ops, *op)
+	}
+	return ops
+}
+
+//Interrupted operations previous driver process left unfinished and which have not completed since
+func (t *Tracker) Interrupted() []Operation {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]Operation{}, t.interrupted...)
+}
+
+//Resolve forget interrupted operation op once it has been rolled back
+func (t *Tracker) Resolve(op Operation) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, interrupted := range t.interrupted {
+		if interrupted.Method == op.Method && interrupted.Key == op.Key {
+			t.interrupted = append(t.interrupted[:i], t.interrupted[i+1:]...)
+			break
+		}
+	}
+	t.save()
+}
+
+//Drain refuse new operations and wait up to timeout for running ones, then cancel their contexts and wait up to grace.
+//Operations still running are returned, they stay in the journal and are reported as interrupted at next startup.
+func (t *Tracker) Drain(timeout, grace time.Duration) []Operation {
+	t.mutex.Lock()
+	t.draining = true
+	t.mutex.Unlock()
+
+	if t.wait(timeout) {
+		return nil
+	}
+	running := t.Running()
+	for _, op := range running {
+		log.Warnf("cancelling %s of %s running since %s", op.Method, op.Key, op.Started.Format(time.RFC3339))
+		op.cancel()
+	}
+	if t.wait(grace) {
+		return nil
+	}
+	return t.Running()
+}
+
+//wait until no operation runs or timeout expires, true when none runs
+func (t *Tracker) wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		t.mutex.Lock()
+		idle := len(t.running) == 0
+		t.mutex.Unlock()
+		if idle {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(pollInterval)
+	}
+}
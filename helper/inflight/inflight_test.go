@@ -0,0 +1,178 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package inflight
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type InflightSuite struct {
+	suite.Suite
+	dir string
+}
+
+func TestInflightSuite(t *testing.T) {
+	suite.Run(t, new(InflightSuite))
+}
+
+func (suite *InflightSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "inflight")
+	suite.Require().NoError(err)
+	suite.dir = dir
+}
+
+func (suite *InflightSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+}
+
+var stageInfo = &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+
+//start run blocking RPC through tracker, RPC returns when release is closed or its context is cancelled
+func (suite *InflightSuite) start(t *Tracker, volumeID string, release chan struct{}, ignoreCancel bool) chan error {
+	started := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		_, err := t.UnaryServerInterceptor(context.Background(), &csi.NodeStageVolumeRequest{VolumeId: volumeID}, stageInfo,
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				close(started)
+				if ignoreCancel {
+					<-release
+					return nil, nil
+				}
+				select {
+				case <-release:
+					return nil, nil
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			})
+		result <- err
+	}()
+	<-started
+	return result
+}
+
+func (suite *InflightSuite) Test_Drain_Waits() {
+	t := NewTracker()
+	release := make(chan struct{})
+	result := suite.start(t, "vol1", release, false)
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+
+	assert.Empty(suite.T(), t.Drain(time.Second, time.Second))
+	assert.Nil(suite.T(), <-result, "operation completed")
+
+	_, err := t.UnaryServerInterceptor(context.Background(), &csi.NodeStageVolumeRequest{VolumeId: "vol2"}, stageInfo,
+		func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+	assert.Equal(suite.T(), codes.Unavailable, status.Code(err), "new operations are refused")
+}
+
+func (suite *InflightSuite) Test_Drain_Cancels() {
+	t := NewTracker()
+	result := suite.start(t, "vol1", make(chan struct{}), false)
+
+	assert.Empty(suite.T(), t.Drain(50*time.Millisecond, time.Second))
+	assert.Equal(suite.T(), context.Canceled, <-result)
+}
+
+func (suite *InflightSuite) Test_Journal_Interrupted() {
+	path := filepath.Join(suite.dir, "node-operations.json")
+	t := NewTracker()
+	interrupted, err := t.Open(path)
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), interrupted)
+
+	release := make(chan struct{})
+	defer close(release)
+	suite.start(t, "vol1", release, true)
+	running := t.Drain(10*time.Millisecond, 10*time.Millisecond)
+	assert.Equal(suite.T(), 1, len(running), "operation ignoring cancellation keeps running")
+
+	// next driver process
+	next := NewTracker()
+	interrupted, err = next.Open(path)
+	suite.Require().NoError(err)
+	suite.Require().Equal(1, len(interrupted))
+	assert.Equal(suite.T(), "NodeStageVolume", interrupted[0].Method)
+	assert.Equal(suite.T(), "vol1", interrupted[0].Key)
+
+	fail := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, errors.New("failed") }
+	next.UnaryServerInterceptor(context.Background(), &csi.NodeStageVolumeRequest{VolumeId: "vol1"}, stageInfo, fail)
+	assert.Equal(suite.T(), 1, len(next.Interrupted()), "failed retry keeps operation interrupted")
+
+	succeed := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	next.UnaryServerInterceptor(context.Background(), &csi.NodeStageVolumeRequest{VolumeId: "vol1"}, stageInfo, succeed)
+	assert.Empty(suite.T(), next.Interrupted(), "successful retry completes operation")
+
+	interrupted, err = NewTracker().Open(path)
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), interrupted)
+}
+
+func (suite *InflightSuite) Test_RequestKey() {
+	assert.Equal(suite.T(), "vol1", requestKey(&csi.DeleteVolumeRequest{VolumeId: "vol1"}))
+	assert.Equal(suite.T(), "snap1", requestKey(&csi.DeleteSnapshotRequest{SnapshotId: "snap1"}))
+	assert.Equal(suite.T(), "pvc-1", requestKey(&csi.CreateVolumeRequest{Name: "pvc-1"}))
+	assert.Equal(suite.T(), "", requestKey(&csi.ProbeRequest{}))
+}
+
+func (suite *InflightSuite) Test_Journal_Resolve() {
+	path := filepath.Join(suite.dir, "controller-operations.json")
+	t := NewTracker()
+	_, err := t.Open(path)
+	suite.Require().NoError(err)
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	createInfo := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	go t.UnaryServerInterceptor(context.Background(), &csi.CreateVolumeRequest{Name: "pvc-1", Parameters: map[string]string{"storage_protocol": "nfs"}}, createInfo,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			close(started)
+			<-release
+			return nil, nil
+		})
+	<-started
+	t.Drain(10*time.Millisecond, 10*time.Millisecond)
+
+	next := NewTracker()
+	interrupted, err := next.Open(path)
+	suite.Require().NoError(err)
+	suite.Require().Equal(1, len(interrupted))
+	assert.Equal(suite.T(), map[string]string{"storage_protocol": "nfs"}, interrupted[0].Parameters, "parameters are kept for rollback")
+
+	next.Resolve(interrupted[0])
+	assert.Empty(suite.T(), next.Interrupted())
+	interrupted, err = NewTracker().Open(path)
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), interrupted, "rolled back operation is dropped from journal")
+}
+
+func (suite *InflightSuite) Test_RequestParameters() {
+	req := &csi.CreateVolumeRequest{Name: "pvc-1", Parameters: map[string]string{"storage_protocol": "iscsi"}}
+	assert.Equal(suite.T(), map[string]string{"storage_protocol": "iscsi"}, requestParameters(req))
+	assert.Nil(suite.T(), requestParameters(&csi.NodeStageVolumeRequest{VolumeId: "1$$iscsi", StagingTargetPath: "/stage"}),
+		"an interrupted NodeStageVolume is not rolled back, kubelet retries it")
+	assert.Nil(suite.T(), requestParameters(&csi.DeleteVolumeRequest{VolumeId: "vol1"}))
+}
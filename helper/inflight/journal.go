@@ -0,0 +1,84 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package inflight
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+)
+
+//maxInterruptedAge interrupted operations older than this are not retried by the CO any more and are dropped
+const maxInterruptedAge = 7 * 24 * time.Hour
+
+//journal file of keyed operations in progress, rewritten as a whole on every change
+type journal struct {
+	path string
+}
+
+type journalContent struct {
+	Operations []Operation `json:"operations"`
+}
+
+//openJournal journal at path and operations recorded in it
+func openJournal(path string) (*journal, []Operation, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, nil, err
+	}
+	j := &journal{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var content journalContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		// a corrupt journal must not keep the driver from starting
+		log.Errorf("ignoring unreadable operation journal %s: %v", path, err)
+		return j, nil, nil
+	}
+	var interrupted []Operation
+	seen := map[string]bool{}
+	for _, op := range content.Operations {
+		if time.Since(op.Started) > maxInterruptedAge {
+			log.Warnf("dropping %s of %s interrupted at %s", op.Method, op.Key, op.Started.Format(time.RFC3339))
+			continue
+		}
+		// an interrupted operation retried and interrupted again is recorded twice
+		if seen[op.Method+"/"+op.Key] {
+			continue
+		}
+		seen[op.Method+"/"+op.Key] = true
+		interrupted = append(interrupted, op)
+	}
+	return j, interrupted, nil
+}
+
+//write replace journal content with ops
+func (j *journal) write(ops []Operation) error {
+	data, err := json.Marshal(journalContent{Operations: ops})
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	return os.Rename(tmp, j.path)
+}
@@ -0,0 +1,246 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package lock
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+const (
+	leaseNamePrefix = "infinibox-csi-"
+	//LeaseKeyAnnotation lease annotation holding locked key, lease names are hashed keys
+	LeaseKeyAnnotation = "csi.infinidat.com/lock-key"
+	//DefaultLeaseDuration lease lifetime when not renewed, e.g. after controller crash
+	DefaultLeaseDuration = 30 * time.Second
+	leaseRetryInterval   = time.Second
+)
+
+//leaseManager lock keys across controller replicas with Kubernetes leases,
+//keys are locked in-process first so only one operation per process competes for lease
+type leaseManager struct {
+	local    Manager
+	leases   coordinationclient.LeaseInterface
+	identity string
+	duration time.Duration
+}
+
+//NewLeaseManager return manager locking keys with leases in namespace of leases, held by identity
+func NewLeaseManager(leases coordinationclient.LeaseInterface, identity string, duration time.Duration) Manager {
+	if duration <= 0 {
+		duration = DefaultLeaseDuration
+	}
+	return &leaseManager{local: NewLocalManager(), leases: leases, identity: identity, duration: duration}
+}
+
+func (m *leaseManager) TryLock(ctx context.Context, key string) (context.Context, Unlock, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, unlockLocal, err := m.local.TryLock(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	acquired, err := m.acquire(key)
+	if err != nil || !acquired {
+		unlockLocal()
+		if err == nil {
+			err = ErrBusy
+		}
+		return nil, nil, err
+	}
+	heldCtx, unlock := m.hold(ctx, key, unlockLocal)
+	return heldCtx, unlock, nil
+}
+
+func (m *leaseManager) Lock(ctx context.Context, key string) (context.Context, Unlock, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, unlockLocal, err := m.local.Lock(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		acquired, err := m.acquire(key)
+		if err != nil {
+			unlockLocal()
+			return nil, nil, err
+		}
+		if acquired {
+			heldCtx, unlock := m.hold(ctx, key, unlockLocal)
+			return heldCtx, unlock, nil
+		}
+		select {
+		case <-time.After(leaseRetryInterval):
+		case <-ctx.Done():
+			unlockLocal()
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+func leaseName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return leaseNamePrefix + hex.EncodeToString(sum[:])[:32]
+}
+
+//acquire create lease for key or take over expired one, false when held by other holder
+func (m *leaseManager) acquire(key string) (bool, error) {
+	now := metav1.NewMicroTime(time.Now())
+	durationSeconds := int32(m.duration / time.Second)
+	lease, err := m.leases.Get(leaseName(key), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = m.leases.Create(&coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        leaseName(key),
+				Annotations: map[string]string{LeaseKeyAnnotation: key},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &m.identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		})
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != m.identity && !expired(lease, now.Time) {
+		return false, nil
+	}
+	lease.Spec.HolderIdentity = &m.identity
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	_, err = m.leases.Update(lease)
+	if apierrors.IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func expired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+//hold renew lease of key until returned Unlock is called, which deletes lease.
+//Returned context is cancelled when lease is taken over or could not be renewed before it expired,
+//Unlock then returns ErrLost
+func (m *leaseManager) hold(ctx context.Context, key string, unlockLocal Unlock) (context.Context, Unlock) {
+	heldCtx, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	lost := false
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(m.duration / 3)
+		defer ticker.Stop()
+		renewed := time.Now()
+		for {
+			select {
+			case <-ticker.C:
+				err := m.renew(key)
+				if err == nil {
+					renewed = time.Now()
+					continue
+				}
+				if err != ErrLost && time.Since(renewed) < m.duration {
+					log.Warnf("failed to renew lease of %s: %v", key, err)
+					continue
+				}
+				log.Errorf("lease of %s is lost, cancelling operation: %v", key, err)
+				lost = true
+				cancel()
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return heldCtx, func() error {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+			cancel()
+			if err := m.release(key); err != nil {
+				log.Warnf("failed to release lease of %s, it expires in %v: %v", key, m.duration, err)
+			}
+			unlockLocal()
+		})
+		if lost {
+			return ErrLost
+		}
+		return nil
+	}
+}
+
+//renew extend lease of key, ErrLost when another holder took it over
+func (m *leaseManager) renew(key string) error {
+	lease, err := m.leases.Get(leaseName(key), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return ErrLost
+	}
+	if err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != m.identity {
+		log.Warnf("lease of %s was taken over by %v", key, lease.Spec.HolderIdentity)
+		return ErrLost
+	}
+	now := metav1.NewMicroTime(time.Now())
+	lease.Spec.RenewTime = &now
+	_, err = m.leases.Update(lease)
+	if apierrors.IsConflict(err) {
+		return ErrLost
+	}
+	return err
+}
+
+//release delete lease of key when still held by this manager
+func (m *leaseManager) release(key string) error {
+	lease, err := m.leases.Get(leaseName(key), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != m.identity {
+		return nil
+	}
+	uid := lease.UID
+	err = m.leases.Delete(lease.Name, &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+	if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package lock
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+//ErrBusy returned by TryLock when key is held by another operation
+var ErrBusy = errors.New("operation already in progress")
+
+//ErrLost returned by Unlock when key was lost while held, e.g. lease taken over by another controller
+var ErrLost = errors.New("lock lost while operation was running")
+
+//Unlock release acquired key, ErrLost when key was lost before, calling it more than once is harmless
+type Unlock func() error
+
+//Manager hand out locks on keys such as volume/<id>, host/<name> or filesystem/<id>,
+//operation runs with returned context, which is cancelled when key is lost
+type Manager interface {
+	//TryLock acquire key without waiting, ErrBusy when already held
+	TryLock(ctx context.Context, key string) (context.Context, Unlock, error)
+	//Lock acquire key, waiting until it is released or ctx is done
+	Lock(ctx context.Context, key string) (context.Context, Unlock, error)
+}
+
+//Release call unlock when operation is done, err of operation becomes ErrLost when key was lost meanwhile
+func Release(unlock Unlock, err *error) {
+	if unlockErr := unlock(); unlockErr != nil && *err == nil {
+		*err = unlockErr
+	}
+}
+
+//VolumeKey key of CSI volume or snapshot id, or of volume name while it is created
+func VolumeKey(id string) string {
+	return "volume/" + id
+}
+
+//HostKey key of InfiniBox host
+func HostKey(name string) string {
+	return "host/" + name
+}
+
+//FileSystemKey key of InfiniBox filesystem
+func FileSystemKey(id int64) string {
+	return "filesystem/" + strconv.FormatInt(id, 10)
+}
+
+//PoolKey key of InfiniBox pool
+func PoolKey(id int64) string {
+	return "pool/" + strconv.FormatInt(id, 10)
+}
+
+var (
+	defaultManager Manager = NewLocalManager()
+	defaultMutex   sync.RWMutex
+)
+
+//Get return process wide lock manager, in-process unless replaced with Set
+func Get() Manager {
+	defaultMutex.RLock()
+	defer defaultMutex.RUnlock()
+	return defaultManager
+}
+
+//Set replace process wide lock manager, e.g. with lease backed manager for active-active controllers
+func Set(m Manager) {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	defaultManager = m
+}
+
+//localManager lock keys within the process
+type localManager struct {
+	mutex sync.Mutex
+	held  map[string]chan struct{}
+}
+
+//NewLocalManager return manager locking keys within the process
+func NewLocalManager() Manager {
+	return &localManager{held: make(map[string]chan struct{})}
+}
+
+func (l *localManager) TryLock(ctx context.Context, key string) (context.Context, Unlock, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, busy := l.held[key]; busy {
+		return nil, nil, ErrBusy
+	}
+	return ctx, l.acquire(key), nil
+}
+
+func (l *localManager) Lock(ctx context.Context, key string) (context.Context, Unlock, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for {
+		l.mutex.Lock()
+		released, busy := l.held[key]
+		if !busy {
+			unlock := l.acquire(key)
+			l.mutex.Unlock()
+			return ctx, unlock, nil
+		}
+		l.mutex.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+//acquire mark key held, caller holds l.mutex
+func (l *localManager) acquire(key string) Unlock {
+	released := make(chan struct{})
+	l.held[key] = released
+	var once sync.Once
+	return func() error {
+		once.Do(func() {
+			l.mutex.Lock()
+			delete(l.held, key)
+			l.mutex.Unlock()
+			close(released)
+		})
+		return nil
+	}
+}
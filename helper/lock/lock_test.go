@@ -0,0 +1,148 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package lock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type LockSuite struct {
+	suite.Suite
+}
+
+func TestLockSuite(t *testing.T) {
+	suite.Run(t, new(LockSuite))
+}
+
+func (suite *LockSuite) Test_LocalTryLock() {
+	m := NewLocalManager()
+	_, unlock, err := m.TryLock(context.Background(), VolumeKey("1$$iscsi"))
+	suite.Require().NoError(err)
+
+	_, _, err = m.TryLock(context.Background(), VolumeKey("1$$iscsi"))
+	assert.Equal(suite.T(), ErrBusy, err, "in-flight duplicate should be rejected")
+	_, other, err := m.TryLock(context.Background(), VolumeKey("2$$iscsi"))
+	assert.Nil(suite.T(), err, "unrelated volume should not be blocked")
+	other()
+
+	unlock()
+	unlock()
+	_, again, err := m.TryLock(context.Background(), VolumeKey("1$$iscsi"))
+	assert.Nil(suite.T(), err)
+	again()
+}
+
+func (suite *LockSuite) Test_LocalLockWaits() {
+	m := NewLocalManager()
+	_, unlock, err := m.Lock(context.Background(), FileSystemKey(10))
+	suite.Require().NoError(err)
+
+	acquired := make(chan struct{})
+	go func() {
+		_, unlockWaiter, err := m.Lock(context.Background(), FileSystemKey(10))
+		if err == nil {
+			unlockWaiter()
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		suite.Fail("lock acquired while held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		suite.Fail("lock not acquired after release")
+	}
+
+	_, unlock, _ = m.Lock(context.Background(), HostKey("worker-1"))
+	defer unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, _, err = m.Lock(ctx, HostKey("worker-1"))
+	assert.Equal(suite.T(), context.DeadlineExceeded, err)
+}
+
+func (suite *LockSuite) Test_LeaseManager() {
+	leases := fake.NewSimpleClientset().CoordinationV1().Leases("infinidat-csi")
+	first := NewLeaseManager(leases, "controller-0", time.Minute)
+	second := NewLeaseManager(leases, "controller-1", time.Minute)
+
+	_, unlock, err := first.TryLock(context.Background(), VolumeKey("pvc-1"))
+	suite.Require().NoError(err)
+	lease, err := leases.Get(leaseName(VolumeKey("pvc-1")), metav1.GetOptions{})
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), "controller-0", *lease.Spec.HolderIdentity)
+	assert.Equal(suite.T(), VolumeKey("pvc-1"), lease.Annotations[LeaseKeyAnnotation])
+
+	_, _, err = second.TryLock(context.Background(), VolumeKey("pvc-1"))
+	assert.Equal(suite.T(), ErrBusy, err, "key held by other replica")
+
+	unlock()
+	_, err = leases.Get(leaseName(VolumeKey("pvc-1")), metav1.GetOptions{})
+	assert.NotNil(suite.T(), err, "lease should be deleted on unlock")
+
+	_, unlock, err = second.TryLock(context.Background(), VolumeKey("pvc-1"))
+	assert.Nil(suite.T(), err)
+	unlock()
+}
+
+func (suite *LockSuite) Test_LeaseManager_TakeOverExpired() {
+	leases := fake.NewSimpleClientset().CoordinationV1().Leases("infinidat-csi")
+	holder := "crashed-controller"
+	duration := int32(30)
+	renewed := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	_, err := leases.Create(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: leaseName(HostKey("worker-1"))},
+		Spec:       coordinationv1.LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &duration, RenewTime: &renewed},
+	})
+	suite.Require().NoError(err)
+
+	m := NewLeaseManager(leases, "controller-0", time.Minute)
+	_, unlock, err := m.Lock(context.Background(), HostKey("worker-1"))
+	suite.Require().NoError(err, "expired lease should be taken over")
+	unlock()
+}
+
+func (suite *LockSuite) Test_LeaseManager_Lost() {
+	leases := fake.NewSimpleClientset().CoordinationV1().Leases("infinidat-csi")
+	m := NewLeaseManager(leases, "controller-0", 300*time.Millisecond)
+	ctx, unlock, err := m.TryLock(context.Background(), VolumeKey("pvc-1"))
+	suite.Require().NoError(err)
+
+	lease, err := leases.Get(leaseName(VolumeKey("pvc-1")), metav1.GetOptions{})
+	suite.Require().NoError(err)
+	other := "controller-1"
+	lease.Spec.HolderIdentity = &other
+	_, err = leases.Update(lease)
+	suite.Require().NoError(err)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		suite.Fail("operation context not cancelled after lease was taken over")
+	}
+	assert.Equal(suite.T(), ErrLost, unlock())
+	lease, err = leases.Get(leaseName(VolumeKey("pvc-1")), metav1.GetOptions{})
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), "controller-1", *lease.Spec.HolderIdentity, "lease of new holder is not released")
+}
@@ -0,0 +1,133 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package logger
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"sync/atomic"
+
+	csictx "github.com/rexray/gocsi/context"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+//Field names attached to request scoped log lines
+const (
+	FieldRPC       = "rpc"
+	FieldRequestID = "request_id"
+	FieldTraceID   = "trace_id"
+	FieldVolumeID  = "volume_id"
+	FieldSnapshot  = "snapshot_id"
+	FieldNodeID    = "node_id"
+	FieldNode      = "node"
+	FieldHost      = "infinibox"
+)
+
+type fieldsKey struct{}
+
+var requestCounter uint64
+
+//NewContext return context carrying fields, merged with fields already in ctx
+func NewContext(ctx context.Context, fields Fields) context.Context {
+	merged := Fields{}
+	if existing, ok := ctx.Value(fieldsKey{}).(Fields); ok {
+		for k, v := range existing {
+			merged[k] = v
+		}
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+//FromContext return log entry with request fields carried by ctx
+func FromContext(ctx context.Context) *logrus.Entry {
+	entry := logrusEntry()
+	if ctx == nil {
+		return entry
+	}
+	if fields, ok := ctx.Value(fieldsKey{}).(Fields); ok {
+		entry = entry.WithFields(logrus.Fields(fields))
+	}
+	return entry
+}
+
+type volumeIDGetter interface {
+	GetVolumeId() string
+}
+
+type sourceVolumeIDGetter interface {
+	GetSourceVolumeId() string
+}
+
+type snapshotIDGetter interface {
+	GetSnapshotId() string
+}
+
+type nodeIDGetter interface {
+	GetNodeId() string
+}
+
+type secretsGetter interface {
+	GetSecrets() map[string]string
+}
+
+//requestFields collect ids identifying CSI request, and register its secrets for redaction
+func requestFields(req interface{}) Fields {
+	fields := Fields{}
+	if r, ok := req.(volumeIDGetter); ok && r.GetVolumeId() != "" {
+		fields[FieldVolumeID] = r.GetVolumeId()
+	} else if r, ok := req.(sourceVolumeIDGetter); ok && r.GetSourceVolumeId() != "" {
+		fields[FieldVolumeID] = r.GetSourceVolumeId()
+	}
+	if r, ok := req.(snapshotIDGetter); ok && r.GetSnapshotId() != "" {
+		fields[FieldSnapshot] = r.GetSnapshotId()
+	}
+	if r, ok := req.(nodeIDGetter); ok && r.GetNodeId() != "" {
+		fields[FieldNodeID] = r.GetNodeId()
+	}
+	if r, ok := req.(secretsGetter); ok {
+		secrets := r.GetSecrets()
+		RegisterSecrets(secrets)
+		if hostname := secrets["hostname"]; hostname != "" {
+			fields[FieldHost] = hostname
+		}
+	}
+	return fields
+}
+
+//NewUnaryServerInterceptor attach RPC name, request id, trace id and ids found in request to ctx of every CSI RPC,
+//together with given static fields
+func NewUnaryServerInterceptor(static Fields) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		fields := requestFields(req)
+		for k, v := range static {
+			if v != "" {
+				fields[k] = v
+			}
+		}
+		fields[FieldRPC] = path.Base(info.FullMethod)
+		if id, ok := csictx.GetRequestID(ctx); ok {
+			fields[FieldRequestID] = strconv.FormatUint(id, 10)
+		} else {
+			fields[FieldRequestID] = strconv.FormatUint(atomic.AddUint64(&requestCounter, 1), 10)
+		}
+		if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+			fields[FieldTraceID] = sc.TraceID().String()
+		}
+		return handler(NewContext(ctx, fields), req)
+	}
+}
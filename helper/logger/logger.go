@@ -12,18 +12,15 @@ limitations under the License.*/
 package logger
 
 import (
-	"context"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 
-	csictx "github.com/rexray/gocsi/context"
 	"github.com/sirupsen/logrus"
 )
 
 var logInstance *logrus.Logger
-var logLevel string
 
 type Fields map[string]interface{}
 
@@ -31,24 +28,39 @@ func getLoggerInstance() *logrus.Logger {
 	if logInstance == nil {
 		logInstance = logrus.New()
 		//logInstance.SetReportCaller(true)
-		logLevel, _ = csictx.LookupEnv(context.Background(), "APP_LOG_LEVEL")
-
-		// set global log level
-		ll, err := logrus.ParseLevel(logLevel)
-		if err != nil {
-			logrus.Error("Invalid logging level: ", logLevel)
-			ll = logrus.InfoLevel
-		}
-		logInstance.SetLevel(ll)
-		logrus.Info("Log level set to ", logInstance.GetLevel().String())
+		logInstance.SetLevel(logrus.InfoLevel)
+		logInstance.AddHook(redactHook{})
 
 	}
 	return logInstance
 }
 
+//Configure set log level and format ("text" or "json") from driver configuration
+func Configure(level, format string) {
+	SetLevel(level)
+	if strings.EqualFold(format, "json") {
+		getLoggerInstance().SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		getLoggerInstance().SetFormatter(&logrus.TextFormatter{})
+	}
+}
+
+//SetLevel change log level, safe while logging
+func SetLevel(level string) {
+	ll, err := logrus.ParseLevel(level)
+	if err != nil {
+		logrus.Error("Invalid logging level: ", level)
+		ll = logrus.InfoLevel
+	}
+	if getLoggerInstance().GetLevel() != ll {
+		getLoggerInstance().SetLevel(ll)
+		logrus.Info("Log level set to ", ll.String())
+	}
+}
+
 func logrusEntry() *logrus.Entry {
 	var logEntry *logrus.Entry
-	if strings.EqualFold(logLevel, "error") {
+	if getLoggerInstance().GetLevel() == logrus.ErrorLevel {
 		_, file, no, ok := runtime.Caller(2)
 		source := "undefined"
 		if ok {
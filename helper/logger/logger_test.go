@@ -0,0 +1,93 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+)
+
+type LoggerSuite struct {
+	suite.Suite
+	output *bytes.Buffer
+}
+
+func (suite *LoggerSuite) SetupTest() {
+	suite.output = &bytes.Buffer{}
+	getLoggerInstance().SetOutput(suite.output)
+	getLoggerInstance().SetFormatter(&logrus.JSONFormatter{})
+}
+
+func TestLoggerSuite(t *testing.T) {
+	suite.Run(t, new(LoggerSuite))
+}
+
+func (suite *LoggerSuite) lastLine() map[string]interface{} {
+	line := map[string]interface{}{}
+	suite.Require().NoError(json.Unmarshal(suite.output.Bytes(), &line))
+	return line
+}
+
+func (suite *LoggerSuite) Test_Redact() {
+	assert.Equal(suite.T(), "map[hostname:ibox01 password:*** username:admin]",
+		Redact(fmt.Sprint(map[string]string{"hostname": "ibox01", "username": "admin", "password": "Passw0rd"})))
+	assert.Equal(suite.T(), `{"node.session.auth.password_in":"***","node.session.auth.username":"user"}`,
+		Redact(`{"node.session.auth.password_in":"s3cr3t","node.session.auth.username":"user"}`))
+	assert.Equal(suite.T(), "{Inbound_secret:*** Port:3260}", Redact("{Inbound_secret:abcdef Port:3260}"))
+	assert.Equal(suite.T(), "secrets are missing or not valid", Redact("secrets are missing or not valid"))
+}
+
+func (suite *LoggerSuite) Test_RegisterSecrets() {
+	RegisterSecrets(map[string]string{"outbound_secret": "chapsecret12", "outbound_user": "iqn.2020-06.com.out", "password": "abc"})
+	assert.Equal(suite.T(), "iscsiadm -n node.session.auth.password_in -v *** -n user iqn.2020-06.com.out",
+		Redact("iscsiadm -n node.session.auth.password_in -v chapsecret12 -n user iqn.2020-06.com.out"))
+	assert.Equal(suite.T(), "abc", Redact("abc"), "short secrets are not redacted literally")
+}
+
+func (suite *LoggerSuite) Test_UnaryServerInterceptor_FromContext() {
+	interceptor := NewUnaryServerInterceptor(Fields{FieldNode: "worker-1"})
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId: "1234$$iscsi",
+		Secrets:  map[string]string{"hostname": "ibox01", "username": "admin", "password": "Passw0rd"},
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	_, err := interceptor(context.Background(), req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		FromContext(ctx).Info("NodeStageVolume called with ", req.(*csi.NodeStageVolumeRequest).GetSecrets(), " login Passw0rd")
+		return nil, nil
+	})
+	assert.Nil(suite.T(), err)
+
+	line := suite.lastLine()
+	assert.Equal(suite.T(), "NodeStageVolume", line[FieldRPC])
+	assert.Equal(suite.T(), "1234$$iscsi", line[FieldVolumeID])
+	assert.Equal(suite.T(), "ibox01", line[FieldHost])
+	assert.Equal(suite.T(), "worker-1", line[FieldNode])
+	assert.NotEmpty(suite.T(), line[FieldRequestID])
+	assert.Equal(suite.T(), "NodeStageVolume called with map[hostname:ibox01 password:*** username:admin] login ***", line["msg"])
+}
+
+func (suite *LoggerSuite) Test_FromContext_WithoutFields() {
+	FromContext(nil).WithField("chap_password", "x").Info("plain")
+	line := suite.lastLine()
+	assert.Equal(suite.T(), "plain", line["msg"])
+	assert.Equal(suite.T(), "***", line["chap_password"])
+	assert.Nil(suite.T(), line[FieldRPC])
+}
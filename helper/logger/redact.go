@@ -0,0 +1,97 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package logger
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	redacted = "***"
+	// shorter values are not redacted literally, they would mangle unrelated text
+	minSecretLength = 4
+)
+
+var (
+	// key:value, key=value and "key":"value" pairs whose key names a password or secret,
+	// as printed for maps, structs and json
+	secretPairRegex = regexp.MustCompile(`(?i)([\w.-]*(?:password|passwd|secret)[\w.-]*)(["']?\s*[:=]\s*["']?)([^\s,"'\]})]+)`)
+	secretKeyRegex  = regexp.MustCompile(`(?i)password|passwd|secret`)
+
+	secrets = struct {
+		sync.RWMutex
+		values map[string]struct{}
+	}{values: map[string]struct{}{}}
+)
+
+//RegisterSecrets remember values of password and secret keys in secretMap, so they are redacted wherever logged
+func RegisterSecrets(secretMap map[string]string) {
+	for key, value := range secretMap {
+		if !secretKeyRegex.MatchString(key) || len(value) < minSecretLength {
+			continue
+		}
+		secrets.RLock()
+		_, known := secrets.values[value]
+		secrets.RUnlock()
+		if !known {
+			secrets.Lock()
+			secrets.values[value] = struct{}{}
+			secrets.Unlock()
+		}
+	}
+}
+
+//Redact replace registered secrets and values of password and secret keys in s
+func Redact(s string) string {
+	s = secretPairRegex.ReplaceAllString(s, "${1}${2}"+redacted)
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for value := range secrets.values {
+		if strings.Contains(s, value) {
+			s = strings.Replace(s, value, redacted, -1)
+		}
+	}
+	return s
+}
+
+//redactHook redact message and fields of every log entry
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+	for key, value := range entry.Data {
+		if secretKeyRegex.MatchString(key) {
+			entry.Data[key] = redacted
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = Redact(v)
+		case error:
+			entry.Data[key] = Redact(v.Error())
+		case fmt.Stringer:
+			entry.Data[key] = Redact(v.String())
+		case map[string]string:
+			entry.Data[key] = Redact(fmt.Sprint(v))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "infinibox_csi"
+
+var (
+	registry = prometheus.NewRegistry()
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of CSI RPCs by method and gRPC status code.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"method", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "infinibox_request_duration_seconds",
+		Help:      "Duration of InfiniBox REST requests by HTTP method and endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "endpoint"})
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "infinibox_requests_total",
+		Help:      "InfiniBox REST requests by HTTP method, endpoint and status code, status is 0 when no response was received.",
+	}, []string{"method", "endpoint", "status"})
+
+	iscsiLoginsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "iscsi_logins_total",
+		Help:      "iSCSI target logins by result.",
+	}, []string{"result"})
+
+	multipathFlushesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "multipath_flushes_total",
+		Help:      "Multipath device flushes by result.",
+	}, []string{"result"})
+
+	mountFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mount_failures_total",
+		Help:      "Failed mounts by storage protocol.",
+	}, []string{"protocol"})
+
+	interruptedOperationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "interrupted_operations_total",
+		Help:      "CSI RPCs left unfinished by a previous driver process, by method.",
+	}, []string{"method"})
+
+	staleResourcesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "node_stale_resources_total",
+		Help:      "Stale devices, iSCSI sessions and ifaces found by the node reconciler, by kind and action.",
+	}, []string{"kind", "action"})
+
+	poolFileSystems = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_filesystems",
+		Help:      "Filesystems in pool, as last seen by the controller.",
+	}, []string{"pool"})
+
+	poolTreeqs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_treeqs",
+		Help:      "Treeqs created by driver in pool, as last seen by the controller.",
+	}, []string{"pool"})
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		operationDuration,
+		requestDuration,
+		requestsTotal,
+		iscsiLoginsTotal,
+		multipathFlushesTotal,
+		mountFailuresTotal,
+		interruptedOperationsTotal,
+		staleResourcesTotal,
+		poolFileSystems,
+		poolTreeqs,
+	)
+}
+
+//Serve expose metrics on given address under /metrics, blocks until listener fails
+func Serve(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	log.Infof("serving metrics on %s/metrics", address)
+	return http.ListenAndServe(address, mux)
+}
+
+//UnaryServerInterceptor record latency and result of every CSI RPC
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	operationDuration.WithLabelValues(path.Base(info.FullMethod), status.Code(err).String()).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+var (
+	idSegment  = regexp.MustCompile(`^[0-9]+$`)
+	keySegment = regexp.MustCompile(`\.`)
+)
+
+//endpoint reduce request url to low cardinality endpoint, e.g. api/rest/volumes/:id
+func endpoint(url string) string {
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		url = url[:i]
+	}
+	segments := strings.Split(strings.Trim(url, "/"), "/")
+	for i, segment := range segments {
+		switch {
+		case idSegment.MatchString(segment):
+			segments[i] = ":id"
+		case keySegment.MatchString(segment):
+			segments[i] = ":key"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+//ObserveInfiniboxRequest record InfiniBox REST request
+func ObserveInfiniboxRequest(method, url string, statusCode int, duration time.Duration) {
+	ep := endpoint(url)
+	requestDuration.WithLabelValues(method, ep).Observe(duration.Seconds())
+	requestsTotal.WithLabelValues(method, ep, strconv.Itoa(statusCode)).Inc()
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+//IscsiLogin count iscsi target login
+func IscsiLogin(err error) {
+	iscsiLoginsTotal.WithLabelValues(result(err)).Inc()
+}
+
+//MultipathFlush count multipath device flush
+func MultipathFlush(err error) {
+	multipathFlushesTotal.WithLabelValues(result(err)).Inc()
+}
+
+//MountFailure count failed mount of given protocol
+func MountFailure(protocol string) {
+	mountFailuresTotal.WithLabelValues(protocol).Inc()
+}
+
+//InterruptedOperation count operation of method a previous driver process left unfinished
+func InterruptedOperation(method string) {
+	interruptedOperationsTotal.WithLabelValues(method).Inc()
+}
+
+//StaleResource count stale resource of kind the node reconciler reported, removed or failed to remove
+func StaleResource(kind, action string) {
+	staleResourcesTotal.WithLabelValues(kind, action).Inc()
+}
+
+//SetPoolFileSystems set filesystem count of pool
+func SetPoolFileSystems(pool string, count int) {
+	poolFileSystems.WithLabelValues(pool).Set(float64(count))
+}
+
+var treeqCounts = struct {
+	sync.Mutex
+	pools  map[int64]string
+	counts map[int64]int
+}{pools: map[int64]string{}, counts: map[int64]int{}}
+
+//SetFileSystemTreeqs record treeq count of filesystem and update treeq count of its pool,
+//pool may be empty when filesystem was seen before
+func SetFileSystemTreeqs(pool string, fileSystemID int64, count int) {
+	treeqCounts.Lock()
+	defer treeqCounts.Unlock()
+	if pool == "" {
+		pool = treeqCounts.pools[fileSystemID]
+		if pool == "" {
+			return
+		}
+	}
+	treeqCounts.pools[fileSystemID] = pool
+	treeqCounts.counts[fileSystemID] = count
+	if count <= 0 {
+		delete(treeqCounts.pools, fileSystemID)
+		delete(treeqCounts.counts, fileSystemID)
+	}
+	total := 0
+	for id, p := range treeqCounts.pools {
+		if p == pool {
+			total += treeqCounts.counts[id]
+		}
+	}
+	poolTreeqs.WithLabelValues(pool).Set(float64(total))
+}
@@ -0,0 +1,46 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type MetricsSuite struct {
+	suite.Suite
+}
+
+func TestMetricsSuite(t *testing.T) {
+	suite.Run(t, new(MetricsSuite))
+}
+
+func (suite *MetricsSuite) Test_endpoint() {
+	assert.Equal(suite.T(), "api/rest/volumes/:id", endpoint("/api/rest/volumes/1234?approved=true"))
+	assert.Equal(suite.T(), "api/rest/metadata/:id/:key", endpoint("api/rest/metadata/12/host.k8s.treeq.5.pvcname?approved=true"))
+	assert.Equal(suite.T(), "api/rest/hosts", endpoint("api/rest/hosts?page=2&page_size=1000"))
+}
+
+func (suite *MetricsSuite) Test_SetFileSystemTreeqs() {
+	SetFileSystemTreeqs("pool1", 1, 3)
+	SetFileSystemTreeqs("pool1", 2, 4)
+	assert.Equal(suite.T(), float64(7), testutil.ToFloat64(poolTreeqs.WithLabelValues("pool1")))
+
+	SetFileSystemTreeqs("", 2, 1)
+	assert.Equal(suite.T(), float64(4), testutil.ToFloat64(poolTreeqs.WithLabelValues("pool1")), "pool should be resolved from earlier update")
+
+	SetFileSystemTreeqs("", 99, 5)
+	assert.Equal(suite.T(), float64(4), testutil.ToFloat64(poolTreeqs.WithLabelValues("pool1")), "unknown filesystem should be ignored")
+}
@@ -0,0 +1,87 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+//NewExec wrap exec so every command runs in span, child of span in ctx
+func NewExec(ctx context.Context, exec mount.Exec) mount.Exec {
+	return &tracedExec{ctx: ctx, exec: exec}
+}
+
+type tracedExec struct {
+	ctx  context.Context
+	exec mount.Exec
+}
+
+func (e *tracedExec) Run(cmd string, args ...string) ([]byte, error) {
+	_, span := StartSpan(e.ctx, "exec "+cmd, attribute.String("exec.command", cmd), ArgsAttribute(args))
+	out, err := e.exec.Run(cmd, args...)
+	EndSpan(span, err)
+	return out, err
+}
+
+//ArgsAttribute exec.args attribute of command arguments, values of iscsiadm auth settings and registered secrets are redacted
+func ArgsAttribute(args []string) attribute.KeyValue {
+	redactedArgs := make([]string, len(args))
+	copy(redactedArgs, args)
+	name := ""
+	for i := 0; i < len(redactedArgs); i++ {
+		switch redactedArgs[i] {
+		case "-n", "--name":
+			if i+1 < len(redactedArgs) {
+				name = strings.ToLower(redactedArgs[i+1])
+			}
+		case "-v", "--value":
+			if i+1 < len(redactedArgs) && strings.Contains(name, "auth") {
+				i++
+				redactedArgs[i] = "***"
+			}
+		}
+	}
+	return attribute.String("exec.args", log.Redact(strings.Join(redactedArgs, " ")))
+}
+
+//NewMounter wrap mounter so mount and unmount run in span, child of span in ctx
+func NewMounter(ctx context.Context, mounter mount.Interface) mount.Interface {
+	return &tracedMounter{Interface: mounter, ctx: ctx}
+}
+
+type tracedMounter struct {
+	mount.Interface
+	ctx context.Context
+}
+
+func (m *tracedMounter) Mount(source string, target string, fstype string, options []string) error {
+	_, span := StartSpan(m.ctx, "mount",
+		attribute.String("mount.source", source),
+		attribute.String("mount.target", target),
+		attribute.String("mount.fstype", fstype))
+	err := m.Interface.Mount(source, target, fstype, options)
+	EndSpan(span, err)
+	return err
+}
+
+func (m *tracedMounter) Unmount(target string) error {
+	_, span := StartSpan(m.ctx, "umount", attribute.String("mount.target", target))
+	err := m.Interface.Unmount(target)
+	EndSpan(span, err)
+	return err
+}
@@ -0,0 +1,165 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package tracing
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	csictx "github.com/rexray/gocsi/context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const tracerName = "infinibox-csi-driver"
+
+func init() {
+	// trace context is propagated even when spans are not exported
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+//Init configure OTLP exporter from OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT,
+//tracing stays disabled when neither is set. Returned function flushes pending spans.
+func Init(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	endpoint := getEnv(ctx, "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := getEnv(ctx, "OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		log.Info("tracing disabled, OTEL_EXPORTER_OTLP_ENDPOINT is not set")
+		return func(context.Context) error { return nil }, nil
+	}
+	if name := getEnv(ctx, "OTEL_SERVICE_NAME"); name != "" {
+		serviceName = name
+	}
+	exporter := newOTLPExporter(endpoint, parseHeaders(getEnv(ctx, "OTEL_EXPORTER_OTLP_HEADERS")))
+	attrs := []attribute.KeyValue{attribute.String("service.name", serviceName)}
+	if mode := getEnv(ctx, "X_CSI_MODE"); mode != "" {
+		attrs = append(attrs, attribute.String("csi.mode", mode))
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+	)
+	otel.SetTracerProvider(provider)
+	log.Infof("tracing enabled, exporting spans to %s", endpoint)
+	return provider.Shutdown, nil
+}
+
+func getEnv(ctx context.Context, key string) string {
+	value, _ := csictx.LookupEnv(ctx, key)
+	return strings.TrimSpace(value)
+}
+
+//parseHeaders parse OTEL_EXPORTER_OTLP_HEADERS formatted as key1=value1,key2=value2
+func parseHeaders(value string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) != "" {
+			headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return headers
+}
+
+//StartSpan start span as child of span in ctx
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+//StartClientSpan start client span as child of span in ctx, used for outgoing requests
+func StartClientSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+//EndSpan record err on span and end it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+//metadataCarrier adapt gRPC metadata to propagation.TextMapCarrier
+type metadataCarrier metadata.MD
+
+func (mc metadataCarrier) Get(key string) string {
+	values := metadata.MD(mc).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (mc metadataCarrier) Set(key, value string) {
+	metadata.MD(mc).Set(key, value)
+}
+
+func (mc metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(mc))
+	for key := range mc {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+//UnaryServerInterceptor start span for every CSI RPC, continuing W3C trace context from gRPC metadata
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+	method := path.Base(info.FullMethod)
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "csi."+method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", method),
+			attribute.String("rpc.service", path.Dir(strings.TrimPrefix(info.FullMethod, "/"))),
+		))
+	resp, err := handler(ctx, req)
+	span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+	EndSpan(span, err)
+	return resp, err
+}
+
+//Inject add W3C trace context of ctx to outgoing gRPC metadata
+func Inject(ctx context.Context) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		md = metadata.MD{}
+	} else {
+		md = md.Copy()
+	}
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
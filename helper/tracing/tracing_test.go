@@ -0,0 +1,141 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentID = "00f067aa0ba902b7"
+)
+
+type TracingSuite struct {
+	suite.Suite
+	exporter *tracetest.InMemoryExporter
+}
+
+func (suite *TracingSuite) SetupTest() {
+	suite.exporter = tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(suite.exporter)))
+}
+
+func (suite *TracingSuite) TearDownTest() {
+	otel.SetTracerProvider(trace.NewNoopTracerProvider())
+}
+
+func TestTracingSuite(t *testing.T) {
+	suite.Run(t, new(TracingSuite))
+}
+
+func (suite *TracingSuite) Test_UnaryServerInterceptor_ContinuesTraceContext() {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", "00-"+traceID+"-"+parentID+"-01"))
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		exec := NewExec(ctx, mount.NewFakeExec(func(cmd string, args ...string) ([]byte, error) {
+			return nil, errors.New("exit status 21")
+		}))
+		_, err := exec.Run("iscsiadm", "-m", "session")
+		return nil, err
+	}
+
+	_, err := UnaryServerInterceptor(ctx, nil, info, handler)
+	assert.NotNil(suite.T(), err)
+
+	spans := suite.exporter.GetSpans()
+	assert.Equal(suite.T(), 2, len(spans))
+	execSpan, rpcSpan := spans[0], spans[1]
+	assert.Equal(suite.T(), "exec iscsiadm", execSpan.Name)
+	assert.Equal(suite.T(), codes.Error, execSpan.Status.Code)
+	assert.Equal(suite.T(), rpcSpan.SpanContext.SpanID(), execSpan.Parent.SpanID(), "command span should be child of rpc span")
+
+	assert.Equal(suite.T(), "csi.NodeStageVolume", rpcSpan.Name)
+	assert.Equal(suite.T(), trace.SpanKindServer, rpcSpan.SpanKind)
+	assert.Equal(suite.T(), traceID, rpcSpan.SpanContext.TraceID().String())
+	assert.Equal(suite.T(), parentID, rpcSpan.Parent.SpanID().String())
+	assert.True(suite.T(), rpcSpan.Parent.IsRemote())
+}
+
+func (suite *TracingSuite) Test_Inject() {
+	ctx, span := StartSpan(context.Background(), "client")
+	md, _ := metadata.FromOutgoingContext(Inject(ctx))
+	span.End()
+	assert.Equal(suite.T(), []string{"00-" + span.SpanContext().TraceID().String() + "-" + span.SpanContext().SpanID().String() + "-01"}, md.Get("traceparent"))
+}
+
+func (suite *TracingSuite) Test_otlpExporter() {
+	var body []byte
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	exporter := newOTLPExporter(server.URL+"/v1/traces", map[string]string{"Authorization": "Bearer token"})
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	_, span := provider.Tracer(tracerName).Start(context.Background(), "api.GetVolume", trace.WithAttributes(
+		attribute.String("http.method", "GET"), attribute.Int("http.status_code", 404)))
+	EndSpan(span, errors.New("VOLUME_NOT_FOUND"))
+
+	assert.Equal(suite.T(), "application/json", header.Get("Content-Type"))
+	assert.Equal(suite.T(), "Bearer token", header.Get("Authorization"))
+	request := otlpRequest{}
+	suite.Require().NoError(json.Unmarshal(body, &request))
+	suite.Require().Equal(1, len(request.ResourceSpans))
+	suite.Require().Equal(1, len(request.ResourceSpans[0].ScopeSpans))
+	exported := request.ResourceSpans[0].ScopeSpans[0].Spans
+	suite.Require().Equal(1, len(exported))
+	assert.Equal(suite.T(), "api.GetVolume", exported[0].Name)
+	assert.Equal(suite.T(), span.SpanContext().TraceID().String(), exported[0].TraceID)
+	assert.Equal(suite.T(), 2, exported[0].Status.Code)
+	assert.Equal(suite.T(), "VOLUME_NOT_FOUND", exported[0].Status.Message)
+	assert.Contains(suite.T(), exported[0].Attributes, otlpKeyValue{Key: "http.status_code", Value: map[string]interface{}{"intValue": "404"}})
+	assert.Equal(suite.T(), "exception", exported[0].Events[0].Name)
+}
+
+func (suite *TracingSuite) Test_parseHeaders() {
+	assert.Equal(suite.T(), map[string]string{"api-key": "secret", "tenant": "a=b"}, parseHeaders(" api-key = secret,tenant=a=b,invalid"))
+	assert.Equal(suite.T(), map[string]string{}, parseHeaders(""))
+}
+
+func (suite *TracingSuite) Test_ArgsAttribute() {
+	args := []string{"-m", "node", "-T", "iqn.2009-11.com.infinidat:storage:infinibox-sn-1234", "-o", "update",
+		"-n", "node.session.auth.password", "-v", "chapsecret12"}
+	attr := ArgsAttribute(args)
+	assert.Equal(suite.T(), "exec.args", string(attr.Key))
+	assert.NotContains(suite.T(), attr.Value.AsString(), "chapsecret12")
+	assert.Contains(suite.T(), attr.Value.AsString(), "-n node.session.auth.password -v ***")
+	assert.Equal(suite.T(), "chapsecret12", args[9], "arguments of command are left unchanged")
+
+	attr = ArgsAttribute([]string{"-m", "node", "-o", "update", "-n", "node.startup", "-v", "manual"})
+	assert.Equal(suite.T(), "-m node -o update -n node.startup -v manual", attr.Value.AsString())
+}
@@ -12,6 +12,11 @@ package main
 
 import (
 	"context"
+	"flag"
+	"os"
+	"infinibox-csi-driver/helper/driverconfig"
+	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/tracing"
 	"infinibox-csi-driver/provider"
 	"infinibox-csi-driver/service"
 
@@ -19,20 +24,46 @@ import (
 	csictx "github.com/rexray/gocsi/context"
 )
 
+var mode = flag.String("mode", "", "services to run: controller, node or all, overrides X_CSI_MODE")
+
 //starting method of CSI-Driver
 func main() {
+	flag.Parse()
 	configParams := getConfigParams()
+	// configuration file and resource are applied by the service, until then log as environment asks
+	envConfig := driverconfig.FromEnv(driverconfig.Defaults())
+	log.Configure(envConfig.LogLevel, envConfig.LogFormat)
+	var err error
+	if configParams["mode"], err = service.ParseMode(configParams["mode"]); err == nil {
+		err = service.ValidateConfig(configParams)
+	}
+	if err != nil {
+		log.Errorf("driver not started: %v", err)
+		os.Exit(1)
+	}
+	// gocsi registers services of X_CSI_MODE, keep it the same as the mode of the service
+	os.Setenv(gocsi.EnvVarMode, configParams["mode"])
+	// spans are flushed by the plugin when it stops, gocsi exits without returning
+	shutdownTracing, err := tracing.Init(context.Background(), service.ServiceName)
+	if err != nil {
+		log.Errorf("failed to initialize tracing: %v", err)
+		shutdownTracing = func(context.Context) error { return nil }
+	}
 	gocsi.Run(
 		context.Background(),
 		service.ServiceName,
 		"A Infinibox CSI Driver Plugin",
 		usage,
-		provider.New(configParams))
+		provider.New(configParams, shutdownTracing))
 
 }
 
 func getConfigParams() map[string]string {
 	configParams := make(map[string]string)
+	configParams["mode"] = *mode
+	if configParams["mode"] == "" {
+		configParams["mode"], _ = csictx.LookupEnv(context.Background(), gocsi.EnvVarMode)
+	}
 	if nodeip, ok := csictx.LookupEnv(context.Background(), "NODE_IP_ADDRESS"); ok {
 		configParams["nodeip"] = nodeip
 		configParams["nodeid"] = nodeip
@@ -46,6 +77,33 @@ func getConfigParams() map[string]string {
 	if driverversion, ok := csictx.LookupEnv(context.Background(), "CSI_DRIVER_VERSION"); ok {
 		configParams["driverversion"] = driverversion
 	}
+	if metricsaddress, ok := csictx.LookupEnv(context.Background(), "METRICS_ADDRESS"); ok {
+		configParams["metricsaddress"] = metricsaddress
+	}
+	if lockmode, ok := csictx.LookupEnv(context.Background(), "LOCK_MODE"); ok {
+		configParams["lockmode"] = lockmode
+	}
+	if namespace, ok := csictx.LookupEnv(context.Background(), "POD_NAMESPACE"); ok {
+		configParams["podnamespace"] = namespace
+	}
+	if podname, ok := csictx.LookupEnv(context.Background(), "POD_NAME"); ok {
+		configParams["podname"] = podname
+	}
+	if arraysconfig, ok := csictx.LookupEnv(context.Background(), "ARRAYS_CONFIG"); ok {
+		configParams["arraysconfig"] = arraysconfig
+	}
+	if driverconfig, ok := csictx.LookupEnv(context.Background(), "DRIVER_CONFIG"); ok {
+		configParams["driverconfig"] = driverconfig
+	}
+	if driverconfigname, ok := csictx.LookupEnv(context.Background(), "DRIVER_CONFIG_NAME"); ok {
+		configParams["driverconfigname"] = driverconfigname
+	}
+	if statedir, ok := csictx.LookupEnv(context.Background(), "STATE_DIR"); ok {
+		configParams["statedir"] = statedir
+	}
+	if hostexecutor, ok := csictx.LookupEnv(context.Background(), "HOST_EXECUTOR"); ok {
+		configParams["hostexecutor"] = hostexecutor
+	}
 	return configParams
 }
 
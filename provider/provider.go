@@ -11,25 +11,80 @@ limitations under the License.*/
 package provider
 
 import (
+	"context"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
+	"infinibox-csi-driver/helper/tracing"
 	"infinibox-csi-driver/service"
 
 	"github.com/rexray/gocsi"
+	"google.golang.org/grpc"
 )
 
-//New initialise the parameter to controller and nodeserver
-func New(config map[string]string) gocsi.StoragePluginProvider {
+//tracingShutdownTimeout time spans still buffered get to be exported when the plugin stops
+const tracingShutdownTimeout = 5 * time.Second
+
+//New initialise the parameter to controller and nodeserver, shutdownTracing flushes spans once the server stopped
+func New(config map[string]string, shutdownTracing func(context.Context) error) gocsi.StoragePluginProvider {
 	srvc := service.New(config)
-	return &gocsi.StoragePlugin{
-		Controller:  srvc,
-		Node:        srvc,
+	sp := &gocsi.StoragePlugin{
 		Identity:    srvc,
 		BeforeServe: srvc.BeforeServe,
+		Interceptors: []grpc.UnaryServerInterceptor{
+			tracing.UnaryServerInterceptor,
+			log.NewUnaryServerInterceptor(log.Fields{log.FieldNode: config["nodename"]}),
+			srvc.OperationInterceptor,
+			metrics.UnaryServerInterceptor,
+		},
 		EnvVars: []string{
 			// Enable request validation
 			gocsi.EnvVarSpecReqValidation + "=true",
 
-			// Enable serial volume access
-			gocsi.EnvVarSerialVolAccess + "=true",
+			// Concurrent operations on same volume are rejected by service with helper/lock
+			gocsi.EnvVarSerialVolAccess + "=false",
 		},
 	}
+	// only services of config["mode"] are registered
+	if service.IsController(config["mode"]) {
+		sp.Controller = srvc
+	}
+	if service.IsNode(config["mode"]) {
+		sp.Node = srvc
+	}
+	return &plugin{StoragePlugin: sp, service: srvc, shutdownTracing: shutdownTracing}
+}
+
+//plugin storage plugin draining operations of service before it stops, and flushing spans after.
+//gocsi exits the process as soon as the server stopped, deferred calls of main never run
+type plugin struct {
+	*gocsi.StoragePlugin
+	service         service.Service
+	shutdownTracing func(context.Context) error
+}
+
+//GracefulStop wait for operations in progress, server is stopped without waiting when some do not return
+func (p *plugin) GracefulStop(ctx context.Context) {
+	defer p.flushSpans()
+	if !p.service.Drain(ctx) {
+		p.StoragePlugin.Stop(ctx)
+		return
+	}
+	p.StoragePlugin.GracefulStop(ctx)
+}
+
+//Stop stop server without waiting for operations in progress
+func (p *plugin) Stop(ctx context.Context) {
+	defer p.flushSpans()
+	p.StoragePlugin.Stop(ctx)
+}
+
+//flushSpans export spans still buffered, for up to tracingShutdownTimeout
+func (p *plugin) flushSpans() {
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := p.shutdownTracing(ctx); err != nil {
+		log.Warnf("failed to export pending spans: %v", err)
+	}
 }
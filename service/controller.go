@@ -16,6 +16,7 @@ import (
 	"fmt"
 	"infinibox-csi-driver/storage"
 
+	"infinibox-csi-driver/helper/csiid"
 	log "infinibox-csi-driver/helper/logger"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -32,6 +33,12 @@ func (s *service) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest
 		}
 	}()
 
+	ctx, unlock, lockErr := lockVolume(ctx, req.GetName())
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock(&err)
+
 	//TODO: validate the required parameter
 	configparams := make(map[string]string)
 	configparams["nodeid"] = s.nodeID
@@ -39,13 +46,24 @@ func (s *service) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest
 
 	storageprotocol := req.GetParameters()["storage_protocol"]
 
-	log.Infof("In CreateVolume method nodeid: %s, storageprotocols %s", s.nodeID, storageprotocol)
+	log.FromContext(ctx).Infof("In CreateVolume method nodeid: %s, storageprotocols %s", s.nodeID, storageprotocol)
 	if storageprotocol == "" {
 		return &csi.CreateVolumeResponse{}, status.Error(codes.Internal, "storage protocol is not found, 'storage_protocol' is required field")
 	}
-	storageController, err := storage.NewStorageController(storageprotocol, configparams, req.GetSecrets())
+	arraySerial := req.GetParameters()["array_serial"]
+	if sourceSerial := contentSourceSerial(req.GetVolumeContentSource()); sourceSerial != "" {
+		if arraySerial != "" && arraySerial != sourceSerial {
+			return nil, status.Errorf(codes.InvalidArgument, "content source is on InfiniBox %s, storage class selects %s", sourceSerial, arraySerial)
+		}
+		arraySerial = sourceSerial
+	}
+	secrets, err := resolveArray(ctx, arraySerial, req.GetSecrets(), configparams)
+	if err != nil {
+		return nil, err
+	}
+	storageController, err := storage.NewStorageController(ctx, storageprotocol, configparams, secrets)
 	if err != nil || storageController == nil {
-		log.Errorf("In CreateVolume method : %v", err)
+		log.FromContext(ctx).Errorf("In CreateVolume method : %v", err)
 		err = errors.New("fail to initialise storage controller while create volume " + storageprotocol)
 		return
 	}
@@ -55,14 +73,28 @@ func (s *service) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest
 		return
 	}
 	if csiResp != nil && csiResp.Volume != nil && csiResp.Volume.VolumeId != "" {
-		csiResp.Volume.VolumeId = csiResp.Volume.VolumeId + "$$" + storageprotocol
-		log.Infof("CreateVolume updated volumeId %s", csiResp.Volume.VolumeId)
+		log.FromContext(ctx).Infof("CreateVolume created volumeId %s", csiResp.Volume.VolumeId)
 		return
 	}
 	err = errors.New("CreateVolume error: failed to create volume")
 	return
 }
 
+//contentSourceSerial array serial of snapshot or volume a volume is cloned from, empty when its ID does not carry it
+func contentSourceSerial(source *csi.VolumeContentSource) string {
+	if snapshot := source.GetSnapshot(); snapshot != nil {
+		if id, err := csiid.ParseSnapshot(snapshot.GetSnapshotId()); err == nil {
+			return id.ArraySerial
+		}
+	}
+	if volume := source.GetVolume(); volume != nil {
+		if id, err := csiid.Parse(volume.GetVolumeId()); err == nil {
+			return id.ArraySerial
+		}
+	}
+	return ""
+}
+
 func (s *service) createVolumeFromSnapshot(req *csi.CreateVolumeRequest,
 	snapshotSource *csi.VolumeContentSource_SnapshotSource,
 	name string, sizeInKbytes int64, storagePool string) (*csi.CreateVolumeResponse, error) {
@@ -78,84 +110,112 @@ func (s *service) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest
 		}
 	}()
 
-	voltype := req.GetVolumeId()
-	log.Infof("DeleteVolume method called with volume name %s", voltype)
-	volproto, err := s.validateStorageType(req.GetVolumeId())
+	ctx, unlock, lockErr := lockVolume(ctx, req.GetVolumeId())
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock(&err)
+
+	log.FromContext(ctx).Infof("DeleteVolume method called with volume name %s", req.GetVolumeId())
+	volproto, err := csiid.Parse(req.GetVolumeId())
 	if err != nil {
-		log.Errorf("fail to validate storage type %v", err)
+		log.FromContext(ctx).Errorf("fail to validate storage type %v", err)
 		return
 	}
 	config := make(map[string]string)
 	config["nodeid"] = s.nodeID
-	storageController, err := storage.NewStorageController(volproto.StorageType, config, req.GetSecrets())
+	secrets, err := resolveArray(ctx, volproto.ArraySerial, req.GetSecrets(), config)
+	if err != nil {
+		return
+	}
+	storageController, err := storage.NewStorageController(ctx, volproto.Protocol, config, secrets)
 	if err != nil || storageController == nil {
-		err = errors.New("fail to initialise storage controller while delete volume " + volproto.StorageType)
+		err = errors.New("fail to initialise storage controller while delete volume " + volproto.Protocol)
 		return
 	}
-	req.VolumeId = volproto.VolumeID
 	deleteResponce, err = storageController.DeleteVolume(ctx, req)
 	if err != nil {
-		log.Errorf("fail to delete volume %v", err)
-		err = errors.New("fail to delete volume of type " + volproto.StorageType)
+		log.FromContext(ctx).Errorf("fail to delete volume %v", err)
+		err = errors.New("fail to delete volume of type " + volproto.Protocol)
 		return
 	}
-	req.VolumeId = voltype
 	return
 }
 
 //ControllerPublishVolume method
 func (s *service) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (controlePublishResponce *csi.ControllerPublishVolumeResponse, err error) {
-	log.Infof("Main ControllerPublishVolume called with req volumeID %s, nodeID %s", req.GetVolumeId(), req.GetNodeId())
+	log.FromContext(ctx).Infof("Main ControllerPublishVolume called with req volumeID %s, nodeID %s", req.GetVolumeId(), req.GetNodeId())
 	defer func() {
 		if res := recover(); res != nil && err == nil {
 			err = errors.New("Recovered from CSI ControllerPublishVolume  " + fmt.Sprint(res))
 		}
 	}()
 
-	volproto, err := s.validateStorageType(req.GetVolumeId())
+	ctx, unlock, lockErr := lockVolume(ctx, req.GetVolumeId())
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock(&err)
+
+	volproto, err := csiid.Parse(req.GetVolumeId())
 	if err != nil {
-		log.Errorf("fail to validate StorageType Publish Volume %v", err)
+		log.FromContext(ctx).Errorf("fail to validate StorageType Publish Volume %v", err)
 		err = errors.New("fail to validate StorageType")
 		return
 	}
 	config := make(map[string]string)
+	config["driverversion"] = s.driverVersion
+	secrets, err := resolveArray(ctx, volproto.ArraySerial, req.GetSecrets(), config)
+	if err != nil {
+		return
+	}
 
-	storageController, err := storage.NewStorageController(volproto.StorageType, config, req.GetSecrets())
+	storageController, err := storage.NewStorageController(ctx, volproto.Protocol, config, secrets)
 	if err != nil || storageController == nil {
-		err = errors.New("fail to initialise storage controller while ControllerPublishVolume " + volproto.StorageType)
+		err = errors.New("fail to initialise storage controller while ControllerPublishVolume " + volproto.Protocol)
 		return
 	}
 	controlePublishResponce, err = storageController.ControllerPublishVolume(ctx, req)
 	if err != nil {
-		log.Errorf("ControllerPublishVolume %v", err)
+		log.FromContext(ctx).Errorf("ControllerPublishVolume %v", err)
 	}
 	return
 }
 
 //ControllerUnpublishVolume method
 func (s *service) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (controleUnPublishResponce *csi.ControllerUnpublishVolumeResponse, err error) {
-	log.Info("Main ControllerUnpublishVolume called with req", req.GetVolumeId(), req.GetNodeId())
+	log.FromContext(ctx).Info("Main ControllerUnpublishVolume called with req", req.GetVolumeId(), req.GetNodeId())
 	defer func() {
 		if res := recover(); res != nil && err == nil {
 			err = errors.New("Recovered from CSI ControllerUnpublishVolume  " + fmt.Sprint(res))
 		}
 	}()
 
-	volproto, err := s.validateStorageType(req.GetVolumeId())
+	ctx, unlock, lockErr := lockVolume(ctx, req.GetVolumeId())
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock(&err)
+
+	volproto, err := csiid.Parse(req.GetVolumeId())
 	if err != nil {
-		log.Errorf("fail to validate StorageType while Unpublish Volume %v", err)
+		log.FromContext(ctx).Errorf("fail to validate StorageType while Unpublish Volume %v", err)
 		err = errors.New("fail to validate StorageType while Unpublish Volume")
 		return
 	}
 	config := make(map[string]string)
-	storageController, err := storage.NewStorageController(volproto.StorageType, config, req.GetSecrets())
+	secrets, err := resolveArray(ctx, volproto.ArraySerial, req.GetSecrets(), config)
+	if err != nil {
+		return
+	}
+	storageController, err := storage.NewStorageController(ctx, volproto.Protocol, config, secrets)
 	if err != nil || storageController == nil {
-		err = errors.New("fail to initialise storage controller while ControllerUnpublishVolume " + volproto.StorageType)
+		err = errors.New("fail to initialise storage controller while ControllerUnpublishVolume " + volproto.Protocol)
 		return
 	}
 	controleUnPublishResponce, err = storageController.ControllerUnpublishVolume(ctx, req)
 	if err != nil {
-		log.Errorf("ControllerUnpublishVolume %v", err)
+		log.FromContext(ctx).Errorf("ControllerUnpublishVolume %v", err)
 	}
 	return
 }
@@ -235,6 +295,13 @@ func (s *service) ControllerGetCapabilities(ctx context.Context, req *csi.Contro
 					},
 				},
 			},
+			&csi.ControllerServiceCapability{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_PUBLISH_READONLY,
+					},
+				},
+			},
 		},
 	}, nil
 }
@@ -246,18 +313,29 @@ func (s *service) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotReq
 		}
 	}()
 
-	log.Infof("Create Snapshot called with volume Id %s", req.GetSourceVolumeId())
-	volproto, err := s.validateStorageType(req.GetSourceVolumeId())
+	ctx, unlock, lockErr := lockVolume(ctx, req.GetName())
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock(&err)
+
+	log.FromContext(ctx).Infof("Create Snapshot called with volume Id %s", req.GetSourceVolumeId())
+	volproto, err := csiid.Parse(req.GetSourceVolumeId())
 	if err != nil {
-		log.Errorf("fail to validate storage type %v", err)
+		log.FromContext(ctx).Errorf("fail to validate storage type %v", err)
 		return
 	}
 	config := make(map[string]string)
 	config["nodeid"] = s.nodeID
 	config["nodeIPAddress"] = s.nodeIPAddress
-	storageController, err := storage.NewStorageController(volproto.StorageType, config, req.GetSecrets())
+	config["driverversion"] = s.driverVersion
+	secrets, err := resolveArray(ctx, volproto.ArraySerial, req.GetSecrets(), config)
+	if err != nil {
+		return
+	}
+	storageController, err := storage.NewStorageController(ctx, volproto.Protocol, config, secrets)
 	if err != nil {
-		log.Error("Error Occured: ", err)
+		log.FromContext(ctx).Error("Error Occured: ", err)
 		return
 	}
 	if storageController != nil {
@@ -274,23 +352,32 @@ func (s *service) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotReq
 		}
 	}()
 
-	log.Infof("Delete Snapshot called with snapshot Id %s", req.GetSnapshotId())
-	volproto, err := s.validateStorageType(req.GetSnapshotId())
+	ctx, unlock, lockErr := lockVolume(ctx, req.GetSnapshotId())
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock(&err)
+
+	log.FromContext(ctx).Infof("Delete Snapshot called with snapshot Id %s", req.GetSnapshotId())
+	volproto, err := csiid.ParseSnapshot(req.GetSnapshotId())
 	if err != nil {
-		log.Errorf("fail to validate storage type %v", err)
+		log.FromContext(ctx).Errorf("fail to validate storage type %v", err)
 		return
 	}
 
 	config := make(map[string]string)
 	config["nodeid"] = s.nodeID
 	config["nodeIPAddress"] = s.nodeIPAddress
-	storageController, err := storage.NewStorageController(volproto.StorageType, config, req.GetSecrets())
+	secrets, err := resolveArray(ctx, volproto.ArraySerial, req.GetSecrets(), config)
+	if err != nil {
+		return
+	}
+	storageController, err := storage.NewStorageController(ctx, volproto.Protocol, config, secrets)
 	if err != nil {
-		log.Error("Error Occured: ", err)
+		log.FromContext(ctx).Error("Error Occured: ", err)
 		return
 	}
 	if storageController != nil {
-		req.SnapshotId = volproto.VolumeID
 		deleteSnapshot, err := storageController.DeleteSnapshot(ctx, req)
 		return deleteSnapshot, err
 	}
@@ -304,6 +391,12 @@ func (s *service) ControllerExpandVolume(ctx context.Context, req *csi.Controlle
 		}
 	}()
 
+	ctx, unlock, lockErr := lockVolume(ctx, req.GetVolumeId())
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock(&err)
+
 	err = s.validateExpandVolumeRequest(req)
 	if err != nil {
 		return
@@ -311,18 +404,22 @@ func (s *service) ControllerExpandVolume(ctx context.Context, req *csi.Controlle
 
 	configparams := make(map[string]string)
 	configparams["nodeid"] = s.nodeID
-	volproto, err := s.validateStorageType(req.GetVolumeId())
+	volproto, err := csiid.Parse(req.GetVolumeId())
+	if err != nil {
+		return
+	}
+
+	secrets, err := resolveArray(ctx, volproto.ArraySerial, req.GetSecrets(), configparams)
 	if err != nil {
 		return
 	}
 
-	storageController, err := storage.NewStorageController(volproto.StorageType, configparams, req.GetSecrets())
+	storageController, err := storage.NewStorageController(ctx, volproto.Protocol, configparams, secrets)
 	if err != nil {
-		log.Error("Error Occured: ", err)
+		log.FromContext(ctx).Error("Error Occured: ", err)
 		return
 	}
 	if storageController != nil {
-		req.VolumeId = volproto.VolumeID
 		expandVolume, err = storageController.ControllerExpandVolume(ctx, req)
 		return expandVolume, err
 	}
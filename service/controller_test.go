@@ -12,6 +12,8 @@ package service
 
 import (
 	"context"
+	"infinibox-csi-driver/helper/arrays"
+	"infinibox-csi-driver/helper/lock"
 	"infinibox-csi-driver/storage"
 	"testing"
 
@@ -19,6 +21,8 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type ControllerTestSuite struct {
@@ -62,7 +66,7 @@ func (suite *ControllerTestSuite) Test_CreateVolme_success() {
 	createVolumeReq := getControllerCreateVolumeRequest("pvcName", parameterMap)
 	s := getService()
 
-	patch := monkey.Patch(storage.NewStorageController, func(_ string, _ ...map[string]string) (storage.Storageoperations, error) {
+	patch := monkey.Patch(storage.NewStorageController, func(_ context.Context, _ string, _ ...map[string]string) (storage.Storageoperations, error) {
 		return &ControllerMock{}, nil
 	})
 	defer patch.Unpatch()
@@ -93,7 +97,7 @@ func (suite *ControllerTestSuite) Test_DeleteVolume_Success() {
 	deleteVolumeReq := getCtrDeleteVolumeRequest()
 	s := getService()
 
-	patch := monkey.Patch(storage.NewStorageController, func(_ string, _ ...map[string]string) (storage.Storageoperations, error) {
+	patch := monkey.Patch(storage.NewStorageController, func(_ context.Context, _ string, _ ...map[string]string) (storage.Storageoperations, error) {
 		return &ControllerMock{}, nil
 	})
 	defer patch.Unpatch()
@@ -101,6 +105,104 @@ func (suite *ControllerTestSuite) Test_DeleteVolume_Success() {
 	_, err := s.DeleteVolume(context.Background(), deleteVolumeReq)
 	assert.Nil(suite.T(), err, "Invalid volume ID")
 }
+
+func (suite *ControllerTestSuite) Test_DeleteVolume_InFlight() {
+	deleteVolumeReq := getCtrDeleteVolumeRequest()
+	s := getService()
+
+	patch := monkey.Patch(storage.NewStorageController, func(_ context.Context, _ string, _ ...map[string]string) (storage.Storageoperations, error) {
+		return &ControllerMock{}, nil
+	})
+	defer patch.Unpatch()
+
+	_, unlock, err := lock.Get().TryLock(context.Background(), lock.VolumeKey(deleteVolumeReq.GetVolumeId()))
+	suite.Require().NoError(err)
+	_, err = s.DeleteVolume(context.Background(), deleteVolumeReq)
+	assert.Equal(suite.T(), codes.Aborted, status.Code(err), "in-flight duplicate should be aborted")
+
+	unlock()
+	_, err = s.DeleteVolume(context.Background(), deleteVolumeReq)
+	assert.Nil(suite.T(), err, "volume should be unlocked after operation")
+}
+
+func (suite *ControllerTestSuite) Test_DeleteVolume_RegisteredArray() {
+	registerArrays(suite.T())
+	defer arrays.Set(emptyRegistry(suite.T()))
+	deleteVolumeReq := getCtrDeleteVolumeRequest()
+	deleteVolumeReq.VolumeId = "v2:1520:nfs:fs:100"
+	deleteVolumeReq.Secrets = nil
+	s := getService()
+
+	var config, secrets map[string]string
+	patch := monkey.Patch(storage.NewStorageController, func(_ context.Context, _ string, params ...map[string]string) (storage.Storageoperations, error) {
+		config, secrets = params[0], params[1]
+		return &ControllerMock{}, nil
+	})
+	defer patch.Unpatch()
+
+	_, err := s.DeleteVolume(context.Background(), deleteVolumeReq)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "ibox1520", secrets["hostname"], "credentials come from array of volume ID")
+	assert.Equal(suite.T(), "1520", config["arrayserial"])
+
+	deleteVolumeReq.VolumeId = "v2:9999:nfs:fs:100"
+	_, err = s.DeleteVolume(context.Background(), deleteVolumeReq)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err), "unregistered array without secrets")
+}
+
+func (suite *ControllerTestSuite) Test_DeleteVolume_ArraySerialMismatch() {
+	deleteVolumeReq := getCtrDeleteVolumeRequest()
+	deleteVolumeReq.VolumeId = "v2:1520:nfs:fs:100"
+	s := getService()
+
+	patch := monkey.Patch(storage.NewStorageController, func(_ context.Context, _ string, _ ...map[string]string) (storage.Storageoperations, error) {
+		return &ControllerMock{}, nil
+	})
+	defer patch.Unpatch()
+	defer func(lookup func(context.Context, map[string]string) (string, error)) { systemSerial = lookup }(systemSerial)
+	systemSerial = func(_ context.Context, _ map[string]string) (string, error) { return "2810", nil }
+
+	_, err := s.DeleteVolume(context.Background(), deleteVolumeReq)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err), "secrets of other array than volume ID, no registry")
+
+	registerArrays(suite.T())
+	defer arrays.Set(emptyRegistry(suite.T()))
+	deleteVolumeReq.VolumeId = "v2:9999:nfs:fs:100"
+	_, err = s.DeleteVolume(context.Background(), deleteVolumeReq)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err), "secrets of other array than unregistered volume ID")
+
+	systemSerial = func(_ context.Context, _ map[string]string) (string, error) { return "9999", nil }
+	_, err = s.DeleteVolume(context.Background(), deleteVolumeReq)
+	assert.Nil(suite.T(), err, "secrets of unregistered array of volume ID")
+}
+
+func (suite *ControllerTestSuite) Test_CreateVolume_ArraySerial() {
+	registerArrays(suite.T())
+	defer arrays.Set(emptyRegistry(suite.T()))
+	parameterMap := getContrCreateVolumeParamter()
+	parameterMap["array_serial"] = "2810"
+	createVolumeReq := getControllerCreateVolumeRequest("pvcName", parameterMap)
+	s := getService()
+
+	var config, secrets map[string]string
+	patch := monkey.Patch(storage.NewStorageController, func(_ context.Context, _ string, params ...map[string]string) (storage.Storageoperations, error) {
+		config, secrets = params[0], params[1]
+		return &ControllerMock{}, nil
+	})
+	defer patch.Unpatch()
+
+	_, err := s.CreateVolume(context.Background(), createVolumeReq)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "ibox2810", secrets["hostname"])
+	assert.Equal(suite.T(), "2810", config["arrayserial"])
+
+	createVolumeReq.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "v2:1520:nfs:snap:7"}},
+	}
+	_, err = s.CreateVolume(context.Background(), createVolumeReq)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err), "snapshot on other array than storage class")
+}
+
 /*
 func (suite *ControllerTestSuite) Test_DeleteVolume_Error() {
 	deleteVolumeReq := getCtrDeleteVolumeRequest()
@@ -131,7 +233,7 @@ func (suite *ControllerTestSuite) Test_ControllerPublishVolume_succsss() {
 	crtPublishVolumeReq.VolumeId = "100$$nfs"
 
 	s := getService()
-	patch := monkey.Patch(storage.NewStorageController, func(_ string, _ ...map[string]string) (storage.Storageoperations, error) {
+	patch := monkey.Patch(storage.NewStorageController, func(_ context.Context, _ string, _ ...map[string]string) (storage.Storageoperations, error) {
 		return &ControllerMock{}, nil
 	})
 	defer patch.Unpatch()
@@ -160,7 +262,7 @@ func (suite *ControllerTestSuite) Test_ControllerUnpublishVolume_success() {
 	crtUnPublishReq := getCrtControllerUnpublishVolume()
 	crtUnPublishReq.VolumeId = "100$$unknown"
 	s := getService()
-	patch := monkey.Patch(storage.NewStorageController, func(_ string, _ ...map[string]string) (storage.Storageoperations, error) {
+	patch := monkey.Patch(storage.NewStorageController, func(_ context.Context, _ string, _ ...map[string]string) (storage.Storageoperations, error) {
 		return &ControllerMock{}, nil
 	})
 	defer patch.Unpatch()
@@ -190,7 +292,7 @@ func (suite *ControllerTestSuite) Test_CreateSnapshot_success() {
 	crtCreateSnapshotReq.SourceVolumeId = "100$$nfs"
 	s := getService()
 
-	patch := monkey.Patch(storage.NewStorageController, func(_ string, _ ...map[string]string) (storage.Storageoperations, error) {
+	patch := monkey.Patch(storage.NewStorageController, func(_ context.Context, _ string, _ ...map[string]string) (storage.Storageoperations, error) {
 		return &ControllerMock{}, nil
 	})
 	defer patch.Unpatch()
@@ -219,7 +321,7 @@ func (suite *ControllerTestSuite) Test_DeleteSnapshot_success() {
 	crtDeleteSnapshotReq := getCtrDeleteSnapshotRequest()
 
 	s := getService()
-	patch := monkey.Patch(storage.NewStorageController, func(_ string, _ ...map[string]string) (storage.Storageoperations, error) {
+	patch := monkey.Patch(storage.NewStorageController, func(_ context.Context, _ string, _ ...map[string]string) (storage.Storageoperations, error) {
 		return &ControllerMock{}, nil
 	})
 	defer patch.Unpatch()
@@ -247,7 +349,7 @@ func (suite *ControllerTestSuite) Test_ControllerExpandVolume_Invalid_protocol()
 func (suite *ControllerTestSuite) Test_ControllerExpandVolume_success() {
 	crtexpandReq := getCrtControllerExpandVolumeRequest()
 	
-	patch := monkey.Patch(storage.NewStorageController, func(_ string, _ ...map[string]string) (storage.Storageoperations, error) {
+	patch := monkey.Patch(storage.NewStorageController, func(_ context.Context, _ string, _ ...map[string]string) (storage.Storageoperations, error) {
 		return &ControllerMock{}, nil
 	})
 	defer patch.Unpatch()
@@ -363,14 +465,33 @@ func getControllerCreateVolumeReqonse() *csi.CreateVolumeResponse {
 	}
 }
 
+func registerArrays(t *testing.T) {
+	registry, err := arrays.NewRegistry([]arrays.Array{
+		{Serial: "2810", Hostname: "ibox2810", Username: "admin", Password: "secret1"},
+		{Serial: "1520", Hostname: "ibox1520", Username: "admin", Password: "secret2"},
+	})
+	assert.Nil(t, err)
+	arrays.Set(registry)
+}
+
+func emptyRegistry(t *testing.T) *arrays.Registry {
+	registry, err := arrays.NewRegistry(nil)
+	assert.Nil(t, err)
+	return registry
+}
+
 func getService() Service {
+	return New(getConfigParam())
+}
+
+func getConfigParam() map[string]string {
 	configParam := make(map[string]string)
 	configParam["nodeid"] = "10.20.30.50"
 	configParam["drivername"] = "csi-driver"
-	configParam["nodeIPAddress"] = "10.20.30.50"
-	configParam["nodeName"] = "ubuntu"
+	configParam["nodeip"] = "10.20.30.50"
+	configParam["nodename"] = "ubuntu"
 	configParam["initiatorPrefix"] = "iscsi"
 	configParam["hostclustername"] = "clusterName"
 	configParam["driverversion"] = "1.1.0.5s"
-	return New(configParam)
+	return configParam
 }
@@ -17,6 +17,8 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Manifest is the SP's manifest.
@@ -35,31 +37,41 @@ func (s *service) GetPluginInfo( ctx context.Context, req *csi.GetPluginInfoRequ
 }
 
 func (s *service) GetPluginCapabilities( ctx context.Context, req *csi.GetPluginCapabilitiesRequest) ( *csi.GetPluginCapabilitiesResponse, error) {
-	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
+	capabilities := []*csi.PluginCapability{
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
 				},
 			},
+		},
+	}
+	// node deployments do not serve the controller service
+	if IsController(s.mode) {
+		capabilities = append([]*csi.PluginCapability{
 			{
 				Type: &csi.PluginCapability_Service_{
 					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
 					},
 				},
 			},
-		},
+		}, capabilities...)
+	}
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: capabilities,
 	}, nil
 }
 
 func (s *service) Probe( ctx context.Context, req *csi.ProbeRequest) ( *csi.ProbeResponse, error) {
+	if err := probeError(s.probe(ctx)); err != nil {
+		log.FromContext(ctx).Errorf("Probe failed: %v", err)
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
 	ready := new(wrappers.BoolValue)
 	ready.Value = true
 	proberes := new(csi.ProbeResponse)
 	proberes.Ready = ready
-	log.Debugf("Probe returning: %v", proberes.Ready.GetValue())
+	log.FromContext(ctx).Debugf("Probe returning: %v", proberes.Ready.GetValue())
 	return proberes, nil
 }
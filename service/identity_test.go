@@ -2,15 +2,57 @@ package service
 
 import (
 	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper/arrays"
+	"infinibox-csi-driver/helper/hostcheck"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type IdentitySuite struct {
 	suite.Suite
+	hostRoot string
+}
+
+func (suite *IdentitySuite) SetupTest() {
+	root, err := ioutil.TempDir("", "host")
+	suite.Require().NoError(err)
+	suite.hostRoot = root
+	for name, content := range map[string]string{
+		"dev/null":                      "",
+		"etc/iscsi/initiatorname.iscsi": "InitiatorName=iqn.1994-05.com.redhat:node1\n",
+		"sbin/iscsiadm":                 "",
+		"sbin/mount.nfs":                "",
+	} {
+		path := filepath.Join(root, name)
+		suite.Require().NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		suite.Require().NoError(ioutil.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func (suite *IdentitySuite) TearDownTest() {
+	os.RemoveAll(suite.hostRoot)
+	arrays.Set(emptyRegistry(suite.T()))
+}
+
+//probeService service checking fake host of suite
+func (suite *IdentitySuite) probeService(mode string) *service {
+	s := getService().(*service)
+	s.mode = mode
+	s.hostChecker = &hostcheck.Checker{Root: suite.hostRoot, Run: func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		return []byte("pid 42 idle"), nil
+	}}
+	return s
 }
 
 func TestIdentitySuite(t *testing.T) {
@@ -30,8 +72,71 @@ func (suite *IdentitySuite) Test_GetPluginCapabilities() {
 	assert.Nil(suite.T(), err)	
 }
 
+func (suite *IdentitySuite) Test_GetPluginCapabilities_NodeMode() {
+	hasController := func(s *service) bool {
+		res, err := s.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+		assert.Nil(suite.T(), err)
+		for _, capability := range res.GetCapabilities() {
+			if capability.GetService().GetType() == csi.PluginCapability_Service_CONTROLLER_SERVICE {
+				return true
+			}
+		}
+		return false
+	}
+	assert.True(suite.T(), hasController(suite.probeService(ModeController)))
+	assert.True(suite.T(), hasController(suite.probeService(ModeAll)))
+	assert.False(suite.T(), hasController(suite.probeService(ModeNode)))
+}
+
 func (suite *IdentitySuite) Test_Probe() {
-	s := getService()	
+	s := suite.probeService("")
+	res, err := s.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), res.GetReady().GetValue())
+}
+
+func (suite *IdentitySuite) Test_Probe_NodePrerequisites() {
+	os.Remove(filepath.Join(suite.hostRoot, "sbin/iscsiadm"))
+	s := suite.probeService("node")
+	s.hostChecker.Run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		return nil, errors.New("exit status 1")
+	}
 	_, err := s.Probe(context.Background(), &csi.ProbeRequest{})
-	assert.Nil(suite.T(), err)	
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err))
+	assert.Contains(suite.T(), err.Error(), "iscsiadm is not installed")
+	assert.Contains(suite.T(), err.Error(), "multipathd is not running")
+
+	controller := suite.probeService("controller")
+	controller.hostChecker.Root = filepath.Join(suite.hostRoot, "missing")
+	_, err = controller.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.Nil(suite.T(), err, "controller does not check host")
+}
+
+func (suite *IdentitySuite) Test_Probe_Arrays() {
+	registerArrays(suite.T())
+	probeClient := newProbeClient
+	defer func() { newProbeClient = probeClient }()
+	checks := 0
+	newProbeClient = func(ctx context.Context, secrets map[string]string) (api.Client, error) {
+		checks++
+		client := &api.MockApiService{}
+		switch secrets[arrays.KeyHostname] {
+		case "ibox2810":
+			client.On("GetSystemSerial").Return("2810", nil)
+		default:
+			client.On("GetSystemSerial").Return("", errors.New("401 Unauthorized"))
+		}
+		return client, nil
+	}
+
+	s := suite.probeService("controller")
+	_, err := s.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err))
+	assert.Contains(suite.T(), err.Error(), "InfiniBox 1520 (ibox1520) is not accessible: 401 Unauthorized")
+	assert.NotContains(suite.T(), err.Error(), "2810")
+	assert.Equal(suite.T(), 2, checks)
+
+	_, err = s.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NotNil(suite.T(), err)
+	assert.Equal(suite.T(), 2, checks, "result is cached")
 }
\ No newline at end of file
@@ -0,0 +1,76 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//Modes of X_CSI_MODE and --mode, a controller or node deployment serves only its own gRPC service
+const (
+	ModeController = "controller"
+	ModeNode       = "node"
+	ModeAll        = "all"
+)
+
+//ParseMode validate mode, empty mode is all
+func ParseMode(mode string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case ModeController:
+		return ModeController, nil
+	case ModeNode:
+		return ModeNode, nil
+	case ModeAll, "":
+		return ModeAll, nil
+	}
+	return "", fmt.Errorf("mode %q must be controller, node or all", mode)
+}
+
+//IsController mode serves controller service
+func IsController(mode string) bool {
+	return mode != ModeNode
+}
+
+//IsNode mode serves node service
+func IsNode(mode string) bool {
+	return mode != ModeController
+}
+
+//ValidateConfig check settings required by configParam["mode"] are present, all missing settings are reported together
+func ValidateConfig(configParam map[string]string) error {
+	mode, err := ParseMode(configParam["mode"])
+	if err != nil {
+		return err
+	}
+	required := map[string]string{"drivername": "CSI_DRIVER_NAME"}
+	if IsNode(mode) {
+		required["nodename"] = "KUBE_NODE_NAME"
+		required["nodeip"] = "NODE_IP_ADDRESS"
+	}
+	if IsController(mode) && strings.EqualFold(configParam["lockmode"], "lease") {
+		required["podnamespace"] = "POD_NAMESPACE"
+		required["podname"] = "POD_NAME"
+	}
+	missing := []string{}
+	for key, env := range required {
+		if configParam[key] == "" {
+			missing = append(missing, env)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return errors.New(mode + " mode requires " + strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ModeSuite struct {
+	suite.Suite
+}
+
+func TestModeSuite(t *testing.T) {
+	suite.Run(t, new(ModeSuite))
+}
+
+func (suite *ModeSuite) Test_ParseMode() {
+	for value, expected := range map[string]string{"": ModeAll, "all": ModeAll, "Controller": ModeController, " node": ModeNode} {
+		mode, err := ParseMode(value)
+		assert.Nil(suite.T(), err)
+		assert.Equal(suite.T(), expected, mode)
+	}
+	_, err := ParseMode("nodes")
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *ModeSuite) Test_IsControllerIsNode() {
+	assert.True(suite.T(), IsController(ModeController))
+	assert.False(suite.T(), IsNode(ModeController))
+	assert.True(suite.T(), IsNode(ModeNode))
+	assert.False(suite.T(), IsController(ModeNode))
+	assert.True(suite.T(), IsController(ModeAll) && IsNode(ModeAll))
+}
+
+func (suite *ModeSuite) Test_ValidateConfig() {
+	err := ValidateConfig(map[string]string{"mode": ModeNode, "drivername": "infinibox-csi-driver"})
+	assert.EqualError(suite.T(), err, "node mode requires KUBE_NODE_NAME, NODE_IP_ADDRESS")
+
+	err = ValidateConfig(map[string]string{"mode": ModeController, "drivername": "infinibox-csi-driver"})
+	assert.Nil(suite.T(), err, "controller does not need node settings")
+
+	err = ValidateConfig(map[string]string{"mode": ModeController, "drivername": "infinibox-csi-driver", "lockmode": "lease"})
+	assert.EqualError(suite.T(), err, "controller mode requires POD_NAME, POD_NAMESPACE")
+
+	err = ValidateConfig(map[string]string{"mode": ModeAll, "nodename": "worker1", "nodeip": "10.0.0.1"})
+	assert.EqualError(suite.T(), err, "all mode requires CSI_DRIVER_NAME")
+
+	assert.Nil(suite.T(), ValidateConfig(getConfigParam()))
+}
@@ -15,8 +15,10 @@ import (
 	"errors"
 	"fmt"
 	"infinibox-csi-driver/storage"
+	"strings"
 	"time"
 
+	"infinibox-csi-driver/helper/csiid"
 	log "infinibox-csi-driver/helper/logger"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -24,47 +26,72 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-func (s *service) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	var err error
+//newStorageNode node operations of storage protocol, tests replace it with a mock
+var newStorageNode = storage.NewStorageNode
+
+func (s *service) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (resp *csi.NodePublishVolumeResponse, err error) {
 	defer func() {
 		if res := recover(); res != nil && err == nil {
 			err = errors.New("Recovered from NodePublishVolume " + fmt.Sprint(res))
 		}
 	}()
+
+	ctx, unlock, lockErr := lockVolume(ctx, req.GetVolumeId())
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock(&err)
 	voltype := req.GetVolumeId()
-	log.Infof("NodePublishVolume called with volume name %s", voltype)
+	log.FromContext(ctx).Infof("NodePublishVolume called with volume name %s", voltype)
 	storagePorotcol := req.GetVolumeContext()["storage_protocol"]
 	config := make(map[string]string)
 	config["nodeIPAddress"] = s.nodeIPAddress
-	log.Debug("NodePublishVolume nodeIPAddress ", s.nodeIPAddress)
+	log.FromContext(ctx).Debug("NodePublishVolume nodeIPAddress ", s.nodeIPAddress)
+	secrets, err := resolveArray(ctx, volumeArraySerial(voltype), req.GetSecrets(), config)
+	if err != nil {
+		return nil, err
+	}
 
 	// get operator
-	storageNode, err := storage.NewStorageNode(storagePorotcol, config, req.GetSecrets())
+	storageNode, err := newStorageNode(ctx, storagePorotcol, config, secrets)
 	if storageNode != nil {
 		return storageNode.NodePublishVolume(ctx, req)
 	}
-	log.Error("Error Occured: ", err)
+	log.FromContext(ctx).Error("Error Occured: ", err)
 	return &csi.NodePublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
 }
 
-func (s *service) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	var err error
+//volumeArraySerial array serial of volume ID, empty for IDs of earlier releases
+func volumeArraySerial(volumeID string) string {
+	id, err := csiid.Parse(volumeID)
+	if err != nil {
+		return ""
+	}
+	return id.ArraySerial
+}
+
+func (s *service) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (resp *csi.NodeUnpublishVolumeResponse, err error) {
 	defer func() {
 		if res := recover(); res != nil && err == nil {
 			err = errors.New("Recovered from  NodeUnpublishVolume " + fmt.Sprint(res))
 		}
 	}()
-	log.Infof("NodeUnpublishVolume called with volume name %s", req.GetVolumeId())
-	volproto, err := s.validateStorageType(req.GetVolumeId())
+
+	ctx, unlock, lockErr := lockVolume(ctx, req.GetVolumeId())
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock(&err)
+	log.FromContext(ctx).Infof("NodeUnpublishVolume called with volume name %s", req.GetVolumeId())
+	volproto, err := csiid.Parse(req.GetVolumeId())
 	if err != nil {
 		return &csi.NodeUnpublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
 	}
-	protocolOperation, err := storage.NewStorageNode(volproto.StorageType, nil, nil)
+	protocolOperation, err := newStorageNode(ctx, volproto.Protocol, nil, nil)
 	if err != nil {
 		return &csi.NodeUnpublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
 	}
-	resp, err := protocolOperation.NodeUnpublishVolume(ctx, req)
-	return resp, err
+	return protocolOperation.NodeUnpublishVolume(ctx, req)
 }
 
 func (s *service) NodeGetCapabilities(
@@ -99,52 +126,65 @@ func (s *service) NodeGetCapabilities(
 }
 
 func (s *service) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	log.Infof("Setting NodeId %s", s.nodeID)
+	log.FromContext(ctx).Infof("Setting NodeId %s", s.nodeID)
 	nodeFQDN := s.getNodeFQDN()
 	return &csi.NodeGetInfoResponse{
-		NodeId: nodeFQDN + "$$" + s.nodeID,
+		NodeId: csiid.NodeID(nodeFQDN, strings.Split(s.nodeID, ",")...),
 	}, nil
 }
 
-func (s service) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	var err error
+func (s service) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (resp *csi.NodeStageVolumeResponse, err error) {
 	defer func() {
 		if res := recover(); res != nil && err == nil {
 			err = errors.New("Recovered from NodeStageVolume " + fmt.Sprint(res))
 		}
 	}()
+
+	ctx, unlock, lockErr := lockVolume(ctx, req.GetVolumeId())
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock(&err)
 	voltype := req.GetVolumeId()
-	log.Infof("NodeStageVolume called with volume name %s", voltype)
+	log.FromContext(ctx).Infof("NodeStageVolume called with volume name %s", voltype)
 	storagePorotcol := req.GetVolumeContext()["storage_protocol"]
 	config := make(map[string]string)
 	config["nodeIPAddress"] = s.nodeIPAddress
+	secrets, err := resolveArray(ctx, volumeArraySerial(voltype), req.GetSecrets(), config)
+	if err != nil {
+		return nil, err
+	}
 	// get operator
-	storageNode, err := storage.NewStorageNode(storagePorotcol, config, req.GetSecrets())
+	storageNode, err := newStorageNode(ctx, storagePorotcol, config, secrets)
 	if storageNode != nil {
 		return storageNode.NodeStageVolume(ctx, req)
 	}
-	log.Error("Error Occured: ", err)
+	log.FromContext(ctx).Error("Error Occured: ", err)
 	return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, err.Error())
 }
 
-func (s *service) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	var err error
+func (s *service) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (resp *csi.NodeUnstageVolumeResponse, err error) {
 	defer func() {
 		if res := recover(); res != nil && err == nil {
 			err = errors.New("Recovered from NodeUnstageVolume " + fmt.Sprint(res))
 		}
 	}()
-	log.Infof("NodeUnstageVolume called with volume name %s", req.GetVolumeId())
-	volproto, err := s.validateStorageType(req.GetVolumeId())
+
+	ctx, unlock, lockErr := lockVolume(ctx, req.GetVolumeId())
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock(&err)
+	log.FromContext(ctx).Infof("NodeUnstageVolume called with volume name %s", req.GetVolumeId())
+	volproto, err := csiid.Parse(req.GetVolumeId())
 	if err != nil {
 		return &csi.NodeUnstageVolumeResponse{}, status.Error(codes.Internal, err.Error())
 	}
-	protocolOperation, err := storage.NewStorageNode(volproto.StorageType, nil, nil)
+	protocolOperation, err := newStorageNode(ctx, volproto.Protocol, nil, nil)
 	if err != nil {
 		return &csi.NodeUnstageVolumeResponse{}, status.Error(codes.Internal, err.Error())
 	}
-	resp, err := protocolOperation.NodeUnstageVolume(ctx, req)
-	return resp, err
+	return protocolOperation.NodeUnstageVolume(ctx, req)
 }
 func (s *service) NodeGetVolumeStats(
 	ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
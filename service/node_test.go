@@ -3,9 +3,9 @@ package service
 import (
 	"context"
 	"infinibox-csi-driver/storage"
+	"strings"
 	"testing"
 
-	"bou.ke/monkey"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -19,6 +19,14 @@ func TestNodeTestSuite(t *testing.T) {
 	suite.Run(t, new(NodeTestSuite))
 }
 
+//useStorageNode serve node calls of every protocol with node, the returned func restores storage
+func useStorageNode(node storage.Storageoperations) func() {
+	newStorageNode = func(_ context.Context, _ string, _ ...map[string]string) (storage.Storageoperations, error) {
+		return node, nil
+	}
+	return func() { newStorageNode = storage.NewStorageNode }
+}
+
 func (suite *NodeTestSuite) Test_NodePublishVolume_invalid_protocol() {
 	nodePublishReq := getNodeNodePublishVolumeRequest()
 	nodePublishReq.VolumeContext=map[string]string{"storage_protocol":"unknown"}
@@ -30,10 +38,7 @@ func (suite *NodeTestSuite) Test_NodePublishVolume_invalid_protocol() {
 func (suite *NodeTestSuite) Test_NodePublishVolume_success() {
 	nodePublishReq := getNodeNodePublishVolumeRequest()
 	s := getService()	
-	patch := monkey.Patch(storage.NewStorageNode, func(_ string, _ ...map[string]string) (storage.Storageoperations, error) {
-		return &NodeMock{}, nil
-	})
-	defer patch.Unpatch()
+	defer useStorageNode(&NodeMock{})()
 	
 	_, err := s.NodePublishVolume(context.Background(), nodePublishReq)
 	assert.Nil(suite.T(), err, "success")	
@@ -51,10 +56,7 @@ func (suite *NodeTestSuite) Test_NodeUnpublishVolume_invalid_protocol() {
 func (suite *NodeTestSuite) Test_NodeUnpublishVolume_success() {
 	nodeUnPublishReq := getNodeUnpublishVolumeRequest()
 	s := getService()	
-	patch := monkey.Patch(storage.NewStorageNode, func(_ string, _ ...map[string]string) (storage.Storageoperations, error) {
-		return &NodeMock{}, nil
-	})
-	defer patch.Unpatch()
+	defer useStorageNode(&NodeMock{})()
 	_, err := s.NodeUnpublishVolume(context.Background(), nodeUnPublishReq)
 	assert.Nil(suite.T(), err)	
 }
@@ -71,6 +73,15 @@ func (suite *NodeTestSuite) Test_NodeGetInfo() {
 	_, err := s.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
 	assert.Nil(suite.T(), err)	
 }
+
+func (suite *NodeTestSuite) Test_NodeGetInfo_addresses() {
+	configParam := getConfigParam()
+	configParam["nodeid"] = "10.20.30.50,fd00:10::50"
+	s := New(configParam)
+	resp, err := s.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), strings.HasSuffix(resp.GetNodeId(), "$$10.20.30.50,fd00:10::50"), resp.GetNodeId())
+}
 func (suite *NodeTestSuite) Test_NodeStageVolume_invalid_protocol() {
 	nodeStageReq := getNodeStageVolumeRequest()
 	nodeStageReq.VolumeContext=map[string]string{"storage_protocol":"unknown"}
@@ -82,10 +93,7 @@ func (suite *NodeTestSuite) Test_NodeStageVolume_invalid_protocol() {
 func (suite *NodeTestSuite) Test_NodeStageVolume_success() {
 	nodeStageReq := getNodeStageVolumeRequest()
 	s := getService()	
-	patch := monkey.Patch(storage.NewStorageNode, func(_ string, _ ...map[string]string) (storage.Storageoperations, error) {
-		return &NodeMock{}, nil
-	})
-	defer patch.Unpatch()
+	defer useStorageNode(&NodeMock{})()
 
 	_, err := s.NodeStageVolume(context.Background(), nodeStageReq)
 	assert.Nil(suite.T(), err)	
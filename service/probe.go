@@ -0,0 +1,97 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper/arrays"
+	"infinibox-csi-driver/helper/driverconfig"
+)
+
+//newProbeClient client of array checked by controller probe
+var newProbeClient = func(ctx context.Context, secrets map[string]string) (api.Client, error) {
+	return (&api.ClientService{SecretsMap: secrets, Context: ctx}).NewClient()
+}
+
+//arrayProbe result of last check of InfiniBox access, reused until the TTL of the driver configuration expires
+type arrayProbe struct {
+	mutex    sync.Mutex
+	checked  time.Time
+	problems []string
+}
+
+//check return problems of cached check, arrays are checked again once it expired
+func (p *arrayProbe) check(ctx context.Context) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.checked.IsZero() && time.Since(p.checked) < driverconfig.Get().Probe.ArrayCacheTTL.Duration {
+		return p.problems
+	}
+	p.problems = checkArrays(ctx, arrays.Get())
+	p.checked = time.Now()
+	return p.problems
+}
+
+//checkArrays log in to every registered array and confirm it is the system registered under its serial
+func checkArrays(ctx context.Context, registry *arrays.Registry) []string {
+	var problems []string
+	for _, array := range registry.List() {
+		client, err := newProbeClient(ctx, array.Secrets())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("InfiniBox %s (%s): %v", array.Serial, array.Hostname, err))
+			continue
+		}
+		serial, err := client.GetSystemSerial()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("InfiniBox %s (%s) is not accessible: %v", array.Serial, array.Hostname, err))
+			continue
+		}
+		if serial != array.Serial {
+			problems = append(problems, fmt.Sprintf("InfiniBox at %s has serial %s, registered as %s", array.Hostname, serial, array.Serial))
+		}
+	}
+	return problems
+}
+
+//probe check prerequisites of the services running, every problem found is returned
+func (s *service) probe(ctx context.Context) []string {
+	var problems []string
+	if IsController(s.mode) {
+		problems = append(problems, s.arrayProbe.check(ctx)...)
+	}
+	if IsNode(s.mode) {
+		problems = append(problems, s.checkHost(ctx)...)
+	}
+	return problems
+}
+
+//checkHost problems of host prerequisites for protocols of driver configuration
+func (s *service) checkHost(ctx context.Context) []string {
+	config := driverconfig.Get()
+	checker := *s.hostChecker
+	checker.InitiatorName = config.ISCSIInitiatorName
+	return checker.Check(ctx, config.Probe.NodeProtocols)
+}
+
+//probeError error of problems found by probe, nil when there are none
+func probeError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
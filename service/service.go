@@ -14,26 +14,48 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/api/clientgo"
 	"net"
-	"os/exec"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"infinibox-csi-driver/helper/arrays"
+	"infinibox-csi-driver/helper/driverconfig"
+	"infinibox-csi-driver/helper/hostcheck"
+	"infinibox-csi-driver/helper/hostexec"
+	"infinibox-csi-driver/helper/inflight"
+	"infinibox-csi-driver/helper/lock"
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
+	"infinibox-csi-driver/storage"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/rexray/gocsi"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/watch"
 )
 
 const (
 	ServiceName = "infinibox-csi-driver"
+
+	driverConfigReloadInterval = 30 * time.Second
+
+	// timeout of short host commands such as hostname -f and multipathd show daemon
+	hostnameTimeout = 5 * time.Second
+
+	// time cancelled operations get to return before the server is stopped
+	shutdownCancelGrace = 5 * time.Second
 )
 
 type service struct {
 	//service
-	apiclient api.Client
+	arrayProbe  *arrayProbe
+	hostChecker *hostcheck.Checker
+	operations  *inflight.Tracker
 	// parameters
 	mode                string
 	storagePoolIDToName map[int64]string
@@ -43,6 +65,15 @@ type service struct {
 	driverVersion       string
 	nodeIPAddress       string
 	nodeName            string
+	metricsAddress      string
+	lockMode            string
+	podNamespace        string
+	podName             string
+	arraysConfig        string
+	driverConfigPath    string
+	driverConfigName    string
+	stateDir            string
+	hostExecutor        string
 }
 
 // Service is the CSI Mock service provider.
@@ -52,37 +83,293 @@ type Service interface {
 	csi.NodeServer
 
 	BeforeServe(context.Context, *gocsi.StoragePlugin, net.Listener) error
+	OperationInterceptor(context.Context, interface{}, *grpc.UnaryServerInfo, grpc.UnaryHandler) (interface{}, error)
+	Drain(context.Context) bool
 }
 
 // New returns a new Service.
 func New(configParam map[string]string) Service {
 	return &service{
+		mode:                configParam["mode"],
 		nodeID:              configParam["nodeid"],
 		driverName:          configParam["drivername"],
-		nodeIPAddress:       configParam["nodeIPAddress"],
-		nodeName:            configParam["nodeName"],
+		nodeIPAddress:       configParam["nodeip"],
+		nodeName:            configParam["nodename"],
 		driverVersion:       configParam["driverversion"],
+		metricsAddress:      configParam["metricsaddress"],
+		lockMode:            configParam["lockmode"],
+		podNamespace:        configParam["podnamespace"],
+		podName:             configParam["podname"],
+		arraysConfig:        configParam["arraysconfig"],
+		driverConfigPath:    configParam["driverconfig"],
+		driverConfigName:    configParam["driverconfigname"],
+		stateDir:            configParam["statedir"],
+		hostExecutor:        configParam["hostexecutor"],
 		storagePoolIDToName: map[int64]string{},
-		apiclient:           &api.ClientService{},
+		arrayProbe:          &arrayProbe{},
+		hostChecker:         hostcheck.New(hostcheck.DefaultRoot),
+		operations:          inflight.NewTracker(),
 	}
 }
 
 func (s *service) BeforeServe(ctx context.Context, sp *gocsi.StoragePlugin, listner net.Listener) error {
-	s.verifyController()
+	if err := s.loadDriverConfig(ctx); err != nil {
+		return err
+	}
+	if err := s.loadArrays(); err != nil {
+		return err
+	}
+	s.openOperationJournal()
+	if IsController(s.mode) {
+		if err := s.initLocks(); err != nil {
+			return err
+		}
+		if err := s.verifyController(ctx); err != nil {
+			log.Errorf("InfiniBox arrays are not ready, Probe fails until they are: %v", err)
+		}
+		s.recoverInterrupted(ctx, "CreateVolume", s.rollbackCreateVolume)
+	}
+	if IsNode(s.mode) {
+		if err := s.initHostExecutor(); err != nil {
+			return err
+		}
+		s.verifyNode(ctx)
+		s.startReconciler(ctx)
+	}
+	log.Infof("driver started in %s mode", s.modeName())
+	if s.metricsAddress != "" {
+		go func() {
+			if err := metrics.Serve(s.metricsAddress); err != nil {
+				log.Errorf("metrics listener on %s stopped: %v", s.metricsAddress, err)
+			}
+		}()
+	}
 	return nil
 }
 
-func (s *service) verifyController() error {
-	if s.apiclient == nil {
-		c, err := s.apiclient.NewClient()
+//openOperationJournal record operations in progress in STATE_DIR and report those the previous process left unfinished
+func (s *service) openOperationJournal() {
+	if s.stateDir == "" {
+		return
+	}
+	path := filepath.Join(s.stateDir, s.modeName()+"-operations.json")
+	interrupted, err := s.operations.Open(path)
+	if err != nil {
+		log.Errorf("operations in progress are not recorded, failed to open %s: %v", path, err)
+		return
+	}
+	for _, op := range interrupted {
+		log.Warnf("%s of %s was interrupted at %s", op.Method, op.Key, op.Started.Format(time.RFC3339))
+	}
+}
+
+//recoverInterrupted roll back interrupted operations of method the previous process left unfinished, so their retry starts from scratch.
+//Operations whose rollback fails stay in the journal and resume when retried
+func (s *service) recoverInterrupted(ctx context.Context, method string, rollback func(context.Context, inflight.Operation) error) {
+	for _, op := range s.operations.Interrupted() {
+		if op.Method != method {
+			continue
+		}
+		if err := rollback(ctx, op); err != nil {
+			log.Errorf("failed to roll back %s of %s interrupted at %s, it resumes when retried: %v", op.Method, op.Key, op.Started.Format(time.RFC3339), err)
+			continue
+		}
+		log.Infof("rolled back %s of %s interrupted at %s", op.Method, op.Key, op.Started.Format(time.RFC3339))
+		s.operations.Resolve(op)
+	}
+}
+
+//rollbackCreateVolume delete what interrupted CreateVolume op created before it attached PV metadata, credentials come from the arrays registry
+func (s *service) rollbackCreateVolume(ctx context.Context, op inflight.Operation) (err error) {
+	if arrays.Get().Len() == 0 {
+		return errors.New("request secrets are needed without ARRAYS_CONFIG")
+	}
+	if op.Parameters == nil {
+		return errors.New("journal has no parameters of the request")
+	}
+	ctx, unlock, err := lockVolume(ctx, op.Key)
+	if err != nil {
+		return err
+	}
+	defer unlock(&err)
+	configparams := map[string]string{"nodeid": s.nodeID, "driverversion": s.driverVersion}
+	secrets, err := resolveArray(ctx, op.Parameters["array_serial"], nil, configparams)
+	if err != nil {
+		return err
+	}
+	return storage.RollbackCreateVolume(ctx, op.Key, op.Parameters, configparams, secrets)
+}
+
+//OperationInterceptor track RPCs so Drain can wait for them
+func (s *service) OperationInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return s.operations.UnaryServerInterceptor(ctx, req, info, handler)
+}
+
+//Drain refuse new RPCs and wait for those in progress, up to timeouts.shutdownDrain before they are cancelled,
+//false when some did not return and the server must be stopped without waiting for them
+func (s *service) Drain(ctx context.Context) bool {
+	timeout := driverconfig.Get().Timeouts.ShutdownDrain.Duration
+	log.Infof("draining %d operations in progress, for up to %s", len(s.operations.Running()), timeout)
+	running := s.operations.Drain(timeout, shutdownCancelGrace)
+	for _, op := range running {
+		log.Errorf("%s of %s did not return, it is recorded as interrupted", op.Method, op.Key)
+	}
+	return len(running) == 0
+}
+
+//loadDriverConfig apply driver configuration and follow changes of its file and InfiniboxDriverConfig resource
+func (s *service) loadDriverConfig(ctx context.Context) error {
+	loader := &driverconfig.Loader{FilePath: s.driverConfigPath}
+	if err := loader.Load(); err != nil {
+		return err
+	}
+	if s.driverConfigPath != "" {
+		go loader.WatchFile(ctx, driverConfigReloadInterval)
+	}
+	if s.driverConfigName != "" && s.podNamespace != "" {
+		kc, err := clientgo.BuildClient()
 		if err != nil {
-			return errors.New("failed to create rest client")
+			return fmt.Errorf("failed to build kubernetes client for InfiniboxDriverConfig: %v", err)
 		}
-		s.apiclient = c
+		go loader.WatchResource(ctx, func() (watch.Interface, error) {
+			return kc.WatchDriverConfig(s.podNamespace, s.driverConfigName)
+		}, driverConfigReloadInterval)
+		log.Infof("following InfiniboxDriverConfig %s in namespace %s", s.driverConfigName, s.podNamespace)
+	}
+	return nil
+}
+
+//initLocks switch to lease backed locks when LOCK_MODE=lease, so active-active controllers do not run same operation twice
+func (s *service) initLocks() error {
+	if !strings.EqualFold(s.lockMode, "lease") {
+		return nil
+	}
+	if s.podNamespace == "" || s.podName == "" {
+		return errors.New("LOCK_MODE=lease requires POD_NAMESPACE and POD_NAME")
+	}
+	kc, err := clientgo.BuildClient()
+	if err != nil {
+		return fmt.Errorf("failed to build kubernetes client for lease locks: %v", err)
 	}
+	lock.Set(lock.NewLeaseManager(kc.Leases(s.podNamespace), s.podName, lock.DefaultLeaseDuration))
+	log.Infof("operation locks are kept as leases in namespace %s, held by %s", s.podNamespace, s.podName)
 	return nil
 }
 
+//loadArrays load registry of InfiniBox arrays from ARRAYS_CONFIG, without it credentials come from request secrets only
+func (s *service) loadArrays() error {
+	if s.arraysConfig == "" {
+		return nil
+	}
+	registry, err := arrays.Load(s.arraysConfig)
+	if err != nil {
+		return fmt.Errorf("failed to load InfiniBox arrays from %s: %v", s.arraysConfig, err)
+	}
+	arrays.Set(registry)
+	log.Infof("%d InfiniBox arrays registered from %s", registry.Len(), s.arraysConfig)
+	return nil
+}
+
+//systemSerial serial of InfiniBox system secrets give access to, replaced in tests
+var systemSerial = storage.SystemSerial
+
+//resolveArray credentials of array serial (empty when request does not name one), serial resolved is passed to storage in config.
+//Secrets of a request naming an unregistered array are checked to give access to that array.
+func resolveArray(ctx context.Context, serial string, secrets map[string]string, config map[string]string) (map[string]string, error) {
+	lookup := func(secrets map[string]string) (string, error) {
+		return systemSerial(ctx, secrets)
+	}
+	registry := arrays.Get()
+	if registry.Len() == 0 {
+		if serial != "" && secrets[arrays.KeyHostname] != "" {
+			if err := arrays.VerifySerial(serial, secrets, lookup); err != nil {
+				log.FromContext(ctx).Errorf("failed to resolve InfiniBox array: %v", err)
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
+		}
+		config["arrayserial"] = serial
+		return secrets, nil
+	}
+	resolved, arraySerial, err := registry.Resolve(serial, secrets, lookup)
+	if err != nil {
+		log.FromContext(ctx).Errorf("failed to resolve InfiniBox array: %v", err)
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	config["arrayserial"] = arraySerial
+	return resolved, nil
+}
+
+//lockVolume lock volume or snapshot for duration of RPC, in-flight duplicate is rejected with Aborted.
+//RPC runs with returned context, cancelled when lock is lost, and its release fails RPC with Aborted then
+func lockVolume(ctx context.Context, id string) (context.Context, func(*error), error) {
+	lockedCtx, unlock, err := lock.Get().TryLock(ctx, lock.VolumeKey(id))
+	if err == lock.ErrBusy {
+		return nil, nil, status.Errorf(codes.Aborted, "an operation for %s is already in progress", id)
+	}
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "failed to lock %s: %v", id, err)
+	}
+	return lockedCtx, func(rpcErr *error) {
+		if unlockErr := unlock(); unlockErr != nil && *rpcErr == nil {
+			*rpcErr = status.Errorf(codes.Aborted, "operation for %s stopped: %v", id, unlockErr)
+		}
+	}, nil
+}
+
+//verifyNode log missing host prerequisites at startup, Probe keeps reporting them
+func (s *service) verifyNode(ctx context.Context) {
+	for _, problem := range s.checkHost(ctx) {
+		log.Errorf("node prerequisite missing: %s", problem)
+	}
+}
+
+//initHostExecutor run host commands and access host files with executor of HOST_EXECUTOR, chroot into /host by default
+func (s *service) initHostExecutor() error {
+	executor, err := hostexec.New(s.hostExecutor)
+	if err != nil {
+		return err
+	}
+	hostexec.Set(executor)
+	if s.stateDir != "" {
+		storage.SetStageRecordDir(filepath.Join(s.stateDir, "staged"))
+	}
+	s.hostChecker = hostcheck.New(executor.Path("/"))
+	s.hostChecker.Run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		return executor.Run(ctx, hostnameTimeout, name, args...)
+	}
+	log.Infof("host commands run with %s executor", s.hostExecutorName())
+	return nil
+}
+
+//hostExecutorName executor kind for messages
+func (s *service) hostExecutorName() string {
+	if s.hostExecutor == "" {
+		return hostexec.KindChroot
+	}
+	return s.hostExecutor
+}
+
+//startReconciler remove devices, sessions and ifaces of volumes no longer staged on node, per reconcile configuration
+func (s *service) startReconciler(ctx context.Context) {
+	reconciler := storage.NewNodeReconciler(ctx, s.getNodeFQDN(), func() bool {
+		return len(s.operations.Running()) > 0
+	})
+	go reconciler.Run(ctx)
+}
+
+//modeName mode for messages, empty mode of services built without one is all
+func (s *service) modeName() string {
+	if s.mode == "" {
+		return ModeAll
+	}
+	return s.mode
+}
+
+//verifyController log in to registered arrays at startup, result is kept for Probe
+func (s *service) verifyController(ctx context.Context) error {
+	return probeError(s.arrayProbe.check(ctx))
+}
+
 func (s *service) getNodeFQDN() string {
 	var err error
 	defer func() {
@@ -90,37 +377,24 @@ func (s *service) getNodeFQDN() string {
 			err = errors.New("Recovered from getNodeFQDN  " + fmt.Sprint(res))
 		}
 	}()
-	cmd := "hostname -f"
-	out, err := exec.Command("bash", "-c", cmd).Output()
+	out, err := hostexec.Get().Run(context.Background(), hostnameTimeout, "hostname", "-f")
 	if err != nil {
-		log.Warn("could not get fqdn with cmd : 'hostname -f', get hostname with 'echo $HOSTNAME'")
-		cmd = "echo $HOSTNAME"
-		out, err = exec.Command("bash", "-c", cmd).Output()
+		log.Warnf("could not get fqdn with cmd : 'hostname -f', using hostname instead: %v %s", err, strings.TrimSpace(string(out)))
+		hostname, err := os.Hostname()
 		if err != nil {
-			log.Errorf("Failed to execute command: %s", cmd)
+			log.Errorf("Failed to get hostname: %v", err)
 			return s.nodeName
 		}
+		out = []byte(hostname)
 	}
-	nodeFQDN := string(out)
+	nodeFQDN := strings.TrimSpace(string(out))
 	if nodeFQDN == "" {
 		log.Warn("node fqnd not found, setting node name as node fqdn instead")
 		nodeFQDN = s.nodeName
 	}
-	nodeFQDN = strings.TrimSuffix(nodeFQDN, "\n")
 	return nodeFQDN
 }
 
-func (s *service) validateStorageType(str string) (volprotoconf api.VolumeProtocolConfig, err error) {
-	volproto := strings.Split(str, "$$")
-	if len(volproto) != 2 {
-		return volprotoconf, errors.New("volume Id and other details not found")
-	}
-	log.Info("volproto ", volproto)
-	volprotoconf.VolumeID = volproto[0]
-	volprotoconf.StorageType = volproto[1]
-	return volprotoconf, nil
-}
-
 // Controller expand volume request validation
 func (s *service) validateExpandVolumeRequest(req *csi.ControllerExpandVolumeRequest) error {
 	if req.GetVolumeId() == "" {
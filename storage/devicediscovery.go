@@ -0,0 +1,146 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"infinibox-csi-driver/helper/hostexec"
+	log "infinibox-csi-driver/helper/logger"
+)
+
+const (
+	//publishContextWWID publish context key of the NAA WWID of a published volume
+	publishContextWWID = "wwid"
+	//infinidatOUI IEEE company id InfiniBox volume serials start with
+	infinidatOUI = "742b0f"
+)
+
+//deviceWaitInterval time between searches for a device which has not appeared yet
+var deviceWaitInterval = time.Second
+
+//naaWWID NAA WWID of volume serial, lower case hex as in /dev/disk/by-id/wwn-0x<wwid>.
+//Serials reported without the NAA type get the type 6 of InfiniBox volumes.
+func naaWWID(serial string) string {
+	wwid := strings.ToLower(strings.TrimSpace(serial))
+	wwid = strings.TrimPrefix(wwid, "naa.")
+	wwid = strings.TrimPrefix(wwid, "0x")
+	wwid = strings.Replace(wwid, ":", "", -1)
+	wwid = strings.Replace(wwid, "-", "", -1)
+	if strings.HasPrefix(wwid, infinidatOUI) {
+		wwid = "6" + wwid
+	}
+	return wwid
+}
+
+//blockDevices find block devices of a volume by its WWID instead of by LUN number, which changes when LUNs are renumbered.
+//Device links and sysfs are read on the host through host.
+type blockDevices struct {
+	host hostexec.Executor
+}
+
+func newBlockDevices() blockDevices {
+	return blockDevices{host: hostexec.Get()}
+}
+
+//find device of wwid, the multipath map when there is one and the SCSI disk otherwise.
+//The device found is verified, empty device is returned when none is present yet.
+func (b blockDevices) find(wwid string) (string, error) {
+	for _, link := range []string{"dm-uuid-mpath-3" + wwid, "wwn-0x" + wwid, "scsi-3" + wwid} {
+		target, err := b.host.EvalSymlinks(filepath.Join("/dev/disk/by-id", link))
+		if err != nil {
+			continue
+		}
+		device := filepath.Base(target)
+		if !strings.HasPrefix(device, "dm-") {
+			if dm := b.holder(device); dm != "" {
+				device = dm
+			}
+		}
+		if err := b.verify(device, wwid); err != nil {
+			return "", err
+		}
+		log.Debugf("found device %s of WWID %s by %s", device, wwid, link)
+		return "/dev/" + device, nil
+	}
+	return "", nil
+}
+
+//holder multipath map disk is a path of
+func (b blockDevices) holder(disk string) string {
+	holders, err := b.host.ReadDir(filepath.Join("/sys/block", disk, "holders"))
+	if err != nil {
+		return ""
+	}
+	for _, h := range holders {
+		if strings.HasPrefix(h, "dm-") {
+			return h
+		}
+	}
+	return ""
+}
+
+//verify sysfs reports wwid for device and for every path of a multipath map, so a device of another LUN is never formatted
+func (b blockDevices) verify(device, wwid string) error {
+	if !strings.HasPrefix(device, "dm-") {
+		return b.verifyDisk(device, wwid)
+	}
+	block := filepath.Join("/sys/block", device)
+	uuid, err := b.host.ReadFile(filepath.Join(block, "dm/uuid"))
+	if err != nil {
+		return fmt.Errorf("failed to read WWID of %s: %v", device, err)
+	}
+	if found := strings.TrimPrefix(strings.TrimSpace(string(uuid)), "mpath-3"); found != wwid {
+		return fmt.Errorf("device %s has WWID %s, volume has WWID %s", device, found, wwid)
+	}
+	slaves, err := b.host.ReadDir(filepath.Join(block, "slaves"))
+	if err != nil {
+		return fmt.Errorf("failed to read paths of %s: %v", device, err)
+	}
+	for _, slave := range slaves {
+		if err := b.verifyDisk(slave, wwid); err != nil {
+			return fmt.Errorf("multipath device %s: %v", device, err)
+		}
+	}
+	return nil
+}
+
+func (b blockDevices) verifyDisk(disk, wwid string) error {
+	data, err := b.host.ReadFile(filepath.Join("/sys/block", disk, "device/wwid"))
+	if err != nil {
+		return fmt.Errorf("failed to read WWID of %s: %v", disk, err)
+	}
+	if found := naaWWID(string(data)); found != wwid {
+		return fmt.Errorf("device %s has WWID %s, volume has WWID %s", disk, found, wwid)
+	}
+	return nil
+}
+
+//wait find device of wwid for up to timeout, rescan is called between searches when it is not nil
+func (b blockDevices) wait(wwid string, timeout time.Duration, rescan func()) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		device, err := b.find(wwid)
+		if err != nil || device != "" {
+			return device, err
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no device with WWID %s found after %v", wwid, timeout)
+		}
+		if rescan != nil {
+			rescan()
+		}
+		time.Sleep(deviceWaitInterval)
+	}
+}
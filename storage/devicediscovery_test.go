@@ -0,0 +1,140 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"infinibox-csi-driver/helper/hostexec"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	testWWID  = "6742b0f000004e2b0000000000001a2b"
+	otherWWID = "6742b0f000004e2b0000000000009999"
+)
+
+type DeviceDiscoverySuite struct {
+	suite.Suite
+	root    string
+	devices blockDevices
+}
+
+func TestDeviceDiscoverySuite(t *testing.T) {
+	suite.Run(t, new(DeviceDiscoverySuite))
+}
+
+func (suite *DeviceDiscoverySuite) SetupTest() {
+	root, err := ioutil.TempDir("", "devices")
+	suite.Require().NoError(err)
+	suite.root = root
+	suite.devices = blockDevices{host: hostexec.NewFake(root)}
+	suite.Require().NoError(os.MkdirAll(filepath.Join(root, "dev/disk/by-id"), 0755))
+}
+
+func (suite *DeviceDiscoverySuite) TearDownTest() {
+	os.RemoveAll(suite.root)
+}
+
+func (suite *DeviceDiscoverySuite) write(path, content string) {
+	path = filepath.Join(suite.root, path)
+	suite.Require().NoError(os.MkdirAll(filepath.Dir(path), 0755))
+	suite.Require().NoError(ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+//disk SCSI disk reporting wwid, by-id links to the first path of a WWID as udev does
+func (suite *DeviceDiscoverySuite) disk(name, wwid string) {
+	suite.write("dev/"+name, "")
+	suite.write("sys/block/"+name+"/device/wwid", "naa."+wwid+"\n")
+	os.Symlink("../../"+name, filepath.Join(suite.root, "dev/disk/by-id/wwn-0x"+wwid))
+}
+
+//multipath map of wwid with disks as paths
+func (suite *DeviceDiscoverySuite) multipath(name, wwid string, disks ...string) {
+	suite.write("dev/"+name, "")
+	suite.write("sys/block/"+name+"/dm/uuid", "mpath-3"+wwid+"\n")
+	for _, disk := range disks {
+		suite.write("sys/block/"+name+"/slaves/"+disk, "")
+		suite.write("sys/block/"+disk+"/holders/"+name, "")
+	}
+	suite.Require().NoError(os.Symlink("../../"+name, filepath.Join(suite.root, "dev/disk/by-id/dm-uuid-mpath-3"+wwid)))
+}
+
+func (suite *DeviceDiscoverySuite) Test_NaaWWID() {
+	assert.Equal(suite.T(), testWWID, naaWWID("742B0F000004E2B0000000000001A2B"))
+	assert.Equal(suite.T(), testWWID, naaWWID("naa."+testWWID+"\n"))
+	assert.Equal(suite.T(), testWWID, naaWWID("0x"+testWWID))
+}
+
+func (suite *DeviceDiscoverySuite) Test_Find_Multipath() {
+	suite.disk("sdb", testWWID)
+	suite.disk("sdc", testWWID)
+	suite.multipath("dm-3", testWWID, "sdb", "sdc")
+
+	device, err := suite.devices.find(testWWID)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "/dev/dm-3", device)
+}
+
+func (suite *DeviceDiscoverySuite) Test_Find_DiskHolder() {
+	suite.disk("sdb", testWWID)
+	suite.write("sys/block/sdb/holders/dm-3", "")
+	suite.write("sys/block/dm-3/dm/uuid", "mpath-3"+testWWID)
+	suite.write("sys/block/dm-3/slaves/sdb", "")
+
+	device, err := suite.devices.find(testWWID)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "/dev/dm-3", device, "multipath map is used when by-id link points to a path")
+}
+
+func (suite *DeviceDiscoverySuite) Test_Find_Disk() {
+	suite.disk("sdb", testWWID)
+
+	device, err := suite.devices.find(testWWID)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "/dev/sdb", device)
+}
+
+func (suite *DeviceDiscoverySuite) Test_Find_WrongLun() {
+	suite.disk("sdb", testWWID)
+	suite.disk("sdc", otherWWID)
+	suite.multipath("dm-3", testWWID, "sdb", "sdc")
+
+	_, err := suite.devices.find(testWWID)
+	assert.NotNil(suite.T(), err, "path of another LUN in multipath map")
+	assert.Contains(suite.T(), err.Error(), "sdc")
+
+	suite.write("sys/block/sdb/device/wwid", "naa."+otherWWID)
+	os.RemoveAll(filepath.Join(suite.root, "dev/disk/by-id/dm-uuid-mpath-3"+testWWID))
+	os.RemoveAll(filepath.Join(suite.root, "sys/block/sdb/holders"))
+	_, err = suite.devices.find(testWWID)
+	assert.NotNil(suite.T(), err, "disk reporting another WWID")
+}
+
+func (suite *DeviceDiscoverySuite) Test_Wait() {
+	deviceWaitInterval = 10 * time.Millisecond
+	defer func() { deviceWaitInterval = time.Second }()
+
+	rescans := 0
+	_, err := suite.devices.wait(testWWID, 30*time.Millisecond, func() { rescans++ })
+	assert.NotNil(suite.T(), err, "device never appears")
+	assert.True(suite.T(), rescans > 0)
+
+	device, err := suite.devices.wait(testWWID, time.Second, func() { suite.disk("sdb", testWWID) })
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "/dev/sdb", device, "device appears after rescan")
+}
@@ -0,0 +1,176 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"infinibox-csi-driver/helper/driverconfig"
+	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
+)
+
+var (
+	//teardownPollInterval wait between multipath flush attempts and between checks a deleted path is gone
+	teardownPollInterval = 500 * time.Millisecond
+	//pathRemovalChecks checks a deleted SCSI path is gone before teardown fails
+	pathRemovalChecks = 10
+)
+
+//deviceTeardown remove multipath map and SCSI paths of an unstaged iSCSI or FC volume. Each step is verified before the next:
+//nothing holds or mounts the device, its buffers are flushed, the map is flushed and gone, then each path is deleted and gone.
+//With force a device in use or a map which cannot be flushed is logged and its paths are deleted anyway.
+type deviceTeardown struct {
+	blockDevices
+	run           func(mSeconds int, command string, args []string) ([]byte, error)
+	flushTimeout  int
+	flushAttempts int
+	force         bool
+}
+
+func (cs *commonservice) newDeviceTeardown() deviceTeardown {
+	config := driverconfig.Get().Teardown
+	return deviceTeardown{
+		blockDevices:  newBlockDevices(),
+		run:           cs.ExecuteWithTimeout,
+		flushTimeout:  multipathFlushTimeout(),
+		flushAttempts: config.FlushAttempts,
+		force:         config.Force,
+	}
+}
+
+//remove device such as /dev/dm-3 or /dev/sdb, a device which is already gone is not an error
+func (t deviceTeardown) remove(device string) error {
+	name := filepath.Base(fromHost(device))
+	if !t.exists(name) {
+		log.Debugf("device %s is already removed", device)
+		return nil
+	}
+	paths := []string{name}
+	if strings.HasPrefix(name, "dm-") {
+		paths = t.slaves(name)
+	}
+	log.Debugf("removing device %s with paths %v", name, paths)
+
+	if err := t.checkUnused(name, paths); err != nil {
+		if !t.force {
+			return err
+		}
+		log.Warnf("%v, removing it anyway because teardown.force is set", err)
+	}
+	if out, err := t.run(t.flushTimeout, "blockdev", []string{"--flushbufs", "/dev/" + name}); err != nil {
+		err = fmt.Errorf("failed to flush buffers of %s: %s %v", name, strings.TrimSpace(string(out)), err)
+		if !t.force {
+			return err
+		}
+		log.Warnf("%v, removing it anyway because teardown.force is set", err)
+	}
+	if strings.HasPrefix(name, "dm-") {
+		if err := t.flushMultipath(name); err != nil {
+			if !t.force {
+				return err
+			}
+			log.Warnf("%v, removing its paths anyway because teardown.force is set", err)
+		}
+	}
+	for _, path := range paths {
+		if err := t.deletePath(path); err != nil {
+			return err
+		}
+	}
+	log.Debugf("removed device %s", name)
+	return nil
+}
+
+func (t deviceTeardown) exists(name string) bool {
+	_, err := t.host.Stat(filepath.Join("/sys/block", name))
+	return err == nil
+}
+
+//slaves SCSI paths of multipath map
+func (t deviceTeardown) slaves(name string) []string {
+	paths := []string{}
+	slaves, err := t.host.ReadDir(filepath.Join("/sys/block", name, "slaves"))
+	if err != nil {
+		log.Warnf("failed to read paths of %s: %v", name, err)
+		return paths
+	}
+	return append(paths, slaves...)
+}
+
+//checkUnused device and its paths are not mounted and nothing but the map itself is built on them, e.g. LVM or partitions
+func (t deviceTeardown) checkUnused(name string, paths []string) error {
+	for _, device := range append([]string{name}, paths...) {
+		holders, _ := t.host.ReadDir(filepath.Join("/sys/block", device, "holders"))
+		for _, holder := range holders {
+			if holder != name {
+				return fmt.Errorf("device %s is in use by %s", device, holder)
+			}
+		}
+	}
+	aliases := map[string]bool{"/dev/" + name: true}
+	if dmName, err := t.host.ReadFile(filepath.Join("/sys/block", name, "dm/name")); err == nil {
+		aliases["/dev/mapper/"+strings.TrimSpace(string(dmName))] = true
+	}
+	for _, path := range paths {
+		aliases["/dev/"+path] = true
+	}
+	mounts, err := t.host.Open("/proc/1/mounts")
+	if err != nil {
+		log.Debugf("mounts of host are not readable, not checking %s is unmounted: %v", name, err)
+		return nil
+	}
+	defer mounts.Close()
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && aliases[fields[0]] {
+			return fmt.Errorf("device %s is mounted at %s", fields[0], fields[1])
+		}
+	}
+	return nil
+}
+
+//flushMultipath run multipath -f until map is gone
+func (t deviceTeardown) flushMultipath(name string) error {
+	var err error
+	for attempt := 1; attempt <= t.flushAttempts; attempt++ {
+		var out []byte
+		out, err = t.run(t.flushTimeout, "multipath", []string{"-f", "/dev/" + name})
+		metrics.MultipathFlush(err)
+		if !t.exists(name) {
+			return nil
+		}
+		log.Warnf("multipath map %s is still present after multipath -f attempt %d of %d: %s %v", name, attempt, t.flushAttempts, strings.TrimSpace(string(out)), err)
+		if attempt < t.flushAttempts {
+			time.Sleep(teardownPollInterval)
+		}
+	}
+	return fmt.Errorf("multipath map %s is still present after %d attempts of multipath -f, last error: %v", name, t.flushAttempts, err)
+}
+
+//deletePath delete SCSI device and wait until the kernel removed it
+func (t deviceTeardown) deletePath(name string) error {
+	if err := t.host.WriteFile(filepath.Join("/sys/block", name, "device/delete"), []byte("1"), 0200); err != nil && t.exists(name) {
+		return fmt.Errorf("failed to delete SCSI device %s: %v", name, err)
+	}
+	for check := 0; check < pathRemovalChecks; check++ {
+		if !t.exists(name) {
+			return nil
+		}
+		time.Sleep(teardownPollInterval)
+	}
+	return fmt.Errorf("SCSI device %s is still present after it was deleted", name)
+}
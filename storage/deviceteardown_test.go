@@ -0,0 +1,161 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"infinibox-csi-driver/helper/hostexec"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type DeviceTeardownSuite struct {
+	suite.Suite
+	root string
+	// steps commands run and paths deleted, in order
+	steps []string
+	// mapStuck multipath -f leaves map in place
+	mapStuck bool
+	// pathStuck deleted SCSI paths stay
+	pathStuck bool
+	teardown  deviceTeardown
+}
+
+func TestDeviceTeardownSuite(t *testing.T) {
+	suite.Run(t, new(DeviceTeardownSuite))
+}
+
+func (suite *DeviceTeardownSuite) SetupTest() {
+	root, err := ioutil.TempDir("", "teardown")
+	suite.Require().NoError(err)
+	suite.root = root
+	suite.steps = nil
+	suite.mapStuck = false
+	suite.pathStuck = false
+	teardownPollInterval = time.Millisecond
+	suite.teardown = deviceTeardown{
+		blockDevices:  blockDevices{host: teardownHost{Fake: hostexec.NewFake(root), writeFile: suite.writeFile}},
+		run:           suite.run,
+		flushAttempts: 3,
+	}
+	// dm-3 with paths sdb and sdc
+	for _, file := range []string{"sys/block/dm-3/slaves/sdb", "sys/block/dm-3/slaves/sdc",
+		"sys/block/sdb/holders/dm-3", "sys/block/sdc/holders/dm-3"} {
+		suite.write(file, "")
+	}
+	suite.write("sys/block/dm-3/dm/name", "mpatha\n")
+	suite.write("proc/1/mounts", "/dev/sda1 / xfs rw 0 0\n")
+}
+
+//teardownHost fake host whose SCSI device deletions are handled by writeFile
+type teardownHost struct {
+	*hostexec.Fake
+	writeFile func(filename string, data []byte, perm os.FileMode) error
+}
+
+func (h teardownHost) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return h.writeFile(path, data, perm)
+}
+
+func (suite *DeviceTeardownSuite) TearDownTest() {
+	teardownPollInterval = 500 * time.Millisecond
+	os.RemoveAll(suite.root)
+}
+
+func (suite *DeviceTeardownSuite) write(path, content string) {
+	path = filepath.Join(suite.root, path)
+	suite.Require().NoError(os.MkdirAll(filepath.Dir(path), 0755))
+	suite.Require().NoError(ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func (suite *DeviceTeardownSuite) run(mSeconds int, command string, args []string) ([]byte, error) {
+	suite.steps = append(suite.steps, command+" "+strings.Join(args, " "))
+	if command == "multipath" {
+		if suite.mapStuck {
+			return []byte("map in use"), errors.New("exit status 1")
+		}
+		os.RemoveAll(filepath.Join(suite.root, "sys/block/dm-3"))
+	}
+	return nil, nil
+}
+
+func (suite *DeviceTeardownSuite) writeFile(filename string, data []byte, perm os.FileMode) error {
+	device := filepath.Base(filepath.Dir(filepath.Dir(filename)))
+	suite.steps = append(suite.steps, "delete "+device)
+	if !suite.pathStuck {
+		os.RemoveAll(filepath.Join(suite.root, "sys/block", device))
+	}
+	return nil
+}
+
+func (suite *DeviceTeardownSuite) Test_Remove_Ordered() {
+	err := suite.teardown.remove("/host/dev/dm-3")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{"blockdev --flushbufs /dev/dm-3", "multipath -f /dev/dm-3", "delete sdb", "delete sdc"}, suite.steps)
+
+	suite.steps = nil
+	assert.Nil(suite.T(), suite.teardown.remove("/dev/dm-3"), "device already removed")
+	assert.Empty(suite.T(), suite.steps)
+}
+
+func (suite *DeviceTeardownSuite) Test_Remove_InUse() {
+	suite.write("proc/1/mounts", "/dev/mapper/mpatha /var/lib/kubelet/pods/x xfs rw 0 0\n")
+	err := suite.teardown.remove("/dev/dm-3")
+	assert.NotNil(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), "mounted at /var/lib/kubelet/pods/x")
+	assert.Empty(suite.T(), suite.steps, "nothing is removed under a mounted device")
+
+	suite.write("proc/1/mounts", "")
+	suite.write("sys/block/dm-3/holders/dm-4", "")
+	err = suite.teardown.remove("/dev/dm-3")
+	assert.NotNil(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), "in use by dm-4")
+	assert.Empty(suite.T(), suite.steps)
+
+	suite.teardown.force = true
+	assert.Nil(suite.T(), suite.teardown.remove("/dev/dm-3"), "force removes device in use")
+	assert.Equal(suite.T(), 4, len(suite.steps))
+}
+
+func (suite *DeviceTeardownSuite) Test_Remove_MapStuck() {
+	suite.mapStuck = true
+	err := suite.teardown.remove("/dev/dm-3")
+	assert.NotNil(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), "still present after 3 attempts")
+	assert.Equal(suite.T(), []string{"blockdev --flushbufs /dev/dm-3", "multipath -f /dev/dm-3", "multipath -f /dev/dm-3", "multipath -f /dev/dm-3"},
+		suite.steps, "paths are kept while map is present")
+
+	suite.steps = nil
+	suite.teardown.force = true
+	assert.Nil(suite.T(), suite.teardown.remove("/dev/dm-3"))
+	assert.Contains(suite.T(), suite.steps, "delete sdb", "force deletes paths of map which cannot be flushed")
+}
+
+func (suite *DeviceTeardownSuite) Test_Remove_PathStuck() {
+	suite.pathStuck = true
+	err := suite.teardown.remove("/dev/dm-3")
+	assert.NotNil(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), "SCSI device sdb is still present")
+}
+
+func (suite *DeviceTeardownSuite) Test_Remove_Disk() {
+	suite.write("sys/block/sdd/device/wwid", "")
+	assert.Nil(suite.T(), suite.teardown.remove("/dev/sdd"))
+	assert.Equal(suite.T(), []string{"blockdev --flushbufs /dev/sdd", "delete sdd"}, suite.steps)
+}
@@ -18,6 +18,8 @@ import (
 	"strconv"
 	"strings"
 
+	"infinibox-csi-driver/helper/csiid"
+	"infinibox-csi-driver/helper/lock"
 	log "infinibox-csi-driver/helper/logger"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -38,9 +40,9 @@ func (fc *fcstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	if err != nil {
 		return &csi.CreateVolumeResponse{}, err
 	}
-	log.Infof("requested size in bytes is %d ", sizeBytes)
+	log.FromContext(ctx).Infof("requested size in bytes is %d ", sizeBytes)
 	params := req.GetParameters()
-	log.Infof(" csi request parameters %v", params)
+	log.FromContext(ctx).Infof(" csi request parameters %v", params)
 	err = validateParametersFC(params)
 	if err != nil {
 		return &csi.CreateVolumeResponse{}, status.Error(codes.InvalidArgument, err.Error())
@@ -57,18 +59,22 @@ func (fc *fcstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 		return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
 	}
 	for _, volCap := range volCaps {
-		if volCap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-			log.Errorf("volume cpability %s for FC is not supported", volCap.GetAccessMode().GetMode().String())
+		if !blockAccessModeSupported(volCap.GetAccessMode().GetMode()) {
+			log.FromContext(ctx).Errorf("volume cpability %s for FC is not supported", volCap.GetAccessMode().GetMode().String())
 			return &csi.CreateVolumeResponse{}, fmt.Errorf("volume cpability %s for FC is not supported", volCap.GetAccessMode().GetMode().String())
 		}
 	}
 
 	// Volume name to be created
 	name := req.GetName()
-	log.Infof("csi voume name from request is %s", name)
+	log.FromContext(ctx).Infof("csi voume name from request is %s", name)
 	if name == "" {
 		return &csi.CreateVolumeResponse{}, errors.New("Name cannot be empty")
 	}
+	name, err = getObjectName(name, params)
+	if err != nil {
+		return &csi.CreateVolumeResponse{}, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	targetVol, err := fc.cs.api.GetVolumeByName(name)
 	if err != nil {
@@ -105,24 +111,23 @@ func (fc *fcstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	}
 	volumeResp, err := fc.cs.api.CreateVolume(volumeParam, poolName)
 	if err != nil {
-		log.Errorf("error creating volume: %s pool %s error: %s", name, poolName, err.Error())
+		log.FromContext(ctx).Errorf("error creating volume: %s pool %s error: %s", name, poolName, err.Error())
 		return &csi.CreateVolumeResponse{}, status.Errorf(codes.Internal,
 			"error when creating volume %s storagepool %s: %s", name, poolName, err.Error())
 
 	}
-	vi := fc.cs.getCSIResponse(volumeResp, req)
+	vi := fc.cs.getCSIResponse(volumeResp, req, FC)
 	copyRequestParameters(req.GetParameters(), vi.VolumeContext)
 	csiResp := &csi.CreateVolumeResponse{
 		Volume: vi,
 	}
 
-	metadata := make(map[string]interface{})
-	metadata["host.k8s.pvname"] = volumeResp.Name
-	metadata["host.filesystem_type"] = fstype
+	metadata := fc.cs.getVolumeMetadata(volumeResp.Name, req.GetParameters())
+	metadata[MetadataFilesystemType] = fstype
 	_, err = fc.cs.api.AttachMetadataToObject(int64(volumeResp.ID), metadata)
 	if err != nil {
-		log.Errorf("fail to attach metadata for volume : %s", volumeResp.Name)
-		log.Errorf("error to attach metadata %v", err)
+		log.FromContext(ctx).Errorf("fail to attach metadata for volume : %s", volumeResp.Name)
+		log.FromContext(ctx).Errorf("error to attach metadata %v", err)
 		return &csi.CreateVolumeResponse{}, errors.New("error attach metadata")
 	}
 	return csiResp, err
@@ -134,17 +139,17 @@ func (fc *fcstorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 			err = errors.New("Recovered from FC DeleteSnapshot  " + fmt.Sprint(res))
 		}
 	}()
-	log.Debug("Called DeleteVolume")
+	log.FromContext(ctx).Debug("Called DeleteVolume")
 	if req.GetVolumeId() == "" {
 		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.Internal,
 			"error parsing volume id : %s", errors.New("Volume id not found"))
 	}
-	id, err := strconv.Atoi(req.GetVolumeId())
+	volumeID, err := csiid.Parse(req.GetVolumeId())
 	if err != nil {
 		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.Internal,
 			"error parsing volume id : %s", err.Error())
 	}
-	err = fc.ValidateDeleteVolume(id)
+	err = fc.ValidateDeleteVolume(int(volumeID.ObjectID))
 	if err != nil {
 		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.Internal,
 			"error deleting volume : %s", err.Error())
@@ -163,25 +168,23 @@ func (fc *fcstorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest,
 	volumecontent := req.GetVolumeContentSource()
 	volumeContentID := ""
 	var restoreType string
+	var volproto csiid.ID
 	if volumecontent.GetSnapshot() != nil {
 		restoreType = "Snapshot"
 		volumeContentID = volumecontent.GetSnapshot().GetSnapshotId()
+		volproto, err = csiid.ParseSnapshot(volumeContentID)
 	} else if volumecontent.GetVolume() != nil {
 		volumeContentID = volumecontent.GetVolume().GetVolumeId()
 		restoreType = "Volume"
+		volproto, err = csiid.Parse(volumeContentID)
 	}
 
 	// Lookup the snapshot source volume.
-	volproto, err := validateStorageType(volumeContentID)
 	if err != nil {
 		log.Errorf("Failed to validate storage type %v", err)
 		return nil, errors.New("error getting volume id")
 	}
-
-	ID, err := strconv.Atoi(volproto.VolumeID)
-	if err != nil {
-		return nil, errors.New("error getting volume id")
-	}
+	ID := int(volproto.ObjectID)
 	srcVol, err := fc.cs.api.GetVolume(ID)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, restoreType+" not found: %s", volumeContentID)
@@ -212,7 +215,7 @@ func (fc *fcstorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest,
 	snapshotParam := &api.VolumeSnapshot{
 		ParentID:       ID,
 		SnapshotName:   name,
-		WriteProtected: false,
+		WriteProtected: readOnlyVolume(req.GetVolumeCapabilities()),
 		SsdEnabled:     ssdEnabled,
 	}
 	// Create snapshot
@@ -229,12 +232,11 @@ func (fc *fcstorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest,
 	}
 
 	// Create a volume response and return it
-	csiVolume := fc.cs.getCSIResponse(dstVol, req)
+	csiVolume := fc.cs.getCSIResponse(dstVol, req, FC)
 	copyRequestParameters(req.GetParameters(), csiVolume.VolumeContext)
 
-	metadata := make(map[string]interface{})
-	metadata["host.k8s.pvname"] = dstVol.Name
-	metadata["host.filesystem_type"] = req.GetParameters()["fstype"]
+	metadata := fc.cs.getVolumeMetadata(dstVol.Name, req.GetParameters())
+	metadata[MetadataFilesystemType] = req.GetParameters()["fstype"]
 	_, err = fc.cs.api.AttachMetadataToObject(int64(dstVol.ID), metadata)
 	if err != nil {
 		log.Errorf("fail to attach metadata for volume : %s", dstVol.Name)
@@ -247,19 +249,24 @@ func (fc *fcstorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest,
 }
 
 func (fc *fcstorage) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (resp *csi.ControllerPublishVolumeResponse, err error) {
-	log.Infof("ControllerPublishVolume called with nodeID %s and volumeId %s", req.GetNodeId(), req.GetVolumeId())
-	volproto, err := validateStorageType(req.GetVolumeId())
+	log.FromContext(ctx).Infof("ControllerPublishVolume called with nodeID %s and volumeId %s", req.GetNodeId(), req.GetVolumeId())
+	volproto, err := csiid.Parse(req.GetVolumeId())
 	if err != nil {
-		log.Errorf("Failed to validate storage type %v", err)
+		log.FromContext(ctx).Errorf("Failed to validate storage type %v", err)
 		return &csi.ControllerPublishVolumeResponse{}, errors.New("error getting volume id")
 	}
-	volID, _ := strconv.Atoi(volproto.VolumeID)
+	volID := int(volproto.ObjectID)
 
-	nodeNameIP := strings.Split(req.GetNodeId(), "$$")
-	if len(nodeNameIP) != 2 {
-		return &csi.ControllerPublishVolumeResponse{}, errors.New("Node ID not found")
+	hostName, _, err := csiid.ParseNodeID(req.GetNodeId())
+	if err != nil {
+		return &csi.ControllerPublishVolumeResponse{}, err
 	}
-	hostName := nodeNameIP[0]
+	// host creation and lun mapping are serialised per host
+	ctx, unlock, err := lock.Get().Lock(ctx, lock.HostKey(hostName))
+	if err != nil {
+		return &csi.ControllerPublishVolumeResponse{}, status.Error(codes.Aborted, err.Error())
+	}
+	defer lock.Release(unlock, &err)
 
 	host, err := fc.cs.validateHost(hostName)
 	if err != nil {
@@ -283,11 +290,11 @@ func (fc *fcstorage) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 	}
 	for _, lun := range lunList {
 		if lun.VolumeID == volID {
-			volCtx := make(map[string]string)
-			volCtx["lun"] = strconv.Itoa(lun.Lun)
-			volCtx["hostID"] = strconv.Itoa(host.ID)
-			volCtx["hostPorts"] = ports
-			log.Debugf("volumeID %d already mapped to host %s", lun.VolumeID, host.Name)
+			volCtx, err := fc.cs.publishContext(volID, host, lun.Lun, ports)
+			if err != nil {
+				return &csi.ControllerPublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
+			}
+			log.FromContext(ctx).Debugf("volumeID %d already mapped to host %s", lun.VolumeID, host.Name)
 			return &csi.ControllerPublishVolumeResponse{
 				PublishContext: volCtx,
 			}, nil
@@ -296,70 +303,75 @@ func (fc *fcstorage) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 
 	maxAllowedVol, err := strconv.Atoi(req.GetVolumeContext()["max_vols_per_host"])
 	if err != nil {
-		log.Errorf("Invalid parameter max_vols_per_host error:  %v", err)
+		log.FromContext(ctx).Errorf("Invalid parameter max_vols_per_host error:  %v", err)
 		return &csi.ControllerPublishVolumeResponse{}, err
 	}
-	log.Debugf("host can have maximum %d volume mapped", maxAllowedVol)
-	log.Debugf("host %s has %d volume mapped", host.Name, len(lunList))
+	log.FromContext(ctx).Debugf("host can have maximum %d volume mapped", maxAllowedVol)
+	log.FromContext(ctx).Debugf("host %s has %d volume mapped", host.Name, len(lunList))
 	if len(lunList) >= maxAllowedVol {
-		log.Errorf("unable to publish volume on host %s, as maximum allowed volume per host is (%d), limit reached", host.Name, maxAllowedVol)
+		log.FromContext(ctx).Errorf("unable to publish volume on host %s, as maximum allowed volume per host is (%d), limit reached", host.Name, maxAllowedVol)
 		return &csi.ControllerPublishVolumeResponse{}, status.Error(codes.Internal, "Unable to publish volume as max allowed volume (per host) limit reached")
 	}
 	// map volume to host
-	log.Debugf("mapping volume %d to host %s", volID, host.Name)
+	log.FromContext(ctx).Debugf("mapping volume %d to host %s", volID, host.Name)
 	luninfo, err := fc.cs.mapVolumeTohost(volID, host.ID)
 	if err != nil {
-		log.Errorf("Failed to map volume to host with error %v", err)
+		log.FromContext(ctx).Errorf("Failed to map volume to host with error %v", err)
 		return &csi.ControllerPublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
 	}
 
-	volCtx := make(map[string]string)
-	volCtx["lun"] = strconv.Itoa(luninfo.Lun)
-	volCtx["hostID"] = strconv.Itoa(host.ID)
-	volCtx["hostPorts"] = ports
+	volCtx, err := fc.cs.publishContext(volID, host, luninfo.Lun, ports)
+	if err != nil {
+		return &csi.ControllerPublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
+	}
 	return &csi.ControllerPublishVolumeResponse{
 		PublishContext: volCtx,
 	}, nil
 }
 
 func (fc *fcstorage) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (resp *csi.ControllerUnpublishVolumeResponse, err error) {
-	log.Infof("ControllerUnpublishVolume called with nodeID %s and volumeId %s", req.GetNodeId(), req.GetVolumeId())
-	volproto, err := validateStorageType(req.GetVolumeId())
+	log.FromContext(ctx).Infof("ControllerUnpublishVolume called with nodeID %s and volumeId %s", req.GetNodeId(), req.GetVolumeId())
+	volproto, err := csiid.Parse(req.GetVolumeId())
 	if err != nil {
-		log.Errorf("failed to validate storage type %v", err)
+		log.FromContext(ctx).Errorf("failed to validate storage type %v", err)
 		return nil, errors.New("error getting volume id")
 	}
-	nodeNameIP := strings.Split(req.GetNodeId(), "$$")
-	if len(nodeNameIP) != 2 {
-		return &csi.ControllerUnpublishVolumeResponse{}, errors.New("Node ID not found")
+	hostName, _, err := csiid.ParseNodeID(req.GetNodeId())
+	if err != nil {
+		return &csi.ControllerUnpublishVolumeResponse{}, err
+	}
+	// host creation and lun mapping are serialised per host
+	ctx, unlock, err := lock.Get().Lock(ctx, lock.HostKey(hostName))
+	if err != nil {
+		return &csi.ControllerUnpublishVolumeResponse{}, status.Error(codes.Aborted, err.Error())
 	}
-	hostName := nodeNameIP[0]
+	defer lock.Release(unlock, &err)
 	host, err := fc.cs.api.GetHostByName(hostName)
 	if err != nil {
 		if strings.Contains(err.Error(), "HOST_NOT_FOUND") {
 			return &csi.ControllerUnpublishVolumeResponse{}, nil
 		}
-		log.Errorf("failed to get host details with error %v", err)
+		log.FromContext(ctx).Errorf("failed to get host details with error %v", err)
 		return nil, err
 	}
 	if len(host.Luns) > 0 {
-		volID, _ := strconv.Atoi(volproto.VolumeID)
-		log.Debugf("unmap volume %d from host %d", volID, host.ID)
+		volID := int(volproto.ObjectID)
+		log.FromContext(ctx).Debugf("unmap volume %d from host %d", volID, host.ID)
 		err = fc.cs.unmapVolumeFromHost(host.ID, volID)
 		if err != nil {
-			log.Errorf("failed to unmap volume %d from host %d with error %v", volID, host.ID, err)
+			log.FromContext(ctx).Errorf("failed to unmap volume %d from host %d with error %v", volID, host.ID, err)
 			return &csi.ControllerUnpublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
 		}
 	}
 	if len(host.Luns) < 2 {
 		luns, err := fc.cs.api.GetAllLunByHost(host.ID)
 		if err != nil {
-			log.Errorf("failed to retrive luns for host %d with error %v", host.ID, err)
+			log.FromContext(ctx).Errorf("failed to retrive luns for host %d with error %v", host.ID, err)
 		}
 		if len(luns) == 0 {
 			err = fc.cs.api.DeleteHost(host.ID)
 			if err != nil && !strings.Contains(err.Error(), "HOST_NOT_FOUND") {
-				log.Errorf("failed to delete host with error %v", err)
+				log.FromContext(ctx).Errorf("failed to delete host with error %v", err)
 				return &csi.ControllerUnpublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
 			}
 		}
@@ -391,21 +403,25 @@ func (fc *fcstorage) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshot
 		}
 	}()
 	var snapshotID string
-	snapshotName := req.GetName()
-	log.Debugf("Create Snapshot of name %s", snapshotName)
-	log.Debugf("Create Snapshot called with volume Id %s", req.GetSourceVolumeId())
-	volproto, err := validateStorageType(req.GetSourceVolumeId())
+	snapshotName, err := getObjectName(req.GetName(), req.GetParameters())
 	if err != nil {
-		log.Errorf("fail to validate storage type %v", err)
+		err = status.Error(codes.InvalidArgument, err.Error())
+		return
+	}
+	log.FromContext(ctx).Debugf("Create Snapshot of name %s", snapshotName)
+	log.FromContext(ctx).Debugf("Create Snapshot called with volume Id %s", req.GetSourceVolumeId())
+	volproto, err := csiid.Parse(req.GetSourceVolumeId())
+	if err != nil {
+		log.FromContext(ctx).Errorf("fail to validate storage type %v", err)
 		return
 	}
 
-	sourceVolumeID, _ := strconv.Atoi(volproto.VolumeID)
+	sourceVolumeID := int(volproto.ObjectID)
 	volumeSnapshot, err := fc.cs.api.GetVolumeByName(snapshotName)
 	if err != nil {
-		log.Debug("Snapshot with given name not found : ", snapshotName)
+		log.FromContext(ctx).Debug("Snapshot with given name not found : ", snapshotName)
 	} else if volumeSnapshot.ParentId == sourceVolumeID {
-		snapshotID = strconv.Itoa(volumeSnapshot.ID) + "$$" + volproto.StorageType
+		snapshotID = fc.cs.newID(volproto.Protocol, csiid.Snapshot, int64(volumeSnapshot.ID)).String()
 		return &csi.CreateSnapshotResponse{
 			Snapshot: &csi.Snapshot{
 				SizeBytes:      volumeSnapshot.Size,
@@ -425,11 +441,15 @@ func (fc *fcstorage) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshot
 
 	snapshot, err := fc.cs.api.CreateSnapshotVolume(snapshotParam)
 	if err != nil {
-		log.Errorf("Failed to create snapshot %s error %v", snapshotName, err)
+		log.FromContext(ctx).Errorf("Failed to create snapshot %s error %v", snapshotName, err)
 		return
 	}
 
-	snapshotID = strconv.Itoa(snapshot.SnapShotID) + "$$" + volproto.StorageType
+	snapshotMetadata := fc.cs.getSnapshotMetadata(req.GetName(), strconv.FormatInt(volproto.ObjectID, 10), req.GetParameters())
+	if _, metadataErr := fc.cs.api.AttachMetadataToObject(int64(snapshot.SnapShotID), snapshotMetadata); metadataErr != nil {
+		log.FromContext(ctx).Warnf("fail to attach metadata for snapshot %s error %v", snapshotName, metadataErr)
+	}
+	snapshotID = fc.cs.newID(volproto.Protocol, csiid.Snapshot, int64(snapshot.SnapShotID)).String()
 	csiSnapshot := &csi.Snapshot{
 		SnapshotId:     snapshotID,
 		SourceVolumeId: req.GetSourceVolumeId(),
@@ -437,7 +457,7 @@ func (fc *fcstorage) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshot
 		CreationTime:   ptypes.TimestampNow(),
 		SizeBytes:      snapshot.Size,
 	}
-	log.Debug("CreateFileSystemSnapshot resp() ", csiSnapshot)
+	log.FromContext(ctx).Debug("CreateFileSystemSnapshot resp() ", csiSnapshot)
 	snapshotResp := &csi.CreateSnapshotResponse{Snapshot: csiSnapshot}
 	return snapshotResp, nil
 }
@@ -449,10 +469,13 @@ func (fc *fcstorage) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshot
 		}
 	}()
 
-	snapshotID, _ := strconv.Atoi(req.GetSnapshotId())
-	err = fc.ValidateDeleteVolume(snapshotID)
+	snapshotID, err := csiid.ParseSnapshot(req.GetSnapshotId())
+	if err != nil {
+		return &csi.DeleteSnapshotResponse{}, status.Errorf(codes.InvalidArgument, "invalid snapshot id %s: %v", req.GetSnapshotId(), err)
+	}
+	err = fc.ValidateDeleteVolume(int(snapshotID.ObjectID))
 	if err != nil {
-		log.Errorf("fail to delete snapshot %v", err)
+		log.FromContext(ctx).Errorf("fail to delete snapshot %v", err)
 		return &csi.DeleteSnapshotResponse{}, err
 	}
 	return &csi.DeleteSnapshotResponse{}, nil
@@ -511,16 +534,17 @@ func (fc *fcstorage) ControllerExpandVolume(ctx context.Context, req *csi.Contro
 		}
 	}()
 
-	volumeID, err := strconv.Atoi(req.GetVolumeId())
+	volproto, err := csiid.Parse(req.GetVolumeId())
 	if err != nil {
-		log.Errorf("Invalid Volume ID %v", err)
+		log.FromContext(ctx).Errorf("Invalid Volume ID %v", err)
 		return
 	}
+	volumeID := int(volproto.ObjectID)
 
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
 	if capacity < gib {
 		capacity = gib
-		log.Warn("Volume Minimum capacity should be greater 1 GB")
+		log.FromContext(ctx).Warn("Volume Minimum capacity should be greater 1 GB")
 	}
 
 	// Expand volume size
@@ -528,10 +552,10 @@ func (fc *fcstorage) ControllerExpandVolume(ctx context.Context, req *csi.Contro
 	volume.Size = capacity
 	_, err = fc.cs.api.UpdateVolume(volumeID, volume)
 	if err != nil {
-		log.Errorf("Failed to update file system %v", err)
+		log.FromContext(ctx).Errorf("Failed to update file system %v", err)
 		return
 	}
-	log.Infoln("Volume size updated successfully")
+	log.FromContext(ctx).Infoln("Volume size updated successfully")
 	return &csi.ControllerExpandVolumeResponse{
 		CapacityBytes:         capacity,
 		NodeExpansionRequired: false,
@@ -62,7 +62,7 @@ func (suite *FCControllerSuite) Test_CreateVolume_GetVolumeCapabilities_Mode_fai
 
 	capa := csi.VolumeCapability{
 		AccessMode: &csi.VolumeCapability_AccessMode{
-			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
 		},
 	}
 	var arr []*csi.VolumeCapability
@@ -272,8 +272,12 @@ func (suite *FCControllerSuite) Test_ControllerPublishVolume() {
 	suite.api.On("GetHostByName", mock.Anything).Return(getHostByName(), nil)
 	suite.api.On("GetAllLunByHost", mock.Anything).Return(getLunInfoArry(), nil)	
 	suite.api.On("MapVolumeToHost", mock.Anything).Return(getLunInf(), nil)		
-	_, err := service.ControllerPublishVolume(context.Background(), ctrPublishValReq)
+	volume := getVolume()
+	volume.Serial = "742B0F000004E2B0000000000001A2B"
+	suite.api.On("GetVolume", 1).Return(volume, nil)
+	resp, err := service.ControllerPublishVolume(context.Background(), ctrPublishValReq)
 	assert.Nil(suite.T(), err, "fail to control publish for fc protocol")
+	assert.Equal(suite.T(), "6742b0f000004e2b0000000000001a2b", resp.GetPublishContext()["wwid"], "publish context carries volume WWID")
 }
 
 
@@ -371,9 +375,13 @@ func (suite *FCControllerSuite) Test_CreateSnapshot() {
 	ctrUnPublishValReq := getISCSICreateSnapshotRequest()	
 	suite.api.On("GetVolumeByName", mock.Anything).Return(getVolume(), nil)
 	suite.api.On("CreateSnapshotVolume", mock.Anything).Return(getSnapshotResp(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, nil)
 	
 		_, err := service.CreateSnapshot(context.Background(), ctrUnPublishValReq)
 	assert.Nil(suite.T(), err, "Error should be notnil")
+	suite.api.AssertCalled(suite.T(), "AttachMetadataToObject", mock.Anything, mock.MatchedBy(func(metadata map[string]interface{}) bool {
+		return metadata[MetadataSourceVolumeID] != nil && metadata[MetadataSnapshotName] != nil
+	}))
 }
 
 
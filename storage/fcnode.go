@@ -12,19 +12,21 @@ package storage
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"infinibox-csi-driver/helper/driverconfig"
+	"infinibox-csi-driver/helper/hostexec"
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -58,7 +60,7 @@ type FCMounter struct {
 }
 
 func (fc *fcstorage) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	log.Debugf("NodePublishVolume called")
+	log.FromContext(ctx).Debugf("NodePublishVolume called")
 	fcDetails, err := fc.getFCDiskDetails(req)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
@@ -105,42 +107,42 @@ func (fc *fcstorage) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 			err = errors.New("Recovered from FC NodeStageVolume  " + fmt.Sprint(res))
 		}
 	}()
-	log.Info("NodeStageVolume called with ", req.GetPublishContext())
+	log.FromContext(ctx).Info("NodeStageVolume called with ", req.GetPublishContext())
 	hostID := req.GetPublishContext()["hostID"]
 	ports := req.GetPublishContext()["hostPorts"]
 
 	hstID, _ := strconv.Atoi(hostID)
-	log.Debugf("publishing volume to host id is %s", hostID)
+	log.FromContext(ctx).Debugf("publishing volume to host id is %s", hostID)
 	//validate host exists
 	if hstID < 1 {
-		log.Errorf("hostID %d is not valid host ID", hstID)
+		log.FromContext(ctx).Errorf("hostID %d is not valid host ID", hstID)
 		return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, "not a valid host")
 	}
 	fcPorts := getPortName()
 	if len(fcPorts) == 0 {
-		log.Error("port name not found on worker")
+		log.FromContext(ctx).Error("port name not found on worker")
 		return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, "Port name not found")
 	}
 	for _, fcp := range fcPorts {
 		if !strings.Contains(ports, fcp) {
-			log.Debugf("host port %s is not created, creating it", fcp)
+			log.FromContext(ctx).Debugf("host port %s is not created, creating it", fcp)
 			err = fc.cs.AddPortForHost(hstID, "FC", fcp)
 			if err != nil {
-				log.Errorf("error creating host port %v", err)
+				log.FromContext(ctx).Errorf("error creating host port %v", err)
 				return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, err.Error())
 			}
 			_, err := fc.cs.api.GetHostPort(hstID, fcp)
 			if err != nil {
-				log.Errorf("failed to get host port %s with error %v", fcp, err)
+				log.FromContext(ctx).Errorf("failed to get host port %s with error %v", fcp, err)
 				return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, err.Error())
 			}
 		}
 	}
-	log.Debug("NodeStageVolume completed")
+	log.FromContext(ctx).Debug("NodeStageVolume completed")
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 func (fc *fcstorage) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	log.Info("Called FC NodeUnstageVolume")
+	log.FromContext(ctx).Info("Called FC NodeUnstageVolume")
 	var err error
 	defer func() {
 		if res := recover(); res != nil && err == nil {
@@ -150,84 +152,50 @@ func (fc *fcstorage) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 	var mpathDevice string
 	stagePath := req.GetStagingTargetPath()
 
-	volproto := strings.Split(req.GetVolumeId(), "$$")
-	volName := volproto[0]
+	volName := diskName(req.GetVolumeId())
 
 	dskInfo := diskInfo{}
 	dskInfo.VolName = volName
 
 	// load iscsi disk config from json file
-	log.Debug("read fc config from staging path")
+	log.FromContext(ctx).Debug("read fc config from staging path")
 	if err := fc.loadFcDiskInfoFromFile(&dskInfo, stagePath); err == nil {
 		mpathDevice = dskInfo.MpathDevice
-		log.Debugf("fc config: mpathDevice %s", mpathDevice)
+		log.FromContext(ctx).Debugf("fc config: mpathDevice %s", mpathDevice)
 	} else {
-		log.Debug("fc config not existing at staging path")
-		confFile := path.Join("/host", stagePath, volName+".json")
-		log.Debug("check if fc config file exists")
+		log.FromContext(ctx).Debug("fc config not existing at staging path")
+		confFile := path.Join(stagePath, volName+".json")
+		log.FromContext(ctx).Debug("check if fc config file exists")
 		pathExist, pathErr := fc.cs.pathExists(confFile)
 		if pathErr == nil {
 			if !pathExist {
-				log.Debug("fc config file is not exists")
-				if err := os.RemoveAll(stagePath); err != nil {
-					log.Errorf("fc: failed to remove mount path Error: %v", err)
+				log.FromContext(ctx).Debug("fc config file is not exists")
+				if err := hostexec.Get().RemoveAll(stagePath); err != nil {
+					log.FromContext(ctx).Errorf("fc: failed to remove mount path Error: %v", err)
 					return nil, err
 				}
-				log.Debug("removed stage path: ", stagePath)
+				log.FromContext(ctx).Debug("removed stage path: ", stagePath)
+				removeStageRecord(stagePath)
 				return &csi.NodeUnstageVolumeResponse{}, nil
 			}
 		}
-		log.Warnf("fc detach disk: failed to get fc config from path %s Error: %v", stagePath, err)
+		log.FromContext(ctx).Warnf("fc detach disk: failed to get fc config from path %s Error: %v", stagePath, err)
 	}
 
-	// remove multipath
-	var devices []string
-	multiPath := false
-	dstPath := mpathDevice
-
-	log.Debug("removing mpath")
-	if strings.HasPrefix(dstPath, "/host") {
-		dstPath = strings.Replace(dstPath, "/host", "", 1)
-	}
-
-	log.Debugf("remove multipath device %s", dstPath)
-	if strings.HasPrefix(dstPath, "/dev/dm-") {
-		multiPath = true
-		devices = findSlaveDevicesOnMultipath(dstPath)
-	} else {
-		// Add single targetPath to devices
-		devices = append(devices, dstPath)
-	}
-	var lastErr error
-	for _, device := range devices {
-		err := detachDisk(device)
-		if err != nil {
-			log.Errorf("fc: detachFCDisk failed. device: %v err: %v", device, err)
-			lastErr = fmt.Errorf("fc: detach disk failed. device: %v err: %v", device, err)
-		}
-	}
-	if lastErr != nil {
-		log.Errorf("fc: last error occurred during detach disk:\n%v", lastErr)
-		return nil, lastErr
-	}
-	if multiPath {
-		log.Debug("flush multipath device using multipath -f ", dstPath)
-		_, err := fc.cs.ExecuteWithTimeout(4000, "multipath", []string{"-f", dstPath})
-		if err != nil {
-			if _, e := os.Stat("/host" + dstPath); os.IsNotExist(e) {
-				log.Debugf("multipath device %s deleted", dstPath)
-			} else {
-				log.Errorf("multipath -f %s failed to device with error %v", dstPath, err.Error())
-				return nil, err
-			}
+	// remove multipath map and its paths, before the staging directory with the record of them
+	if mpathDevice != "" {
+		if err := fc.cs.newDeviceTeardown().remove(mpathDevice); err != nil {
+			log.FromContext(ctx).Errorf("fc: failed to remove device %s of volume %s: %v", mpathDevice, volName, err)
+			return nil, err
 		}
+		log.FromContext(ctx).Debug("Removed multipath sucessfully!")
 	}
-	log.Debug("Removed multipath sucessfully!")
 
-	if err := os.RemoveAll("/host" + stagePath); err != nil {
-		log.Errorf("fc: failed to remove mount path Error: %v", err)
+	if err := hostexec.Get().RemoveAll(stagePath); err != nil {
+		log.FromContext(ctx).Errorf("fc: failed to remove mount path Error: %v", err)
 		return nil, err
 	}
+	removeStageRecord(stagePath)
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
@@ -274,43 +242,47 @@ func (fc *fcstorage) MountFCDisk(fm FCMounter, devicePath string) error {
 	}
 	if fm.fcDisk.isBlock {
 		log.Infof("Block volume will be mount at file %s", fm.TargetPath)
-		if fm.ReadOnly {
-			return status.Error(codes.Internal, "Read only is not supported for Block Volume")
-		}
 
-		if err := os.MkdirAll(filepath.Dir(fm.TargetPath), 0750); err != nil {
+		if err := hostexec.Get().MkdirAll(filepath.Dir(fm.TargetPath), 0750); err != nil {
 			log.Errorf("fc: failed to mkdir %s, error", filepath.Dir(fm.TargetPath))
 			return err
 		}
 
-		_, err = os.Create("/host/" + fm.TargetPath)
+		err = hostexec.Get().WriteFile(fm.TargetPath, nil, 0640)
 		if err != nil {
 			log.Errorf("failed to create target file %q: %v", fm.TargetPath, err)
 			return fmt.Errorf("failed to create target file for raw block bind mount: %v", err)
 		}
-		devicePath = strings.Replace(devicePath, "/host", "", 1)
+		devicePath = fromHost(devicePath)
 		options := []string{"bind"}
-		options = append(options, "rw")
+		if fm.ReadOnly {
+			// device opened for writing through a read only bind mount fails with EROFS
+			options = append(options, "ro")
+		} else {
+			options = append(options, "rw")
+		}
 		if err := fm.Mounter.Mount(devicePath, fm.TargetPath, "", options); err != nil {
+			metrics.MountFailure("fc")
 			log.Errorf("fc: failed to mount fc volume %s to %s, error %v", devicePath, fm.TargetPath, err)
 			return err
 		}
 		log.Debug("Block volume mounted successfully")
 	} else {
 		log.Debugf("mount volume to given path %s", fm.TargetPath)
-		if err := os.MkdirAll(fm.TargetPath, 0750); err != nil {
+		if err := hostexec.Get().MkdirAll(fm.TargetPath, 0750); err != nil {
 			log.Errorf("fc: failed to mkdir %s, error", fm.TargetPath)
 			return err
 		}
 		var options []string
 
 		if fm.ReadOnly {
-			options = append(options, "ro")
+			options = append(options, readOnlyMountOptions(fm.FsType)...)
 		} else {
 			options = append(options, "rw")
 		}
 		options = append(options, fm.MountOptions...)
 		if err = fm.Mounter.FormatAndMount(devicePath, fm.TargetPath, fm.FsType, options); err != nil {
+			metrics.MountFailure("fc")
 			return fmt.Errorf("fc: failed to mount fc volume %s [%s] to %s, error %v", devicePath, fm.FsType, fm.TargetPath, err)
 		}
 	}
@@ -334,17 +306,28 @@ func getPortName() []string {
 		}
 	}()
 	ports := []string{}
-	cmd := "cat /sys/class/fc_host/host*/port_name"
-	out, err := exec.Command("bash", "-c", cmd).Output()
+	dir, err := hostexec.Get().Open("/sys/class/fc_host")
 	if err != nil {
 		log.Errorf("Failed to port name with error %v", err)
 		return ports
 	}
-	portName := string(out)
-	if portName != "" {
-		for _, port := range strings.Split(strings.TrimSuffix(portName, "\n"), "\n") {
-			ports = append(ports, strings.Replace(port, "0x", "", 1))
+	hosts, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		log.Errorf("Failed to port name with error %v", err)
+		return ports
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		if !strings.HasPrefix(host, "host") {
+			continue
+		}
+		port, err := hostexec.Get().ReadFile(path.Join("/sys/class/fc_host", host, "port_name"))
+		if err != nil {
+			log.Errorf("Failed to port name with error %v", err)
+			continue
 		}
+		ports = append(ports, strings.Replace(strings.TrimSpace(string(port)), "0x", "", 1))
 	}
 	log.Debugf("fc ports found %v ", ports)
 	return ports
@@ -357,9 +340,9 @@ func (fc *fcstorage) getFCDiskDetails(req *csi.NodePublishVolumeRequest) (*fcDev
 			err = errors.New("Recovered from FC getFCDiskDetails " + fmt.Sprint(res))
 		}
 	}()
-	volproto := strings.Split(req.GetVolumeId(), "$$")
-	volName := volproto[0]
+	volName := diskName(req.GetVolumeId())
 	lun := req.GetPublishContext()["lun"]
+	wwid := req.GetPublishContext()[publishContextWWID]
 	wwids := req.GetVolumeContext()["WWIDs"]
 	wwidList := strings.Split(wwids, ",")
 	targetList := []string{}
@@ -375,7 +358,7 @@ func (fc *fcstorage) getFCDiskDetails(req *csi.NodePublishVolumeRequest) (*fcDev
 		}
 	}
 	log.Debugf("lun %s , targetList %v , wwidList %v", lun, targetList, wwidList)
-	if lun == "" || (len(targetList) == 0 && len(wwidList) == 0) {
+	if wwid == "" && (lun == "" || (len(targetList) == 0 && len(wwidList) == 0)) {
 		return nil, fmt.Errorf("FC target information is missing")
 	}
 	fcConnector := &Connector{
@@ -383,6 +366,7 @@ func (fc *fcstorage) getFCDiskDetails(req *csi.NodePublishVolumeRequest) (*fcDev
 		TargetWWNs: targetList,
 		WWIDs:      wwidList,
 		Lun:        lun,
+		WWID:       wwid,
 	}
 	//Only pass the connector
 	return &fcDevice{
@@ -396,11 +380,11 @@ func (fc *fcstorage) getFCDiskMounter(req *csi.NodePublishVolumeRequest, fcDetai
 	mountOptions := req.GetVolumeCapability().GetMount().GetMountFlags()
 	return FCMounter{
 		fcDisk:       fcDetails,
-		ReadOnly:     false,
+		ReadOnly:     readOnlyPublish(req.GetReadonly(), req.GetVolumeCapability()),
 		FsType:       fstype,
 		MountOptions: mountOptions,
-		Mounter:      &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: mount.NewOsExec()},
-		Exec:         mount.NewOsExec(),
+		Mounter:      &mount.SafeFormatAndMount{Interface: hostMounter(fc.cs.ctx), Exec: hostExec(fc.cs.ctx)},
+		Exec:         hostExec(fc.cs.ctx),
 		DeviceUtil:   util.NewDeviceHandler(util.NewIOHandler()),
 		TargetPath:   req.GetTargetPath(),
 		StagePath:    req.GetStagingTargetPath(),
@@ -420,6 +404,7 @@ type Connector struct {
 	TargetWWNs []string
 	Lun        string
 	WWIDs      []string
+	WWID       string // empty for volumes published before the controller passed it
 	io         ioHandler
 }
 
@@ -441,9 +426,9 @@ func (handler *OSioHandler) EvalSymlinks(path string) (string, error) {
 	return filepath.EvalSymlinks(path)
 }
 
-//WriteFile calls WriteFile from ioutil package
+//WriteFile write host file, such as a sysfs attribute
 func (handler *OSioHandler) WriteFile(filename string, data []byte, perm os.FileMode) error {
-	return ioutil.WriteFile(filename, data, perm)
+	return hostexec.Get().WriteFile(filename, data, perm)
 }
 
 // FindMultipathDeviceForDevice given a device name like /dev/sdx, find the devicemapper parent
@@ -479,7 +464,7 @@ func (fc *fcstorage) findDeviceForPath(path string) (string, error) {
 	}
 	// if path /dev/hdX split into "", "dev", "hdX" then we will
 	// return just the last part
-	devicePath = strings.Replace(devicePath, "/host", "", 1)
+	devicePath = fromHost(devicePath)
 	parts := strings.Split(devicePath, "/")
 	if len(parts) == 3 && strings.HasPrefix(parts[1], "dev") {
 		log.Debug("found device ", parts[2])
@@ -501,6 +486,9 @@ func scsiHostRescan(io ioHandler) {
 
 func (fc *fcstorage) searchDisk(c Connector, io ioHandler) (string, error) {
 	log.Debug("In searchDisk")
+	if c.WWID != "" {
+		return newBlockDevices().wait(c.WWID, driverconfig.Get().Timeouts.DeviceAttach.Duration, func() { scsiHostRescan(io) })
+	}
 	var diskIds []string
 	var disk string
 	var dm string
@@ -554,7 +542,7 @@ func (fc *fcstorage) searchDisk(c Connector, io ioHandler) (string, error) {
 func (fc *fcstorage) findFcDisk(wwn, lun string, io ioHandler) (string, string) {
 	log.Debug("In findFcDisk")
 	FcPath := "-fc-0x" + wwn + "-lun-" + lun
-	DevPath := "/host/dev/disk/by-path/"
+	DevPath := hostPath("/dev/disk/by-path") + "/"
 	if dirs, err := io.ReadDir(DevPath); err == nil {
 		for _, f := range dirs {
 			name := f.Name()
@@ -610,7 +598,7 @@ func (fc *fcstorage) AttachFCDisk(c Connector, io ioHandler) (string, error) {
 		log.Infof("unable to find disk given WWNN or WWIDs with error %v", err)
 		return "", err
 	}
-	devicePath = strings.Replace(devicePath, "/host", "", 1)
+	devicePath = fromHost(devicePath)
 	log.Debugf("Attaching fc volume successful, device path %s", devicePath)
 
 	return devicePath, nil
@@ -628,23 +616,18 @@ func (fc *fcstorage) DetachFCDisk(targetPath string, io ioHandler) (err error) {
 	if io == nil {
 		io = &OSioHandler{}
 	}
-	mounter := mount.New("")
-	mntPath := path.Join("/host", targetPath)
+	mounter := hostMounter(fc.cs.ctx)
 	// unmount volume
 	if pathExist, pathErr := fc.cs.pathExists(targetPath); pathErr != nil {
 		return fmt.Errorf("Error checking if path exists: %v", pathErr)
 	} else if !pathExist {
-		if pathExist, _ = fc.cs.pathExists(mntPath); pathErr == nil {
-			if !pathExist {
-				log.Warnf("Warning: Unmount skipped because path does not exist: %v", targetPath)
-				return nil
-			}
-		}
+		log.Warnf("Warning: Unmount skipped because path does not exist: %v", targetPath)
+		return nil
 	}
 	if err := mounter.Unmount(targetPath); err != nil {
 		if strings.Contains(err.Error(), "not mounted") {
 			log.Debug("volume not mounted removing files ", targetPath)
-			if err := os.RemoveAll(filepath.Dir("/host" + targetPath)); err != nil {
+			if err := hostexec.Get().RemoveAll(filepath.Dir(targetPath)); err != nil {
 				log.Errorf("fc: failed to remove mount path Error: %v", err)
 			}
 			return nil
@@ -652,7 +635,7 @@ func (fc *fcstorage) DetachFCDisk(targetPath string, io ioHandler) (err error) {
 		log.Errorf("fc detach disk: failed to unmount: %s\nError: %v", targetPath, err)
 		return err
 	}
-	if err := os.RemoveAll(filepath.Dir("/host" + targetPath)); err != nil {
+	if err := hostexec.Get().RemoveAll(filepath.Dir(targetPath)); err != nil {
 		log.Errorf("fc: failed to remove mount path Error: %v", err)
 		return err
 	}
@@ -662,32 +645,17 @@ func (fc *fcstorage) DetachFCDisk(targetPath string, io ioHandler) (err error) {
 }
 
 func (fc *fcstorage) createFcConfigFile(conf diskInfo, mnt string) error {
-	file := path.Join("/host", mnt, conf.VolName+".json")
-	fp, err := os.Create(file)
-	if err != nil {
+	if err := writeDiskConfig(conf, mnt, conf.VolName); err != nil {
 		log.Errorf("fc: failed creating persist file with error %v", err)
-		return fmt.Errorf("fc: create %s err %s", file, err)
+		return fmt.Errorf("fc: %v", err)
 	}
-	defer fp.Close()
-	encoder := json.NewEncoder(fp)
-	if err = encoder.Encode(conf); err != nil {
-		log.Errorf("fc: failed creating persist file with error %v", err)
-		return fmt.Errorf("fc: encode err: %v", err)
-	}
-	log.Debugf("fc: created persist config file at path %s", file)
+	log.Debugf("fc: created persist config file in %s", mnt)
 	return nil
 }
 
 func (fc *fcstorage) loadFcDiskInfoFromFile(conf *diskInfo, mnt string) error {
-	file := path.Join("/host", mnt, conf.VolName+".json")
-	fp, err := os.Open(file)
-	if err != nil {
-		return fmt.Errorf("fc: open %s err %s", file, err)
-	}
-	defer fp.Close()
-	decoder := json.NewDecoder(fp)
-	if err = decoder.Decode(conf); err != nil {
-		return fmt.Errorf("fc: decode err: %v ", err)
+	if err := readDiskConfig(conf, mnt, conf.VolName); err != nil {
+		return fmt.Errorf("fc: %v", err)
 	}
 	return nil
 }
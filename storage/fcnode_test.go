@@ -0,0 +1,75 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"infinibox-csi-driver/helper/hostexec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type FCNodeSuite struct {
+	suite.Suite
+	root     string
+	previous hostexec.Executor
+}
+
+func TestFCNodeSuite(t *testing.T) {
+	suite.Run(t, new(FCNodeSuite))
+}
+
+func (suite *FCNodeSuite) SetupTest() {
+	root, err := ioutil.TempDir("", "fcnode")
+	suite.Require().NoError(err)
+	suite.root = root
+	suite.previous = hostexec.Get()
+	hostexec.Set(hostexec.NewFake(root))
+}
+
+func (suite *FCNodeSuite) TearDownTest() {
+	hostexec.Set(suite.previous)
+	os.RemoveAll(suite.root)
+}
+
+func (suite *FCNodeSuite) Test_getPortName() {
+	assert.Empty(suite.T(), getPortName(), "no fc_host on host")
+
+	for host, port := range map[string]string{"host3": "0x21000024ff6b3a10\n", "host4": "0x21000024ff6b3a11\n"} {
+		dir := filepath.Join(suite.root, "sys/class/fc_host", host)
+		suite.Require().NoError(os.MkdirAll(dir, 0755))
+		suite.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "port_name"), []byte(port), 0644))
+	}
+	assert.Equal(suite.T(), []string{"21000024ff6b3a10", "21000024ff6b3a11"}, getPortName())
+}
+
+func (suite *FCNodeSuite) Test_ConfigFile() {
+	fc := &fcstorage{}
+	stagePath := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"
+	suite.Require().NoError(os.MkdirAll(filepath.Join(suite.root, stagePath), 0755))
+	disk := diskInfo{VolName: "pvc-1", MpathDevice: "/dev/dm-4"}
+	assert.Nil(suite.T(), fc.createFcConfigFile(disk, stagePath))
+
+	loaded := diskInfo{VolName: "pvc-1"}
+	assert.Nil(suite.T(), fc.loadFcDiskInfoFromFile(&loaded, stagePath))
+	assert.Equal(suite.T(), "/dev/dm-4", loaded.MpathDevice)
+}
+
+func (suite *FCNodeSuite) Test_readOnlyMountOptions() {
+	assert.Equal(suite.T(), []string{"ro", "norecovery"}, readOnlyMountOptions("xfs"), "xfs log is not replayed")
+	assert.Equal(suite.T(), []string{"ro", "noload"}, readOnlyMountOptions("ext4"), "ext4 journal is not replayed")
+	assert.Equal(suite.T(), []string{"ro", "noload"}, readOnlyMountOptions(""), "empty fsType is formatted as ext4")
+	assert.Equal(suite.T(), []string{"ro"}, readOnlyMountOptions("btrfs"))
+}
@@ -14,13 +14,15 @@ import (
 	"errors"
 	"fmt"
 	"infinibox-csi-driver/api"
-	"infinibox-csi-driver/helper"
+	"infinibox-csi-driver/helper/lock"
 	"path"
 	"strconv"
 	"strings"
 	"sync"
 
+	"infinibox-csi-driver/helper/driverconfig"
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -43,6 +45,10 @@ const (
 const (
 	NFSTREEQ             = "nfs_treeq"
 	NFS                  = "nfs"
+	ISCSI                = "iscsi"
+	FC                   = "fc"
+	SMB                  = "smb"
+	NVMeTCP              = "nvme_tcp"
 	TreeqUnixPermissions = "750"
 )
 
@@ -159,6 +165,7 @@ func (filesystem *FilesystemService) IsTreeqAlreadyExist(pool_name, network_spac
 			treeqVolume["ID"] = strconv.FormatInt(treeqData.FilesystemID, 10)
 			treeqVolume["TREEQID"] = strconv.FormatInt(treeqData.ID, 10)
 			treeqVolume["ipAddress"] = filesystem.ipAddress
+			treeqVolume["network_space"] = network_space
 			treeqVolume["volumePath"] = path.Join(filesystem.exportpath, treeqData.Path)
 			return
 		}		
@@ -199,13 +206,19 @@ func (filesystem *FilesystemService) getExpectedFileSystemID(maxFileSystemSize i
 					err = errors.New("fail to get treeq count of filesystemID " + strconv.FormatInt(fs.ID, 10))
 					return
 				}
+				metrics.SetFileSystemTreeqs(filesystem.configmap["pool_name"], fs.ID, treeqCnt)
 				if treeqCnt < filesystem.getAllowedCount(MAXTREEQSPERFILESYSTEM) {
-					filesystem.treeqCnt = treeqCnt
-					log.Debugf("filesystem found to create treeQ,filesystemID %d", fs.ID)
-					exportErr := filesystem.getExportPath(fs.ID) //fetch export path and set to filesystem exportPath
+					exported, exportErr := filesystem.getVersionedExportPath(fs.ID) //fetch export path of nfs_version and set to filesystem exportPath
 					if exportErr != nil {
 						err = exportErr
+						return
+					}
+					if !exported {
+						log.Debugf("filesystem %d is not exported with NFS versions %v", fs.ID, exportVersions(filesystem.configmap))
+						continue
 					}
+					filesystem.treeqCnt = treeqCnt
+					log.Debugf("filesystem found to create treeQ,filesystemID %d", fs.ID)
 					filesys = &fs
 					return
 				}
@@ -227,11 +240,8 @@ func (filesystem *FilesystemService) setParameter(config map[string]string, capa
 	filesystem.exportpath = "/" + filesystem.pVName
 }
 
-var createMutex sync.Mutex
-
 //CreateTreeqVolume create volumne method
 func (filesystem *FilesystemService) CreateTreeqVolume(config map[string]string, capacity int64, pvName string) (treeqVolume map[string]string, err error) {
-
 	defer func() {
 		if res := recover(); res != nil {
 			err = errors.New("error while creating treeq method " + fmt.Sprint(res))
@@ -240,6 +250,9 @@ func (filesystem *FilesystemService) CreateTreeqVolume(config map[string]string,
 	treeqVolume = make(map[string]string)
 	treeqVolume["storage_protocol"] = config["storage_protocol"]
 	treeqVolume["nfs_mount_options"] = config["nfs_mount_options"]
+	treeqVolume["network_space"] = config["network_space"]
+	treeqVolume[NFSVersion] = config[NFSVersion]
+	treeqVolume[NConnect] = config[NConnect]
 	filesystem.setParameter(config, capacity, pvName)
 
 	ipAddress, err := filesystem.cs.getNetworkSpaceIP(strings.Trim(config["network_space"], " "))
@@ -264,8 +277,27 @@ func (filesystem *FilesystemService) CreateTreeqVolume(config map[string]string,
 	}
 
 	var filesys *api.FileSystem
-	helper.GetMutex().Mutex.Lock()
-	defer helper.GetMutex().Mutex.Unlock()
+	// filesystem selection is serialised per pool, treeqs of other pools are created in parallel
+	_, unlockPool, err := lock.Get().Lock(filesystem.cs.ctx, lock.PoolKey(poolID))
+	if err != nil {
+		log.Errorf("fail to lock pool %d %v", poolID, err)
+		return
+	}
+	defer lock.Release(unlockPool, &err)
+	var unlockFileSystem lock.Unlock = func() error { return nil }
+	defer func() { lock.Release(unlockFileSystem, &err) }()
+
+	// every completed step is undone when a later one fails, so no filesystem, export, treeq or count change is left behind.
+	// Rollback runs while pool and filesystem are still locked.
+	tx := newSaga("create treeq " + pvName)
+	defer func() {
+		if res := recover(); res != nil {
+			err = errors.New("error while creating treeq method " + fmt.Sprint(res))
+		}
+		if err != nil {
+			tx.rollback()
+		}
+	}()
 
 	filesys, err=filesystem.getExpectedFileSystemID(maxFileSystemSize)	
 	if err != nil {
@@ -274,12 +306,15 @@ func (filesystem *FilesystemService) CreateTreeqVolume(config map[string]string,
 	}
 	var filesystemID int64
 	if filesys == nil { // if pool is empty or no file system found to createTreeq
-		err = filesystem.createFileSystem()
+		err = tx.step("filesystem for treeq "+filesystem.pVName, filesystem.createFileSystem, func() error {
+			_, err := filesystem.cs.api.DeleteFileSystem(filesystem.fileSystemID)
+			return err
+		})
 		if err != nil {
 			log.Errorf("fail to create fileSystem %v", err)
 			return
 		}
-		err = filesystem.createExportPathAndAddMetadata()
+		err = filesystem.createExportPathAndAddMetadata(tx)
 		if err != nil {
 			log.Errorf("fail to create export and metadata %v", err)
 			return
@@ -288,17 +323,24 @@ func (filesystem *FilesystemService) CreateTreeqVolume(config map[string]string,
 	} else {
 		filesystemID = filesys.ID
 	}
-	
+	_, unlockFileSystem, err = lock.Get().Lock(filesystem.cs.ctx, lock.FileSystemKey(filesystemID))
+	if err != nil {
+		unlockFileSystem = func() error { return nil }
+		log.Errorf("fail to lock filesystem %d %v", filesystemID, err)
+		return
+	}
+
 	//create treeq
-	treeqResponse, createTreeqerr := filesystem.cs.api.CreateTreeq(filesystemID, filesystem.getTreeParameters())
-	if createTreeqerr != nil {
+	var treeqResponse *api.Treeq
+	err = tx.step("treeq "+filesystem.pVName, func() (err error) {
+		treeqResponse, err = filesystem.cs.api.CreateTreeq(filesystemID, filesystem.getTreeParameters())
+		return
+	}, func() error {
+		_, err := filesystem.cs.api.DeleteTreeq(filesystemID, treeqResponse.ID)
+		return err
+	})
+	if err != nil {
 		log.Errorf("fail to create treeq  %s error %v", filesystem.pVName, err)
-		if filesys == nil { //if the file system created at the time of creating first treeq ,then delete the complete filesystem with export and metata
-			deleteFilesystemErr := filesystem.cs.api.DeleteFileSystemComplete(filesystemID)
-			if deleteFilesystemErr != nil {
-				log.Errorf("fail to delete filesystem ,filesystemID = %d", filesystemID)
-			}
-		}
 		err = errors.New("fail to Create Treeq")
 		return
 	}
@@ -307,84 +349,70 @@ func (filesystem *FilesystemService) CreateTreeqVolume(config map[string]string,
 	treeqVolume["ipAddress"] = filesystem.ipAddress
 	treeqVolume["volumePath"] = path.Join(filesystem.exportpath, treeqResponse.Path)
 
-	//if AttachMetadataToObject - fail to add metadata then delete the created treeq
-	defer func() {
-		if res := recover(); res != nil {
-			err = errors.New("error while update metadata" + fmt.Sprint(res))
-		}
-		if err != nil && filesystem.fileSystemID != 0 {
-			log.Infof("Seemes to be some problem reverting treeq: %s", filesystem.pVName)
-			filesystem.cs.api.DeleteTreeq(filesystem.fileSystemID, treeqResponse.ID)
-		}
-	}()
-
-	treeqCount := filesystem.treeqCnt + 1
-	_, updateTreeqErr := filesystem.UpdateTreeqCnt(filesystemID, NONE, treeqCount)
-	if updateTreeqErr != nil {
+	previousTreeqCount := filesystem.treeqCnt
+	err = tx.step("treeq count of filesystem "+strconv.FormatInt(filesystemID, 10), func() error {
+		_, err := filesystem.UpdateTreeqCnt(filesystemID, NONE, previousTreeqCount+1)
+		return err
+	}, func() error {
+		return filesystem.setTreeqCnt(filesystemID, previousTreeqCount)
+	})
+	if err != nil {
 		err = errors.New("fail to increment treeq count as metadata")
 		return
 	}
 
-	//if UpdateFilesystem - is fail then descrement the tree count from metadata
-	defer func() {
-		if res := recover(); res != nil {
-			err = errors.New("error while update file size" + fmt.Sprint(res))
-		}
-		if err != nil && filesystemID != 0 {
-			log.Infof("Seemes to be some problem reverting treeqcount")
-			filesystem.UpdateTreeqCnt(filesystemID, DecrementTreeqCount, 0)
-		}
-	}()
-
 	// if new file system is created ,while creating the treeq, then not need to update size
 	if filesys != nil {
-		var updateFileSys api.FileSystem
-		updateFileSys.Size = filesys.Size + filesystem.capacity
-		_, updateFileSizeErr := filesystem.cs.api.UpdateFilesystem(filesystemID, updateFileSys)
-		if updateFileSizeErr != nil {
+		err = tx.step("size of filesystem "+strconv.FormatInt(filesystemID, 10), func() error {
+			_, err := filesystem.cs.api.UpdateFilesystem(filesystemID, api.FileSystem{Size: filesys.Size + filesystem.capacity})
+			return err
+		}, func() error {
+			_, err := filesystem.cs.api.UpdateFilesystem(filesystemID, api.FileSystem{Size: filesys.Size})
+			return err
+		})
+		if err != nil {
 			log.Errorf("fail to update File Size %v", err)
 			err = errors.New("fail to update files size")
 			return
 		}
 	}
+
+	treeqMetadata := filesystem.cs.getTreeqMetadata(treeqResponse.ID, filesystem.pVName, filesystem.configmap)
+	if _, metadataErr := filesystem.cs.api.AttachMetadataToObject(filesystemID, treeqMetadata); metadataErr != nil {
+		log.Warnf("fail to attach metadata of treeq %s to filesystemID %d error %v", filesystem.pVName, filesystemID, metadataErr)
+	}
 	return
 }
 
-func (filesystem *FilesystemService) createExportPathAndAddMetadata() (err error) {
+//createExportPathAndAddMetadata export new filesystem and attach its metadata as steps of tx
+func (filesystem *FilesystemService) createExportPathAndAddMetadata(tx *saga) (err error) {
 	defer func() {
 		if res := recover(); res != nil {
 			err = errors.New("error while export directory" + fmt.Sprint(res))
 		}
-		if err != nil && filesystem.fileSystemID != 0 {
-			log.Infof("Seemes to be some problem reverting filesystem: %s", filesystem.pVName)
-			filesystem.cs.api.DeleteFileSystem(filesystem.fileSystemID)
-		}
 	}()
 
-	err = filesystem.createExportPath()
+	err = tx.step("export "+filesystem.exportpath, filesystem.createExportPath, func() error {
+		_, err := filesystem.cs.api.DeleteExportPath(filesystem.exportID)
+		return err
+	})
 	if err != nil {
 		log.Errorf("fail to export path %v", err)
 		return
 	}
 	log.Debugf("export path created for filesystem: %s", filesystem.pVName)
 
-	defer func() {
-		if res := recover(); res != nil {
-			err = errors.New("error while AttachMetadata directory" + fmt.Sprint(res))
-		}
-		if err != nil && filesystem.exportID != 0 {
-			log.Infoln("Seemes to be some problem reverting created export id:", filesystem.exportID)
-			filesystem.cs.api.DeleteExportPath(filesystem.exportID)
-		}
-	}()
-	metadata := make(map[string]interface{})
-	metadata["host.k8s.pvname"] = filesystem.pVName
-	metadata["host.created_by"] = filesystem.cs.GetCreatedBy()
+	// filesystem is shared by treeqs, PVC details are kept per treeq
+	metadata := filesystem.cs.getCSIMetadata()
+	metadata[MetadataPVName] = filesystem.pVName
 
-	_, err = filesystem.cs.api.AttachMetadataToObject(filesystem.fileSystemID, metadata)
+	// metadata goes with the filesystem, it has no compensation of its own
+	err = tx.step("metadata of filesystem "+filesystem.exportpath, func() error {
+		_, err := filesystem.cs.api.AttachMetadataToObject(filesystem.fileSystemID, metadata)
+		return err
+	}, nil)
 	if err != nil {
 		log.Errorf("fail to attach metadata for fileSystem : %s", filesystem.pVName)
-		log.Errorf("error to attach metadata %v", err)
 		return
 	}
 	log.Debugf("metadata attached successfully for filesystem %s", filesystem.pVName)
@@ -397,6 +425,7 @@ func (filesystem *FilesystemService) createFileSystem() (err error) {
 		log.Errorf("fail to get the filesystem count from Ibox %v", err)
 		return
 	}
+	metrics.SetPoolFileSystems(filesystem.configmap["pool_name"], fileSystemCnt)
 	if fileSystemCnt >= filesystem.getAllowedCount(MAXFILESYSTEMS) {
 		log.Debugf("Max filesystem allowed on Pool %v", filesystem.getAllowedCount(MAXFILESYSTEMS))
 		log.Debugf("Current filesystem count on Pool %v", fileSystemCnt)
@@ -415,10 +444,15 @@ func (filesystem *FilesystemService) createFileSystem() (err error) {
 	var treeqFileSystemName string
 
 	pvSplit := strings.Split(filesystem.pVName, "-")
-	treeqFileSystemName = "csit_" + pvSplit[1]
+	nameSuffix := pvSplit[1]
+	if filesystem.configmap[ParameterNameTemplate] != "" {
+		// templated names end with uniqueness suffix
+		nameSuffix = pvSplit[len(pvSplit)-1]
+	}
+	treeqFileSystemName = "csit_" + nameSuffix
 
 	if prefix, ok := filesystem.configmap[FSPREFIX]; ok {
-		treeqFileSystemName = prefix + pvSplit[1]
+		treeqFileSystemName = prefix + nameSuffix
 	}
 	filesystem.exportpath = "/" + treeqFileSystemName
 	mapRequest["name"] = treeqFileSystemName
@@ -431,6 +465,7 @@ func (filesystem *FilesystemService) createFileSystem() (err error) {
 		return
 	}
 	filesystem.fileSystemID = fileSystem.ID
+	metrics.SetPoolFileSystems(filesystem.configmap["pool_name"], fileSystemCnt+1)
 	log.Debugf("filesystem Created %s", filesystem.pVName)
 	return
 }
@@ -462,6 +497,7 @@ func (filesystem *FilesystemService) createExportPath() (err error) {
 	exportFileSystem.Transport_protocols = "TCP"
 	exportFileSystem.Privileged_port = true
 	exportFileSystem.Export_path = filesystem.exportpath
+	exportFileSystem.NfsVersions = exportVersions(filesystem.configmap)
 	exportFileSystem.Permissionsput = append(exportFileSystem.Permissionsput, permissionsput...)
 	exportResp, err := filesystem.cs.api.ExportFileSystem(exportFileSystem)
 	if err != nil {
@@ -488,11 +524,12 @@ func (filesystem *FilesystemService) validateTreeqParameters(config map[string]s
 }
 
 func getDefaultValues() map[string]string {
+	treeqConfig := driverconfig.Get().Treeq
 	defaultConfigMap := make(map[string]string)
 	defaultConfigMap[PROVISIONTYPE] = "thin"
-	defaultConfigMap[MAXTREEQSPERFILESYSTEM] = "1000"
-	defaultConfigMap[MAXFILESYSTEMS] = "1000"
-	defaultConfigMap[MAXFILESYSTEMSIZE] = "100tib"
+	defaultConfigMap[MAXTREEQSPERFILESYSTEM] = strconv.Itoa(treeqConfig.MaxTreeqsPerFileSystem)
+	defaultConfigMap[MAXFILESYSTEMS] = strconv.Itoa(treeqConfig.MaxFileSystems)
+	defaultConfigMap[MAXFILESYSTEMSIZE] = treeqConfig.MaxFileSystemSize
 	//defaultConfigMap[UNIXPERMISSION] = "750"
 	return defaultConfigMap
 }
@@ -576,6 +613,22 @@ func (filesystem *FilesystemService) getExportPath(filesystemID int64) error {
 	return nil
 }
 
+//getVersionedExportPath set exportpath to export of filesystem whose NFS versions are those nfs_version asks for, false when there is none
+func (filesystem *FilesystemService) getVersionedExportPath(filesystemID int64) (bool, error) {
+	exportResponse, exportErr := filesystem.cs.api.GetExportByFileSystem(filesystemID)
+	if exportErr != nil {
+		log.Errorf("fail to get export path of filesystem %d", filesystemID)
+		return false, exportErr
+	}
+	for _, export := range *exportResponse {
+		if sameExportVersions(export.NfsVersions, exportVersions(filesystem.configmap)) {
+			filesystem.exportpath = export.ExportPath
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func isTreeQEmpty(treeq api.Treeq) bool {
 	if treeq.UsedCapacity > 0 {
 		return false
@@ -583,8 +636,6 @@ func isTreeQEmpty(treeq api.Treeq) bool {
 	return true
 }
 
-var deleteMutex sync.Mutex
-
 //DeleteNFSVolume delete volume method
 func (filesystem *FilesystemService) DeleteTreeqVolume(filesystemID, treeqID int64) (err error) {
 
@@ -615,8 +666,12 @@ func (filesystem *FilesystemService) DeleteTreeqVolume(filesystemID, treeqID int
 
 	//3 first decremnt the treeq count to recover
 	// In case of 1 - we are deleting the file system,
-	deleteMutex.Lock()
-	defer deleteMutex.Unlock()
+	_, unlock, err := lock.Get().Lock(filesystem.cs.ctx, lock.FileSystemKey(filesystemID))
+	if err != nil {
+		log.Errorf("fail to lock filesystem %d %v", filesystemID, err)
+		return
+	}
+	defer lock.Release(unlock, &err)
 
 	treeqCnt, err := filesystem.UpdateTreeqCnt(filesystemID, DecrementTreeqCount, 0)
 	if err != nil {
@@ -632,6 +687,13 @@ func (filesystem *FilesystemService) DeleteTreeqVolume(filesystemID, treeqID int
 	}
 
 	//5.Delete file system if all treeq are delete
+	if treeqCnt > 0 {
+		for _, key := range treeqMetadataKeys(treeqID) {
+			if _, detachErr := filesystem.cs.api.DetachMetadataKeyFromObject(filesystemID, key); detachErr != nil {
+				log.Warnf("fail to detach metadata %s from filesystemID %d error %v", key, filesystemID, detachErr)
+			}
+		}
+	}
 	if treeqCnt == 0 { // measn all tree are delete. then delete the complete filesystem with exportPath ,metadata..etc
 		err = filesystem.cs.api.DeleteFileSystemComplete(filesystemID)
 		if err != nil {
@@ -668,10 +730,20 @@ func (filesystem *FilesystemService) UpdateTreeqCnt(fileSystemID int64, action A
 	}
 
 	treeqCount = treeqCnt
+	metrics.SetFileSystemTreeqs(filesystem.configmap["pool_name"], fileSystemID, treeqCnt)
 	log.Debugf("treeq count updated successfully of fileSystemID: %d", fileSystemID)
 	return
 }
 
+//setTreeqCnt set treeq count metadata of filesystem to count, which may be 0
+func (filesystem *FilesystemService) setTreeqCnt(fileSystemID int64, count int) error {
+	if _, err := filesystem.cs.api.AttachMetadataToObject(fileSystemID, map[string]interface{}{TREEQCOUNT: count}); err != nil {
+		return err
+	}
+	metrics.SetFileSystemTreeqs(filesystem.configmap["pool_name"], fileSystemID, count)
+	return nil
+}
+
 //UpdateTreeqVolume Upadate volume size method
 func (filesystem *FilesystemService) UpdateTreeqVolume(filesystemID, treeqID, capacity int64, maxSize string) (err error) {
 	defer func() {
@@ -146,6 +146,101 @@ func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_Success() {
 
 }
 
+//treeqRollbackCase step of CreateTreeqVolume failing and compensations expected for it
+type treeqRollbackCase struct {
+	name     string
+	fail     string
+	deleted  []string
+	retained []string
+}
+
+func isTreeqCount(metadata map[string]interface{}) bool {
+	_, ok := metadata[TREEQCOUNT]
+	return ok
+}
+
+func errorIf(failing bool) error {
+	if failing {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+//runTreeqRollback create treeq with c.fail failing, filesystem 1 is created for it or filesystem 11 is reused
+func (suite *FileSystemServiceSuite) runTreeqRollback(c treeqRollbackCase, reuse bool) {
+	suite.SetupTest()
+	var poolID int64 = 10
+	var fsID int64 = 1
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getnetworkspace(), nil)
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(poolID, nil)
+	if reuse {
+		fsID = 11
+		suite.api.On("GetFileSystemsByPoolID", poolID, 1).Return(*getfsMetadata2(), nil)
+		suite.api.On("GetFilesytemTreeqCount", fsID).Return(1, nil)
+		suite.api.On("GetExportByFileSystem", fsID).Return(getExportResponse(), nil)
+	} else {
+		suite.api.On("GetFileSystemsByPoolID", poolID, 1).Return(api.FSMetadata{}, nil)
+		suite.api.On("GetFileSystemCountByPoolID", mock.Anything).Return(200, nil)
+		suite.api.On("CreateFilesystem", mock.Anything).Return(getFileSystem(), nil)
+		suite.api.On("ExportFileSystem", mock.Anything).Return(getExportResponseValue(), errorIf(c.fail == "export"))
+		suite.api.On("AttachMetadataToObject", fsID, mock.MatchedBy(func(m map[string]interface{}) bool { return m[MetadataPVName] != nil })).
+			Return(nil, errorIf(c.fail == "metadata"))
+	}
+	suite.api.On("CreateTreeq", fsID, mock.Anything).Return(*getTreeQResponse(fsID), errorIf(c.fail == "treeq"))
+	suite.api.On("AttachMetadataToObject", fsID, mock.MatchedBy(isTreeqCount)).Return(nil, errorIf(c.fail == "count"))
+	suite.api.On("UpdateFilesystem", fsID, api.FileSystem{Size: 11000}).Return(nil, errorIf(c.fail == "size"))
+	suite.api.On("UpdateFilesystem", fsID, api.FileSystem{Size: 10000}).Return(nil, nil)
+	suite.api.On("AttachMetadataToObject", fsID, mock.Anything).Return(nil, nil)
+	suite.api.On("DeleteTreeq", fsID, int64(1)).Return(nil, nil)
+	suite.api.On("DeleteExportPath", int64(1)).Return(nil, nil)
+	suite.api.On("DeleteFileSystem", fsID).Return(nil, nil)
+
+	service := FilesystemService{cs: *suite.cs}
+	configMap := make(map[string]string)
+	configMap["network_space"] = "networkspace"
+	configMap["fs_prefix"] = "csit_"
+	configMap["nfs_export_permissions"] = "[{'access':'RW','client':'192.168.147.190-192.168.147.199','no_root_squash':false}]"
+
+	_, err := service.CreateTreeqVolume(configMap, 1000, "csi-TestTreeq")
+	assert.NotNil(suite.T(), err, c.name)
+	undo := map[string][]interface{}{
+		"treeq":      {"DeleteTreeq", fsID, int64(1)},
+		"count":      {"AttachMetadataToObject", fsID, map[string]interface{}{TREEQCOUNT: 1}},
+		"size":       {"UpdateFilesystem", fsID, api.FileSystem{Size: 10000}},
+		"export":     {"DeleteExportPath", int64(1)},
+		"filesystem": {"DeleteFileSystem", fsID},
+	}
+	for _, d := range c.deleted {
+		suite.api.AssertCalled(suite.T(), undo[d][0].(string), undo[d][1:]...)
+	}
+	for _, r := range c.retained {
+		suite.api.AssertNotCalled(suite.T(), undo[r][0].(string), undo[r][1:]...)
+	}
+}
+
+func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_NewFileSystem_Rollback() {
+	cases := []treeqRollbackCase{
+		{name: "export fails", fail: "export", deleted: []string{"filesystem"}, retained: []string{"export", "treeq"}},
+		{name: "metadata fails", fail: "metadata", deleted: []string{"export", "filesystem"}, retained: []string{"treeq"}},
+		{name: "treeq fails", fail: "treeq", deleted: []string{"export", "filesystem"}, retained: []string{"treeq"}},
+		{name: "count fails", fail: "count", deleted: []string{"treeq", "export", "filesystem"}},
+	}
+	for _, c := range cases {
+		suite.runTreeqRollback(c, false)
+	}
+}
+
+func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_ReusedFileSystem_Rollback() {
+	cases := []treeqRollbackCase{
+		{name: "treeq fails", fail: "treeq", retained: []string{"treeq", "count", "filesystem"}},
+		{name: "count fails", fail: "count", deleted: []string{"treeq"}, retained: []string{"count", "filesystem"}},
+		{name: "size fails", fail: "size", deleted: []string{"count", "treeq"}, retained: []string{"size", "filesystem", "export"}},
+	}
+	for _, c := range cases {
+		suite.runTreeqRollback(c, true)
+	}
+}
+
 func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_FileSystemCount_Error() {
 	var fsMetada api.FSMetadata
 	var poolID int64 = 10
@@ -404,9 +499,11 @@ func (suite *FileSystemServiceSuite) Test_DeleteTreeqVolume_DeleteTreeq_success(
 	suite.api.On("GetFilesytemTreeqCount", fsID).Return(10, nil)
 	suite.api.On("AttachMetadataToObject", fsID, mock.Anything).Return(nil, nil)
 	suite.api.On("DeleteTreeq", fsID, treeqID).Return(nil, nil)
+	suite.api.On("DetachMetadataKeyFromObject", fsID, mock.Anything).Return(nil, nil)
 	service := FilesystemService{cs: *suite.cs}
 	err := service.DeleteTreeqVolume(fsID, treeqID)
 	assert.Nil(suite.T(), err, "empty object")
+	suite.api.AssertCalled(suite.T(), "DetachMetadataKeyFromObject", fsID, "host.k8s.treeq.10.pvcname")
 }
 
 func (suite *FileSystemServiceSuite) Test_DeleteTreeqVolume_DeleteTreeq_Error() {
@@ -614,12 +711,13 @@ func (suite *FileSystemServiceSuite) Test_IsTreeqAlreadyExist_GetExportByFileSys
 
 //*****Test case Data Generation
 
-func getExportResponse() *[]api.ExportResponse {
+func getExportResponse() []api.ExportResponse {
 	exportRespArry := []api.ExportResponse{}
 
 	exportResp := api.ExportResponse{}
 	exportResp.ExportPath = "/exportPath"
-	return &exportRespArry
+	exportRespArry = append(exportRespArry, exportResp)
+	return exportRespArry
 }
 func getMetadaResponse() *[]api.Metadata {
 	metadataArry := []api.Metadata{}
@@ -677,3 +775,12 @@ func getfsMetadata2() *api.FSMetadata {
 	fsMetadata.FileSystemArry = fsArry
 	return &fsMetadata
 }
+
+func (suite *FileSystemServiceSuite) Test_getTreeqMetadata() {
+	parameters := map[string]string{ParameterPVCName: "data", ParameterPVCNamespace: "tenant1"}
+	metadata := suite.cs.getTreeqMetadata(5, "pvc-1234", parameters)
+	assert.Equal(suite.T(), "pvc-1234", metadata["host.k8s.treeq.5.pvname"])
+	assert.Equal(suite.T(), "data", metadata["host.k8s.treeq.5.pvcname"])
+	assert.Equal(suite.T(), "tenant1", metadata["host.k8s.treeq.5.pvcnamespace"])
+	assert.Equal(suite.T(), 3, len(metadata), "pvc uid is not available outside cluster")
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper/csiid"
 	"testing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -60,7 +61,7 @@ func (suite *ISCSIControllerSuite) Test_CreateVolume_GetVolumeCapabilities_Mode_
 
 	capa := csi.VolumeCapability{
 		AccessMode: &csi.VolumeCapability_AccessMode{
-			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
 		},
 	}
 	var arr []*csi.VolumeCapability
@@ -125,6 +126,46 @@ func (suite *ISCSIControllerSuite) Test_CreateVolume_CreateVolume_success() {
 	assert.Nil(suite.T(), err )
 }
 
+func (suite *ISCSIControllerSuite) Test_CreateVolume_ArraySerial() {
+	suite.cs.arraySerial = "2810"
+	service := iscsistorage{cs: *suite.cs}
+	parameterMap := getISCSICreateVolumeParamter()
+	crtValReq := getISCSICreateValumeRequest("PVName", parameterMap)
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+	suite.api.On("CreateVolume", mock.Anything, mock.Anything).Return(getVolume(), nil)
+	suite.api.On("GetVolume", mock.Anything).Return(getVolume(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, nil)
+
+	resp, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err)
+	volID, err := csiid.Parse(resp.Volume.VolumeId)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "2810", volID.ArraySerial, "volume ID carries array serial")
+	assert.Equal(suite.T(), ISCSI, volID.Protocol)
+}
+
+func (suite *ISCSIControllerSuite) Test_CreateVolume_CreateVolume_PVCMetadata() {
+	service := iscsistorage{cs: *suite.cs}
+	parameterMap := getISCSICreateVolumeParamter()
+	parameterMap[ParameterPVCName] = "data"
+	parameterMap[ParameterPVCNamespace] = "tenant1"
+	parameterMap[ParameterPVName] = "pvc-1234"
+	crtValReq := getISCSICreateValumeRequest("PVName", parameterMap)
+
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+	suite.api.On("CreateVolume", mock.Anything, mock.Anything).Return(getVolume(), nil)
+	suite.api.On("GetVolume", mock.Anything).Return(getVolume(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "extra create metadata parameters should pass validation")
+	suite.api.AssertCalled(suite.T(), "AttachMetadataToObject", mock.Anything, mock.MatchedBy(func(metadata map[string]interface{}) bool {
+		return metadata[MetadataPVCName] == "data" && metadata[MetadataPVCNamespace] == "tenant1" && metadata[MetadataPVName] == "pvc-1234"
+	}))
+}
+
 
 func (suite *ISCSIControllerSuite) Test_CreateVolume_CreateVolume_metadataError() {
 	service := iscsistorage{cs: *suite.cs}
@@ -235,6 +276,48 @@ func (suite *ISCSIControllerSuite) Test_CreateVolume_CreateVolume_content_succes
 }
 
 
+func (suite *ISCSIControllerSuite) Test_CreateVolume_content_ReadOnlyMany() {
+	service := iscsistorage{cs: *suite.cs}
+	crtValReq := getISCSICreateVolumeCloneRequest(getISCSICreateVolumeParamter())
+	crtValReq.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "1$$iscsi"}},
+	}
+	crtValReq.VolumeCapabilities = []*csi.VolumeCapability{
+		{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY}},
+	}
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+	suite.api.On("GetVolume", mock.Anything).Return(getVolume(), nil)
+	var poolID int64 = 10
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(poolID, nil)
+	suite.api.On("CreateSnapshotVolume", mock.Anything).Return(getSnapshotResp(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, nil)
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err)
+	suite.api.AssertCalled(suite.T(), "CreateSnapshotVolume", mock.MatchedBy(func(param *api.VolumeSnapshot) bool {
+		return param.WriteProtected
+	}))
+}
+
+func (suite *ISCSIControllerSuite) Test_CreateVolume_content_ReaderAndWriter() {
+	service := iscsistorage{cs: *suite.cs}
+	crtValReq := getISCSICreateVolumeCloneRequest(getISCSICreateVolumeParamter())
+	crtValReq.VolumeCapabilities = append(crtValReq.VolumeCapabilities,
+		&csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY}})
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+	suite.api.On("GetVolume", mock.Anything).Return(getVolume(), nil)
+	var poolID int64 = 10
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(poolID, nil)
+	suite.api.On("CreateSnapshotVolume", mock.Anything).Return(getSnapshotResp(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, nil)
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err)
+	suite.api.AssertCalled(suite.T(), "CreateSnapshotVolume", mock.MatchedBy(func(param *api.VolumeSnapshot) bool {
+		return !param.WriteProtected
+	}))
+}
+
 func (suite *ISCSIControllerSuite) Test_CreateVolume_CreateVolume_content_AttachMetadataToObject_err() {
 	service := iscsistorage{cs: *suite.cs}
 	parameterMap := getISCSICreateVolumeParamter()
@@ -262,8 +345,12 @@ func (suite *ISCSIControllerSuite) Test_ControllerPublishVolume() {
 	suite.api.On("GetHostByName", mock.Anything).Return(getHostByName(), nil)
 	suite.api.On("GetAllLunByHost", mock.Anything).Return(getLunInfoArry(), nil)	
 	suite.api.On("MapVolumeToHost", mock.Anything).Return(getLunInf(), nil)		
-	_, err := service.ControllerPublishVolume(context.Background(), ctrPublishValReq)
+	volume := getVolume()
+	volume.Serial = "742B0F000004E2B0000000000001A2B"
+	suite.api.On("GetVolume", 1).Return(volume, nil)
+	resp, err := service.ControllerPublishVolume(context.Background(), ctrPublishValReq)
 	assert.Nil(suite.T(), err, "fail to control publish for iscsi protocol")
+	assert.Equal(suite.T(), "6742b0f000004e2b0000000000001a2b", resp.GetPublishContext()["wwid"], "publish context carries volume WWID")
 }
 
 func (suite *ISCSIControllerSuite) Test_ControllerPublishVolume_storageClassError() {
@@ -358,9 +445,13 @@ func (suite *ISCSIControllerSuite) Test_CreateSnapshot() {
 	ctrUnPublishValReq := getISCSICreateSnapshotRequest()	
 	suite.api.On("GetVolumeByName", mock.Anything).Return(getVolume(), nil)
 	suite.api.On("CreateSnapshotVolume", mock.Anything).Return(getSnapshotResp(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, nil)
 	
 		_, err := service.CreateSnapshot(context.Background(), ctrUnPublishValReq)
 	assert.Nil(suite.T(), err, "Error should be notnil")
+	suite.api.AssertCalled(suite.T(), "AttachMetadataToObject", mock.Anything, mock.MatchedBy(func(metadata map[string]interface{}) bool {
+		return metadata[MetadataSourceVolumeID] != nil && metadata[MetadataSnapshotName] != nil
+	}))
 }
 
 func (suite *ISCSIControllerSuite) Test_CreateSnapshot_already_Created() {
@@ -435,7 +526,7 @@ func (suite *ISCSIControllerSuite) Test_GetCapacity(){
 
 func getISCSIExpandVolumeRequest() *csi.ControllerExpandVolumeRequest {
 	return &csi.ControllerExpandVolumeRequest{
-		VolumeId: "1",
+		VolumeId: "1$$iscsi",
 	}
 }
 
@@ -515,7 +606,7 @@ func getVolumeArray()[]api.Volume{
 
 func getISCSIDeleteRequest()*csi.DeleteVolumeRequest{
 	return &csi.DeleteVolumeRequest{
-		VolumeId:"103",
+		VolumeId:"103$$iscsi",
 	}
 }
 
@@ -12,21 +12,22 @@ package storage
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"infinibox-csi-driver/helper/driverconfig"
+	"infinibox-csi-driver/helper/hostexec"
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -55,6 +56,7 @@ type iscsiDisk struct {
 	Portals        []string
 	Iqn            string
 	lun            string
+	wwid           string
 	Iface          string
 	chap_discovery bool
 	chap_session   bool
@@ -87,7 +89,7 @@ type StatFunc func(string) (os.FileInfo, error)
 type GlobFunc func(string) ([]string, error)
 
 func (iscsi *iscsistorage) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	log.Debugf("NodePublishVolume called")
+	log.FromContext(ctx).Debugf("NodePublishVolume called")
 	iscsiInfo, err := iscsi.getISCSIInfo(req)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
@@ -135,32 +137,32 @@ func (iscsi *iscsistorage) NodeStageVolume(ctx context.Context, req *csi.NodeSta
 			err = errors.New("Recovered from ISCSI NodeStageVolume  " + fmt.Sprint(res))
 		}
 	}()
-	log.Info("NodeStageVolume called with ", req.GetPublishContext())
+	log.FromContext(ctx).Info("NodeStageVolume called with ", req.GetPublishContext())
 	hostID := req.GetPublishContext()["hostID"]
 	ports := req.GetPublishContext()["hostPorts"]
 	hostSecurity := req.GetPublishContext()["securityMethod"]
 	useChap := req.GetVolumeContext()["useCHAP"]
 	hstID, _ := strconv.Atoi(hostID)
-	log.Debugf("publishing volume to host id is %s", hostID)
+	log.FromContext(ctx).Debugf("publishing volume to host id is %s", hostID)
 	//validate host exists
 	if hstID < 1 {
-		log.Errorf("hostID %d is not valid host ID", hstID)
+		log.FromContext(ctx).Errorf("hostID %d is not valid host ID", hstID)
 		return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, "not a valid host")
 	}
 	initiatorName := getInitiatorName()
 	if initiatorName == "" {
-		log.Error("initiator name not found")
+		log.FromContext(ctx).Error("initiator name not found")
 		return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, "Inititator name not found")
 	}
 	if !strings.Contains(ports, initiatorName) {
-		log.Debug("host port is not created, creating one")
+		log.FromContext(ctx).Debug("host port is not created, creating one")
 		err = iscsi.cs.AddPortForHost(hstID, "ISCSI", initiatorName)
 		if err != nil {
-			log.Errorf("error creating host port %v", err)
+			log.FromContext(ctx).Errorf("error creating host port %v", err)
 			return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, err.Error())
 		}
 	}
-	log.Debugf("setup chap auth as %s", useChap)
+	log.FromContext(ctx).Debugf("setup chap auth as %s", useChap)
 	if strings.ToLower(hostSecurity) != useChap || !strings.Contains(ports, initiatorName) {
 		secrets := req.GetSecrets()
 		chapCreds := make(map[string]string)
@@ -184,14 +186,14 @@ func (iscsi *iscsistorage) NodeStageVolume(ctx context.Context, req *csi.NodeSta
 				}
 			}
 			if len(chapCreds) > 1 {
-				log.Debugf("create chap authentication for host %d", hstID)
+				log.FromContext(ctx).Debugf("create chap authentication for host %d", hstID)
 				err := iscsi.cs.AddChapSecurityForHost(hstID, chapCreds)
 				if err != nil {
 					return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, err.Error())
 				}
 			}
 		} else if hostSecurity != "NONE" {
-			log.Debugf("remove chap authentication for host %d", hstID)
+			log.FromContext(ctx).Debugf("remove chap authentication for host %d", hstID)
 			chapCreds["security_method"] = "NONE"
 			err := iscsi.cs.AddChapSecurityForHost(hstID, chapCreds)
 			if err != nil {
@@ -199,11 +201,11 @@ func (iscsi *iscsistorage) NodeStageVolume(ctx context.Context, req *csi.NodeSta
 			}
 		}
 	}
-	log.Debug("NodeStageVolume completed")
+	log.FromContext(ctx).Debug("NodeStageVolume completed")
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 func (iscsi *iscsistorage) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (res *csi.NodeUnstageVolumeResponse, err error) {
-	log.Info("Called ISCSI NodeUnstageVolume")
+	log.FromContext(ctx).Info("Called ISCSI NodeUnstageVolume")
 	defer func() {
 		if res := recover(); res != nil && err == nil {
 			err = errors.New("Recovered from ISCSI NodeUnstageVolume  " + fmt.Sprint(res))
@@ -221,27 +223,37 @@ func (iscsi *iscsistorage) NodeUnstageVolume(ctx context.Context, req *csi.NodeU
 		bkpPortal, iqn, iface, volName, initiatorName, mpathDevice = diskUnmounter.iscsiDisk.Portals, diskUnmounter.iscsiDisk.Iqn, diskUnmounter.iscsiDisk.Iface,
 			diskUnmounter.iscsiDisk.VolName, diskUnmounter.iscsiDisk.InitiatorName, diskUnmounter.iscsiDisk.MpathDevice
 	} else {
-		confFile := path.Join("/host", stagePath, diskUnmounter.iscsiDisk.VolName+".json")
-		log.Debug("check if iscsi config file exists")
+		confFile := path.Join(stagePath, diskUnmounter.iscsiDisk.VolName+".json")
+		log.FromContext(ctx).Debug("check if iscsi config file exists")
 		pathExist, pathErr := iscsi.cs.pathExists(confFile)
 		if pathErr == nil {
 			if !pathExist {
-				log.Debug("iscsi config file is not exists")
-				if err := os.RemoveAll(stagePath); err != nil {
-					log.Errorf("iscsi: failed to remove mount path Error: %v", err)
+				log.FromContext(ctx).Debug("iscsi config file is not exists")
+				if err := hostexec.Get().RemoveAll(stagePath); err != nil {
+					log.FromContext(ctx).Errorf("iscsi: failed to remove mount path Error: %v", err)
 					return nil, err
 				}
-				log.Debug("removed stage path: ", stagePath)
+				log.FromContext(ctx).Debug("removed stage path: ", stagePath)
+				removeStageRecord(stagePath)
 				return &csi.NodeUnstageVolumeResponse{}, nil
 			}
 		}
-		log.Warnf("iscsi detach disk: failed to get iscsi config from path %s Error: %v", stagePath, err)
+		log.FromContext(ctx).Warnf("iscsi detach disk: failed to get iscsi config from path %s Error: %v", stagePath, err)
 		diskConfigFound = false
 	}
 
+	// devices are removed while their sessions are still logged in, so the multipath map can be flushed
+	if mpathDevice != "" {
+		if err := iscsi.cs.newDeviceTeardown().remove(mpathDevice); err != nil {
+			log.FromContext(ctx).Errorf("iscsi: failed to remove device %s of volume %s: %v", mpathDevice, volName, err)
+			return res, err
+		}
+		log.FromContext(ctx).Debug("Removed multipath sucessfully!")
+	}
+
 	if diskConfigFound {
 		// disconnecting iscsi session
-		log.Debugf("logout session for initiatorName %s, iqn %s, volume id %s", initiatorName, iqn, volName)
+		log.FromContext(ctx).Debugf("logout session for initiatorName %s, iqn %s, volume id %s", initiatorName, iqn, volName)
 		portals := iscsi.removeDuplicate(bkpPortal)
 		if len(portals) == 0 {
 			return res, fmt.Errorf("iscsi detach disk: failed to detach iscsi disk, Couldn't get connected portals from configurations")
@@ -256,12 +268,12 @@ func (iscsi *iscsistorage) NodeUnstageVolume(ctx context.Context, req *csi.NodeU
 			}
 			out, err := diskUnmounter.exec.Run("iscsiadm", logoutArgs...)
 			if err != nil {
-				log.Errorf("iscsi: failed to detach disk Error: %s", string(out))
+				log.FromContext(ctx).Errorf("iscsi: failed to detach disk Error: %s", string(out))
 			}
 			// Delete the node record
 			out, err = diskUnmounter.exec.Run("iscsiadm", deleteArgs...)
 			if err != nil {
-				log.Errorf("iscsi: failed to delete node record Error: %s", string(out))
+				log.FromContext(ctx).Errorf("iscsi: failed to delete node record Error: %s", string(out))
 			}
 		}
 
@@ -269,71 +281,29 @@ func (iscsi *iscsistorage) NodeUnstageVolume(ctx context.Context, req *csi.NodeU
 		// If the iface is not created via iscsi plugin, skip to delete
 		for _, portal := range portals {
 			if initiatorName != "" && found && iface == (portal+":"+volName) {
-				log.Debugf("Delete the iface %s", iface)
+				log.FromContext(ctx).Debugf("Delete the iface %s", iface)
 				deleteArgs := []string{"-m", "iface", "-I", iface, "-o", "delete"}
 				out, err := diskUnmounter.exec.Run("iscsiadm", deleteArgs...)
 				if err != nil {
-					log.Errorf("iscsi: failed to delete iface Error: %s", string(out))
+					log.FromContext(ctx).Errorf("iscsi: failed to delete iface Error: %s", string(out))
 				}
 				break
 			}
 		}
-		log.Debug("Detach Disk Successfully!")
+		log.FromContext(ctx).Debug("Detach Disk Successfully!")
 
 		// rescan disks
-		log.Debug("rescan sessions to discover newly mapped LUNs")
+		log.FromContext(ctx).Debug("rescan sessions to discover newly mapped LUNs")
 		for _, portal := range portals {
 			diskUnmounter.exec.Run("iscsiadm", "-m", "node", "-p", portal, "-T", iqn, "-R")
 		}
-		log.Debug("Rescan Disk Successfully!")
-	}
-	// remove multipath
-	var devices []string
-	multiPath := false
-	dstPath := mpathDevice
-	if dstPath != "" {
-		if strings.HasPrefix(dstPath, "/host") {
-			dstPath = strings.Replace(dstPath, "/host", "", 1)
-		}
-
-		log.Debugf("remove multipath device %s", dstPath)
-		if strings.HasPrefix(dstPath, "/dev/dm-") {
-			multiPath = true
-			devices = findSlaveDevicesOnMultipath(dstPath)
-		} else {
-			// Add single targetPath to devices
-			devices = append(devices, dstPath)
-		}
-		var lastErr error
-		for _, device := range devices {
-			err := detachDisk(device)
-			if err != nil {
-				log.Errorf("iscsi: detachFCDisk failed. device: %v err: %v", device, err)
-				lastErr = fmt.Errorf("iscsi: detachFCDisk failed. device: %v err: %v", device, err)
-			}
-		}
-		if lastErr != nil {
-			log.Errorf("iscsi: last error occurred during detach disk:\n%v", lastErr)
-			return res, lastErr
-		}
-		if multiPath {
-			log.Debug("flush multipath device using multipath -f ", dstPath)
-			_, err := iscsi.cs.ExecuteWithTimeout(4000, "multipath", []string{"-f", dstPath})
-			if err != nil {
-				if _, e := os.Stat("/host" + dstPath); os.IsNotExist(e) {
-					log.Debugf("multipath device %s deleted", dstPath)
-				} else {
-					log.Errorf("multipath -f %s failed to device with error %v", dstPath, err.Error())
-					return res, err
-				}
-			}
-		}
-		log.Debug("Removed multipath sucessfully!")
+		log.FromContext(ctx).Debug("Rescan Disk Successfully!")
 	}
-	if err := os.RemoveAll("/host" + stagePath); err != nil {
-		log.Errorf("iscsi: failed to remove mount path Error: %v", err)
+	if err := hostexec.Get().RemoveAll(stagePath); err != nil {
+		log.FromContext(ctx).Errorf("iscsi: failed to remove mount path Error: %v", err)
 		return nil, err
 	}
+	removeStageRecord(stagePath)
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
@@ -379,6 +349,9 @@ func (iscsi *iscsistorage) AttachDisk(b iscsiDiskMounter) (mntPath string, err e
 	var devicePaths []string
 	var iscsiTransport string
 	var lastErr error
+	// with the volume WWID devices are found once every portal has a session, instead of by LUN per portal
+	sessions := 0
+	attachTimeout := driverconfig.Get().Timeouts.DeviceAttach.Duration
 
 	log.Info("Called AttachDisk")
 	log.WithFields(log.Fields{"iqn": b.iscsiDisk.Iqn, "lun": b.iscsiDisk.lun,
@@ -427,6 +400,10 @@ func (iscsi *iscsistorage) AttachDisk(b iscsiDiskMounter) (mntPath string, err e
 		out, err := b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-T", b.Iqn, "-R")
 		if err != nil {
 			log.Errorf("iscsi: failed to rescan session with error: %s (%v)", string(out), err)
+		} else if b.wwid != "" {
+			log.Debugf("iscsi: session to portal %s exists", tp)
+			sessions++
+			continue
 		}
 
 		if iscsiTransport == "" {
@@ -434,12 +411,12 @@ func (iscsi *iscsistorage) AttachDisk(b iscsiDiskMounter) (mntPath string, err e
 			return "", fmt.Errorf("Could not parse iface file for %s", b.Iface)
 		}
 		if iscsiTransport == "tcp" {
-			devicePath = strings.Join([]string{"/host/dev/disk/by-path/ip", tp, "iscsi", b.Iqn, "lun", b.lun}, "-")
+			devicePath = strings.Join([]string{hostPath("/dev/disk/by-path/ip"), tp, "iscsi", b.Iqn, "lun", b.lun}, "-")
 		} else {
-			devicePath = strings.Join([]string{"/host/dev/disk/by-path/pci", "*", "ip", tp, "iscsi", b.Iqn, "lun", b.lun}, "-")
+			devicePath = strings.Join([]string{hostPath("/dev/disk/by-path/pci"), "*", "ip", tp, "iscsi", b.Iqn, "lun", b.lun}, "-")
 		}
 
-		if exist := iscsi.waitForPathToExist(&devicePath, 1, iscsiTransport); exist {
+		if b.wwid == "" && iscsi.waitForPathToExist(&devicePath, 1, iscsiTransport) {
 			log.Infof("iscsi: devicepath (%s) exists", devicePath)
 			devicePaths = append(devicePaths, devicePath)
 			continue
@@ -473,22 +450,39 @@ func (iscsi *iscsistorage) AttachDisk(b iscsiDiskMounter) (mntPath string, err e
 		log.Debug(" login to iscsi target")
 		// login to iscsi target
 		out, err = b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-T", b.Iqn, "-I", b.Iface, "--login")
+		metrics.IscsiLogin(err)
 		if err != nil {
 			// delete the node record from database
 			b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-I", b.Iface, "-T", b.Iqn, "-o", "delete")
 			lastErr = fmt.Errorf("iscsi: failed to attach disk: Error: %s (%v)", string(out), err)
 			continue
 		}
-		if exist := iscsi.waitForPathToExist(&devicePath, 10, iscsiTransport); !exist {
-			log.Errorf("Could not attach disk: Timeout after 10s")
+		if b.wwid != "" {
+			sessions++
+			continue
+		}
+		if exist := iscsi.waitForPathToExist(&devicePath, int(attachTimeout/time.Second), iscsiTransport); !exist {
+			log.Errorf("Could not attach disk: Timeout after %v", attachTimeout)
 			// update last error
-			lastErr = fmt.Errorf("Could not attach disk: Timeout after 10s")
+			lastErr = fmt.Errorf("Could not attach disk: Timeout after %v", attachTimeout)
 			continue
 		} else {
 			devicePaths = append(devicePaths, devicePath)
 		}
 	}
 
+	if sessions > 0 {
+		rescan := func() { b.exec.Run("iscsiadm", "-m", "node", "-T", b.Iqn, "-R") }
+		if device, err := newBlockDevices().wait(b.wwid, attachTimeout, rescan); err != nil {
+			lastErr = err
+		} else {
+			devicePaths = append(devicePaths, device)
+			if strings.HasPrefix(device, "/dev/dm-") {
+				b.iscsiDisk.MpathDevice = device
+			}
+		}
+	}
+
 	if len(devicePaths) == 0 {
 		// delete cloned iface
 		log.Debug(" device path not found, deleting iface")
@@ -514,7 +508,7 @@ func (iscsi *iscsistorage) AttachDisk(b iscsiDiskMounter) (mntPath string, err e
 	}
 
 	for _, path := range devicePaths {
-		if path == "" {
+		if path == "" || b.wwid != "" {
 			continue
 		}
 		// check if the dev is using mpio and if so mount it via the dm-XX device
@@ -527,24 +521,27 @@ func (iscsi *iscsistorage) AttachDisk(b iscsiDiskMounter) (mntPath string, err e
 
 	if b.isBlock {
 		log.Debugf("Block volume will be mount at file %s", b.targetPath)
-		if b.readOnly {
-			return "", status.Error(codes.Internal, "Read only is not supported for Block Volume")
-		}
 
-		if err := os.MkdirAll(filepath.Dir(b.targetPath), 0750); err != nil {
+		if err := hostexec.Get().MkdirAll(filepath.Dir(b.targetPath), 0750); err != nil {
 			log.Errorf("iscsi: failed to mkdir %s, error", filepath.Dir(b.targetPath))
 			return "", err
 		}
 
-		_, err = os.Create("/host/" + b.targetPath)
+		err = hostexec.Get().WriteFile(b.targetPath, nil, 0640)
 		if err != nil {
 			log.Errorf("failed to create target file %q: %v", b.targetPath, err)
 			return "", fmt.Errorf("failed to create target file for raw block bind mount: %v", err)
 		}
-		devicePath = strings.Replace(devicePath, "/host", "", 1)
+		devicePath = fromHost(devicePath)
 		options := []string{"bind"}
-		options = append(options, "rw")
+		if b.readOnly {
+			// device opened for writing through a read only bind mount fails with EROFS
+			options = append(options, "ro")
+		} else {
+			options = append(options, "rw")
+		}
 		if err := b.mounter.Mount(devicePath, b.targetPath, "", options); err != nil {
+			metrics.MountFailure("iscsi")
 			log.Errorf("iscsi: failed to mount iscsi volume %s [%s] to %s, error %v", devicePath, b.fsType, b.targetPath, err)
 			return "", err
 		}
@@ -556,7 +553,7 @@ func (iscsi *iscsistorage) AttachDisk(b iscsiDiskMounter) (mntPath string, err e
 		return devicePath, err
 	} else {
 		log.Debugf("mount volume to given path %s", b.targetPath)
-		if err := os.MkdirAll(mntPath, 0750); err != nil {
+		if err := hostexec.Get().MkdirAll(mntPath, 0750); err != nil {
 			log.Errorf("iscsi: failed to mkdir %s, error", mntPath)
 			return "", err
 		}
@@ -564,7 +561,7 @@ func (iscsi *iscsistorage) AttachDisk(b iscsiDiskMounter) (mntPath string, err e
 		var options []string
 
 		if b.readOnly {
-			options = append(options, "ro")
+			options = append(options, readOnlyMountOptions(b.fsType)...)
 		} else {
 			options = append(options, "rw")
 		}
@@ -572,9 +569,10 @@ func (iscsi *iscsistorage) AttachDisk(b iscsiDiskMounter) (mntPath string, err e
 
 		log.Debug("devicePath is ", devicePath)
 		log.Debug("format (if needed) and mount volume")
-		devicePath = strings.Replace(devicePath, "/host", "", 1)
+		devicePath = fromHost(devicePath)
 		err = b.mounter.FormatAndMount(devicePath, mntPath, b.fsType, options)
 		if err != nil {
+			metrics.MountFailure("iscsi")
 			log.Errorf("iscsi: failed to mount iscsi volume %s [%s] to %s, error %v", devicePath, b.fsType, mntPath, err)
 			return "", err
 		}
@@ -596,22 +594,17 @@ func (iscsi *iscsistorage) DetachDisk(c iscsiDiskUnmounter, targetPath string) (
 			err = errors.New("Recovered from ISCSI DetachDisk  " + fmt.Sprint(res))
 		}
 	}()
-	mntPath := path.Join("/host", targetPath)
 	if pathExist, pathErr := iscsi.pathExists(targetPath); pathErr != nil {
 		return fmt.Errorf("Error checking if path exists: %v", pathErr)
 	} else if !pathExist {
-		if pathExist, _ = iscsi.pathExists(mntPath); pathErr == nil {
-			if !pathExist {
-				log.Warnf("Warning: Unmount skipped because path does not exist: %v", targetPath)
-				return nil
-			}
-		}
+		log.Warnf("Warning: Unmount skipped because path does not exist: %v", targetPath)
+		return nil
 	}
 	log.Debug("unmout volume from tagetpath ", targetPath)
 	if err = c.mounter.Unmount(targetPath); err != nil {
 		if strings.Contains(err.Error(), "not mounted") {
 			log.Debug("volume not mounted removing files ", targetPath)
-			if err := os.RemoveAll(filepath.Dir(mntPath)); err != nil {
+			if err := hostexec.Get().RemoveAll(filepath.Dir(targetPath)); err != nil {
 				log.Errorf("iscsi: failed to remove mount path Error: %v", err)
 			}
 			return nil
@@ -619,7 +612,7 @@ func (iscsi *iscsistorage) DetachDisk(c iscsiDiskUnmounter, targetPath string) (
 		log.Errorf("iscsi detach disk: failed to unmount: %s\nError: %v", targetPath, err)
 		return err
 	}
-	if err := os.RemoveAll(filepath.Dir(mntPath)); err != nil {
+	if err := hostexec.Get().RemoveAll(filepath.Dir(targetPath)); err != nil {
 		log.Errorf("iscsi: failed to remove mount path Error: %v", err)
 		return err
 	}
@@ -641,17 +634,20 @@ func getInitiatorName() string {
 			err = errors.New("Recovered from ISCSI getInitiatorName  " + fmt.Sprint(res))
 		}
 	}()
-	cmd := "cat /etc/iscsi/initiatorname.iscsi | grep InitiatorName="
-	out, err := exec.Command("bash", "-c", cmd).Output()
+	out, err := hostexec.Get().ReadFile("/etc/iscsi/initiatorname.iscsi")
 	if err != nil {
 		log.Errorf("Failed to get initiator name with error %v", err)
 		return ""
 	}
-	initiatorName := string(out)
-	initiatorName = strings.TrimSuffix(initiatorName, "\n")
-	log.Debugf("host initiator name %s ", initiatorName)
-	arr := strings.Split(initiatorName, "=")
-	return arr[1]
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "InitiatorName=") {
+			initiatorName := strings.TrimSpace(strings.TrimPrefix(line, "InitiatorName="))
+			log.Debugf("host initiator name %s ", initiatorName)
+			return initiatorName
+		}
+	}
+	log.Error("Failed to get initiator name, /etc/iscsi/initiatorname.iscsi has no InitiatorName")
+	return ""
 }
 
 func (iscsi *iscsistorage) getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
@@ -682,14 +678,14 @@ func (iscsi *iscsistorage) getISCSIInfo(req *csi.NodePublishVolumeRequest) (*isc
 		}
 	}
 
-	volproto := strings.Split(req.GetVolumeId(), "$$")
-	volName := volproto[0]
+	volName := diskName(req.GetVolumeId())
 	iqn := req.GetVolumeContext()["iqn"]
 	lun := req.GetPublishContext()["lun"]
+	wwid := req.GetPublishContext()[publishContextWWID]
 	portals := req.GetVolumeContext()["portals"]
 	portalList := strings.Split(portals, ",")
 
-	if len(portalList) == 0 || iqn == "" || lun == "" {
+	if len(portalList) == 0 || iqn == "" || (lun == "" && wwid == "") {
 		return nil, fmt.Errorf("iSCSI target information is missing")
 	}
 	bkportal := []string{}
@@ -701,6 +697,7 @@ func (iscsi *iscsistorage) getISCSIInfo(req *csi.NodePublishVolumeRequest) (*isc
 		Portals:        bkportal,
 		Iqn:            iqn,
 		lun:            lun,
+		wwid:           wwid,
 		Iface:          "default",
 		chap_discovery: chapDiscovery,
 		chap_session:   chapSession,
@@ -714,10 +711,10 @@ func (iscsi *iscsistorage) getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.No
 	return &iscsiDiskMounter{
 		iscsiDisk:    iscsiInfo,
 		fsType:       fstype,
-		readOnly:     false,
+		readOnly:     readOnlyPublish(req.GetReadonly(), req.GetVolumeCapability()),
 		mountOptions: mountOptions,
-		mounter:      &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: mount.NewOsExec()},
-		exec:         mount.NewOsExec(),
+		mounter:      &mount.SafeFormatAndMount{Interface: hostMounter(iscsi.cs.ctx), Exec: hostExec(iscsi.cs.ctx)},
+		exec:         hostExec(iscsi.cs.ctx),
 		targetPath:   req.GetTargetPath(),
 		stagePath:    req.GetStagingTargetPath(),
 		deviceUtil:   util.NewDeviceHandler(util.NewIOHandler()),
@@ -725,14 +722,13 @@ func (iscsi *iscsistorage) getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.No
 }
 
 func (iscsi *iscsistorage) getISCSIDiskUnmounter(volumeID string) *iscsiDiskUnmounter {
-	volproto := strings.Split(volumeID, "$$")
-	volName := volproto[0]
+	volName := diskName(volumeID)
 	return &iscsiDiskUnmounter{
 		iscsiDisk: &iscsiDisk{
 			VolName: volName,
 		},
-		mounter: mount.New(""),
-		exec:    mount.NewOsExec(),
+		mounter: hostMounter(iscsi.cs.ctx),
+		exec:    hostExec(iscsi.cs.ctx),
 	}
 }
 
@@ -847,32 +843,17 @@ func (iscsi *iscsistorage) waitForPathToExistInternal(devicePath *string, maxRet
 }
 
 func (iscsi *iscsistorage) createISCSIConfigFile(conf iscsiDisk, mnt string) error {
-	file := path.Join("/host", mnt, conf.VolName+".json")
-	log.Debugf("persistISCSI: creating persist file at path %s", file)
-	fp, err := os.Create(file)
-	if err != nil {
-		log.Errorf("persistISCSI: failed creating persist file with error %v", err)
-		return fmt.Errorf("iscsi: create %s err %s", file, err)
-	}
-	defer fp.Close()
-	encoder := json.NewEncoder(fp)
-	if err = encoder.Encode(conf); err != nil {
+	log.Debugf("persistISCSI: creating persist file in %s", mnt)
+	if err := writeDiskConfig(conf, mnt, conf.VolName); err != nil {
 		log.Errorf("persistISCSI: failed creating persist file with error %v", err)
-		return fmt.Errorf("iscsi: encode err: %v", err)
+		return fmt.Errorf("iscsi: %v", err)
 	}
 	return nil
 }
 
 func (iscsi *iscsistorage) loadDiskInfoFromFile(conf *iscsiDisk, mnt string) error {
-	file := path.Join("/host", mnt, conf.VolName+".json")
-	fp, err := os.Open(file)
-	if err != nil {
-		return fmt.Errorf("iscsi: open %s err %s", file, err)
-	}
-	defer fp.Close()
-	decoder := json.NewDecoder(fp)
-	if err = decoder.Decode(conf); err != nil {
-		return fmt.Errorf("iscsi: decode err: %v ", err)
+	if err := readDiskConfig(conf, mnt, conf.VolName); err != nil {
+		return fmt.Errorf("iscsi: %v", err)
 	}
 	return nil
 }
@@ -895,8 +876,9 @@ func (iscsi *iscsistorage) isCorruptedMnt(err error) bool {
 
 	return underlyingError == syscall.ENOTCONN || underlyingError == syscall.ESTALE || underlyingError == syscall.EIO
 }
+//pathExists host path exists
 func (iscsi *iscsistorage) pathExists(path string) (bool, error) {
-	_, err := os.Stat(path)
+	_, err := hostexec.Get().Stat(path)
 	if err == nil {
 		log.Debug("Path exists: ", path)
 		return true, nil
@@ -1000,11 +982,17 @@ func (iscsi *iscsistorage) findMultipathDeviceForDevice(device string) string {
 		return ""
 	}
 	sysPath := "/sys/block/"
-	if dirs, err := ioutil.ReadDir(sysPath); err == nil {
-		for _, f := range dirs {
-			name := f.Name()
+	names := []string{}
+	dir, err := hostexec.Get().Open(sysPath)
+	if err == nil {
+		names, err = dir.Readdirnames(-1)
+		dir.Close()
+	}
+	if err == nil {
+		sort.Strings(names)
+		for _, name := range names {
 			if strings.HasPrefix(name, "dm-") {
-				if _, err1 := os.Lstat(sysPath + name + "/slaves/" + disk); err1 == nil {
+				if _, err1 := hostexec.Get().Stat(sysPath + name + "/slaves/" + disk); err1 == nil {
 					return "/dev/" + name
 				}
 			}
@@ -1022,7 +1010,7 @@ func findDeviceForPath(path string) (string, error) {
 	}
 	// if path /dev/hdX split into "", "dev", "hdX" then we will
 	// return just the last part
-	devicePath = strings.Replace(devicePath, "/host", "", 1)
+	devicePath = fromHost(devicePath)
 	parts := strings.Split(devicePath, "/")
 	if len(parts) == 3 && strings.HasPrefix(parts[1], "dev") {
 		return parts[2], nil
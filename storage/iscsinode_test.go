@@ -0,0 +1,97 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"errors"
+	"infinibox-csi-driver/helper/hostexec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ISCSINodeSuite struct {
+	suite.Suite
+	root     string
+	fake     *hostexec.Fake
+	previous hostexec.Executor
+}
+
+func TestISCSINodeSuite(t *testing.T) {
+	suite.Run(t, new(ISCSINodeSuite))
+}
+
+func (suite *ISCSINodeSuite) SetupTest() {
+	root, err := ioutil.TempDir("", "iscsinode")
+	suite.Require().NoError(err)
+	suite.root = root
+	suite.fake = hostexec.NewFake(root)
+	suite.previous = hostexec.Get()
+	hostexec.Set(suite.fake)
+}
+
+func (suite *ISCSINodeSuite) TearDownTest() {
+	hostexec.Set(suite.previous)
+	os.RemoveAll(suite.root)
+}
+
+func (suite *ISCSINodeSuite) writeFile(name, content string) {
+	file := filepath.Join(suite.root, name)
+	suite.Require().NoError(os.MkdirAll(filepath.Dir(file), 0755))
+	suite.Require().NoError(ioutil.WriteFile(file, []byte(content), 0644))
+}
+
+func (suite *ISCSINodeSuite) Test_getInitiatorName() {
+	assert.Equal(suite.T(), "", getInitiatorName(), "no initiatorname.iscsi on host")
+
+	suite.writeFile("etc/iscsi/initiatorname.iscsi", "## generated by open-iscsi\nInitiatorName=iqn.1993-08.org.debian:01:node1\n")
+	assert.Equal(suite.T(), "iqn.1993-08.org.debian:01:node1", getInitiatorName())
+}
+
+func (suite *ISCSINodeSuite) Test_ConfigFile() {
+	iscsi := &iscsistorage{}
+	stagePath := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"
+	suite.Require().NoError(os.MkdirAll(filepath.Join(suite.root, stagePath), 0755))
+	disk := iscsiDisk{Portals: []string{"172.20.37.54:3260"}, Iqn: "iqn.2009-11.com.infinidat:storage:infinibox-sn-1234", VolName: "pvc-1", MpathDevice: "/dev/dm-3"}
+	assert.Nil(suite.T(), iscsi.createISCSIConfigFile(disk, stagePath))
+
+	_, err := os.Stat(filepath.Join(suite.root, stagePath, "pvc-1.json"))
+	assert.Nil(suite.T(), err, "config is written on host")
+	loaded := iscsiDisk{VolName: "pvc-1"}
+	assert.Nil(suite.T(), iscsi.loadDiskInfoFromFile(&loaded, stagePath))
+	assert.Equal(suite.T(), disk, loaded)
+
+	missing := iscsiDisk{VolName: "pvc-2"}
+	assert.NotNil(suite.T(), iscsi.loadDiskInfoFromFile(&missing, stagePath))
+}
+
+func (suite *ISCSINodeSuite) Test_ExecuteWithTimeout() {
+	cs := &commonservice{ctx: context.Background()}
+	suite.fake.Expect("iscsiadm -m session", "tcp: [1] 172.20.37.54:3260,1 iqn.2009-11.com.infinidat:storage:infinibox-sn-1234 (non-flash)", nil)
+	suite.fake.Expect("iscsiadm -m node -o delete", "", errors.New("exit status 21"))
+
+	out, err := cs.ExecuteWithTimeout(1000, "iscsiadm", []string{"-m", "session"})
+	assert.Nil(suite.T(), err)
+	assert.Contains(suite.T(), string(out), "infinibox-sn-1234")
+	_, err = cs.ExecuteWithTimeout(1000, "iscsiadm", []string{"-m", "node", "-o", "delete"})
+	assert.NotNil(suite.T(), err)
+	assert.Empty(suite.T(), suite.fake.Unused())
+}
+
+func (suite *ISCSINodeSuite) Test_fromHost() {
+	assert.Equal(suite.T(), "/dev/dm-3", fromHost(filepath.Join(suite.root, "dev/dm-3")))
+	assert.Equal(suite.T(), filepath.Join(suite.root, "sys/block"), hostPath("/sys/block"))
+}
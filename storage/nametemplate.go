@@ -0,0 +1,92 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"text/template"
+
+	"infinibox-csi-driver/helper/driverconfig"
+)
+
+const (
+	//ParameterNameTemplate storage class and snapshot class parameter naming infinibox objects
+	ParameterNameTemplate = "name_template"
+
+	//maxObjectNameLength max length of infinibox volume, filesystem, treeq and snapshot name
+	maxObjectNameLength = 64
+	nameSuffixLength    = 8
+)
+
+var objectNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+//nameTemplateData placeholders available in name_template
+type nameTemplateData struct {
+	PVCNamespace string
+	PVCName      string
+	PVName       string
+	ClusterName  string
+}
+
+//getObjectName return infinibox object name for request name, rendered from name_template when given.
+//Rendered names end with suffix derived from request name, so retries of same request resolve to same object.
+func getObjectName(requestName string, parameters map[string]string) (string, error) {
+	nameTemplate := parameters[ParameterNameTemplate]
+	if nameTemplate == "" {
+		return requestName, nil
+	}
+	data := nameTemplateData{
+		PVCNamespace: parameters[ParameterPVCNamespace],
+		PVCName:      parameters[ParameterPVCName],
+		PVName:       requestName,
+		ClusterName:  getClusterName(),
+	}
+	if data.PVCName == "" {
+		data.PVCName = parameters[ParameterVolumeSnapshotName]
+		data.PVCNamespace = parameters[ParameterVolumeSnapshotNamespace]
+	}
+	return renderObjectName(nameTemplate, requestName, data)
+}
+
+func renderObjectName(nameTemplate, requestName string, data nameTemplateData) (string, error) {
+	tmpl, err := template.New(ParameterNameTemplate).Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", ParameterNameTemplate, nameTemplate, err)
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", ParameterNameTemplate, nameTemplate, err)
+	}
+	name := buf.String()
+	if name == "" {
+		return "", fmt.Errorf("%s %q rendered empty name, check csi-provisioner --extra-create-metadata is enabled", ParameterNameTemplate, nameTemplate)
+	}
+
+	sum := sha256.Sum256([]byte(requestName))
+	suffix := hex.EncodeToString(sum[:])[:nameSuffixLength]
+	if maxLength := maxObjectNameLength - len(suffix) - 1; len(name) > maxLength {
+		name = name[:maxLength]
+	}
+	name = name + "-" + suffix
+	if !objectNameRegex.MatchString(name) {
+		return "", fmt.Errorf("%s %q rendered invalid name %s, only letters, digits, '_', '-' and '.' are allowed", ParameterNameTemplate, nameTemplate, name)
+	}
+	return name, nil
+}
+
+//getClusterName return cluster name configured on driver, used by {{.ClusterName}}
+func getClusterName() string {
+	return driverconfig.Get().ClusterName
+}
@@ -0,0 +1,67 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type NameTemplateSuite struct {
+	suite.Suite
+}
+
+func TestNameTemplateSuite(t *testing.T) {
+	suite.Run(t, new(NameTemplateSuite))
+}
+
+func (suite *NameTemplateSuite) Test_getObjectName_NoTemplate() {
+	name, err := getObjectName("csi-1234567890", map[string]string{})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "csi-1234567890", name, "request name should be kept")
+}
+
+func (suite *NameTemplateSuite) Test_getObjectName_Template() {
+	parameters := map[string]string{
+		ParameterNameTemplate: "{{.PVCNamespace}}-{{.PVCName}}",
+		ParameterPVCNamespace: "tenant1",
+		ParameterPVCName:      "data",
+	}
+	name, err := getObjectName("csi-1234567890", parameters)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), strings.HasPrefix(name, "tenant1-data-"), name)
+
+	again, _ := getObjectName("csi-1234567890", parameters)
+	assert.Equal(suite.T(), name, again, "same request should render same name")
+	other, _ := getObjectName("csi-0987654321", parameters)
+	assert.NotEqual(suite.T(), name, other, "suffix should keep names unique")
+}
+
+func (suite *NameTemplateSuite) Test_getObjectName_Truncate() {
+	parameters := map[string]string{ParameterNameTemplate: strings.Repeat("a", 100) + "-{{.PVName}}"}
+	name, err := getObjectName("csi-1234567890", parameters)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), maxObjectNameLength, len(name))
+}
+
+func (suite *NameTemplateSuite) Test_getObjectName_Invalid() {
+	_, err := getObjectName("csi-1", map[string]string{ParameterNameTemplate: "{{.PVCName"})
+	assert.NotNil(suite.T(), err, "template parse error")
+	_, err = getObjectName("csi-1", map[string]string{ParameterNameTemplate: "{{.Unknown}}"})
+	assert.NotNil(suite.T(), err, "unknown placeholder")
+	_, err = getObjectName("csi-1", map[string]string{ParameterNameTemplate: "vol/{{.PVName}}"})
+	assert.NotNil(suite.T(), err, "invalid charset")
+	_, err = getObjectName("csi-1", map[string]string{ParameterNameTemplate: "{{.PVCName}}"})
+	assert.NotNil(suite.T(), err, "empty name without extra create metadata")
+}
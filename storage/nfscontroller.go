@@ -16,9 +16,13 @@ import (
 	"errors"
 	"fmt"
 	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/api/clientgo"
+	"net"
 	"strconv"
 	"strings"
 
+	"infinibox-csi-driver/helper/csiid"
+	"infinibox-csi-driver/helper/driverconfig"
 	log "infinibox-csi-driver/helper/logger"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -59,15 +63,6 @@ type infinidatVolume struct {
 	FileSystemID  int64      `json:"fileSystemID"`
 	ExportBlock   string     `json:"exportBlock"`
 }
-type MetaData struct {
-	pVName    string
-	k8sVer    string
-	namespace string
-	pvcId     string
-	pvcName   string
-	pvname    string
-}
-
 type accessType int
 
 const (
@@ -75,9 +70,6 @@ const (
 	blockAccess
 
 	//Infinibox default values
-	//Ibox max allowed filesystem
-	MaxFileSystemAllowed = 4000
-	MountOptions         = "hard,rsize=1024,wsize=1024"
 	NfsExportPermissions = "RW"
 	NoRootSquash         = true
 	NfsUnixPermissions   = "777"
@@ -106,23 +98,30 @@ func validateParameter(config map[string]string) (bool, map[string]string) {
 }
 
 func (nfs *nfsstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (csiResp *csi.CreateVolumeResponse, err error) {
-	log.Debug("Creating Volume of nfs protocol")
+	log.FromContext(ctx).Debug("Creating Volume of nfs protocol")
 	//Adding the the request parameter into Map config
 	config := req.GetParameters()
 	pvName := req.GetName()
 
-	log.Debugf("Creating fileystem %s of nfs protocol ", pvName)
+	log.FromContext(ctx).Debugf("Creating fileystem %s of nfs protocol ", pvName)
 	validationStatus, validationStatusMap := validateParameter(config)
 	if !validationStatus {
-		log.Errorf("Fail to validate parameter for nfs protocol %v ", validationStatusMap)
+		log.FromContext(ctx).Errorf("Fail to validate parameter for nfs protocol %v ", validationStatusMap)
 		return nil, status.Error(codes.InvalidArgument, "Fail to validate parameter for nfs protocol")
 	}
-	log.Debugf("fileystem %s ,parameter validation success", pvName)
+	if err = validateNFSVersion(config); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	pvName, err = getObjectName(pvName, config)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	log.FromContext(ctx).Debugf("fileystem %s ,parameter validation success", pvName)
 
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
 	if capacity < gib { //INF90
 		capacity = gib
-		log.Warnf("Volume Minimum capacity should be greater %d", gib)
+		log.FromContext(ctx).Warnf("Volume Minimum capacity should be greater %d", gib)
 	}
 
 	nfs.pVName = pvName
@@ -131,15 +130,15 @@ func (nfs *nfsstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRe
 	nfs.exportpath = "/" + pvName
 	ipAddress, err := nfs.cs.getNetworkSpaceIP(strings.Trim(config["network_space"], " "))
 	if err != nil {
-		log.Errorf("fail to get networkspace ipaddress %v", err)
+		log.FromContext(ctx).Errorf("fail to get networkspace ipaddress %v", err)
 		return nil, err
 	}
 	nfs.ipAddress = ipAddress
-	log.Debugf("getNetworkSpaceIP ipAddress %s", nfs.ipAddress)
+	log.FromContext(ctx).Debugf("getNetworkSpaceIP ipAddress %s", nfs.ipAddress)
 
 	// check if volume with given name already exists
 	volume, err := nfs.cs.api.GetFileSystemByName(pvName)
-	log.Debug("CreateVolume - GetFileSystemByName error : ", err)
+	log.FromContext(ctx).Debug("CreateVolume - GetFileSystemByName error : ", err)
 	if err != nil && !strings.EqualFold(err.Error(), "filesystem with given name not found") {
 		return &csi.CreateVolumeResponse{}, err
 	}
@@ -163,27 +162,27 @@ func (nfs *nfsstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRe
 
 	// Volume content source support Volumes and Snapshots
 	contentSource := req.GetVolumeContentSource()
-	log.Debug("content volume source is : ", contentSource)
+	log.FromContext(ctx).Debug("content volume source is : ", contentSource)
 	if contentSource != nil {
 		if contentSource.GetSnapshot() != nil {
 			snapshot := req.GetVolumeContentSource().GetSnapshot()
 			csiResp, err = nfs.createVolumeFrmPVCSource(req, capacity, config["pool_name"], snapshot.GetSnapshotId())
 			if err != nil {
-				log.Errorf("failed to create volume from snapshot with error %v", err)
+				log.FromContext(ctx).Errorf("failed to create volume from snapshot with error %v", err)
 				return &csi.CreateVolumeResponse{}, err
 			}
 		} else if contentSource.GetVolume() != nil {
 			volume := req.GetVolumeContentSource().GetVolume()
 			csiResp, err = nfs.createVolumeFrmPVCSource(req, capacity, config["pool_name"], volume.GetVolumeId())
 			if err != nil {
-				log.Errorf("failed to create volume from pvc with error %v", err)
+				log.FromContext(ctx).Errorf("failed to create volume from pvc with error %v", err)
 				return &csi.CreateVolumeResponse{}, err
 			}
 		}
 	} else {
 		csiResp, err = nfs.CreateNFSVolume(req)
 		if err != nil {
-			log.Errorf("fail to create volume %v", err)
+			log.FromContext(ctx).Errorf("fail to create volume %v", err)
 			return &csi.CreateVolumeResponse{}, err
 		}
 	}
@@ -192,70 +191,84 @@ func (nfs *nfsstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRe
 
 func (nfs *nfsstorage) createVolumeFrmPVCSource(req *csi.CreateVolumeRequest, size int64, storagePool string, volumeID string) (csiResp *csi.CreateVolumeResponse, err error) {
 	log.Info("Called createVolumeFrmPVCSource")
+	tx := newSaga("create nfs volume " + req.GetName())
 	defer func() {
 		if res := recover(); res != nil {
 			err = errors.New("error while creating volume from clone (PVC) " + fmt.Sprint(res))
 		}
+		if err != nil {
+			tx.rollback()
+		}
 	}()
-	//volume := req.GetVolumeContentSource().GetVolume()
-	name := req.GetName()
-
-	volproto, err := validateStorageType(volumeID)
-	if err != nil || volproto.VolumeID == "" {
-		return nil, errors.New("error getting volume id")
+	if err = nfs.snapshotSource(tx, req, size, storagePool, volumeID); err != nil {
+		return nil, err
+	}
+	err = nfs.createExportPathAndAddMetadata(tx)
+	if err != nil {
+		log.Errorf("fail to create export and metadata %v", err)
+		return nil, err
 	}
-	sourceVolumeID, err := strconv.ParseInt(volproto.VolumeID, 10, 64)
+	return nfs.getNfsCsiResponse(req), nil
+}
+
+//snapshotSource snapshot filesystem of volume or snapshot volumeID as the filesystem of the volume, a step of tx
+func (nfs *nfsstorage) snapshotSource(tx *saga, req *csi.CreateVolumeRequest, size int64, storagePool string, volumeID string) error {
+	name := req.GetName()
+	volproto, err := csiid.Parse(volumeID)
 	if err != nil {
-		return nil, errors.New("invalid volume id " + volproto.VolumeID)
+		return errors.New("error getting volume id")
 	}
+	sourceVolumeID := volproto.ObjectID
 	// Lookup the VolumeSource source.
 	srcfsys, err := nfs.cs.api.GetFileSystemByID(sourceVolumeID)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "volume not found: %d", sourceVolumeID)
+		return status.Errorf(codes.NotFound, "volume not found: %d", sourceVolumeID)
 	}
 
 	// Validate the size is the same.
 	if srcfsys.Size != size {
-		return nil, status.Errorf(codes.InvalidArgument,
+		return status.Errorf(codes.InvalidArgument,
 			"volume %d has not valid size %d with requested %d ",
 			sourceVolumeID, srcfsys.Size, size)
 	}
 	// Validate the storagePool is the same.
 	storagePoolID, err := nfs.cs.api.GetStoragePoolIDByName(storagePool)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal,
+		return status.Errorf(codes.Internal,
 			"error while getting storagepoolid with name %s ", storagePool)
 	}
 	if storagePoolID != srcfsys.PoolID {
-		return nil, status.Errorf(codes.InvalidArgument,
+		return status.Errorf(codes.InvalidArgument,
 			"volume storage pool is different than the requested storage pool %s", storagePool)
 	}
 
-	snapParam := &api.FileSystemSnapshot{ParentID: sourceVolumeID, SnapshotName: name, WriteProtected: false}
+	snapParam := &api.FileSystemSnapshot{ParentID: sourceVolumeID, SnapshotName: name, WriteProtected: readOnlyVolume(req.GetVolumeCapabilities())}
 	log.Info("createVolumeFrmPVCSource creating filesystem with params : ", snapParam)
 	// Create snapshot
 	snapResponse, err := nfs.cs.api.CreateFileSystemSnapshot(snapParam)
 	if err != nil {
 		log.Errorf("Failed to create snapshot: %s error: %v", snapParam.SnapshotName, err.Error())
-		return nil, status.Errorf(codes.Internal, "Failed to create snapshot: %s", err.Error())
+		return status.Errorf(codes.Internal, "Failed to create snapshot: %s", err.Error())
 	}
 	log.Info("createVolumeFrmPVCSource successfully created volume from clone with name: ", snapParam.SnapshotName)
 	nfs.fileSystemID = snapResponse.SnapshotID
-
-	err = nfs.createExportPathAndAddMetadata()
-	if err != nil {
-		log.Errorf("fail to create export and metadata %v", err)
-		return nil, err
-	}
-	return nfs.getNfsCsiResponse(req), nil
+	tx.onUndo("snapshot filesystem "+name, func() error {
+		_, err := nfs.cs.api.DeleteFileSystem(snapResponse.SnapshotID)
+		return err
+	})
+	return nil
 }
 
-//CreateNFSVolume create volumne method
+//CreateNFSVolume create volumne method, filesystem and export are removed again when a later step fails
 func (nfs *nfsstorage) CreateNFSVolume(req *csi.CreateVolumeRequest) (csiResp *csi.CreateVolumeResponse, err error) {
+	tx := newSaga("create nfs volume " + nfs.pVName)
 	defer func() {
 		if res := recover(); res != nil {
 			err = errors.New("error while creating CreateNFSVolume method " + fmt.Sprint(res))
 		}
+		if err != nil {
+			tx.rollback()
+		}
 	}()
 	validnwlist, err := nfs.cs.api.OneTimeValidation(nfs.configmap["pool_name"], nfs.configmap["network_space"])
 	if err != nil {
@@ -265,12 +278,15 @@ func (nfs *nfsstorage) CreateNFSVolume(req *csi.CreateVolumeRequest) (csiResp *c
 	nfs.configmap["network_space"] = validnwlist
 	log.Debug("networkspace validation success")
 
-	err = nfs.createFileSystem()
+	err = tx.step("filesystem "+nfs.pVName, nfs.createFileSystem, func() error {
+		_, err := nfs.cs.api.DeleteFileSystem(nfs.fileSystemID)
+		return err
+	})
 	if err != nil {
 		log.Errorf("fail to create fileSystem %v", err)
 		return nil, err
 	}
-	err = nfs.createExportPathAndAddMetadata()
+	err = nfs.createExportPathAndAddMetadata(tx)
 	if err != nil {
 		log.Errorf("fail to create export and metadata %v", err)
 		return nil, err
@@ -278,41 +294,32 @@ func (nfs *nfsstorage) CreateNFSVolume(req *csi.CreateVolumeRequest) (csiResp *c
 	return nfs.getNfsCsiResponse(req), nil
 }
 
-func (nfs *nfsstorage) createExportPathAndAddMetadata() (err error) {
+//createExportPathAndAddMetadata export filesystem and attach its metadata as steps of tx
+func (nfs *nfsstorage) createExportPathAndAddMetadata(tx *saga) (err error) {
 	defer func() {
 		if res := recover(); res != nil {
 			err = errors.New("error while export directory" + fmt.Sprint(res))
 		}
-		if err != nil && nfs.fileSystemID != 0 {
-			log.Infof("Seemes to be some problem reverting filesystem: %s", nfs.pVName)
-			nfs.cs.api.DeleteFileSystem(nfs.fileSystemID)
-		}
 	}()
 
-	err = nfs.createExportPath()
+	err = tx.step("export "+nfs.exportpath, nfs.createExportPath, func() error {
+		_, err := nfs.cs.api.DeleteExportPath(nfs.exportID)
+		return err
+	})
 	if err != nil {
 		log.Errorf("fail to export path %v", err)
 		return
 	}
 	log.Debugf("export path created for filesytem: %s", nfs.pVName)
 
-	defer func() {
-		if res := recover(); res != nil {
-			err = errors.New("error while AttachMetadata directory" + fmt.Sprint(res))
-		}
-		if err != nil && nfs.exportID != 0 {
-			log.Infoln("Seemes to be some problem reverting created export id:", nfs.exportID)
-			nfs.cs.api.DeleteExportPath(nfs.exportID)
-		}
-	}()
-	metadata := make(map[string]interface{})
-	metadata["host.k8s.pvname"] = nfs.pVName
-	metadata["host.created_by"] = nfs.cs.GetCreatedBy()
-
-	_, err = nfs.cs.api.AttachMetadataToObject(nfs.fileSystemID, metadata)
+	metadata := nfs.cs.getVolumeMetadata(nfs.pVName, nfs.configmap)
+	// metadata goes with the filesystem, it has no compensation of its own
+	err = tx.step("metadata of filesystem "+nfs.pVName, func() error {
+		_, err := nfs.cs.api.AttachMetadataToObject(nfs.fileSystemID, metadata)
+		return err
+	}, nil)
 	if err != nil {
 		log.Errorf("fail to attach metadata for fileSystem : %s", nfs.pVName)
-		log.Errorf("error to attach metadata %v", err)
 		return
 	}
 	log.Debugf("metadata attached successfully for filesystem %s", nfs.pVName)
@@ -329,6 +336,29 @@ func getPermission(permission string) ([]map[string]interface{}, error) {
 	return permissionMap, err
 }
 
+//parsePermission access, client and no_root_squash of nfs_export_permissions entry, no_root_squash may be a bool or a string
+func parsePermission(pass map[string]interface{}) (access, client string, noRootSquash bool) {
+	access, _ = pass["access"].(string)
+	if access == "" {
+		access = NfsExportPermissions
+	}
+	client, _ = pass["client"].(string)
+	switch rootsq := pass["no_root_squash"].(type) {
+	case bool:
+		noRootSquash = rootsq
+	case string:
+		var err error
+		noRootSquash, err = strconv.ParseBool(rootsq)
+		if err != nil {
+			log.Debug("fail to cast no_root_squash value in export permission . setting default value 'true' ")
+			noRootSquash = NoRootSquash
+		}
+	default:
+		noRootSquash = NoRootSquash
+	}
+	return access, client, noRootSquash
+}
+
 func (nfs *nfsstorage) createExportPath() (err error) {
 	permissionsMapArray, err := getPermission(nfs.configmap["nfs_export_permissions"])
 	if err != nil {
@@ -336,19 +366,7 @@ func (nfs *nfsstorage) createExportPath() (err error) {
 	}
 	var permissionsput []map[string]interface{}
 	for _, pass := range permissionsMapArray {
-		access := pass["access"].(string)
-		var rootsq bool
-		_, ok := pass["no_root_squash"].(string)
-		if ok {
-			rootsq, err = strconv.ParseBool(pass["no_root_squash"].(string))
-			if err != nil {
-				log.Debug("fail to cast no_root_squash value in export permission . setting default value 'true' ")
-				rootsq = true
-			}
-		} else {
-			rootsq = pass["no_root_squash"].(bool)
-		}
-		client := pass["client"].(string)
+		access, client, rootsq := parsePermission(pass)
 		permissionsput = append(permissionsput, map[string]interface{}{"access": access, "no_root_squash": rootsq, "client": client})
 	}
 	var exportFileSystem api.ExportFileSys
@@ -356,6 +374,7 @@ func (nfs *nfsstorage) createExportPath() (err error) {
 	exportFileSystem.Transport_protocols = "TCP"
 	exportFileSystem.Privileged_port = true
 	exportFileSystem.Export_path = nfs.exportpath
+	exportFileSystem.NfsVersions = exportVersions(nfs.configmap)
 	exportFileSystem.Permissionsput = append(exportFileSystem.Permissionsput, permissionsput...)
 	exportResp, err := nfs.cs.api.ExportFileSystem(exportFileSystem)
 	if err != nil {
@@ -373,8 +392,8 @@ func (nfs *nfsstorage) createFileSystem() (err error) {
 		log.Errorf("fail to get the filesystem count from Ibox %v", err)
 		return
 	}
-	if fileSystemCnt >= MaxFileSystemAllowed {
-		log.Debugf("Max filesystem allowed on Ibox %v", MaxFileSystemAllowed)
+	if maxFileSystems := driverconfig.Get().NFS.MaxFileSystems; fileSystemCnt >= maxFileSystems {
+		log.Debugf("Max filesystem allowed on Ibox %v", maxFileSystems)
 		log.Debugf("Current filesystem count on Ibox %v", fileSystemCnt)
 		log.Errorf("Ibox not allowed to create new file system")
 		err = errors.New("Ibox not allowed to create new file system")
@@ -397,6 +416,9 @@ func (nfs *nfsstorage) createFileSystem() (err error) {
 	mapRequest["ssd_enabled"] = ssd
 	mapRequest["provtype"] = strings.ToUpper(nfs.configmap["provision_type"])
 	mapRequest["size"] = nfs.capacity
+	if securityStyle := nfs.configmap["security_style"]; securityStyle != "" {
+		mapRequest["security_style"] = strings.ToUpper(securityStyle)
+	}
 	fileSystem, err := nfs.cs.api.CreateFilesystem(mapRequest)
 	if err != nil {
 		log.Errorf("fail to create filesystem %s", nfs.pVName)
@@ -409,7 +431,7 @@ func (nfs *nfsstorage) createFileSystem() (err error) {
 
 func (nfs *nfsstorage) getNfsCsiResponse(req *csi.CreateVolumeRequest) *csi.CreateVolumeResponse {
 	infinidatVol := &infinidatVolume{
-		VolID:        fmt.Sprint(nfs.fileSystemID),
+		VolID:        nfs.cs.newID(NFS, csiid.FileSystem, nfs.fileSystemID).String(),
 		VolName:      nfs.pVName,
 		VolSize:      nfs.capacity,
 		VolPath:      nfs.exportpath,
@@ -438,24 +460,23 @@ func (nfs *nfsstorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRe
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
 
-	volumeID := req.GetVolumeId()
-	volID, err := strconv.ParseInt(volumeID, 10, 64)
+	volumeID, err := csiid.Parse(req.GetVolumeId())
 	if err != nil {
-		log.Errorf("Invalid Volume ID %v", err)
+		log.FromContext(ctx).Errorf("Invalid Volume ID %v", err)
 		return nil, err
 	}
 
-	nfs.uniqueID = volID
+	nfs.uniqueID = volumeID.ObjectID
 	nfsDeleteErr := nfs.DeleteNFSVolume()
 	if nfsDeleteErr != nil {
 		if strings.Contains(nfsDeleteErr.Error(), "FILESYSTEM_NOT_FOUND") {
-			log.Error("file system already delete from infinibox")
+			log.FromContext(ctx).Error("file system already delete from infinibox")
 			return &csi.DeleteVolumeResponse{}, nil
 		}
-		log.Errorf("fail to delete NFS Volume %v", nfsDeleteErr)
+		log.FromContext(ctx).Errorf("fail to delete NFS Volume %v", nfsDeleteErr)
 		return &csi.DeleteVolumeResponse{}, nfsDeleteErr
 	}
-	log.Infof("volume %s successfully deleted", volumeID)
+	log.FromContext(ctx).Infof("volume %s successfully deleted", volumeID)
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -503,42 +524,128 @@ func (nfs *nfsstorage) DeleteNFSVolume() (err error) {
 	return
 }
 
-//ControllerPublishVolume
+//ControllerPublishVolume add export rule of every address of the node, with access and no_root_squash of its nfs_export_permissions entry.
+//Volumes published read only, or with a read only access mode, get RO rules.
 func (nfs *nfsstorage) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	exportID := req.GetVolumeContext()["exportID"]
-	access := NfsExportPermissions
-	/*noRootSquash, castErr := strconv.ParseBool(req.GetVolumeContext()["no_root_squash"])
-	if castErr != nil {
-		log.Debug("fail to cast no_root_squash .set default =true")
-		noRootSquash = true
-	}*/
-	noRootSquash := true //defautl value
-	nodeNameIP := strings.Split(req.GetNodeId(), "$$")
-	if len(nodeNameIP) != 2 {
-		return &csi.ControllerPublishVolumeResponse{}, errors.New("Node ID not found")
-	}
-	nodeIP := nodeNameIP[1]
-	eportid, _ := strconv.Atoi(exportID)
-	_, err := nfs.cs.api.AddNodeInExport(eportid, access, noRootSquash, nodeIP)
-	if err != nil {
-		log.Errorf("fail to add export rule %v", err)
-		return &csi.ControllerPublishVolumeResponse{}, status.Errorf(codes.Internal, "fail to add export rule  %s", err)
+	exportID, err := strconv.Atoi(req.GetVolumeContext()["exportID"])
+	if err != nil {
+		return &csi.ControllerPublishVolumeResponse{}, status.Errorf(codes.InvalidArgument, "invalid exportID %q of volume %s", req.GetVolumeContext()["exportID"], req.GetVolumeId())
+	}
+	addresses, err := nodeAddresses(ctx, req.GetNodeId())
+	if err != nil {
+		return &csi.ControllerPublishVolumeResponse{}, err
+	}
+	permissions, err := getPermission(req.GetVolumeContext()["nfs_export_permissions"])
+	if err != nil && req.GetVolumeContext()["nfs_export_permissions"] != "" {
+		return &csi.ControllerPublishVolumeResponse{}, status.Errorf(codes.InvalidArgument, "invalid nfs_export_permissions of volume %s: %v", req.GetVolumeId(), err)
+	}
+	for _, ip := range addresses {
+		access, noRootSquash := exportPermission(permissions, ip, readOnlyPublish(req.GetReadonly(), req.GetVolumeCapability()))
+		log.FromContext(ctx).Debugf("adding export rule %s access %s no_root_squash %t to export %d", ip, access, noRootSquash, exportID)
+		if _, err = nfs.cs.api.AddNodeInExport(exportID, access, noRootSquash, ip); err != nil {
+			log.FromContext(ctx).Errorf("fail to add export rule %s: %v", ip, err)
+			return &csi.ControllerPublishVolumeResponse{}, status.Errorf(codes.Internal, "fail to add export rule %s: %v", ip, err)
+		}
 	}
 	return &csi.ControllerPublishVolumeResponse{}, nil
 }
 
+//ControllerUnpublishVolume remove export rule of every address of the node, rules already removed are skipped
 func (nfs *nfsstorage) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	voltype := req.GetVolumeId()
-	volproto := strings.Split(voltype, "$$")
-	fileID, _ := strconv.ParseInt(volproto[0], 10, 64)
-	err := nfs.cs.api.DeleteExportRule(fileID, req.GetNodeId())
+	volproto, err := csiid.Parse(req.GetVolumeId())
 	if err != nil {
-		log.Errorf("fail to delete Export Rule fileystemID %d error %v", fileID, err)
-		return &csi.ControllerUnpublishVolumeResponse{}, status.Errorf(codes.Internal, "fail to delete Export Rule  %v", err)
+		return &csi.ControllerUnpublishVolumeResponse{}, status.Errorf(codes.InvalidArgument, "invalid volume id %s: %v", req.GetVolumeId(), err)
+	}
+	addresses, err := nodeAddresses(ctx, req.GetNodeId())
+	if err != nil {
+		return &csi.ControllerUnpublishVolumeResponse{}, err
+	}
+	fileID := volproto.ObjectID
+	failed := []string{}
+	for _, ip := range addresses {
+		if err = nfs.cs.api.DeleteExportRule(fileID, ip); err != nil {
+			log.FromContext(ctx).Errorf("fail to delete export rule %s of fileystemID %d error %v", ip, fileID, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", ip, err))
+		}
+	}
+	if len(failed) > 0 {
+		return &csi.ControllerUnpublishVolumeResponse{}, status.Errorf(codes.Internal, "fail to delete export rules %s", strings.Join(failed, ", "))
 	}
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
+//getKubeNodeAddresses addresses of kubernetes node, replaced in tests
+var getKubeNodeAddresses = func(nodeName string) ([]string, error) {
+	cl, err := clientgo.BuildClient()
+	if err != nil {
+		return nil, err
+	}
+	return cl.GetNodeAddresses(nodeName)
+}
+
+//nodeAddresses distinct addresses of node ID export rules are kept for. With nfs.kubeNodeAddresses those of the
+//kubernetes node named as the node fqdn, or its short name, are added; a node which cannot be found is logged and skipped.
+func nodeAddresses(ctx context.Context, nodeID string) ([]string, error) {
+	fqdn, ips, err := csiid.ParseNodeAddresses(nodeID)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid node id %s: %v", nodeID, err)
+	}
+	addresses := []string{}
+	add := func(address string) {
+		ip := net.ParseIP(strings.Trim(address, "[]"))
+		if ip == nil {
+			log.FromContext(ctx).Warnf("node %s address %q is not an IP address, skipped", fqdn, address)
+			return
+		}
+		for _, known := range addresses {
+			if net.ParseIP(known).Equal(ip) {
+				return
+			}
+		}
+		addresses = append(addresses, ip.String())
+	}
+	for _, ip := range ips {
+		add(ip)
+	}
+	if driverconfig.Get().NFS.KubeNodeAddresses {
+		for _, name := range []string{fqdn, strings.SplitN(fqdn, ".", 2)[0]} {
+			kubeIPs, err := getKubeNodeAddresses(name)
+			if err != nil {
+				log.FromContext(ctx).Warnf("fail to get addresses of kubernetes node %s: %v", name, err)
+				continue
+			}
+			for _, ip := range kubeIPs {
+				add(ip)
+			}
+			break
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "node id %s has no IP address", nodeID)
+	}
+	return addresses, nil
+}
+
+//exportPermission access and no_root_squash of export rule of address ip, from the first nfs_export_permissions entry
+//whose client covers ip, else from the first entry, else RW with no_root_squash. Read only publish is RO.
+func exportPermission(permissions []map[string]interface{}, ip string, readOnly bool) (access string, noRootSquash bool) {
+	access, noRootSquash = NfsExportPermissions, NoRootSquash
+	if len(permissions) > 0 {
+		permission := permissions[0]
+		for _, candidate := range permissions {
+			if client, _ := candidate["client"].(string); api.ClientMatches(client, ip) {
+				permission = candidate
+				break
+			}
+		}
+		access, _, noRootSquash = parsePermission(permission)
+	}
+	if readOnly {
+		access = "RO"
+	}
+	return access, noRootSquash
+}
+
 func (nfs *nfsstorage) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	return nil, nil
 }
@@ -565,21 +672,25 @@ func (nfs *nfsstorage) CreateSnapshot(ctx context.Context, req *csi.CreateSnapsh
 	}()
 	//var ts *timestamp.Timestamp
 	var snapshotID string
-	snapshotName := req.GetName()
-	log.Debugf("Create Snapshot of name %s", snapshotName)
-	log.Infof("Create Snapshot called with volume Id %s", req.GetSourceVolumeId())
-	volproto, err := validateStorageType(req.GetSourceVolumeId())
+	snapshotName, err := getObjectName(req.GetName(), req.GetParameters())
+	if err != nil {
+		err = status.Error(codes.InvalidArgument, err.Error())
+		return
+	}
+	log.FromContext(ctx).Debugf("Create Snapshot of name %s", snapshotName)
+	log.FromContext(ctx).Infof("Create Snapshot called with volume Id %s", req.GetSourceVolumeId())
+	volproto, err := csiid.Parse(req.GetSourceVolumeId())
 	if err != nil {
-		log.Errorf("fail to validate storage type %v", err)
+		log.FromContext(ctx).Errorf("fail to validate storage type %v", err)
 		return
 	}
 
-	sourceFilesystemID, _ := strconv.ParseInt(volproto.VolumeID, 10, 64)
+	sourceFilesystemID := volproto.ObjectID
 	snapshotArray, err := nfs.cs.api.GetSnapshotByName(snapshotName)
 	for _, snap := range *snapshotArray {
 		if snap.ParentId == sourceFilesystemID {
-			snapshotID = strconv.FormatInt(snap.SnapshotID, 10) + "$$" + volproto.StorageType
-			log.Debug("Got snapshot so returning nil")
+			snapshotID = nfs.cs.newID(volproto.Protocol, csiid.Snapshot, snap.SnapshotID).String()
+			log.FromContext(ctx).Debug("Got snapshot so returning nil")
 			return &csi.CreateSnapshotResponse{
 				Snapshot: &csi.Snapshot{
 					SizeBytes:      snap.Size,
@@ -600,11 +711,15 @@ func (nfs *nfsstorage) CreateSnapshot(ctx context.Context, req *csi.CreateSnapsh
 
 	resp, err := nfs.cs.api.CreateFileSystemSnapshot(fileSystemSnapshot)
 	if err != nil {
-		log.Errorf("Failed to create snapshot %s error %v", snapshotName, err)
+		log.FromContext(ctx).Errorf("Failed to create snapshot %s error %v", snapshotName, err)
 		return
 	}
 
-	snapshotID = strconv.FormatInt(resp.SnapshotID, 10) + "$$" + volproto.StorageType
+	snapshotMetadata := nfs.cs.getSnapshotMetadata(req.GetName(), strconv.FormatInt(volproto.ObjectID, 10), req.GetParameters())
+	if _, metadataErr := nfs.cs.api.AttachMetadataToObject(resp.SnapshotID, snapshotMetadata); metadataErr != nil {
+		log.FromContext(ctx).Warnf("fail to attach metadata for snapshot %s error %v", snapshotName, metadataErr)
+	}
+	snapshotID = nfs.cs.newID(volproto.Protocol, csiid.Snapshot, resp.SnapshotID).String()
 	snapshot := &csi.Snapshot{
 		SnapshotId:     snapshotID,
 		SourceVolumeId: req.GetSourceVolumeId(),
@@ -612,7 +727,7 @@ func (nfs *nfsstorage) CreateSnapshot(ctx context.Context, req *csi.CreateSnapsh
 		CreationTime:   ptypes.TimestampNow(),
 		SizeBytes:      resp.Size,
 	}
-	log.Debug("CreateFileSystemSnapshot resp() ", snapshot)
+	log.FromContext(ctx).Debug("CreateFileSystemSnapshot resp() ", snapshot)
 	snapshotResp := &csi.CreateSnapshotResponse{Snapshot: snapshot}
 	return snapshotResp, nil
 }
@@ -624,16 +739,20 @@ func (nfs *nfsstorage) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapsh
 		}
 	}()
 
-	snapshotID, _ := strconv.ParseInt(req.GetSnapshotId(), 10, 64)
-	nfs.uniqueID = snapshotID
+	snapshotID, err := csiid.ParseSnapshot(req.GetSnapshotId())
+	if err != nil {
+		err = status.Errorf(codes.InvalidArgument, "invalid snapshot id %s: %v", req.GetSnapshotId(), err)
+		return
+	}
+	nfs.uniqueID = snapshotID.ObjectID
 	nfsSnapDeleteErr := nfs.DeleteNFSVolume()
 	if nfsSnapDeleteErr != nil {
 		if strings.Contains(nfsSnapDeleteErr.Error(), "FILESYSTEM_NOT_FOUND") {
-			log.Error("snapshot already delete from infinibox")
+			log.FromContext(ctx).Error("snapshot already delete from infinibox")
 			deleteSnapshot = &csi.DeleteSnapshotResponse{}
 			return
 		}
-		log.Errorf("fail to delete snapshot %v", nfsSnapDeleteErr)
+		log.FromContext(ctx).Errorf("fail to delete snapshot %v", nfsSnapDeleteErr)
 		err = nfsSnapDeleteErr
 		return
 	}
@@ -648,16 +767,17 @@ func (nfs *nfsstorage) ControllerExpandVolume(ctx context.Context, req *csi.Cont
 		}
 	}()
 
-	ID, err := strconv.ParseInt(req.GetVolumeId(), 10, 64)
+	volproto, err := csiid.Parse(req.GetVolumeId())
 	if err != nil {
-		log.Errorf("Invalid Volume ID %v", err)
+		log.FromContext(ctx).Errorf("Invalid Volume ID %v", err)
 		return
 	}
+	ID := volproto.ObjectID
 
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
 	if capacity < gib {
 		capacity = gib
-		log.Warn("Volume Minimum capacity should be greater 1 GB")
+		log.FromContext(ctx).Warn("Volume Minimum capacity should be greater 1 GB")
 	}
 
 	// Expand file system size
@@ -665,10 +785,10 @@ func (nfs *nfsstorage) ControllerExpandVolume(ctx context.Context, req *csi.Cont
 	fileSys.Size = capacity
 	_, err = nfs.cs.api.UpdateFilesystem(ID, fileSys)
 	if err != nil {
-		log.Errorf("Failed to update file system %v", err)
+		log.FromContext(ctx).Errorf("Failed to update file system %v", err)
 		return
 	}
-	log.Infoln("Filesystem size updated successfully")
+	log.FromContext(ctx).Infoln("Filesystem size updated successfully")
 	return &csi.ControllerExpandVolumeResponse{
 		CapacityBytes:         capacity,
 		NodeExpansionRequired: false,
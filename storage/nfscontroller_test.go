@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper/driverconfig"
 	"testing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -36,6 +37,20 @@ func (suite *NFSControllerSuite) Test_CreateVolume_paramerValidation_Fail() {
 	assert.NotNil(suite.T(), err, "Fail to validate parameter for nfs protocol")
 }
 
+func (suite *NFSControllerSuite) Test_CreateVolume_NFSVersion_Invalid() {
+	service := nfsstorage{cs: *suite.cs}
+	for _, invalid := range []map[string]string{{NFSVersion: "4.2"}, {NConnect: "17"}, {NConnect: "two"}, {NFSVersion: "4.1", "nfs_mount_options": "hard,vers=3"}} {
+		parameterMap := getCreateVolumeParamter()
+		for key, value := range invalid {
+			parameterMap[key] = value
+		}
+		_, err := service.CreateVolume(context.Background(), getNFSCreateVolumeRequest("PVName", parameterMap))
+		assert.NotNil(suite.T(), err, "invalid %v", invalid)
+	}
+	assert.Equal(suite.T(), []string{"V4_1", "V3"}, exportVersions(map[string]string{NFSVersion: "4.1"}))
+	assert.Nil(suite.T(), exportVersions(getCreateVolumeParamter()), "array default")
+}
+
 func (suite *NFSControllerSuite) Test_CreateVolume_NetworkSpaceIP_Error() {
 	service := nfsstorage{cs: *suite.cs}
 	parameterMap := getCreateVolumeParamter()
@@ -220,8 +235,48 @@ func (suite *NFSControllerSuite) Test_CreateVolume_success() {
 
 	resp, err := service.CreateVolume(context.Background(), crtValReq)
 	assert.Nil(suite.T(), err, "fail to create the file system")
-	assert.Equal(suite.T(), resp.GetVolume().GetVolumeId(), "1", "successfully created volumne ID")
+	assert.Equal(suite.T(), resp.GetVolume().GetVolumeId(), "1$$nfs", "successfully created volumne ID")
+
+}
+
+func (suite *NFSControllerSuite) mockCreateNFSVolume(parameterMap map[string]string) {
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	suite.api.On("OneTimeValidation", mock.Anything, mock.Anything).Return("networkspace", nil)
+	suite.api.On("GetFileSystemCount").Return(40, nil)
+	suite.api.On("GetStoragePoolIDByName", parameterMap["pool_name"]).Return(100, nil)
+	suite.api.On("CreateFilesystem", mock.Anything).Return(getFileSystem(), nil)
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_createExportPath_Rollback() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	crtValReq := getNFSCreateVolumeRequest("PVName", parameterMap)
+	suite.mockCreateNFSVolume(parameterMap)
+	suite.api.On("ExportFileSystem", mock.Anything).Return(nil, errors.New("some error"))
+	suite.api.On("DeleteFileSystem", int64(1)).Return(nil, nil)
 
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.NotNil(suite.T(), err)
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystem", int64(1))
+	suite.api.AssertNotCalled(suite.T(), "DeleteExportPath", mock.Anything)
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_metadata_Rollback() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	crtValReq := getNFSCreateVolumeRequest("PVName", parameterMap)
+	suite.mockCreateNFSVolume(parameterMap)
+	suite.api.On("ExportFileSystem", mock.Anything).Return(getExportResponseValue(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, errors.New("some error"))
+	// a failing compensation does not keep the filesystem
+	suite.api.On("DeleteExportPath", int64(1)).Return(nil, errors.New("some error"))
+	suite.api.On("DeleteFileSystem", int64(1)).Return(nil, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.NotNil(suite.T(), err)
+	suite.api.AssertCalled(suite.T(), "DeleteExportPath", int64(1))
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystem", int64(1))
 }
 
 //=================================================Create Volume END=================================//
@@ -384,6 +439,32 @@ func (suite *NFSControllerSuite) Test_CreateVolume_Snapshot_metadatafailed() {
 	assert.NotNil(suite.T(), err.Error(), "fail to update metadata")
 }
 
+func (suite *NFSControllerSuite) Test_CreateVolume_Snapshot_Rollback() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	crtValReq := getCreateVolumeSnapshotRequest("PVName", parameterMap)
+	crtValReq.GetVolumeContentSource().GetSnapshot().SnapshotId = "1$$nfs"
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	fileSystem := getFileSystem()
+	fileSystem.Size = 1073741824
+	suite.api.On("GetFileSystemByID", mock.Anything).Return(fileSystem, nil)
+	var poolID int64 = 100
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(poolID, nil)
+	suite.api.On("CreateFileSystemSnapshot", mock.Anything).Return(GetFileSystemSnapshotResponce(5), nil)
+	suite.api.On("ExportFileSystem", mock.Anything).Return(getExportResponseValue(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, errors.New("some error"))
+	suite.api.On("DeleteExportPath", int64(1)).Return(nil, nil)
+	suite.api.On("DeleteFileSystem", int64(5)).Return(nil, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.NotNil(suite.T(), err)
+	suite.api.AssertCalled(suite.T(), "DeleteExportPath", int64(1))
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystem", int64(5))
+	suite.api.AssertNotCalled(suite.T(), "DeleteFileSystem", int64(1))
+}
+
 func (suite *NFSControllerSuite) Test_CreateVolume_Snapshot_Success() {
 	service := nfsstorage{cs: *suite.cs}
 	parameterMap := getCreateVolumeParamter()
@@ -496,7 +577,7 @@ func (suite *NFSControllerSuite) Test_NfsControllerExpandVolume_success() {
 func (suite *NFSControllerSuite) Test_NfsControllerExpandVolume_UpdateVolume_Error() {
 	service := nfsstorage{cs: *suite.cs}
 	expectedErr := errors.New("some error")
-	fileSystemID := "100"
+	fileSystemID := "100$$nfs"
 	suite.api.On("UpdateFilesystem", mock.Anything, mock.Anything).Return(nil, expectedErr)
 	_, err := service.ControllerExpandVolume(context.Background(), getNfsExpandVolumeRequest(fileSystemID))
 	assert.NotNil(suite.T(), err, "error expected")
@@ -504,7 +585,7 @@ func (suite *NFSControllerSuite) Test_NfsControllerExpandVolume_UpdateVolume_Err
 
 func (suite *NFSControllerSuite) Test_NfsControllerExpandVolume_success_expand() {
 	service := nfsstorage{cs: *suite.cs}
-	fileSystemID := "100"
+	fileSystemID := "100$$nfs"
 	suite.api.On("UpdateFilesystem", mock.Anything, mock.Anything).Return(nil, nil)
 	_, err := service.ControllerExpandVolume(context.Background(), getNfsExpandVolumeRequest(fileSystemID))
 	assert.Nil(suite.T(), err, "error expected")
@@ -565,9 +646,10 @@ func (suite *NFSControllerSuite) Test_NfsCreateSnapshot_CreateFileSystemS_succes
 
 	suite.api.On("GetSnapshotByName", mock.Anything).Return(fileSysSnapshotRespArry, nil)
 	suite.api.On("CreateFileSystemSnapshot", mock.Anything).Return(filesystem, nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, errors.New("some error"))
 	service := nfsstorage{cs: *suite.cs}
 	_, err := service.CreateSnapshot(context.Background(), getNfsCreateSnapshotRequest("1$$nfs"))
-	assert.Nil(suite.T(), err, "empty error")
+	assert.Nil(suite.T(), err, "snapshot metadata failure should not fail snapshot")
 }
 
 func (suite *NFSControllerSuite) Test_NfsDeleteSnapshot_SourceVolumeID_empty() {
@@ -584,7 +666,7 @@ func (suite *NFSControllerSuite) Test_NfsDeleteSnapshot_InvalidSourceVolumeID()
 	var snapshotID int64 = 1000000000000000000
 	expectedErr := errors.New("Invalid Source ID")
 	suite.api.On("GetFileSystemByID", snapshotID).Return(nil, expectedErr)
-	_, err := service.DeleteSnapshot(context.Background(), getNfsDeleteSnapshotRequest("1000000000000000000"))
+	_, err := service.DeleteSnapshot(context.Background(), getNfsDeleteSnapshotRequest("1000000000000000000$$nfs"))
 	assert.NotNil(suite.T(), err, "Invalid Snapshot ID in request")
 }
 
@@ -593,7 +675,7 @@ func (suite *NFSControllerSuite) Test_NfsDeleteSnapshot_Error() {
 	var snapshotID int64 = 100
 	expectedErr := errors.New("some error")
 	suite.api.On("GetFileSystemByID", snapshotID).Return(nil, expectedErr)
-	_, err := service.DeleteSnapshot(context.Background(), getNfsDeleteSnapshotRequest("100"))
+	_, err := service.DeleteSnapshot(context.Background(), getNfsDeleteSnapshotRequest("100$$nfs"))
 	assert.NotNil(suite.T(), err, "error expected")
 }
 
@@ -602,7 +684,7 @@ func (suite *NFSControllerSuite) Test_NfsDeleteSnapshot_file_not_found() {
 	var snapshotID int64 = 100
 	expectedErr := errors.New("FILESYSTEM_NOT_FOUND")
 	suite.api.On("GetFileSystemByID", snapshotID).Return(nil, expectedErr)
-	_, err := service.DeleteSnapshot(context.Background(), getNfsDeleteSnapshotRequest("100"))
+	_, err := service.DeleteSnapshot(context.Background(), getNfsDeleteSnapshotRequest("100$$nfs"))
 	assert.Nil(suite.T(), err, "error expected")
 }
 
@@ -762,6 +844,76 @@ func (suite *NFSControllerSuite) Test_ControllerPublishVolume_success() {
 	_, err := service.ControllerPublishVolume(context.Background(), publishValReq)
 	assert.Nil(suite.T(), err, "invalid nodeID ID")
 }
+func (suite *NFSControllerSuite) Test_ControllerPublishVolume_addresses() {
+	service := nfsstorage{cs: *suite.cs}
+	publishValReq := getNFSControllerPublishVolume()
+	publishValReq.NodeId = "worker-1$$10.20.20.51,fd00:10:0:0::51,10.20.20.51"
+	publishValReq.VolumeContext["nfs_export_permissions"] = "[{'access':'RO','client':'10.20.20.1-10.20.20.99','no_root_squash':'false'},{'access':'RW','client':'*','no_root_squash':true}]"
+	suite.api.On("AddNodeInExport", 1, "RO", false, "10.20.20.51").Return(nil, nil).Once()
+	suite.api.On("AddNodeInExport", 1, "RW", true, "fd00:10::51").Return(nil, nil).Once()
+	_, err := service.ControllerPublishVolume(context.Background(), publishValReq)
+	assert.Nil(suite.T(), err)
+	suite.api.AssertExpectations(suite.T())
+}
+
+func (suite *NFSControllerSuite) Test_ControllerPublishVolume_ReadOnly() {
+	service := nfsstorage{cs: *suite.cs}
+	publishValReq := getNFSControllerPublishVolume()
+	publishValReq.Readonly = true
+	suite.api.On("AddNodeInExport", 1, "RO", true, "10.20.20.51").Return(nil, nil).Once()
+	_, err := service.ControllerPublishVolume(context.Background(), publishValReq)
+	assert.Nil(suite.T(), err)
+	suite.api.AssertExpectations(suite.T())
+}
+
+func (suite *NFSControllerSuite) Test_ControllerPublishVolume_ReaderOnlyAccessMode() {
+	service := nfsstorage{cs: *suite.cs}
+	reader := getNFSControllerPublishVolume()
+	reader.VolumeCapability = &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY}}
+	writer := getNFSControllerPublishVolume()
+	writer.NodeId = "worker-2$$10.20.20.52"
+	writer.VolumeCapability = &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}}
+	suite.api.On("AddNodeInExport", 1, "RO", true, "10.20.20.51").Return(nil, nil).Once()
+	suite.api.On("AddNodeInExport", 1, "RW", true, "10.20.20.52").Return(nil, nil).Once()
+	_, err := service.ControllerPublishVolume(context.Background(), reader)
+	assert.Nil(suite.T(), err)
+	_, err = service.ControllerPublishVolume(context.Background(), writer)
+	assert.Nil(suite.T(), err)
+	suite.api.AssertExpectations(suite.T())
+}
+
+func (suite *NFSControllerSuite) Test_ControllerPublishVolume_NoAddress() {
+	service := nfsstorage{cs: *suite.cs}
+	publishValReq := getNFSControllerPublishVolume()
+	publishValReq.NodeId = "worker-1$$nfs"
+	_, err := service.ControllerPublishVolume(context.Background(), publishValReq)
+	assert.NotNil(suite.T(), err, "node ID without address")
+}
+
+func (suite *NFSControllerSuite) Test_ControllerUnpublishVolume_KubeNodeAddresses() {
+	previous := driverconfig.Get()
+	defer driverconfig.Apply(previous)
+	config := driverconfig.Defaults()
+	config.NFS.KubeNodeAddresses = true
+	assert.Nil(suite.T(), driverconfig.Apply(config))
+	defer func(get func(string) ([]string, error)) { getKubeNodeAddresses = get }(getKubeNodeAddresses)
+	getKubeNodeAddresses = func(nodeName string) ([]string, error) {
+		if nodeName != "worker-1" {
+			return nil, errors.New("not found")
+		}
+		return []string{"10.20.20.51", "192.168.1.51"}, nil
+	}
+
+	service := nfsstorage{cs: *suite.cs}
+	unPublishValReq := getNFSControllerUnpublishVolume()
+	unPublishValReq.NodeId = "worker-1.example.com$$10.20.20.51"
+	suite.api.On("DeleteExportRule", int64(1), "10.20.20.51").Return(nil).Once()
+	suite.api.On("DeleteExportRule", int64(1), "192.168.1.51").Return(errors.New("some Error")).Once()
+	_, err := service.ControllerUnpublishVolume(context.Background(), unPublishValReq)
+	assert.NotNil(suite.T(), err, "every address is tried, failures are reported")
+	suite.api.AssertExpectations(suite.T())
+}
+
 func (suite *NFSControllerSuite) Test_ControllerUnpublishVolume_DeleteExportRule_error() {
 	service := nfsstorage{cs: *suite.cs}
 	unPublishValReq := getNFSControllerUnpublishVolume()
@@ -785,19 +937,20 @@ func (suite *NFSControllerSuite) Test_ControllerUnpublishVolume_DeleteExportRule
 func getNFSControllerUnpublishVolume() *csi.ControllerUnpublishVolumeRequest {
 	return &csi.ControllerUnpublishVolumeRequest{
 		VolumeId: "1$$nfs",
+		NodeId:   "worker-1$$10.20.20.51",
 	}
 }
 
 func getNFSControllerPublishVolume() *csi.ControllerPublishVolumeRequest {
 	return &csi.ControllerPublishVolumeRequest{
-		VolumeId:      "1",
+		VolumeId:      "1$$nfs",
 		VolumeContext: map[string]string{"exportID": "1"},
-		NodeId:        "10.20.20.50$$nfs",
+		NodeId:        "worker-1$$10.20.20.51",
 	}
 }
 func getNFSDeletRequest() *csi.DeleteVolumeRequest {
 	return &csi.DeleteVolumeRequest{
-		VolumeId: "1",
+		VolumeId: "1$$nfs",
 	}
 }
 
@@ -13,10 +13,10 @@ package storage
 import (
 	"context"
 	"fmt"
-	"strings"
 	"time"
 
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -31,57 +31,50 @@ func (nfs *nfsstorage) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnsta
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 func (nfs *nfsstorage) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	log.Debug("NodePublishVolume")
+	log.FromContext(ctx).Debug("NodePublishVolume")
 	targetPath := req.GetTargetPath()
 	notMnt, err := nfs.mounter.IsNotMountPoint(targetPath)
 	if err != nil {
 		if nfs.osHelper.IsNotExist(err) {
 			if err := nfs.osHelper.MkdirAll(targetPath, 0750); err != nil {
-				log.Errorf("Error while mkdir %v", err)
+				log.FromContext(ctx).Errorf("Error while mkdir %v", err)
 				return nil, err
 			}
 			notMnt = true
 		} else {
-			log.Errorf("IsLikelyNotMountPint method error  %v", err)
+			log.FromContext(ctx).Errorf("IsLikelyNotMountPint method error  %v", err)
 			return nil, err
 		}
 	}
 	if !notMnt {
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
-	mountOptions := []string{}
-	configMountOptions := req.GetVolumeContext()["nfs_mount_options"]
-	if configMountOptions == "" {
-		configMountOptions = MountOptions
-	}
-	for _, option := range strings.Split(configMountOptions, ",") {
-		if option != "" {
-			mountOptions = append(mountOptions, option)
-		}
-	}
-	if req.GetReadonly() {
-		mountOptions = append(mountOptions, "ro")
-	}
+	mountOptions := nfsMountOptions(ctx, req.GetVolumeContext(), readOnlyPublish(req.GetReadonly(), req.GetVolumeCapability()))
 
-	sourceIP := req.GetVolumeContext()["ipAddress"]
+	sourceIP, err := nfs.cs.nfsMountIP(ctx, req.GetVolumeContext())
+	if err != nil {
+		metrics.MountFailure("nfs")
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
 	ep := req.GetVolumeContext()["volPathd"]
 	source := fmt.Sprintf("%s:%s", sourceIP, ep)
-	log.Debugf("Mount sourcePath %v, tagetPath %v", source, targetPath)
-	err = nfs.mounter.Mount(source, targetPath, "nfs", mountOptions)
+	log.FromContext(ctx).Debugf("Mount sourcePath %v, tagetPath %v", source, targetPath)
+	err = mountNFS(ctx, nfs.mounter, source, targetPath, mountOptions)
 	if err != nil {
-		log.Errorf("fail to mount source path '%s' : %s", source, err)
+		metrics.MountFailure("nfs")
+		log.FromContext(ctx).Errorf("fail to mount source path '%s' : %s", source, err)
 		return nil, status.Errorf(codes.Internal, "Failed to mount target path '%s': %s", targetPath, err)
 	}
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
 func (nfs *nfsstorage) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	log.Debug("NodeUnpublishVolume")
+	log.FromContext(ctx).Debug("NodeUnpublishVolume")
 	targetPath := req.GetTargetPath()
 	notMnt, err := nfs.mounter.IsNotMountPoint(targetPath)
 	if err != nil {
 		if nfs.osHelper.IsNotExist(err) {
-			log.Warnf("mount point '%s' already doesn't exist: '%s', return OK", targetPath, err)
+			log.FromContext(ctx).Warnf("mount point '%s' already doesn't exist: '%s', return OK", targetPath, err)
 			return &csi.NodeUnpublishVolumeResponse{}, nil
 		}
 		return nil, err
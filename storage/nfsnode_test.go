@@ -13,7 +13,9 @@ package storage
 import (
 	"context"
 	"errors"
+	"infinibox-csi-driver/api"
 	"infinibox-csi-driver/helper"
+	"infinibox-csi-driver/helper/driverconfig"
 	"os"
 	"testing"
 
@@ -91,6 +93,18 @@ func (suite *NodeSuite) Test_NodePublishVolume_mount_fail() {
 	assert.NotNil(suite.T(), err, " error NOT should be nil")
 }
 
+func (suite *NodeSuite) Test_NodePublishVolume_ReaderOnly() {
+	service := nfsstorage{mounter: suite.nfsMountMock}
+	suite.nfsMountMock.On("IsNotMountPoint", mock.Anything).Return(true, nil)
+	suite.nfsMountMock.On("Mount", mock.Anything, mock.Anything, mock.Anything, mock.MatchedBy(func(options []string) bool {
+		return options[len(options)-1] == "ro"
+	})).Return(nil)
+	req := getNodePublishVolumeRequest("/var/lib/kublet/", getPublishContexMap())
+	req.VolumeCapability = &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY}}
+	_, err := service.NodePublishVolume(context.Background(), req)
+	assert.Nil(suite.T(), err, "reader only access mode is mounted ro")
+}
+
 func (suite *NodeSuite) Test_NodeUnpublishVolume_MountPoint_fail() {
 	service := nfsstorage{mounter: suite.nfsMountMock, osHelper: suite.osmock}
 	volumeID := "1234"
@@ -152,6 +166,99 @@ func (suite *NodeSuite) Test_NodeUnpublishVolume_Success() {
 }
 
 //**************************
+func (suite *NodeSuite) Test_nfsMountOptions() {
+	previous := kernelRelease
+	defer func() { kernelRelease = previous }()
+	volumeContext := map[string]string{"nfs_mount_options": "hard,rsize=1048576,wsize=1048576", NFSVersion: "4.1", NConnect: "8"}
+
+	kernelRelease = func() (string, error) { return "5.4.0-42-generic", nil }
+	assert.Equal(suite.T(), []string{"hard", "rsize=1048576", "wsize=1048576", "vers=4.1", "nconnect=8", "ro"}, nfsMountOptions(context.Background(), volumeContext, true))
+
+	kernelRelease = func() (string, error) { return "3.10.0-1160.el7.x86_64", nil }
+	assert.Equal(suite.T(), []string{"hard", "rsize=1048576", "wsize=1048576", "vers=4.1"}, nfsMountOptions(context.Background(), volumeContext, false), "nconnect needs kernel 5.3")
+
+	volumeContext["nfs_mount_options"] = "hard,nfsvers=4.1"
+	assert.Equal(suite.T(), []string{"hard", "nfsvers=4.1"}, nfsMountOptions(context.Background(), volumeContext, false), "mount options keep their vers")
+}
+
+func (suite *NodeSuite) Test_NodePublishVolume_NFSv3Fallback() {
+	service := nfsstorage{mounter: suite.nfsMountMock}
+	suite.nfsMountMock.On("IsNotMountPoint", mock.Anything).Return(true, nil)
+	suite.nfsMountMock.On("Mount", mock.Anything, mock.Anything, mock.Anything, []string{"hard", "vers=4.1"}).Return(errors.New("mount.nfs: Protocol not supported"))
+	suite.nfsMountMock.On("Mount", mock.Anything, mock.Anything, mock.Anything, []string{"hard", "vers=3"}).Return(nil)
+	publishContext := getPublishContexMap()
+	publishContext["nfs_mount_options"] = "hard"
+	publishContext[NFSVersion] = "4.1"
+	req := getNodePublishVolumeRequest("/var/lib/kublet/", nil)
+	req.VolumeContext = publishContext
+	_, err := service.NodePublishVolume(context.Background(), req)
+	assert.Nil(suite.T(), err, "NFSv4.1 refused mounts NFSv3")
+	suite.nfsMountMock.AssertNumberOfCalls(suite.T(), "Mount", 2)
+}
+
+func (suite *NodeSuite) Test_kernelAtLeast() {
+	assert.True(suite.T(), kernelAtLeast("5.3.0", 5, 3))
+	assert.True(suite.T(), kernelAtLeast("5.10.0-19-amd64", 5, 3))
+	assert.True(suite.T(), kernelAtLeast("6.1", 5, 3))
+	assert.False(suite.T(), kernelAtLeast("4.18.0-305.el8.x86_64", 5, 3))
+	assert.False(suite.T(), kernelAtLeast("unknown", 5, 3))
+}
+
+func (suite *NodeSuite) Test_nfsMountIP() {
+	defer func(reachable func(context.Context, string) bool) { portalReachable = reachable }(portalReachable)
+	down := map[string]bool{"172.20.37.52": true}
+	portalReachable = func(ctx context.Context, ip string) bool { return !down[ip] }
+	apiMock := new(api.MockApiService)
+	apiMock.On("GetNetworkSpaceByName", "nas-rotate").Return(api.NetworkSpace{Portals: []api.Portal{
+		{IpAdress: "172.20.37.51", Enabled: true}, {IpAdress: "172.20.37.52", Enabled: true},
+		{IpAdress: "172.20.37.53", Enabled: true}, {IpAdress: "172.20.37.54"}}}, nil)
+	cs := &commonservice{api: apiMock}
+	volumeContext := map[string]string{"network_space": "nas-rotate", "ipAddress": "172.20.37.52"}
+
+	chosen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		ip, err := cs.nfsMountIP(context.Background(), volumeContext)
+		assert.Nil(suite.T(), err)
+		chosen[ip]++
+	}
+	assert.Equal(suite.T(), map[string]int{"172.20.37.51": 3, "172.20.37.53": 3}, chosen, "reachable enabled portals taken in turn")
+
+	down["172.20.37.51"], down["172.20.37.53"] = true, true
+	ip, err := cs.nfsMountIP(context.Background(), volumeContext)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "172.20.37.52", ip, "stored address when no portal is reachable")
+	_, err = cs.nfsMountIP(context.Background(), map[string]string{"network_space": "nas-rotate"})
+	assert.NotNil(suite.T(), err)
+
+	ip, err = cs.nfsMountIP(context.Background(), map[string]string{"ipAddress": "10.2.2.112"})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "10.2.2.112", ip, "volumes of earlier releases have no network_space")
+	apiMock.On("GetNetworkSpaceByName", "nas-gone").Return(api.NetworkSpace{}, errors.New("not found"))
+	ip, err = cs.nfsMountIP(context.Background(), map[string]string{"network_space": "nas-gone", "ipAddress": "10.2.2.112"})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "10.2.2.112", ip)
+}
+
+func (suite *NodeSuite) Test_nfsMountIP_PreferSameSubnet() {
+	previous := driverconfig.Get()
+	defer driverconfig.Apply(previous)
+	config := driverconfig.Defaults()
+	config.NFS.PreferSameSubnet = true
+	assert.Nil(suite.T(), driverconfig.Apply(config))
+	defer func(reachable func(context.Context, string) bool) { portalReachable = reachable }(portalReachable)
+	portalReachable = func(ctx context.Context, ip string) bool { return true }
+	apiMock := new(api.MockApiService)
+	apiMock.On("GetNetworkSpaceByName", "nas-subnet").Return(api.NetworkSpace{NetworkConfig: api.NetworkConfigDetails{Netmask: 24}, Portals: []api.Portal{
+		{IpAdress: "172.20.37.51", Enabled: true}, {IpAdress: "10.20.20.11", Enabled: true}, {IpAdress: "10.20.20.12", Enabled: true}}}, nil)
+	cs := &commonservice{api: apiMock, nodeIPAddress: "192.168.1.51,10.20.20.51"}
+
+	for i := 0; i < 4; i++ {
+		ip, err := cs.nfsMountIP(context.Background(), map[string]string{"network_space": "nas-subnet"})
+		assert.Nil(suite.T(), err)
+		assert.Contains(suite.T(), []string{"10.20.20.11", "10.20.20.12"}, ip, "portals in the node subnet first")
+	}
+}
+
 func getNodePublishVolumeRequest(tagetPath string, publishContexMap map[string]string) *csi.NodePublishVolumeRequest {
 	return &csi.NodePublishVolumeRequest{
 		TargetPath:     tagetPath,
@@ -0,0 +1,191 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"infinibox-csi-driver/helper/driverconfig"
+	log "infinibox-csi-driver/helper/logger"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+//storage class parameters of nfs and treeq volumes
+const (
+	NFSVersion = "nfs_version"
+	NConnect   = "nconnect"
+)
+
+const (
+	nfsV3  = "3"
+	nfsV41 = "4.1"
+	//maxNConnect connections per server linux allows
+	maxNConnect = 16
+)
+
+//exportVersion InfiniBox export versions of nfs_version values
+var exportVersion = map[string]string{nfsV3: "V3", nfsV41: "V4_1"}
+
+//kernelRelease release of the running kernel, shared by host and container, replaced in tests
+var kernelRelease = func() (string, error) {
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	return strings.TrimSpace(string(release)), err
+}
+
+//mountOptionValue value of option name in options, vers and nfsvers are the same option
+func mountOptionValue(options []string, names ...string) (string, bool) {
+	for _, option := range options {
+		for _, name := range names {
+			if strings.HasPrefix(option, name+"=") {
+				return strings.TrimPrefix(option, name+"="), true
+			}
+		}
+	}
+	return "", false
+}
+
+func splitMountOptions(options string) []string {
+	split := []string{}
+	for _, option := range strings.Split(options, ",") {
+		if option = strings.TrimSpace(option); option != "" {
+			split = append(split, option)
+		}
+	}
+	return split
+}
+
+//validateNFSVersion check nfs_version and nconnect storage class parameters, and that nfs_mount_options does not ask for another version
+func validateNFSVersion(config map[string]string) error {
+	if version := config[NFSVersion]; version != "" {
+		if _, ok := exportVersion[version]; !ok {
+			return fmt.Errorf("%s %q must be %s or %s", NFSVersion, version, nfsV3, nfsV41)
+		}
+		if vers, ok := mountOptionValue(splitMountOptions(config["nfs_mount_options"]), "vers", "nfsvers"); ok && vers != version {
+			return fmt.Errorf("%s %s conflicts with vers=%s of nfs_mount_options", NFSVersion, version, vers)
+		}
+	}
+	if nconnect := config[NConnect]; nconnect != "" {
+		n, err := strconv.Atoi(nconnect)
+		if err != nil || n < 1 || n > maxNConnect {
+			return fmt.Errorf("%s %q must be a number from 1 to %d", NConnect, nconnect, maxNConnect)
+		}
+	}
+	return nil
+}
+
+//exportVersions InfiniBox export versions for nfs_version of config, none for the array default NFSv3.
+//NFSv4.1 exports allow NFSv3 too, for nodes which cannot mount NFSv4.1.
+func exportVersions(config map[string]string) []string {
+	switch config[NFSVersion] {
+	case nfsV41:
+		return []string{exportVersion[nfsV41], exportVersion[nfsV3]}
+	case nfsV3:
+		return []string{exportVersion[nfsV3]}
+	}
+	return nil
+}
+
+//sameExportVersions whether export versions are equal, an empty list is the array default NFSv3
+func sameExportVersions(got, want []string) bool {
+	normalize := func(versions []string) []string {
+		if len(versions) == 0 {
+			return []string{exportVersion[nfsV3]}
+		}
+		sorted := append([]string{}, versions...)
+		sort.Strings(sorted)
+		return sorted
+	}
+	return reflect.DeepEqual(normalize(got), normalize(want))
+}
+
+//kernelAtLeast whether kernel release, such as 5.4.0-42-generic, is major.minor or later
+func kernelAtLeast(release string, major, minor int) bool {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	gotMajor, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	gotMinor, err := strconv.Atoi(strings.TrimRightFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' }))
+	if err != nil {
+		return false
+	}
+	return gotMajor > major || gotMajor == major && gotMinor >= minor
+}
+
+//nfsMountOptions options nfs and treeq volumes are mounted with: nfs_mount_options or nfs.mountOptions,
+//vers and nconnect of the volume unless those options set them, and ro. nconnect is left out when the kernel is older than 5.3.
+func nfsMountOptions(ctx context.Context, volumeContext map[string]string, readOnly bool) []string {
+	configMountOptions := volumeContext["nfs_mount_options"]
+	if configMountOptions == "" {
+		configMountOptions = driverconfig.Get().NFS.MountOptions
+	}
+	mountOptions := splitMountOptions(configMountOptions)
+	if version := volumeContext[NFSVersion]; version != "" {
+		if _, ok := mountOptionValue(mountOptions, "vers", "nfsvers"); !ok {
+			mountOptions = append(mountOptions, "vers="+version)
+		}
+	}
+	if nconnect := volumeContext[NConnect]; nconnect != "" {
+		if _, ok := mountOptionValue(mountOptions, "nconnect"); !ok {
+			mountOptions = append(mountOptions, "nconnect="+nconnect)
+		}
+	}
+	if _, ok := mountOptionValue(mountOptions, "nconnect"); ok {
+		if release, err := kernelRelease(); err != nil || !kernelAtLeast(release, 5, 3) {
+			log.FromContext(ctx).Warnf("kernel %q does not support nconnect, mounting with one connection", release)
+			mountOptions = removeMountOption(mountOptions, "nconnect")
+		}
+	}
+	if readOnly {
+		mountOptions = append(mountOptions, "ro")
+	}
+	return mountOptions
+}
+
+func removeMountOption(options []string, name string) []string {
+	kept := []string{}
+	for _, option := range options {
+		if !strings.HasPrefix(option, name+"=") {
+			kept = append(kept, option)
+		}
+	}
+	return kept
+}
+
+//versionNotSupported whether mount failed because client or server lacks the NFS version asked for
+func versionNotSupported(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "protocol not supported") || strings.Contains(message, "requested nfs version or transport protocol is not supported")
+}
+
+//mountNFS mount source at target, an NFSv4.1 mount refused for its version is retried as NFSv3
+func mountNFS(ctx context.Context, mounter mount.Interface, source, target string, options []string) error {
+	err := mounter.Mount(source, target, "nfs", options)
+	if err == nil {
+		return nil
+	}
+	if vers, _ := mountOptionValue(options, "vers", "nfsvers"); vers != nfsV41 || !versionNotSupported(err) {
+		return err
+	}
+	log.FromContext(ctx).Warnf("NFSv4.1 mount of %s refused: %v, mounting NFSv3", source, err)
+	v3 := append(removeMountOption(removeMountOption(options, "vers"), "nfsvers"), "vers="+nfsV3)
+	return mounter.Mount(source, target, "nfs", v3)
+}
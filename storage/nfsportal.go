@@ -0,0 +1,147 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper/driverconfig"
+	log "infinibox-csi-driver/helper/logger"
+)
+
+//portalProbeTimeout time a portal has to accept a connection to the NFS port
+const portalProbeTimeout = 2 * time.Second
+
+//portalReachable whether the NFS port of portal ip accepts connections, replaced in tests
+var portalReachable = func(ctx context.Context, ip string) bool {
+	dialer := net.Dialer{Timeout: portalProbeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, "2049"))
+	if err != nil {
+		log.FromContext(ctx).Debugf("portal %s not reachable: %v", ip, err)
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+//portalCursor next portal of each network space, so mounts of a node rotate over the portals
+var portalCursor = struct {
+	sync.Mutex
+	next map[string]int
+}{next: map[string]int{}}
+
+func portalStart(networkSpace string) int {
+	portalCursor.Lock()
+	defer portalCursor.Unlock()
+	return portalCursor.next[networkSpace]
+}
+
+//portalChosen continue the rotation after the portal chosen, unreachable portals skipped do not shift load to their successor
+func portalChosen(networkSpace string, next int) {
+	portalCursor.Lock()
+	defer portalCursor.Unlock()
+	portalCursor.next[networkSpace] = next
+}
+
+//nfsMountIP address nfs and treeq volumes are mounted from: a reachable enabled portal of the volume's network space, taken in turn,
+//those in the subnet of the node first with nfs.preferSameSubnet. Volumes without network_space, and volumes whose network space
+//cannot be read or has no reachable portal, use the ipAddress chosen when they were created.
+func (cs *commonservice) nfsMountIP(ctx context.Context, volumeContext map[string]string) (string, error) {
+	storedIP := volumeContext["ipAddress"]
+	networkSpace := strings.TrimSpace(volumeContext["network_space"])
+	if networkSpace == "" || cs.api == nil {
+		return storedIP, nil
+	}
+	nspace, err := cs.api.GetNetworkSpaceByName(networkSpace)
+	if err != nil {
+		log.FromContext(ctx).Warnf("fail to get network space %s, mounting from %s: %v", networkSpace, storedIP, err)
+		return storedIP, nil
+	}
+	for _, group := range portalGroups(nspace, cs.nodeIPAddress, driverconfig.Get().NFS.PreferSameSubnet) {
+		start := portalStart(networkSpace)
+		for i := range group {
+			ip := group[(start+i)%len(group)]
+			if portalReachable(ctx, ip) {
+				portalChosen(networkSpace, (start+i+1)%len(group))
+				log.FromContext(ctx).Debugf("mounting from portal %s of network space %s", ip, networkSpace)
+				return ip, nil
+			}
+		}
+	}
+	if storedIP == "" {
+		return "", fmt.Errorf("no reachable portal in network space %s", networkSpace)
+	}
+	log.FromContext(ctx).Warnf("no reachable portal in network space %s, mounting from %s", networkSpace, storedIP)
+	return storedIP, nil
+}
+
+//portalGroups addresses of the enabled portals of nspace, in one group, or with sameSubnet two: those in the subnet of a node address, then the others
+func portalGroups(nspace api.NetworkSpace, nodeIPAddress string, sameSubnet bool) [][]string {
+	var near, far []string
+	subnets := nodeSubnets(nspace, nodeIPAddress)
+	for _, portal := range nspace.Portals {
+		if !portal.Enabled || portal.IpAdress == "" {
+			continue
+		}
+		if sameSubnet && inSubnets(subnets, portal.IpAdress) {
+			near = append(near, portal.IpAdress)
+		} else {
+			far = append(far, portal.IpAdress)
+		}
+	}
+	groups := [][]string{}
+	for _, group := range [][]string{near, far} {
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+//nodeSubnets networks of the network space netmask holding a node address, node addresses are separated by commas
+func nodeSubnets(nspace api.NetworkSpace, nodeIPAddress string) []*net.IPNet {
+	subnets := []*net.IPNet{}
+	if nspace.NetworkConfig.Netmask <= 0 {
+		return subnets
+	}
+	for _, address := range strings.Split(nodeIPAddress, ",") {
+		ip := net.ParseIP(strings.TrimSpace(address))
+		if ip == nil {
+			continue
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		if nspace.NetworkConfig.Netmask > bits {
+			continue
+		}
+		mask := net.CIDRMask(nspace.NetworkConfig.Netmask, bits)
+		subnets = append(subnets, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+	return subnets
+}
+
+func inSubnets(subnets []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	for _, subnet := range subnets {
+		if ip != nil && subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,518 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"infinibox-csi-driver/helper/arrays"
+	"infinibox-csi-driver/helper/driverconfig"
+	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
+)
+
+const (
+	//infinidatVendor SCSI vendor of InfiniBox disks in sysfs
+	infinidatVendor = "NFINIDAT"
+	//reconcileIdleCheck time before a disabled reconciler checks its configuration again
+	reconcileIdleCheck = time.Minute
+	//iscsiadmTimeout timeout in milliseconds of iscsiadm commands run by the reconciler
+	iscsiadmTimeout = 30000
+)
+
+var (
+	//legacyStagingGlobs disk files on host of volumes staged before the driver kept stage records.
+	//Kubelet stages filesystem volumes in csi/pv/<pv> or csi/<driver>/<sha256 of volume handle>, depending on its version
+	legacyStagingGlobs = []string{
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/*/*/globalmount/*.json",
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/staging/*/*.json",
+	}
+	//clonedIfaceRe iface AttachDisk clones per volume as <portal>:<volume name>
+	clonedIfaceRe = regexp.MustCompile(`^(.+):(\d+):([^:]+)$`)
+	//scsiAddressRe host:channel:target:lun of a SCSI device
+	scsiAddressRe = regexp.MustCompile(`^\d+:\d+:\d+:(\d+)$`)
+)
+
+//NodeReconciler remove devices, iSCSI sessions and cloned ifaces which node crashes and failed unstages left behind.
+//Staged volumes are read from the stage records NodeStageVolume writes, anything they use is kept.
+//A resource is removed only when two passes in a row find it stale, and passes are skipped while operations are in progress,
+//so devices and sessions of a volume being staged are never taken for stale.
+type NodeReconciler struct {
+	hostName string
+	busy     func() bool
+	teardown deviceTeardown
+	//records directory of stage records, see SetStageRecordDir
+	records string
+	//mapped WWIDs of volumes mapped to host, nil when mapping is not known
+	mapped func(hostName string) (map[string]bool, error)
+	//suspects stale resources of previous pass
+	suspects map[string]bool
+}
+
+//NewNodeReconciler reconciler of node with host name hostName on InfiniBox, busy reports operations in progress
+func NewNodeReconciler(ctx context.Context, hostName string, busy func() bool) *NodeReconciler {
+	cs := &commonservice{ctx: ctx}
+	return &NodeReconciler{
+		hostName: hostName,
+		busy:     busy,
+		teardown: cs.newDeviceTeardown(),
+		records:  stageRecordDir,
+		mapped:   mappedWWIDs(ctx),
+		suspects: map[string]bool{},
+	}
+}
+
+//staleResource resource found stale by a pass
+type staleResource struct {
+	kind   string
+	name   string
+	reason string
+	remove func() error
+}
+
+func (s staleResource) key() string {
+	return s.kind + "/" + s.name
+}
+
+//stagedVolumes volumes staged on node and the devices they use
+type stagedVolumes struct {
+	names   map[string]bool
+	devices map[string]bool
+	wwids   map[string]bool
+}
+
+//Run reconcile every reconcile.interval until ctx is done
+func (r *NodeReconciler) Run(ctx context.Context) {
+	if err := r.importStaged(); err != nil {
+		log.Errorf("node reconciler failed to record volumes staged by a previous driver version: %v", err)
+	}
+	for {
+		config := driverconfig.Get().Reconcile
+		wait := config.Interval.Duration
+		if wait <= 0 {
+			wait = reconcileIdleCheck
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if config = driverconfig.Get().Reconcile; config.Interval.Duration > 0 {
+			r.reconcile(config.DryRun)
+		}
+	}
+}
+
+//reconcile run one pass, resources removed or reported are returned
+func (r *NodeReconciler) reconcile(dryRun bool) (stale []staleResource) {
+	defer func() {
+		if res := recover(); res != nil {
+			log.Errorf("node reconciler pass failed: %v", res)
+		}
+	}()
+	if r.busy() {
+		log.Debug("node reconciler pass skipped, operations are in progress")
+		r.suspects = map[string]bool{}
+		return nil
+	}
+	staged, err := r.stagedVolumes()
+	if err != nil {
+		log.Warnf("node reconciler pass skipped, staged volumes are not known: %v", err)
+		return nil
+	}
+	mapped, err := r.mapped(r.hostName)
+	if err != nil {
+		log.Warnf("node reconciler does not know LUNs mapped to host %s, only failed devices are stale: %v", r.hostName, err)
+		mapped = nil
+	}
+	found := r.staleDevices(staged, mapped)
+	found = append(found, r.staleSessions(staged)...)
+
+	suspects := map[string]bool{}
+	for _, resource := range found {
+		suspects[resource.key()] = true
+		if !r.suspects[resource.key()] {
+			log.Infof("node reconciler found %s %s stale, %s; it is removed if still stale in next pass", resource.kind, resource.name, resource.reason)
+			continue
+		}
+		stale = append(stale, resource)
+		if dryRun {
+			log.Infof("node reconciler would remove %s %s, %s (reconcile.dryRun is set)", resource.kind, resource.name, resource.reason)
+			metrics.StaleResource(resource.kind, "reported")
+			continue
+		}
+		log.Infof("node reconciler removes %s %s, %s", resource.kind, resource.name, resource.reason)
+		if err := resource.remove(); err != nil {
+			log.Errorf("node reconciler failed to remove %s %s: %v", resource.kind, resource.name, err)
+			metrics.StaleResource(resource.kind, "failed")
+			continue
+		}
+		metrics.StaleResource(resource.kind, "removed")
+	}
+	r.suspects = suspects
+	return stale
+}
+
+//importStaged write stage records of volumes staged before the driver kept them, from their disk files in staging paths
+func (r *NodeReconciler) importStaged() error {
+	if r.records == "" {
+		return nil
+	}
+	for _, glob := range legacyStagingGlobs {
+		files, err := r.teardown.host.Glob(glob)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			stagePath := filepath.Dir(file)
+			if _, err := os.Stat(stageRecordFile(r.records, stagePath)); err == nil {
+				continue
+			}
+			data, err := r.teardown.host.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			// a filesystem volume mounted at a staging path of another driver may hold JSON files of its own
+			var volume struct{ VolName string }
+			if json.Unmarshal(data, &volume) != nil || volume.VolName+".json" != filepath.Base(file) {
+				continue
+			}
+			if err := writeStageRecord(r.records, stagePath, bytes.TrimSpace(data)); err != nil {
+				return err
+			}
+			log.Infof("node reconciler recorded volume %s staged at %s", volume.VolName, stagePath)
+		}
+	}
+	return nil
+}
+
+//stagedVolumes read every stage record, a record which cannot be read fails the pass.
+//Records whose staging path is gone are left by unstages which did not complete, they are dropped
+func (r *NodeReconciler) stagedVolumes() (stagedVolumes, error) {
+	staged := stagedVolumes{names: map[string]bool{}, devices: map[string]bool{}, wwids: map[string]bool{}}
+	if r.records == "" {
+		return staged, errors.New("stage records are not kept without STATE_DIR")
+	}
+	records, err := readStageRecords(r.records)
+	if err != nil {
+		return staged, err
+	}
+	for _, record := range records {
+		if _, err := r.teardown.host.Stat(record.StagingPath); os.IsNotExist(err) {
+			log.Infof("node reconciler drops stage record of %s, the staging path is gone", record.StagingPath)
+			if err := os.Remove(stageRecordFile(r.records, record.StagingPath)); err != nil {
+				log.Warnf("failed to remove stage record of %s: %v", record.StagingPath, err)
+			}
+			continue
+		}
+		var volume struct {
+			VolName     string
+			MpathDevice string
+		}
+		if err := json.Unmarshal(record.Disk, &volume); err != nil {
+			return staged, fmt.Errorf("failed to parse stage record of %s: %v", record.StagingPath, err)
+		}
+		if volume.VolName != "" {
+			staged.names[volume.VolName] = true
+		}
+		if volume.MpathDevice == "" {
+			continue
+		}
+		device := filepath.Base(fromHost(volume.MpathDevice))
+		staged.devices[device] = true
+		if wwid := r.wwid(device); wwid != "" {
+			staged.wwids[wwid] = true
+		}
+		if strings.HasPrefix(device, "dm-") {
+			for _, path := range r.teardown.slaves(device) {
+				staged.devices[path] = true
+			}
+		}
+	}
+	return staged, nil
+}
+
+//wwid of multipath map or disk, empty when it cannot be read
+func (r *NodeReconciler) wwid(device string) string {
+	block := filepath.Join("/sys/block", device)
+	if strings.HasPrefix(device, "dm-") {
+		uuid, err := r.teardown.host.ReadFile(filepath.Join(block, "dm/uuid"))
+		if err != nil || !strings.HasPrefix(string(uuid), "mpath-3") {
+			return ""
+		}
+		return strings.TrimPrefix(strings.TrimSpace(string(uuid)), "mpath-3")
+	}
+	data, err := r.teardown.host.ReadFile(filepath.Join(block, "device/wwid"))
+	if err != nil {
+		return ""
+	}
+	return naaWWID(string(data))
+}
+
+//failed SCSI disk is not in running state
+func (r *NodeReconciler) failed(disk string) bool {
+	state, err := r.teardown.host.ReadFile(filepath.Join("/sys/block", disk, "device/state"))
+	return err == nil && strings.TrimSpace(string(state)) != "running"
+}
+
+//staleDevices InfiniBox multipath maps and disks no staged volume uses which are failed or whose LUN is no longer mapped
+func (r *NodeReconciler) staleDevices(staged stagedVolumes, mapped map[string]bool) []staleResource {
+	stale := []staleResource{}
+	devices, err := r.teardown.host.ReadDir("/sys/block")
+	if err != nil {
+		log.Warnf("node reconciler failed to list block devices: %v", err)
+		return stale
+	}
+	for _, name := range devices {
+		if staged.devices[name] {
+			continue
+		}
+		reason := ""
+		if strings.HasPrefix(name, "dm-") {
+			reason = r.staleMap(name, staged, mapped)
+		} else if strings.HasPrefix(name, "sd") {
+			reason = r.staleDisk(name, staged, mapped)
+		}
+		if reason == "" {
+			continue
+		}
+		kind := "path"
+		if strings.HasPrefix(name, "dm-") {
+			kind = "multipath"
+		}
+		device := "/dev/" + name
+		stale = append(stale, staleResource{kind: kind, name: name, reason: reason, remove: func() error {
+			return r.teardown.remove(device)
+		}})
+	}
+	return stale
+}
+
+func (r *NodeReconciler) staleMap(name string, staged stagedVolumes, mapped map[string]bool) string {
+	wwid := r.wwid(name)
+	if !strings.HasPrefix(wwid, "6"+infinidatOUI) || staged.wwids[wwid] {
+		return ""
+	}
+	if mapped != nil && !mapped[wwid] {
+		return fmt.Sprintf("WWID %s is not mapped to host %s", wwid, r.hostName)
+	}
+	for _, path := range r.teardown.slaves(name) {
+		if !r.failed(path) {
+			return ""
+		}
+	}
+	return "all its paths are failed"
+}
+
+//staleDisk disk which is not a path of a multipath map, paths of maps are removed with their map
+func (r *NodeReconciler) staleDisk(name string, staged stagedVolumes, mapped map[string]bool) string {
+	vendor, err := r.teardown.host.ReadFile(filepath.Join("/sys/block", name, "device/vendor"))
+	if err != nil || strings.TrimSpace(string(vendor)) != infinidatVendor || r.teardown.holder(name) != "" {
+		return ""
+	}
+	// LUN 0 of every InfiniBox target is not a volume
+	address, err := r.teardown.host.EvalSymlinks(filepath.Join("/sys/block", name, "device"))
+	if match := scsiAddressRe.FindStringSubmatch(filepath.Base(address)); err != nil || match == nil || match[1] == "0" {
+		return ""
+	}
+	wwid := r.wwid(name)
+	if staged.wwids[wwid] {
+		return ""
+	}
+	if r.failed(name) {
+		return "it is failed"
+	}
+	if mapped != nil && !mapped[wwid] {
+		return fmt.Sprintf("WWID %s is not mapped to host %s", wwid, r.hostName)
+	}
+	return ""
+}
+
+//iscsiSession session as listed by iscsiadm -m session -P 1
+type iscsiSession struct {
+	id     string
+	target string
+	portal string
+	iface  string
+}
+
+//parseSessions sessions of iscsiadm -m session -P 1 output
+func parseSessions(out string) []iscsiSession {
+	sessions := []iscsiSession{}
+	var current iscsiSession
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(fields[1])
+		switch fields[0] {
+		case "Target":
+			current = iscsiSession{target: strings.Fields(value + " ")[0]}
+		case "Current Portal":
+			current.portal = strings.Split(value, ",")[0]
+		case "Iface Name":
+			current.iface = value
+		case "SID":
+			current.id = value
+			sessions = append(sessions, current)
+		}
+	}
+	return sessions
+}
+
+//staleSessions sessions and ifaces AttachDisk created for volumes which are no longer staged
+func (r *NodeReconciler) staleSessions(staged stagedVolumes) []staleResource {
+	stale := []staleResource{}
+	out, err := r.teardown.run(iscsiadmTimeout, "iscsiadm", []string{"-m", "iface"})
+	if err != nil {
+		log.Debugf("node reconciler does not check iSCSI, ifaces are not listed: %s %v", strings.TrimSpace(string(out)), err)
+		return stale
+	}
+	ifaces := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if match := clonedIfaceRe.FindStringSubmatch(fields[0]); match != nil && !staged.names[match[3]] {
+			ifaces = append(ifaces, fields[0])
+		}
+	}
+	sort.Strings(ifaces)
+	if len(ifaces) == 0 {
+		return stale
+	}
+	// iscsiadm fails when there is no session
+	out, _ = r.teardown.run(iscsiadmTimeout, "iscsiadm", []string{"-m", "session", "-P", "1"})
+	sessions := parseSessions(string(out))
+	for _, iface := range ifaces {
+		kept := false
+		for _, session := range sessions {
+			if session.iface != iface {
+				continue
+			}
+			if reason := r.sessionInUse(session.id, staged); reason != "" {
+				log.Warnf("node reconciler keeps session %s on iface %s of unstaged volume, %s", session.id, iface, reason)
+				kept = true
+				continue
+			}
+			session := session
+			stale = append(stale, staleResource{kind: "session", name: session.portal + "," + session.target + "," + iface,
+				reason: "its volume is not staged", remove: func() error {
+					return r.logout(session)
+				}})
+		}
+		if kept {
+			continue
+		}
+		iface := iface
+		stale = append(stale, staleResource{kind: "iface", name: iface, reason: "its volume is not staged", remove: func() error {
+			if out, err := r.teardown.run(iscsiadmTimeout, "iscsiadm", []string{"-m", "iface", "-I", iface, "-o", "delete"}); err != nil {
+				return fmt.Errorf("%s %v", strings.TrimSpace(string(out)), err)
+			}
+			return nil
+		}})
+	}
+	return stale
+}
+
+//sessionInUse reason logout would break a volume: a disk of the session is the last path of a map, is used directly,
+//or backs a map which is mounted or held by another device
+func (r *NodeReconciler) sessionInUse(id string, staged stagedVolumes) string {
+	disks, _ := r.teardown.host.Glob(filepath.Join("/sys/class/iscsi_session/session"+id, "device/target*/*/block/*"))
+	inSession := map[string]bool{}
+	for _, disk := range disks {
+		inSession[filepath.Base(disk)] = true
+	}
+	for disk := range inSession {
+		holder := r.teardown.holder(disk)
+		if holder == "" {
+			if staged.devices[disk] {
+				return fmt.Sprintf("disk %s is a staged volume", disk)
+			}
+			if err := r.teardown.checkUnused(disk, nil); err != nil {
+				return err.Error()
+			}
+			continue
+		}
+		if err := r.teardown.checkUnused(holder, r.teardown.slaves(holder)); err != nil {
+			return fmt.Sprintf("disk %s is a path of %s: %v", disk, holder, err)
+		}
+		others := 0
+		for _, path := range r.teardown.slaves(holder) {
+			if !inSession[path] && !r.failed(path) {
+				others++
+			}
+		}
+		if others == 0 {
+			return fmt.Sprintf("disk %s is the last path of %s", disk, holder)
+		}
+	}
+	return ""
+}
+
+//logout session and delete its node record, as NodeUnstageVolume does
+func (r *NodeReconciler) logout(session iscsiSession) error {
+	node := []string{"-m", "node", "-p", session.portal, "-T", session.target, "-I", session.iface}
+	if out, err := r.teardown.run(iscsiadmTimeout, "iscsiadm", append(node, "--logout")); err != nil {
+		return fmt.Errorf("logout failed: %s %v", strings.TrimSpace(string(out)), err)
+	}
+	if out, err := r.teardown.run(iscsiadmTimeout, "iscsiadm", append(node, "-o", "delete")); err != nil {
+		log.Warnf("failed to delete node record of session %s: %s %v", session.id, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+//mappedWWIDs WWIDs of volumes mapped to host on arrays of the registry, mapping is not known without registered arrays
+func mappedWWIDs(ctx context.Context) func(hostName string) (map[string]bool, error) {
+	return func(hostName string) (map[string]bool, error) {
+		registry := arrays.Get()
+		if registry.Len() == 0 {
+			return nil, errors.New("no InfiniBox arrays are registered on node")
+		}
+		mapped := map[string]bool{}
+		for _, array := range registry.List() {
+			cs, err := buildCommonService(ctx, map[string]string{}, array.Secrets())
+			if err != nil {
+				return nil, fmt.Errorf("array %s: %v", array.Hostname, err)
+			}
+			host, err := cs.api.GetHostByName(hostName)
+			if err != nil {
+				if strings.Contains(err.Error(), "HOST_NOT_FOUND") {
+					continue
+				}
+				return nil, fmt.Errorf("array %s: %v", array.Hostname, err)
+			}
+			for _, lun := range host.Luns {
+				volume, err := cs.api.GetVolume(lun.VolumeID)
+				if err != nil {
+					return nil, fmt.Errorf("array %s: volume %d: %v", array.Hostname, lun.VolumeID, err)
+				}
+				if volume.Serial == "" {
+					return nil, fmt.Errorf("array %s: volume %d has no serial", array.Hostname, lun.VolumeID)
+				}
+				mapped[naaWWID(volume.Serial)] = true
+			}
+		}
+		return mapped, nil
+	}
+}
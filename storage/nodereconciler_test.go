@@ -0,0 +1,307 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"infinibox-csi-driver/helper/hostexec"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	stagedWWID   = "6742b0f000004e2b0000000000000100"
+	unstagedWWID = "6742b0f000004e2b0000000000000200"
+
+	testIfaces = `default tcp,<empty>,<empty>,<empty>,<empty>
+10.0.0.1:3260:100 tcp,<empty>,<empty>,<empty>,iqn.1993-08.org.debian:01:node1
+10.0.0.1:3260:200 tcp,<empty>,<empty>,<empty>,iqn.1993-08.org.debian:01:node1
+`
+	testSessions = `Target: iqn.2009-11.com.infinidat:storage:infinibox-sn-1234 (non-flash)
+	Current Portal: 10.0.0.1:3260,1
+	Persistent Portal: 10.0.0.1:3260,1
+		**********
+		Interface:
+		**********
+		Iface Name: 10.0.0.1:3260:100
+		Iface Transport: tcp
+		SID: 1
+		iSCSI Connection State: LOGGED IN
+	Current Portal: 10.0.0.2:3260,1
+	Persistent Portal: 10.0.0.2:3260,1
+		**********
+		Interface:
+		**********
+		Iface Name: 10.0.0.1:3260:200
+		Iface Transport: tcp
+		SID: 2
+		iSCSI Connection State: LOGGED IN
+`
+)
+
+type NodeReconcilerSuite struct {
+	suite.Suite
+	root string
+	// steps commands run and paths deleted, in order
+	steps      []string
+	busy       bool
+	mapped     map[string]bool
+	reconciler *NodeReconciler
+}
+
+func TestNodeReconcilerSuite(t *testing.T) {
+	suite.Run(t, new(NodeReconcilerSuite))
+}
+
+func (suite *NodeReconcilerSuite) SetupTest() {
+	root, err := ioutil.TempDir("", "reconciler")
+	suite.Require().NoError(err)
+	suite.root = root
+	suite.steps = nil
+	suite.busy = false
+	suite.mapped = nil
+	teardownPollInterval = time.Millisecond
+	suite.reconciler = &NodeReconciler{
+		hostName: "node1",
+		busy:     func() bool { return suite.busy },
+		teardown: deviceTeardown{
+			blockDevices:  blockDevices{host: teardownHost{Fake: hostexec.NewFake(root), writeFile: suite.writeFile}},
+			run:           suite.run,
+			flushAttempts: 1,
+		},
+		records:  filepath.Join(root, "state/staged"),
+		mapped:   func(string) (map[string]bool, error) { return suite.mapped, nil },
+		suspects: map[string]bool{},
+	}
+	// staged volume 100 on dm-3 with paths sdb and sdc
+	suite.disk("sdb", "2:0:0:1", stagedWWID, "running")
+	suite.disk("sdc", "3:0:0:1", stagedWWID, "running")
+	suite.multipath("dm-3", stagedWWID, "sdb", "sdc")
+	suite.stage("/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount",
+		`{"Portals":["10.0.0.1"],"Iface":"10.0.0.1:3260:100","VolName":"100","MpathDevice":"/host/dev/dm-3"}`)
+	suite.write("proc/1/mounts", "/dev/dm-3 /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount xfs rw 0 0\n")
+}
+
+func (suite *NodeReconcilerSuite) TearDownTest() {
+	teardownPollInterval = 500 * time.Millisecond
+	os.RemoveAll(suite.root)
+}
+
+func (suite *NodeReconcilerSuite) write(path, content string) {
+	path = filepath.Join(suite.root, path)
+	suite.Require().NoError(os.MkdirAll(filepath.Dir(path), 0755))
+	suite.Require().NoError(ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+//stage staging path on host and stage record of disk staged there
+func (suite *NodeReconcilerSuite) stage(stagePath, disk string) {
+	suite.Require().NoError(os.MkdirAll(filepath.Join(suite.root, stagePath), 0755))
+	suite.Require().NoError(writeStageRecord(suite.reconciler.records, stagePath, []byte(disk)))
+}
+
+//disk InfiniBox SCSI disk at SCSI address
+func (suite *NodeReconcilerSuite) disk(name, address, wwid, state string) {
+	device := "sys/devices/" + address
+	suite.write(device+"/vendor", infinidatVendor+"  \n")
+	suite.write(device+"/wwid", "naa."+wwid+"\n")
+	suite.write(device+"/state", state+"\n")
+	suite.Require().NoError(os.MkdirAll(filepath.Join(suite.root, "sys/block", name), 0755))
+	suite.Require().NoError(os.Symlink(filepath.Join(suite.root, device), filepath.Join(suite.root, "sys/block", name, "device")))
+}
+
+func (suite *NodeReconcilerSuite) multipath(name, wwid string, disks ...string) {
+	suite.write("sys/block/"+name+"/dm/uuid", "mpath-3"+wwid+"\n")
+	suite.write("sys/block/"+name+"/dm/name", "mpath"+name+"\n")
+	for _, disk := range disks {
+		suite.write("sys/block/"+name+"/slaves/"+disk, "")
+		suite.write("sys/block/"+disk+"/holders/"+name, "")
+	}
+}
+
+func (suite *NodeReconcilerSuite) run(mSeconds int, command string, args []string) ([]byte, error) {
+	step := command + " " + strings.Join(args, " ")
+	switch step {
+	case "iscsiadm -m iface":
+		return []byte(testIfaces), nil
+	case "iscsiadm -m session -P 1":
+		return []byte(testSessions), nil
+	}
+	suite.steps = append(suite.steps, step)
+	if command == "multipath" {
+		os.RemoveAll(filepath.Join(suite.root, "sys/block", filepath.Base(args[1])))
+	}
+	return nil, nil
+}
+
+func (suite *NodeReconcilerSuite) writeFile(filename string, data []byte, perm os.FileMode) error {
+	device := filepath.Base(filepath.Dir(filepath.Dir(filename)))
+	suite.steps = append(suite.steps, "delete "+device)
+	os.RemoveAll(filepath.Join(suite.root, "sys/block", device))
+	return nil
+}
+
+func staleKeys(stale []staleResource) []string {
+	found := []string{}
+	for _, resource := range stale {
+		found = append(found, resource.key())
+	}
+	return found
+}
+
+func (suite *NodeReconcilerSuite) Test_ParseSessions() {
+	sessions := parseSessions(testSessions)
+	assert.Equal(suite.T(), []iscsiSession{
+		{id: "1", target: "iqn.2009-11.com.infinidat:storage:infinibox-sn-1234", portal: "10.0.0.1:3260", iface: "10.0.0.1:3260:100"},
+		{id: "2", target: "iqn.2009-11.com.infinidat:storage:infinibox-sn-1234", portal: "10.0.0.2:3260", iface: "10.0.0.1:3260:200"},
+	}, sessions)
+	assert.Empty(suite.T(), parseSessions("iscsiadm: No active sessions.\n"))
+}
+
+func (suite *NodeReconcilerSuite) Test_Reconcile_FailedDevices() {
+	// map of volume 200 whose paths all failed, a failed disk without map and LUN 0 of target
+	suite.disk("sdd", "2:0:0:2", unstagedWWID, "offline")
+	suite.multipath("dm-4", unstagedWWID, "sdd")
+	suite.disk("sde", "3:0:0:3", unstagedWWID, "transport-offline")
+	suite.disk("sdf", "2:0:0:0", "6742b0f000004e2b0000000000000000", "offline")
+
+	assert.Empty(suite.T(), suite.reconciler.reconcile(false), "first pass only suspects stale resources")
+	stale := suite.reconciler.reconcile(true)
+	assert.Contains(suite.T(), staleKeys(stale), "multipath/dm-4")
+	assert.Contains(suite.T(), staleKeys(stale), "path/sde")
+	assert.NotContains(suite.T(), staleKeys(stale), "path/sdf", "LUN 0 is not a volume")
+	assert.Empty(suite.T(), suite.steps, "dry run removes nothing")
+
+	suite.reconciler.reconcile(false)
+	assert.Contains(suite.T(), suite.steps, "multipath -f /dev/dm-4")
+	assert.Contains(suite.T(), suite.steps, "delete sdd")
+	assert.Contains(suite.T(), suite.steps, "delete sde")
+	for _, step := range suite.steps {
+		assert.NotContains(suite.T(), step, "dm-3", "staged volume is kept")
+		assert.NotContains(suite.T(), step, "sdb", "staged volume is kept")
+	}
+}
+
+func (suite *NodeReconcilerSuite) Test_Reconcile_Unmapped() {
+	suite.disk("sdd", "2:0:0:2", unstagedWWID, "running")
+	suite.multipath("dm-4", unstagedWWID, "sdd")
+
+	suite.reconciler.reconcile(true)
+	assert.NotContains(suite.T(), staleKeys(suite.reconciler.reconcile(true)), "multipath/dm-4", "running map is kept while mapping is not known")
+
+	suite.mapped = map[string]bool{stagedWWID: true, unstagedWWID: true}
+	suite.reconciler.reconcile(true)
+	assert.NotContains(suite.T(), staleKeys(suite.reconciler.reconcile(true)), "multipath/dm-4", "mapped LUN is kept")
+
+	suite.mapped = map[string]bool{stagedWWID: true}
+	suite.reconciler.reconcile(true)
+	stale := suite.reconciler.reconcile(true)
+	assert.Contains(suite.T(), staleKeys(stale), "multipath/dm-4")
+	assert.Contains(suite.T(), stale[0].reason, "not mapped to host node1")
+}
+
+//sessionPath session of unstaged volume 200 sees sdd, another path of staged dm-3
+func (suite *NodeReconcilerSuite) sessionPath() {
+	suite.disk("sdd", "4:0:0:1", stagedWWID, "running")
+	suite.write("sys/block/dm-3/slaves/sdd", "")
+	suite.write("sys/block/sdd/holders/dm-3", "")
+	suite.write("sys/class/iscsi_session/session2/device/target4:0:0/4:0:0:1/block/sdd/dev", "")
+}
+
+func (suite *NodeReconcilerSuite) Test_Reconcile_Sessions() {
+	suite.sessionPath()
+	// dm-3 staged as block volume is not mounted
+	suite.write("proc/1/mounts", "")
+
+	suite.reconciler.reconcile(false)
+	stale := suite.reconciler.reconcile(false)
+	assert.Equal(suite.T(), []string{
+		"session/10.0.0.2:3260,iqn.2009-11.com.infinidat:storage:infinibox-sn-1234,10.0.0.1:3260:200",
+		"iface/10.0.0.1:3260:200"}, staleKeys(stale))
+	assert.Equal(suite.T(), []string{
+		"iscsiadm -m node -p 10.0.0.2:3260 -T iqn.2009-11.com.infinidat:storage:infinibox-sn-1234 -I 10.0.0.1:3260:200 --logout",
+		"iscsiadm -m node -p 10.0.0.2:3260 -T iqn.2009-11.com.infinidat:storage:infinibox-sn-1234 -I 10.0.0.1:3260:200 -o delete",
+		"iscsiadm -m iface -I 10.0.0.1:3260:200 -o delete"}, suite.steps)
+}
+
+func (suite *NodeReconcilerSuite) Test_Reconcile_SessionMountedMap() {
+	suite.sessionPath()
+
+	suite.reconciler.reconcile(false)
+	assert.Empty(suite.T(), suite.reconciler.reconcile(false), "session with a path of mounted dm-3 and its iface are kept")
+	assert.Empty(suite.T(), suite.steps)
+}
+
+func (suite *NodeReconcilerSuite) Test_Reconcile_SessionLastPath() {
+	// paths sdb and sdc of staged dm-3 are both in session of unstaged volume 200
+	suite.write("sys/class/iscsi_session/session2/device/target2:0:0/2:0:0:1/block/sdb/dev", "")
+	suite.write("sys/class/iscsi_session/session2/device/target2:0:0/2:0:0:1/block/sdc/dev", "")
+
+	suite.reconciler.reconcile(false)
+	assert.Empty(suite.T(), suite.reconciler.reconcile(false), "session holding last paths of staged volume and its iface are kept")
+	assert.Empty(suite.T(), suite.steps)
+}
+
+func (suite *NodeReconcilerSuite) Test_Reconcile_Busy() {
+	suite.disk("sde", "3:0:0:3", unstagedWWID, "offline")
+
+	suite.reconciler.reconcile(false)
+	suite.busy = true
+	assert.Empty(suite.T(), suite.reconciler.reconcile(false), "pass is skipped while operations are in progress")
+	suite.busy = false
+	assert.Empty(suite.T(), suite.reconciler.reconcile(false), "suspects are forgotten after skipped pass")
+	assert.Contains(suite.T(), staleKeys(suite.reconciler.reconcile(false)), "path/sde")
+}
+
+func (suite *NodeReconcilerSuite) Test_Reconcile_UnreadableStage() {
+	suite.disk("sde", "3:0:0:3", unstagedWWID, "offline")
+	suite.write("state/staged/"+filepath.Base(stageRecordFile("", "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/staging/pvc-2")), "{")
+
+	suite.reconciler.reconcile(false)
+	assert.Empty(suite.T(), suite.reconciler.reconcile(false), "nothing is removed while staged volumes are not known")
+}
+
+func (suite *NodeReconcilerSuite) Test_StagedVolumes_Import() {
+	// volume 300 staged by a previous driver version in the staging path layout of newer kubelets
+	stagePath := "/var/lib/kubelet/plugins/kubernetes.io/csi/infinibox-csi-driver/5b2f/globalmount"
+	suite.write(stagePath+"/300.json", `{"VolName":"300","MpathDevice":"/host/dev/dm-5"}`+"\n")
+	// JSON file of a filesystem mounted at a staging path
+	suite.write("var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-9/globalmount/data.json", `{"VolName":"900"}`)
+
+	suite.Require().NoError(suite.reconciler.importStaged())
+	staged, err := suite.reconciler.stagedVolumes()
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), map[string]bool{"100": true, "300": true}, staged.names)
+	assert.True(suite.T(), staged.devices["dm-5"])
+}
+
+func (suite *NodeReconcilerSuite) Test_StagedVolumes_StagingPathGone() {
+	suite.stage("/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-2/globalmount", `{"VolName":"200","MpathDevice":"/host/dev/dm-4"}`)
+	suite.Require().NoError(os.RemoveAll(filepath.Join(suite.root, "var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-2")))
+
+	staged, err := suite.reconciler.stagedVolumes()
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), map[string]bool{"100": true}, staged.names, "record left by an incomplete unstage is dropped")
+	records, _ := readStageRecords(suite.reconciler.records)
+	assert.Len(suite.T(), records, 1)
+}
+
+func (suite *NodeReconcilerSuite) Test_StagedVolumes_NoRecords() {
+	suite.reconciler.records = ""
+	_, err := suite.reconciler.stagedVolumes()
+	assert.NotNil(suite.T(), err, "staged volumes are not known without STATE_DIR")
+}
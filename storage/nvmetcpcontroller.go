@@ -0,0 +1,281 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper/csiid"
+	"infinibox-csi-driver/helper/lock"
+	log "infinibox-csi-driver/helper/logger"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	//nvmeHostPortType type of host ports holding the host NQN of a node
+	nvmeHostPortType = "NVME"
+	//defaultNVMeTCPPort port of NVMe/TCP portals when the network space sets none
+	defaultNVMeTCPPort = 4420
+)
+
+//volume context of nvme_tcp volumes
+const (
+	NVMeSubsystemNQN = "nqn"
+	NVMePortals      = "portals"
+)
+
+//nvmeTarget NQN of the NVMe subsystem of network space and its enabled portals as address:port
+func (nvme *nvmetcpstorage) nvmeTarget(networkSpace string) (string, string, error) {
+	nspace, err := nvme.cs.api.GetNetworkSpaceByName(networkSpace)
+	if err != nil {
+		return "", "", fmt.Errorf("Error getting network space %s: %v", networkSpace, err)
+	}
+	if nspace.Properties.NvmeNqn == "" {
+		return "", "", fmt.Errorf("network space %s has no NVMe subsystem", networkSpace)
+	}
+	port := nspace.Properties.NvmeTcpPort
+	if port == 0 {
+		port = defaultNVMeTCPPort
+	}
+	portals := []string{}
+	for _, p := range nspace.Portals {
+		if p.Enabled && p.IpAdress != "" {
+			portals = append(portals, net.JoinHostPort(p.IpAdress, strconv.Itoa(port)))
+		}
+	}
+	if len(portals) == 0 {
+		return "", "", fmt.Errorf("network space %s has no enabled portal", networkSpace)
+	}
+	return nspace.Properties.NvmeNqn, strings.Join(portals, ","), nil
+}
+
+//CreateVolume create volume, the subsystem NQN and portals of network_space are kept in the volume context
+func (nvme *nvmetcpstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("Recovered from NVMe/TCP CreateVolume " + fmt.Sprint(res))
+		}
+	}()
+	sizeBytes, err := verifyVolumeSize(req.GetCapacityRange())
+	if err != nil {
+		return &csi.CreateVolumeResponse{}, err
+	}
+	params := req.GetParameters()
+	log.FromContext(ctx).Infof("NVMe/TCP CreateVolume of %d bytes with parameters %v", sizeBytes, params)
+	if err = validateParametersNVMeTCP(params); err != nil {
+		return &csi.CreateVolumeResponse{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	volCaps := req.GetVolumeCapabilities()
+	if volCaps == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
+	}
+	for _, volCap := range volCaps {
+		if !blockAccessModeSupported(volCap.GetAccessMode().GetMode()) {
+			return &csi.CreateVolumeResponse{}, status.Errorf(codes.InvalidArgument, "volume capability %s for NVMe/TCP is not supported", volCap.GetAccessMode().GetMode().String())
+		}
+	}
+	if req.GetName() == "" {
+		return &csi.CreateVolumeResponse{}, errors.New("Name cannot be empty")
+	}
+	name, err := getObjectName(req.GetName(), params)
+	if err != nil {
+		return &csi.CreateVolumeResponse{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	targetVol, err := nvme.cs.api.GetVolumeByName(name)
+	if err != nil && !strings.Contains(err.Error(), "volume with given name not found") {
+		return &csi.CreateVolumeResponse{}, status.Error(codes.Internal, err.Error())
+	}
+	if targetVol != nil {
+		return &csi.CreateVolumeResponse{}, nil
+	}
+
+	nqn, portals, err := nvme.nvmeTarget(params["network_space"])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	params[NVMeSubsystemNQN] = nqn
+	params[NVMePortals] = portals
+
+	poolName := params["pool_name"]
+	if req.GetVolumeContentSource() != nil {
+		return nvme.createVolumeFromVolumeContent(req, name, sizeBytes, poolName)
+	}
+	ssdEnabled, _ := strconv.ParseBool(params["ssd_enabled"])
+	volumeParam := &api.VolumeParam{
+		Name:          name,
+		VolumeSize:    sizeBytes,
+		ProvisionType: params[KeyVolumeProvisionType],
+		SsdEnabled:    ssdEnabled,
+	}
+	volumeResp, err := nvme.cs.api.CreateVolume(volumeParam, poolName)
+	if err != nil {
+		log.FromContext(ctx).Errorf("error creating volume: %s pool %s error: %s", name, poolName, err.Error())
+		return &csi.CreateVolumeResponse{}, status.Errorf(codes.Internal,
+			"error when creating volume %s storagepool %s: %s", name, poolName, err.Error())
+	}
+	vi := nvme.cs.getCSIResponse(volumeResp, req, NVMeTCP)
+	copyRequestParameters(params, vi.VolumeContext)
+
+	metadata := nvme.cs.getVolumeMetadata(volumeResp.Name, params)
+	metadata[MetadataFilesystemType] = params["fstype"]
+	if _, err = nvme.cs.api.AttachMetadataToObject(int64(volumeResp.ID), metadata); err != nil {
+		log.FromContext(ctx).Errorf("fail to attach metadata for volume %s: %v", volumeResp.Name, err)
+		return &csi.CreateVolumeResponse{}, errors.New("error attach metadata")
+	}
+	return &csi.CreateVolumeResponse{Volume: vi}, nil
+}
+
+func (nvme *nvmetcpstorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest, name string, sizeInKbytes int64, storagePool string) (*csi.CreateVolumeResponse, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("Recovered from NVMe/TCP createVolumeFromVolumeContent " + fmt.Sprint(res))
+		}
+	}()
+	volumecontent := req.GetVolumeContentSource()
+	var volumeContentID, restoreType string
+	var volproto csiid.ID
+	if volumecontent.GetSnapshot() != nil {
+		restoreType = "Snapshot"
+		volumeContentID = volumecontent.GetSnapshot().GetSnapshotId()
+		volproto, err = csiid.ParseSnapshot(volumeContentID)
+	} else {
+		restoreType = "Volume"
+		volumeContentID = volumecontent.GetVolume().GetVolumeId()
+		volproto, err = csiid.Parse(volumeContentID)
+	}
+	if err != nil {
+		log.Errorf("Failed to validate storage type %v", err)
+		return nil, errors.New("error getting volume id")
+	}
+	ID := int(volproto.ObjectID)
+	srcVol, err := nvme.cs.api.GetVolume(ID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, restoreType+" not found: %s", volumeContentID)
+	}
+	if int64(srcVol.Size) != sizeInKbytes {
+		return nil, status.Errorf(codes.InvalidArgument,
+			restoreType+" %s has incompatible size %d kbytes with requested %d kbytes",
+			volumeContentID, srcVol.Size, sizeInKbytes)
+	}
+	storagePoolID, err := nvme.cs.api.GetStoragePoolIDByName(storagePool)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"error while getting storagepoolid with name %s ", storagePool)
+	}
+	if storagePoolID != srcVol.PoolId {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"volume storage pool is different than the requested storage pool %s", storagePool)
+	}
+	ssdEnabled, _ := strconv.ParseBool(req.GetParameters()["ssd_enabled"])
+	snapResponse, err := nvme.cs.api.CreateSnapshotVolume(&api.VolumeSnapshot{
+		ParentID:       ID,
+		SnapshotName:   name,
+		WriteProtected: readOnlyVolume(req.GetVolumeCapabilities()),
+		SsdEnabled:     ssdEnabled,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to create snapshot: %s", err.Error())
+	}
+	dstVol, err := nvme.cs.api.GetVolume(snapResponse.SnapShotID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not retrieve created volume: %d", snapResponse.SnapShotID)
+	}
+	csiVolume := nvme.cs.getCSIResponse(dstVol, req, NVMeTCP)
+	copyRequestParameters(req.GetParameters(), csiVolume.VolumeContext)
+
+	metadata := nvme.cs.getVolumeMetadata(dstVol.Name, req.GetParameters())
+	metadata[MetadataFilesystemType] = req.GetParameters()["fstype"]
+	if _, err = nvme.cs.api.AttachMetadataToObject(int64(dstVol.ID), metadata); err != nil {
+		log.Errorf("fail to attach metadata for volume %s: %v", dstVol.Name, err)
+		return &csi.CreateVolumeResponse{}, errors.New("error attach metadata")
+	}
+	return &csi.CreateVolumeResponse{Volume: csiVolume}, nil
+}
+
+//ControllerPublishVolume map volume to host of node, the LUN of the mapping is the namespace ID of the volume in the subsystem
+func (nvme *nvmetcpstorage) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (resp *csi.ControllerPublishVolumeResponse, err error) {
+	log.FromContext(ctx).Infof("ControllerPublishVolume called with nodeID %s and volumeId %s", req.GetNodeId(), req.GetVolumeId())
+	volproto, err := csiid.Parse(req.GetVolumeId())
+	if err != nil {
+		log.FromContext(ctx).Errorf("Failed to validate storage type %v", err)
+		return &csi.ControllerPublishVolumeResponse{}, errors.New("error getting volume id")
+	}
+	volID := int(volproto.ObjectID)
+
+	hostName, _, err := csiid.ParseNodeID(req.GetNodeId())
+	if err != nil {
+		return &csi.ControllerPublishVolumeResponse{}, err
+	}
+	// host creation and lun mapping are serialised per host
+	ctx, unlock, err := lock.Get().Lock(ctx, lock.HostKey(hostName))
+	if err != nil {
+		return &csi.ControllerPublishVolumeResponse{}, status.Error(codes.Aborted, err.Error())
+	}
+	defer lock.Release(unlock, &err)
+
+	host, err := nvme.cs.validateHost(hostName)
+	if err != nil {
+		return &csi.ControllerPublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
+	}
+	ports := []string{}
+	for _, port := range host.Ports {
+		if port.PortType == nvmeHostPortType {
+			ports = append(ports, port.PortAddress)
+		}
+	}
+
+	lunList, err := nvme.cs.api.GetAllLunByHost(host.ID)
+	if err != nil {
+		return &csi.ControllerPublishVolumeResponse{}, err
+	}
+	lun := -1
+	for _, mapped := range lunList {
+		if mapped.VolumeID == volID {
+			log.FromContext(ctx).Debugf("volumeID %d already mapped to host %s", volID, host.Name)
+			lun = mapped.Lun
+		}
+	}
+	if lun < 0 {
+		maxAllowedVol, err := strconv.Atoi(req.GetVolumeContext()["max_vols_per_host"])
+		if err != nil {
+			log.FromContext(ctx).Errorf("Invalid parameter max_vols_per_host error:  %v", err)
+			return &csi.ControllerPublishVolumeResponse{}, err
+		}
+		if len(lunList) >= maxAllowedVol {
+			log.FromContext(ctx).Errorf("unable to publish volume on host %s, as maximum allowed volume per host is (%d), limit reached", host.Name, maxAllowedVol)
+			return &csi.ControllerPublishVolumeResponse{}, status.Error(codes.Internal, "Unable to publish volume as max allowed volume (per host) limit reached")
+		}
+		log.FromContext(ctx).Debugf("mapping volume %d to host %s", volID, host.Name)
+		luninfo, err := nvme.cs.mapVolumeTohost(volID, host.ID)
+		if err != nil {
+			log.FromContext(ctx).Errorf("Failed to map volume to host with error %v", err)
+			return &csi.ControllerPublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
+		}
+		lun = luninfo.Lun
+	}
+	volCtx, err := nvme.cs.publishContext(volID, host, lun, strings.Join(ports, ","))
+	if err != nil {
+		return &csi.ControllerPublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.ControllerPublishVolumeResponse{PublishContext: volCtx}, nil
+}
@@ -0,0 +1,111 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"infinibox-csi-driver/api"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type NVMeTCPControllerSuite struct {
+	suite.Suite
+	api *api.MockApiService
+	cs  *commonservice
+}
+
+func TestNVMeTCPControllerSuite(t *testing.T) {
+	suite.Run(t, new(NVMeTCPControllerSuite))
+}
+
+func (suite *NVMeTCPControllerSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+	suite.cs = &commonservice{api: suite.api}
+}
+
+func (suite *NVMeTCPControllerSuite) service() *nvmetcpstorage {
+	return &nvmetcpstorage{fcstorage: fcstorage{cs: *suite.cs}}
+}
+
+func getNVMeTCPCreateVolumeParameter() map[string]string {
+	return map[string]string{"fstype": "xfs", "pool_name": "pool_name1", "network_space": "nvme_space", "provision_type": "THIN",
+		"storage_protocol": "nvme_tcp", "ssd_enabled": "true", "max_vols_per_host": "10"}
+}
+
+func getNVMeNetworkSpace() api.NetworkSpace {
+	nspace := getNetworkspace()
+	nspace.Properties.NvmeNqn = "nqn.2009-11.com.infinidat:storage:infinibox-sn-1234"
+	nspace.Portals = append(nspace.Portals, api.Portal{IpAdress: "10.20.30.41", Enabled: false}, api.Portal{IpAdress: "fd00::41", Enabled: true})
+	return nspace
+}
+
+func (suite *NVMeTCPControllerSuite) Test_CreateVolume_InvalidParameter() {
+	parameterMap := getNVMeTCPCreateVolumeParameter()
+	delete(parameterMap, "network_space")
+	_, err := suite.service().CreateVolume(context.Background(), getISCSICreateValumeRequest("pvname", parameterMap))
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err))
+}
+
+func (suite *NVMeTCPControllerSuite) Test_CreateVolume_NoSubsystem() {
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", "nvme_space").Return(getNetworkspace(), nil)
+	_, err := suite.service().CreateVolume(context.Background(), getISCSICreateValumeRequest("pvname", getNVMeTCPCreateVolumeParameter()))
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err))
+	suite.api.AssertNotCalled(suite.T(), "CreateVolume", mock.Anything, mock.Anything)
+}
+
+func (suite *NVMeTCPControllerSuite) Test_CreateVolume_Success() {
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", "nvme_space").Return(getNVMeNetworkSpace(), nil)
+	suite.api.On("CreateVolume", mock.Anything, "pool_name1").Return(getVolume(), nil)
+	suite.api.On("AttachMetadataToObject", int64(100), mock.Anything).Return(nil, nil)
+
+	resp, err := suite.service().CreateVolume(context.Background(), getISCSICreateValumeRequest("pvname", getNVMeTCPCreateVolumeParameter()))
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "100$$nvme_tcp", resp.GetVolume().GetVolumeId())
+	assert.Equal(suite.T(), "nqn.2009-11.com.infinidat:storage:infinibox-sn-1234", resp.GetVolume().GetVolumeContext()[NVMeSubsystemNQN])
+	assert.Equal(suite.T(), "10.20.30.40:4420,[fd00::41]:4420", resp.GetVolume().GetVolumeContext()[NVMePortals], "enabled portals only")
+}
+
+func (suite *NVMeTCPControllerSuite) Test_ControllerPublishVolume() {
+	host := getHostByName()
+	host.Ports = append(host.Ports, api.HostPort{PortType: nvmeHostPortType, PortAddress: "nqn.2014-08.org.nvmexpress:uuid:node1"})
+	suite.api.On("GetHostByName", "10.20.20.50").Return(host, nil)
+	suite.api.On("GetAllLunByHost", 10).Return([]api.LunInfo{}, nil)
+	suite.api.On("MapVolumeToHost", 10).Return(api.LunInfo{Lun: 3}, nil)
+	suite.api.On("GetVolume", 1).Return(getVolume(), nil)
+
+	req := getISCSIControllerPublishVolumeRequest()
+	req.VolumeId = "1$$nvme_tcp"
+	resp, err := suite.service().ControllerPublishVolume(context.Background(), req)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "3", resp.GetPublishContext()["lun"], "LUN of the mapping is the namespace ID")
+	assert.Equal(suite.T(), "nqn.2014-08.org.nvmexpress:uuid:node1", resp.GetPublishContext()["hostPorts"], "host ports of other protocols are left out")
+}
+
+func (suite *NVMeTCPControllerSuite) Test_ControllerPublishVolume_AlreadyMapped() {
+	suite.api.On("GetHostByName", "10.20.20.50").Return(getHostByName(), nil)
+	suite.api.On("GetAllLunByHost", 10).Return([]api.LunInfo{{VolumeID: 1, Lun: 7}}, nil)
+	suite.api.On("GetVolume", 1).Return(getVolume(), nil)
+
+	req := getISCSIControllerPublishVolumeRequest()
+	req.VolumeId = "1$$nvme_tcp"
+	resp, err := suite.service().ControllerPublishVolume(context.Background(), req)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "7", resp.GetPublishContext()["lun"])
+	suite.api.AssertNotCalled(suite.T(), "MapVolumeToHost", mock.Anything)
+}
@@ -0,0 +1,384 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"infinibox-csi-driver/helper/driverconfig"
+	"infinibox-csi-driver/helper/hostexec"
+	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+//hostNQNFile NVMe host NQN of the node, written when nvme-cli is installed
+const hostNQNFile = "/etc/nvme/hostnqn"
+
+var (
+	nvmeControllerRe = regexp.MustCompile(`^nvme[0-9]+$`)
+	nvmeNamespaceRe  = regexp.MustCompile(`^nvme[0-9]+n[0-9]+$`)
+)
+
+//nvmeDisk NVMe/TCP volume published on the node, persisted in the staging path as iSCSI and FC disks are
+type nvmeDisk struct {
+	VolName      string
+	SubsystemNQN string
+	Portals      []string
+	Nsid         string
+	Device       string
+	IsBlock      bool
+}
+
+//getHostNQN NVMe host NQN of the node, empty when it is not configured
+func getHostNQN() string {
+	out, err := hostexec.Get().ReadFile(hostNQNFile)
+	if err != nil {
+		log.Errorf("Failed to get host NQN with error %v", err)
+		return ""
+	}
+	hostNQN := strings.TrimSpace(string(out))
+	if hostNQN == "" {
+		log.Errorf("Failed to get host NQN, %s is empty", hostNQNFile)
+	}
+	return hostNQN
+}
+
+//NodeStageVolume register the host NQN of the node as port of its host, so the volumes mapped to the host are namespaces the node can see
+func (nvme *nvmetcpstorage) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("Recovered from NVMe/TCP NodeStageVolume  " + fmt.Sprint(res))
+		}
+	}()
+	log.FromContext(ctx).Info("NodeStageVolume called with ", req.GetPublishContext())
+	hostID, _ := strconv.Atoi(req.GetPublishContext()["hostID"])
+	if hostID < 1 {
+		log.FromContext(ctx).Errorf("hostID %d is not valid host ID", hostID)
+		return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, "not a valid host")
+	}
+	hostNQN := getHostNQN()
+	if hostNQN == "" {
+		return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, "Host NQN not found")
+	}
+	for _, port := range strings.Split(req.GetPublishContext()["hostPorts"], ",") {
+		if port == hostNQN {
+			return &csi.NodeStageVolumeResponse{}, nil
+		}
+	}
+	log.FromContext(ctx).Debugf("host port %s is not created, creating it", hostNQN)
+	if err = nvme.cs.AddPortForHost(hostID, nvmeHostPortType, hostNQN); err != nil {
+		return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+//NodePublishVolume connect to the subsystem of volume and mount the namespace of the volume
+func (nvme *nvmetcpstorage) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	log.FromContext(ctx).Debugf("NodePublishVolume called")
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
+	}
+	disk := nvmeDisk{
+		VolName:      diskName(req.GetVolumeId()),
+		SubsystemNQN: req.GetVolumeContext()[NVMeSubsystemNQN],
+		Nsid:         req.GetPublishContext()["lun"],
+		IsBlock:      volCap.GetBlock() != nil,
+	}
+	for _, portal := range strings.Split(req.GetVolumeContext()[NVMePortals], ",") {
+		if portal != "" {
+			disk.Portals = append(disk.Portals, portal)
+		}
+	}
+	if disk.SubsystemNQN == "" || disk.Nsid == "" || len(disk.Portals) == 0 {
+		return nil, status.Error(codes.Internal, "NVMe/TCP target information is missing")
+	}
+	hostNQN := getHostNQN()
+	if hostNQN == "" {
+		return nil, status.Error(codes.Internal, "Host NQN not found")
+	}
+	exec := hostExec(ctx)
+	devices := newNVMeDevices()
+	if err := devices.connect(exec, disk.SubsystemNQN, disk.Portals, hostNQN); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	device, err := devices.wait(disk.SubsystemNQN, disk.Nsid, driverconfig.Get().Timeouts.DeviceAttach.Duration, func() { devices.rescan(exec, disk.SubsystemNQN) })
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := devices.verify(device, req.GetPublishContext()[publishContextWWID]); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	disk.Device = device
+	mounter := &mount.SafeFormatAndMount{Interface: hostMounter(ctx), Exec: exec}
+	if err := nvme.mountNVMeDisk(mounter, disk, req); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (nvme *nvmetcpstorage) mountNVMeDisk(mounter *mount.SafeFormatAndMount, disk nvmeDisk, req *csi.NodePublishVolumeRequest) error {
+	targetPath := req.GetTargetPath()
+	notMnt, err := mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Heuristic determination of mount point failed: %v", err)
+	}
+	if !notMnt {
+		log.Infof("nvme: %s already mounted", targetPath)
+		return nil
+	}
+	// a block device opened for writing through a read only bind mount fails with EROFS
+	options := []string{"rw"}
+	if readOnlyPublish(req.GetReadonly(), req.GetVolumeCapability()) {
+		options = []string{"ro"}
+	}
+	if disk.IsBlock {
+		if err := hostexec.Get().MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+			return fmt.Errorf("nvme: failed to mkdir %s: %v", filepath.Dir(targetPath), err)
+		}
+		if err := hostexec.Get().WriteFile(targetPath, nil, 0640); err != nil {
+			return fmt.Errorf("failed to create target file for raw block bind mount: %v", err)
+		}
+		if err := mounter.Mount(disk.Device, targetPath, "", append([]string{"bind"}, options...)); err != nil {
+			metrics.MountFailure(NVMeTCP)
+			return fmt.Errorf("nvme: failed to mount %s to %s: %v", disk.Device, targetPath, err)
+		}
+	} else {
+		if err := hostexec.Get().MkdirAll(targetPath, 0750); err != nil {
+			return fmt.Errorf("nvme: failed to mkdir %s: %v", targetPath, err)
+		}
+		fsType := req.GetVolumeContext()["fstype"]
+		if readOnlyPublish(req.GetReadonly(), req.GetVolumeCapability()) {
+			options = readOnlyMountOptions(fsType)
+		}
+		options = append(options, req.GetVolumeCapability().GetMount().GetMountFlags()...)
+		if err := mounter.FormatAndMount(disk.Device, targetPath, fsType, options); err != nil {
+			metrics.MountFailure(NVMeTCP)
+			return fmt.Errorf("nvme: failed to mount %s [%s] to %s: %v", disk.Device, fsType, targetPath, err)
+		}
+	}
+	if err := writeDiskConfig(disk, req.GetStagingTargetPath(), disk.VolName); err != nil {
+		return fmt.Errorf("nvme: %v", err)
+	}
+	log.Debugf("mounted namespace %s of %s at %s", disk.Nsid, disk.SubsystemNQN, targetPath)
+	return nil
+}
+
+//NodeUnstageVolume disconnect from the subsystem of volume when no other namespace of it is left on the node, and remove the staging path.
+//A namespace still mounted or held by another device is not disconnected unless teardown.force is set.
+func (nvme *nvmetcpstorage) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("Recovered from NVMe/TCP NodeUnstageVolume  " + fmt.Sprint(res))
+		}
+	}()
+	stagePath := req.GetStagingTargetPath()
+	disk := nvmeDisk{}
+	if err = readDiskConfig(&disk, stagePath, diskName(req.GetVolumeId())); err != nil {
+		confFile := path.Join(stagePath, diskName(req.GetVolumeId())+".json")
+		if pathExist, pathErr := nvme.cs.pathExists(confFile); pathErr != nil || pathExist {
+			log.FromContext(ctx).Warnf("nvme: failed to get config from path %s: %v", stagePath, err)
+		}
+	} else {
+		devices := newNVMeDevices()
+		others := devices.namespaces(disk.SubsystemNQN)
+		delete(others, disk.Nsid)
+		if len(others) == 0 {
+			// the connection is the only path of the namespace, a mounted or held namespace would fail with I/O errors
+			teardown := nvme.cs.newDeviceTeardown()
+			if err = teardown.checkUnused(filepath.Base(fromHost(disk.Device)), nil); err != nil {
+				if !teardown.force {
+					log.FromContext(ctx).Errorf("nvme: not disconnecting from %s: %v", disk.SubsystemNQN, err)
+					return nil, status.Errorf(codes.FailedPrecondition, "namespace %s of %s: %v", disk.Nsid, disk.SubsystemNQN, err)
+				}
+				log.FromContext(ctx).Warnf("%v, disconnecting from %s anyway because teardown.force is set", err, disk.SubsystemNQN)
+			}
+			log.FromContext(ctx).Debugf("disconnect from subsystem %s, namespace %s was its last one", disk.SubsystemNQN, disk.Nsid)
+			if out, err := hostExec(ctx).Run("nvme", "disconnect", "-n", disk.SubsystemNQN); err != nil {
+				log.FromContext(ctx).Errorf("nvme: failed to disconnect from %s: %s (%v)", disk.SubsystemNQN, strings.TrimSpace(string(out)), err)
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		} else {
+			log.FromContext(ctx).Debugf("keep connection to subsystem %s, namespaces %v are left", disk.SubsystemNQN, others)
+		}
+	}
+	if err = hostexec.Get().RemoveAll(stagePath); err != nil {
+		log.FromContext(ctx).Errorf("nvme: failed to remove mount path Error: %v", err)
+		return nil, err
+	}
+	removeStageRecord(stagePath)
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+//nvmeDevices find namespaces of NVMe subsystems in sysfs of the host, read through host. With native NVMe multipath the kernel
+//presents a namespace reached through every controller of its subsystem as one nvme<subsystem>n<namespace> device.
+type nvmeDevices struct {
+	host hostexec.Executor
+}
+
+func newNVMeDevices() nvmeDevices {
+	return nvmeDevices{host: hostexec.Get()}
+}
+
+//subsystem sysfs directory of subsystem nqn, empty when the node is not connected to it
+func (n nvmeDevices) subsystem(nqn string) string {
+	dirs, _ := n.host.Glob("/sys/class/nvme-subsystem/*")
+	for _, dir := range dirs {
+		if found, err := n.host.ReadFile(filepath.Join(dir, "subsysnqn")); err == nil && strings.TrimSpace(string(found)) == nqn {
+			return dir
+		}
+	}
+	return ""
+}
+
+//entries names of sysfs entries of subsystem nqn matching re, with the content of their attribute file
+func (n nvmeDevices) entries(nqn string, re *regexp.Regexp, attribute string) map[string]string {
+	entries := map[string]string{}
+	dir := n.subsystem(nqn)
+	if dir == "" {
+		return entries
+	}
+	names, _ := n.host.ReadDir(dir)
+	for _, name := range names {
+		if !re.MatchString(name) {
+			continue
+		}
+		if value, err := n.host.ReadFile(filepath.Join(dir, name, attribute)); err == nil {
+			entries[name] = strings.TrimSpace(string(value))
+		}
+	}
+	return entries
+}
+
+//controllers live controllers of subsystem nqn by their portal, address:port as in the volume context
+func (n nvmeDevices) controllers(nqn string) map[string]string {
+	controllers := map[string]string{}
+	states := n.entries(nqn, nvmeControllerRe, "state")
+	for name, address := range n.entries(nqn, nvmeControllerRe, "address") {
+		if states[name] != "live" {
+			continue
+		}
+		fields := map[string]string{}
+		for _, field := range strings.Split(address, ",") {
+			if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+				fields[kv[0]] = kv[1]
+			}
+		}
+		controllers[net.JoinHostPort(fields["traddr"], fields["trsvcid"])] = name
+	}
+	return controllers
+}
+
+//namespaces devices of the namespaces of subsystem nqn by namespace ID
+func (n nvmeDevices) namespaces(nqn string) map[string]string {
+	namespaces := map[string]string{}
+	for name, nsid := range n.entries(nqn, nvmeNamespaceRe, "nsid") {
+		namespaces[nsid] = "/dev/" + name
+	}
+	return namespaces
+}
+
+//connect connect to the portals of subsystem nqn without a live controller. A portal failing is logged,
+//connect fails only when no controller of the subsystem is live, namespaces are then reached through the others.
+func (n nvmeDevices) connect(exec mount.Exec, nqn string, portals []string, hostNQN string) error {
+	connected := n.controllers(nqn)
+	var lastErr error
+	for _, portal := range portals {
+		if _, ok := connected[portal]; ok {
+			continue
+		}
+		address, port, err := net.SplitHostPort(portal)
+		if err != nil {
+			lastErr = fmt.Errorf("invalid portal %s: %v", portal, err)
+			continue
+		}
+		out, err := exec.Run("nvme", "connect", "-t", "tcp", "-a", address, "-s", port, "-n", nqn, "-q", hostNQN)
+		if err != nil && !strings.Contains(string(out), "already connected") {
+			lastErr = fmt.Errorf("nvme connect to %s failed: %s (%v)", portal, strings.TrimSpace(string(out)), err)
+			log.Warn(lastErr)
+		}
+	}
+	if len(n.controllers(nqn)) == 0 {
+		return fmt.Errorf("no live controller of subsystem %s, last error: %v", nqn, lastErr)
+	}
+	return nil
+}
+
+//rescan ask controllers of subsystem nqn for namespaces mapped since they connected
+func (n nvmeDevices) rescan(exec mount.Exec, nqn string) {
+	for _, controller := range n.controllers(nqn) {
+		if out, err := exec.Run("nvme", "ns-rescan", "/dev/"+controller); err != nil {
+			log.Warnf("nvme ns-rescan of %s failed: %s (%v)", controller, strings.TrimSpace(string(out)), err)
+		}
+	}
+}
+
+//verify device is the namespace of the volume with NAA WWID wwid, by the NGUID InfiniBox derives from the volume serial.
+//A namespace ID reused for another volume before the node rescanned is not mounted. Without wwid the volume has no serial.
+func (n nvmeDevices) verify(device, wwid string) error {
+	if wwid == "" {
+		log.Warnf("volume has no WWID, namespace %s is not verified", device)
+		return nil
+	}
+	block := filepath.Join("/sys/block", filepath.Base(device))
+	found := []string{}
+	for _, attribute := range []string{"nguid", "wwid"} {
+		value, err := n.host.ReadFile(filepath.Join(block, attribute))
+		if err != nil {
+			continue
+		}
+		id := strings.TrimSpace(string(value))
+		found = append(found, id)
+		id = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(id), "eui."), "nvme.")
+		if naaWWID(id) == naaWWID(wwid) {
+			return nil
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("identity of %s is not readable, it is not verified to be volume %s", device, wwid)
+	}
+	return fmt.Errorf("%s is %v, not volume %s", device, found, wwid)
+}
+
+//wait find device of namespace nsid of subsystem nqn for up to timeout, rescan is called between searches when it is not nil
+func (n nvmeDevices) wait(nqn, nsid string, timeout time.Duration, rescan func()) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if device := n.namespaces(nqn)[nsid]; device != "" {
+			log.Debugf("found device %s of namespace %s of %s", device, nsid, nqn)
+			return device, nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no device of namespace %s of %s found after %v", nsid, nqn, timeout)
+		}
+		if rescan != nil {
+			rescan()
+		}
+		time.Sleep(deviceWaitInterval)
+	}
+}
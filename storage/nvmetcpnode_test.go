@@ -0,0 +1,218 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"errors"
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper/driverconfig"
+	"infinibox-csi-driver/helper/hostexec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testSubsystemNQN = "nqn.2009-11.com.infinidat:storage:infinibox-sn-1234"
+	testHostNQN      = "nqn.2014-08.org.nvmexpress:uuid:node1"
+)
+
+type NVMeTCPNodeSuite struct {
+	suite.Suite
+	root     string
+	fake     *hostexec.Fake
+	previous hostexec.Executor
+}
+
+func TestNVMeTCPNodeSuite(t *testing.T) {
+	suite.Run(t, new(NVMeTCPNodeSuite))
+}
+
+func (suite *NVMeTCPNodeSuite) SetupTest() {
+	root, err := ioutil.TempDir("", "nvmetcpnode")
+	suite.Require().NoError(err)
+	suite.root = root
+	suite.fake = hostexec.NewFake(root)
+	suite.previous = hostexec.Get()
+	hostexec.Set(suite.fake)
+}
+
+func (suite *NVMeTCPNodeSuite) TearDownTest() {
+	hostexec.Set(suite.previous)
+	os.RemoveAll(suite.root)
+}
+
+func (suite *NVMeTCPNodeSuite) writeFile(name, content string) {
+	file := filepath.Join(suite.root, name)
+	suite.Require().NoError(os.MkdirAll(filepath.Dir(file), 0755))
+	suite.Require().NoError(ioutil.WriteFile(file, []byte(content), 0644))
+}
+
+//controller sysfs entry of a controller of subsystem subsys connected to address:4420
+func (suite *NVMeTCPNodeSuite) controller(subsys, name, address, state string) {
+	dir := filepath.Join("sys/class/nvme-subsystem", subsys, name)
+	suite.writeFile(filepath.Join(dir, "address"), "traddr="+address+",trsvcid=4420,src_addr=10.20.20.50\n")
+	suite.writeFile(filepath.Join(dir, "state"), state+"\n")
+}
+
+func (suite *NVMeTCPNodeSuite) namespace(subsys, name, nsid string) {
+	suite.writeFile(filepath.Join("sys/class/nvme-subsystem", subsys, name, "nsid"), nsid+"\n")
+}
+
+func (suite *NVMeTCPNodeSuite) Test_getHostNQN() {
+	assert.Equal(suite.T(), "", getHostNQN(), "no hostnqn on host")
+
+	suite.writeFile("etc/nvme/hostnqn", testHostNQN+"\n")
+	assert.Equal(suite.T(), testHostNQN, getHostNQN())
+}
+
+func (suite *NVMeTCPNodeSuite) Test_namespaces() {
+	suite.writeFile("sys/class/nvme-subsystem/nvme-subsys0/subsysnqn", "nqn.2014-08.org.nvmexpress:local-disk\n")
+	suite.namespace("nvme-subsys0", "nvme0n1", "5")
+	suite.writeFile("sys/class/nvme-subsystem/nvme-subsys1/subsysnqn", testSubsystemNQN+"\n")
+	suite.controller("nvme-subsys1", "nvme1", "10.20.30.40", "live")
+	suite.controller("nvme-subsys1", "nvme2", "fd00::41", "connecting")
+	suite.namespace("nvme-subsys1", "nvme1n1", "1")
+	suite.namespace("nvme-subsys1", "nvme1n2", "5")
+
+	devices := newNVMeDevices()
+	assert.Equal(suite.T(), map[string]string{"1": "/dev/nvme1n1", "5": "/dev/nvme1n2"}, devices.namespaces(testSubsystemNQN), "namespaces of other subsystems are left out")
+	assert.Equal(suite.T(), map[string]string{"10.20.30.40:4420": "nvme1"}, devices.controllers(testSubsystemNQN), "only live controllers")
+	assert.Empty(suite.T(), devices.namespaces("nqn.2009-11.com.infinidat:storage:infinibox-sn-5678"))
+
+	device, err := devices.wait(testSubsystemNQN, "5", time.Second, nil)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "/dev/nvme1n2", device)
+}
+
+func (suite *NVMeTCPNodeSuite) Test_connect() {
+	suite.writeFile("sys/class/nvme-subsystem/nvme-subsys1/subsysnqn", testSubsystemNQN+"\n")
+	suite.controller("nvme-subsys1", "nvme1", "10.20.30.40", "live")
+	suite.fake.Expect("nvme connect -t tcp -a fd00::41 -s 4420 -n "+testSubsystemNQN+" -q "+testHostNQN, "", nil).Do = func() {
+		suite.controller("nvme-subsys1", "nvme2", "fd00::41", "live")
+	}
+	suite.fake.Expect("nvme connect -t tcp -a 10.20.30.42 -s 4420 -n "+testSubsystemNQN+" -q "+testHostNQN, "could not add new controller", errors.New("exit status 1"))
+
+	devices := newNVMeDevices()
+	err := devices.connect(hostExec(context.Background()), testSubsystemNQN, []string{"10.20.30.40:4420", "[fd00::41]:4420", "10.20.30.42:4420"}, testHostNQN)
+	assert.Nil(suite.T(), err, "a portal failing does not fail connect")
+	assert.Empty(suite.T(), suite.fake.Unused())
+	assert.Len(suite.T(), suite.fake.Calls(), 2, "portal with a live controller is not connected again")
+	assert.Len(suite.T(), devices.controllers(testSubsystemNQN), 2)
+}
+
+func (suite *NVMeTCPNodeSuite) Test_connect_Fail() {
+	suite.fake.Expect("nvme connect -t tcp -a 10.20.30.40 -s 4420 -n "+testSubsystemNQN+" -q "+testHostNQN, "Failed to write to /dev/nvme-fabrics: Connection refused", errors.New("exit status 1"))
+
+	err := newNVMeDevices().connect(hostExec(context.Background()), testSubsystemNQN, []string{"10.20.30.40:4420"}, testHostNQN)
+	assert.NotNil(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), "Connection refused")
+}
+
+func (suite *NVMeTCPNodeSuite) Test_NodeStageVolume() {
+	suite.writeFile("etc/nvme/hostnqn", testHostNQN+"\n")
+	mockAPI := new(api.MockApiService)
+	mockAPI.On("AddHostPort", nvmeHostPortType, testHostNQN, 10).Return(api.HostPort{}, nil)
+	nvme := &nvmetcpstorage{fcstorage: fcstorage{cs: commonservice{api: mockAPI}}}
+
+	_, err := nvme.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{PublishContext: map[string]string{"hostID": "10", "hostPorts": ""}})
+	assert.Nil(suite.T(), err)
+	mockAPI.AssertNumberOfCalls(suite.T(), "AddHostPort", 1)
+
+	_, err = nvme.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{PublishContext: map[string]string{"hostID": "10", "hostPorts": testHostNQN}})
+	assert.Nil(suite.T(), err)
+	mockAPI.AssertNumberOfCalls(suite.T(), "AddHostPort", 1)
+}
+
+func (suite *NVMeTCPNodeSuite) Test_NodeUnstageVolume() {
+	stagePath := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"
+	suite.Require().NoError(os.MkdirAll(filepath.Join(suite.root, stagePath), 0755))
+	suite.writeFile("sys/class/nvme-subsystem/nvme-subsys1/subsysnqn", testSubsystemNQN+"\n")
+	suite.namespace("nvme-subsys1", "nvme1n1", "1")
+	suite.namespace("nvme-subsys1", "nvme1n2", "5")
+	disk := nvmeDisk{VolName: "100", SubsystemNQN: testSubsystemNQN, Portals: []string{"10.20.30.40:4420"}, Nsid: "5", Device: "/dev/nvme1n2"}
+	suite.Require().NoError(writeDiskConfig(disk, stagePath, disk.VolName))
+	nvme := &nvmetcpstorage{}
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: "100$$nvme_tcp", StagingTargetPath: stagePath}
+
+	_, err := nvme.NodeUnstageVolume(context.Background(), req)
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), suite.fake.Calls(), "subsystem with another namespace stays connected")
+	_, err = os.Stat(filepath.Join(suite.root, stagePath))
+	assert.True(suite.T(), os.IsNotExist(err), "staging path is removed")
+
+	suite.Require().NoError(os.RemoveAll(filepath.Join(suite.root, "sys/class/nvme-subsystem/nvme-subsys1/nvme1n1")))
+	suite.Require().NoError(os.MkdirAll(filepath.Join(suite.root, stagePath), 0755))
+	suite.Require().NoError(writeDiskConfig(disk, stagePath, disk.VolName))
+	suite.fake.Expect("nvme disconnect -n "+testSubsystemNQN, "NQN:"+testSubsystemNQN+" disconnected 2 controller(s)", nil)
+	_, err = nvme.NodeUnstageVolume(context.Background(), req)
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), suite.fake.Unused(), "last namespace of subsystem disconnects")
+}
+
+func (suite *NVMeTCPNodeSuite) Test_NodeUnstageVolume_InUse() {
+	stagePath := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"
+	suite.Require().NoError(os.MkdirAll(filepath.Join(suite.root, stagePath), 0755))
+	suite.writeFile("sys/class/nvme-subsystem/nvme-subsys1/subsysnqn", testSubsystemNQN+"\n")
+	suite.namespace("nvme-subsys1", "nvme1n2", "5")
+	disk := nvmeDisk{VolName: "100", SubsystemNQN: testSubsystemNQN, Portals: []string{"10.20.30.40:4420"}, Nsid: "5", Device: "/dev/nvme1n2"}
+	suite.Require().NoError(writeDiskConfig(disk, stagePath, disk.VolName))
+	nvme := &nvmetcpstorage{}
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: "100$$nvme_tcp", StagingTargetPath: stagePath}
+
+	suite.writeFile("proc/1/mounts", "/dev/nvme1n2 /var/lib/kubelet/pods/pod1/volumes/kubernetes.io~csi/pvc-1/mount xfs rw 0 0\n")
+	_, err := nvme.NodeUnstageVolume(context.Background(), req)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err), "mounted namespace")
+	assert.Contains(suite.T(), err.Error(), "is mounted at")
+	assert.Empty(suite.T(), suite.fake.Calls(), "mounted namespace is not disconnected")
+	_, err = os.Stat(filepath.Join(suite.root, stagePath))
+	assert.Nil(suite.T(), err, "staging path is kept for the retry")
+
+	suite.writeFile("proc/1/mounts", "")
+	suite.writeFile("sys/block/nvme1n2/holders/dm-7", "")
+	_, err = nvme.NodeUnstageVolume(context.Background(), req)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err), "namespace held by another device")
+	assert.Empty(suite.T(), suite.fake.Calls())
+
+	previous := driverconfig.Get()
+	defer driverconfig.Apply(previous)
+	config := driverconfig.Get()
+	config.Teardown.Force = true
+	suite.Require().NoError(driverconfig.Apply(config))
+	suite.fake.Expect("nvme disconnect -n "+testSubsystemNQN, "", nil)
+	_, err = nvme.NodeUnstageVolume(context.Background(), req)
+	assert.Nil(suite.T(), err, "force disconnects namespace in use")
+	assert.Empty(suite.T(), suite.fake.Unused())
+}
+
+func (suite *NVMeTCPNodeSuite) Test_verify() {
+	suite.writeFile("sys/block/nvme1n2/nguid", "6742b0f0-0000-4e2b-0000-000000000100\n")
+	suite.writeFile("sys/block/nvme1n2/wwid", "eui.6742b0f000004e2b0000000000000100\n")
+	suite.writeFile("sys/block/nvme1n3/wwid", "eui.6742b0f000004e2b0000000000000200\n")
+	devices := newNVMeDevices()
+
+	assert.Nil(suite.T(), devices.verify("/dev/nvme1n2", "6742b0f000004e2b0000000000000100"))
+	assert.Nil(suite.T(), devices.verify("/dev/nvme1n2", ""), "volume without serial is not verified")
+
+	err := devices.verify("/dev/nvme1n3", "6742b0f000004e2b0000000000000100")
+	assert.NotNil(suite.T(), err, "namespace of another volume")
+	assert.Contains(suite.T(), err.Error(), "0200")
+	assert.NotNil(suite.T(), devices.verify("/dev/nvme1n4", "6742b0f000004e2b0000000000000100"), "identity is not readable")
+}
@@ -0,0 +1,142 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"infinibox-csi-driver/helper/csiid"
+	log "infinibox-csi-driver/helper/logger"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+//RollbackCreateVolume undo CreateVolume of name interrupted by a previous driver process, which left the saga of its steps unfinished.
+//An object still lacking the PV metadata CreateVolume attaches last is deleted with its exports, shares and treeq count,
+//complete objects are kept for the retried CreateVolume to return.
+func RollbackCreateVolume(ctx context.Context, name string, parameters map[string]string, configparams ...map[string]string) (err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("Recovered from RollbackCreateVolume  " + fmt.Sprint(res))
+		}
+	}()
+	protocol := strings.TrimSpace(parameters["storage_protocol"])
+	controller, err := NewStorageController(ctx, protocol, configparams...)
+	if err != nil {
+		return err
+	}
+	objectName, err := getObjectName(name, parameters)
+	if err != nil {
+		return err
+	}
+	var cs *commonservice
+	objectType := csiid.Volume
+	switch s := controller.(type) {
+	case *treeqstorage:
+		return s.rollbackTreeq(ctx, objectName, parameters)
+	case *fcstorage:
+		cs = &s.cs
+	case *iscsistorage:
+		cs = &s.cs
+	case *nvmetcpstorage:
+		cs = &s.cs
+	case *nfsstorage:
+		cs, objectType = &s.cs, csiid.FileSystem
+	case *smbstorage:
+		cs, objectType = &s.cs, csiid.FileSystem
+	default:
+		return fmt.Errorf("rollback of %s volumes is not supported", protocol)
+	}
+	objectID, err := cs.partialObject(objectType, objectName)
+	if err != nil || objectID == 0 {
+		return err
+	}
+	volumeID := cs.newID(protocol, objectType, objectID).String()
+	log.FromContext(ctx).Warnf("deleting %s of interrupted CreateVolume %s, it lacks PV metadata", volumeID, name)
+	_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	return err
+}
+
+//partialObject id of volume or filesystem named name when it has no PV metadata yet, 0 when it is absent or complete
+func (cs *commonservice) partialObject(objectType csiid.ObjectType, name string) (int64, error) {
+	var objectID int64
+	if objectType == csiid.FileSystem {
+		fileSystem, err := cs.api.GetFileSystemByName(name)
+		if err != nil && !strings.Contains(err.Error(), "filesystem with given name not found") {
+			return 0, err
+		}
+		if fileSystem != nil {
+			objectID = fileSystem.ID
+		}
+	} else {
+		volume, err := cs.api.GetVolumeByName(name)
+		if err != nil && !strings.Contains(err.Error(), "volume with given name not found") {
+			return 0, err
+		}
+		if volume != nil {
+			objectID = int64(volume.ID)
+		}
+	}
+	if objectID == 0 {
+		return 0, nil
+	}
+	complete, err := cs.hasMetadata(objectID, MetadataPVName)
+	if err != nil || complete {
+		return 0, err
+	}
+	return objectID, nil
+}
+
+//hasMetadata true when object carries metadata key
+func (cs *commonservice) hasMetadata(objectID int64, key string) (bool, error) {
+	metadata, err := cs.api.GetObjectMetadata(objectID)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range *metadata {
+		if m.Key == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//rollbackTreeq delete treeq named name when its metadata is missing on its filesystem, and count treeqs of the filesystem again
+func (treeq *treeqstorage) rollbackTreeq(ctx context.Context, name string, parameters map[string]string) error {
+	filesystem, ok := treeq.filesysService.(*FilesystemService)
+	if !ok {
+		return errors.New("treeq rollback needs the filesystem service")
+	}
+	filesystem.configmap = parameters
+	treeqVolume, err := filesystem.IsTreeqAlreadyExist(parameters["pool_name"], parameters["network_space"], name)
+	if err != nil || treeqVolume["TREEQID"] == "" {
+		return err
+	}
+	filesystemID, _ := strconv.ParseInt(treeqVolume["ID"], 10, 64)
+	treeqID, _ := strconv.ParseInt(treeqVolume["TREEQID"], 10, 64)
+	complete, err := filesystem.cs.hasMetadata(filesystemID, treeqMetadataKey(treeqID, MetadataPVName))
+	if err != nil || complete {
+		return err
+	}
+	log.FromContext(ctx).Warnf("deleting treeq %d of filesystem %d of interrupted CreateVolume %s, it lacks PV metadata", treeqID, filesystemID, name)
+	if _, err := filesystem.cs.api.DeleteTreeq(filesystemID, treeqID); err != nil {
+		return err
+	}
+	count, err := filesystem.cs.api.GetFilesytemTreeqCount(filesystemID)
+	if err != nil {
+		return err
+	}
+	return filesystem.setTreeqCnt(filesystemID, count)
+}
@@ -0,0 +1,69 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper/csiid"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RecoverySuite struct {
+	suite.Suite
+	api *api.MockApiService
+	cs  *commonservice
+}
+
+func TestRecoverySuite(t *testing.T) {
+	suite.Run(t, new(RecoverySuite))
+}
+
+func (suite *RecoverySuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+	suite.cs = &commonservice{api: suite.api}
+}
+
+func (suite *RecoverySuite) Test_partialObject_Volume() {
+	suite.api.On("GetVolumeByName", "partial").Return(api.Volume{ID: 10}, nil)
+	suite.api.On("GetObjectMetadata", int64(10)).Return([]api.Metadata{{Key: MetadataPVCName, Value: "pvc"}}, nil)
+	suite.api.On("GetVolumeByName", "complete").Return(api.Volume{ID: 11}, nil)
+	suite.api.On("GetObjectMetadata", int64(11)).Return([]api.Metadata{{Key: MetadataPVName, Value: "pvc-1"}}, nil)
+	suite.api.On("GetVolumeByName", "absent").Return(nil, errors.New("volume with given name not found"))
+
+	id, err := suite.cs.partialObject(csiid.Volume, "partial")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(10), id, "volume without PV metadata is rolled back")
+
+	id, err = suite.cs.partialObject(csiid.Volume, "complete")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(0), id, "volume with PV metadata is kept")
+
+	id, err = suite.cs.partialObject(csiid.Volume, "absent")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(0), id)
+}
+
+func (suite *RecoverySuite) Test_partialObject_FileSystem() {
+	suite.api.On("GetFileSystemByName", "partial").Return(api.FileSystem{ID: 20}, nil)
+	suite.api.On("GetObjectMetadata", int64(20)).Return([]api.Metadata{}, nil)
+	suite.api.On("GetFileSystemByName", "failing").Return(api.FileSystem{}, errors.New("connection refused"))
+
+	id, err := suite.cs.partialObject(csiid.FileSystem, "partial")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(20), id)
+
+	_, err = suite.cs.partialObject(csiid.FileSystem, "failing")
+	assert.NotNil(suite.T(), err, "lookup failure is not taken for an absent filesystem")
+}
@@ -0,0 +1,81 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	log "infinibox-csi-driver/helper/logger"
+)
+
+//saga steps of a multi-step operation, each completed step registers a compensating action
+//and a failure of a later step runs the compensations in reverse order
+type saga struct {
+	name          string
+	compensations []compensation
+}
+
+type compensation struct {
+	name string
+	undo func() error
+}
+
+func newSaga(name string) *saga {
+	return &saga{name: name}
+}
+
+//step run do and, when it succeeds, register undo; undo may be nil for steps undone by an earlier compensation
+func (s *saga) step(name string, do func() error, undo func() error) error {
+	if err := do(); err != nil {
+		log.Errorf("%s: %s failed: %v", s.name, name, err)
+		return err
+	}
+	if undo != nil {
+		s.onUndo(name, undo)
+	}
+	return nil
+}
+
+//onUndo register compensation of work done outside step
+func (s *saga) onUndo(name string, undo func() error) {
+	s.compensations = append(s.compensations, compensation{name: name, undo: undo})
+}
+
+//rollback run compensations in reverse order, a failing compensation does not stop the others.
+//Errors of compensations are returned together, the objects they leave behind are logged.
+func (s *saga) rollback() error {
+	var failed []string
+	for i := len(s.compensations) - 1; i >= 0; i-- {
+		c := s.compensations[i]
+		if err := c.run(); err != nil {
+			log.Errorf("%s: failed to undo %s, it is left on the array: %v", s.name, c.name, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", c.name, err))
+			continue
+		}
+		log.Infof("%s: undid %s", s.name, c.name)
+	}
+	s.compensations = nil
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to undo %d steps of %s: %v", len(failed), s.name, failed)
+	}
+	return nil
+}
+
+//run compensation, a panic is a failure of the compensation
+func (c compensation) run() (err error) {
+	defer func() {
+		if res := recover(); res != nil {
+			err = errors.New("recovered from " + fmt.Sprint(res))
+		}
+	}()
+	return c.undo()
+}
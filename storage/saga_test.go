@@ -0,0 +1,82 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type SagaSuite struct {
+	suite.Suite
+}
+
+func TestSagaSuite(t *testing.T) {
+	suite.Run(t, new(SagaSuite))
+}
+
+func (suite *SagaSuite) Test_Rollback_ReverseOrder() {
+	var undone []string
+	tx := newSaga("test")
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		err := tx.step(name, func() error { return nil }, func() error {
+			undone = append(undone, name)
+			return nil
+		})
+		assert.Nil(suite.T(), err)
+	}
+	assert.Nil(suite.T(), tx.rollback())
+	assert.Equal(suite.T(), []string{"third", "second", "first"}, undone)
+
+	undone = nil
+	assert.Nil(suite.T(), tx.rollback(), "compensations run once")
+	assert.Empty(suite.T(), undone)
+}
+
+func (suite *SagaSuite) Test_Step_Failure() {
+	var undone []string
+	tx := newSaga("test")
+	tx.step("first", func() error { return nil }, func() error {
+		undone = append(undone, "first")
+		return nil
+	})
+	tx.step("metadata", func() error { return nil }, nil)
+	expectedErr := errors.New("some error")
+	err := tx.step("second", func() error { return expectedErr }, func() error {
+		undone = append(undone, "second")
+		return nil
+	})
+	assert.Equal(suite.T(), expectedErr, err)
+
+	assert.Nil(suite.T(), tx.rollback())
+	assert.Equal(suite.T(), []string{"first"}, undone, "failed step is not undone")
+}
+
+func (suite *SagaSuite) Test_Rollback_ContinuesAfterFailure() {
+	var undone []string
+	tx := newSaga("test")
+	tx.onUndo("first", func() error {
+		undone = append(undone, "first")
+		return nil
+	})
+	tx.onUndo("second", func() error { return errors.New("some error") })
+	tx.onUndo("third", func() error { panic("nil client") })
+
+	err := tx.rollback()
+	assert.NotNil(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), "failed to undo 2 steps of test")
+	assert.Contains(suite.T(), err.Error(), "nil client")
+	assert.Equal(suite.T(), []string{"first"}, undone)
+}
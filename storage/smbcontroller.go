@@ -0,0 +1,325 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinibox-csi-driver/api"
+	"strings"
+
+	"infinibox-csi-driver/helper/csiid"
+	log "infinibox-csi-driver/helper/logger"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//storage class parameters and volume context of smb volumes
+const (
+	SMBSharePermissions = "smb_share_permissions"
+	SMBShareName        = "smb_share"
+	SecurityStyle       = "security_style"
+)
+
+//defaultSecurityStyle of filesystems of smb volumes, unless security_style is set
+const defaultSecurityStyle = "WINDOWS"
+
+var smbShareAccess = map[string]bool{"FULLCONTROL": true, "CHANGE": true, "READ": true, "NONE": true}
+
+var securityStyles = map[string]bool{"UNIX": true, "WINDOWS": true, "MIXED": true}
+
+//getSMBPermissions parse smb_share_permissions, a list of sid and access like nfs_export_permissions
+func getSMBPermissions(permissions string) ([]api.SMBSharePermission, error) {
+	var entries []map[string]string
+	if err := json.Unmarshal([]byte(strings.Replace(permissions, "'", "\"", -1)), &entries); err != nil {
+		return nil, fmt.Errorf("invalid %s format: %v", SMBSharePermissions, err)
+	}
+	acl := []api.SMBSharePermission{}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		sid, access := strings.TrimSpace(entry["sid"]), strings.ToUpper(strings.TrimSpace(entry["access"]))
+		if sid == "" {
+			return nil, fmt.Errorf("%s entry without sid", SMBSharePermissions)
+		}
+		if !smbShareAccess[access] {
+			return nil, fmt.Errorf("%s access %q of %s must be FULLCONTROL, CHANGE, READ or NONE", SMBSharePermissions, entry["access"], sid)
+		}
+		if seen[strings.ToUpper(sid)] {
+			return nil, fmt.Errorf("%s has sid %s twice", SMBSharePermissions, sid)
+		}
+		seen[strings.ToUpper(sid)] = true
+		acl = append(acl, api.SMBSharePermission{SID: sid, Access: access})
+	}
+	if len(acl) == 0 {
+		return nil, fmt.Errorf("%s has no entry", SMBSharePermissions)
+	}
+	return acl, nil
+}
+
+func validateSMBParameters(config map[string]string) error {
+	missing := []string{}
+	for _, param := range []string{"pool_name", "network_space", SMBSharePermissions} {
+		if config[param] == "" {
+			missing = append(missing, param)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing parameters %s", strings.Join(missing, ", "))
+	}
+	if _, err := getSMBPermissions(config[SMBSharePermissions]); err != nil {
+		return err
+	}
+	if style := config[SecurityStyle]; style != "" && !securityStyles[strings.ToUpper(style)] {
+		return fmt.Errorf("%s %q must be UNIX, WINDOWS or MIXED", SecurityStyle, style)
+	}
+	return nil
+}
+
+//CreateVolume create filesystem and share it, with share permissions of smb_share_permissions
+func (smb *smbstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (csiResp *csi.CreateVolumeResponse, err error) {
+	config := req.GetParameters()
+	if err = validateSMBParameters(config); err != nil {
+		log.FromContext(ctx).Errorf("Fail to validate parameter for smb protocol %v", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	pvName, err := getObjectName(req.GetName(), config)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
+	if capacity < gib {
+		capacity = gib
+		log.FromContext(ctx).Warnf("Volume Minimum capacity should be greater %d", gib)
+	}
+	if config[SecurityStyle] == "" {
+		config[SecurityStyle] = defaultSecurityStyle
+	}
+	smb.pVName = pvName
+	smb.configmap = config
+	smb.capacity = capacity
+	smb.ipAddress, err = smb.cs.getNetworkSpaceIP(strings.TrimSpace(config["network_space"]))
+	if err != nil {
+		log.FromContext(ctx).Errorf("fail to get networkspace ipaddress %v", err)
+		return nil, err
+	}
+
+	// check if volume with given name already exists
+	volume, err := smb.cs.api.GetFileSystemByName(pvName)
+	if err != nil && !strings.EqualFold(err.Error(), "filesystem with given name not found") {
+		return nil, err
+	}
+	if volume != nil {
+		smb.fileSystemID = volume.ID
+		share, err := smb.share(pvName)
+		if err != nil {
+			return nil, err
+		}
+		smb.shareName = share.Name
+		return smb.getSMBCsiResponse(req), nil
+	}
+
+	tx := newSaga("create smb volume " + pvName)
+	defer func() {
+		if res := recover(); res != nil {
+			err = errors.New("error while creating smb volume " + fmt.Sprint(res))
+		}
+		if err != nil {
+			tx.rollback()
+		}
+	}()
+	if source := req.GetVolumeContentSource(); source != nil {
+		sourceID := source.GetVolume().GetVolumeId()
+		if source.GetSnapshot() != nil {
+			sourceID = source.GetSnapshot().GetSnapshotId()
+		}
+		err = smb.snapshotSource(tx, req, capacity, config["pool_name"], sourceID)
+	} else {
+		err = smb.createFileSystemStep(tx)
+	}
+	if err != nil {
+		log.FromContext(ctx).Errorf("fail to create filesystem of smb volume %s: %v", pvName, err)
+		return nil, err
+	}
+	if err = smb.createShareAndAddMetadata(tx); err != nil {
+		log.FromContext(ctx).Errorf("fail to share filesystem of smb volume %s: %v", pvName, err)
+		return nil, err
+	}
+	return smb.getSMBCsiResponse(req), nil
+}
+
+func (smb *smbstorage) createFileSystemStep(tx *saga) error {
+	validnwlist, err := smb.cs.api.OneTimeValidation(smb.configmap["pool_name"], smb.configmap["network_space"])
+	if err != nil {
+		return err
+	}
+	smb.configmap["network_space"] = validnwlist
+	return tx.step("filesystem "+smb.pVName, smb.createFileSystem, func() error {
+		_, err := smb.cs.api.DeleteFileSystem(smb.fileSystemID)
+		return err
+	})
+}
+
+//createShareAndAddMetadata share filesystem, set share permissions and attach metadata as steps of tx
+func (smb *smbstorage) createShareAndAddMetadata(tx *saga) error {
+	var share *api.SMBShare
+	err := tx.step("share "+smb.pVName, func() (err error) {
+		share, err = smb.cs.api.CreateSMBShare(api.SMBShare{Name: smb.pVName, FilesystemID: smb.fileSystemID, InnerPath: "/"})
+		return err
+	}, func() error {
+		return smb.cs.api.DeleteSMBShare(share.ID)
+	})
+	if err != nil {
+		return err
+	}
+	smb.shareName = share.Name
+	if smb.shareName == "" {
+		smb.shareName = smb.pVName
+	}
+	acl, err := getSMBPermissions(smb.configmap[SMBSharePermissions])
+	if err != nil {
+		return err
+	}
+	// permissions go with the share, they have no compensation of their own
+	err = tx.step("permissions of share "+smb.pVName, func() error {
+		return smb.setSharePermissions(*share, acl)
+	}, nil)
+	if err != nil {
+		return err
+	}
+	metadata := smb.cs.getVolumeMetadata(smb.pVName, smb.configmap)
+	return tx.step("metadata of filesystem "+smb.pVName, func() error {
+		_, err := smb.cs.api.AttachMetadataToObject(smb.fileSystemID, metadata)
+		return err
+	}, nil)
+}
+
+//share share of the filesystem of the volume named name, or its only share
+func (smb *smbstorage) share(name string) (*api.SMBShare, error) {
+	shares, err := smb.cs.api.GetSMBSharesByFileSystem(smb.fileSystemID)
+	if err != nil {
+		return nil, err
+	}
+	for _, share := range *shares {
+		if share.Name == name || len(*shares) == 1 {
+			return &share, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "share %s of filesystem %d not found", name, smb.fileSystemID)
+}
+
+//setSharePermissions make permissions of share those of acl: missing sids are added, access of others updated
+//and sids not in acl, such as the Everyone permission of a new share, removed
+func (smb *smbstorage) setSharePermissions(share api.SMBShare, acl []api.SMBSharePermission) error {
+	for _, want := range acl {
+		found := false
+		for _, got := range share.Permissions {
+			if !strings.EqualFold(got.SID, want.SID) {
+				continue
+			}
+			found = true
+			if !strings.EqualFold(got.Access, want.Access) {
+				if err := smb.cs.api.UpdateSMBSharePermission(share.ID, got.ID, want.Access); err != nil {
+					return err
+				}
+			}
+		}
+		if !found {
+			if _, err := smb.cs.api.AddSMBSharePermission(share.ID, want.SID, want.Access); err != nil {
+				return err
+			}
+		}
+	}
+	for _, got := range share.Permissions {
+		wanted := false
+		for _, want := range acl {
+			wanted = wanted || strings.EqualFold(got.SID, want.SID)
+		}
+		if !wanted {
+			if err := smb.cs.api.DeleteSMBSharePermission(share.ID, got.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (smb *smbstorage) getSMBCsiResponse(req *csi.CreateVolumeRequest) *csi.CreateVolumeResponse {
+	smb.configmap["ipAddress"] = smb.ipAddress
+	smb.configmap[SMBShareName] = smb.shareName
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      smb.cs.newID(SMB, csiid.FileSystem, smb.fileSystemID).String(),
+			CapacityBytes: smb.capacity,
+			VolumeContext: smb.configmap,
+			ContentSource: req.GetVolumeContentSource(),
+		},
+	}
+}
+
+//DeleteVolume remove shares of the filesystem, then the filesystem as nfs volumes do
+func (smb *smbstorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	volumeID, err := csiid.Parse(req.GetVolumeId())
+	if err != nil {
+		log.FromContext(ctx).Errorf("Invalid Volume ID %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume id %s: %v", req.GetVolumeId(), err)
+	}
+	shares, err := smb.cs.api.GetSMBSharesByFileSystem(volumeID.ObjectID)
+	if err != nil {
+		log.FromContext(ctx).Errorf("fail to get shares of filesystem %d: %v", volumeID.ObjectID, err)
+		return nil, err
+	}
+	for _, share := range *shares {
+		if err := smb.cs.api.DeleteSMBShare(share.ID); err != nil && !strings.Contains(err.Error(), "NOT_FOUND") {
+			log.FromContext(ctx).Errorf("fail to delete share %s: %v", share.Name, err)
+			return nil, err
+		}
+	}
+	return smb.nfsstorage.DeleteVolume(ctx, req)
+}
+
+//ControllerPublishVolume set share permissions to smb_share_permissions again, so permissions changed on the array are repaired.
+//Volumes with a read only access mode get at most READ.
+func (smb *smbstorage) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	volproto, err := csiid.Parse(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume id %s: %v", req.GetVolumeId(), err)
+	}
+	acl, err := getSMBPermissions(req.GetVolumeContext()[SMBSharePermissions])
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s of volume %s: %v", SMBSharePermissions, req.GetVolumeId(), err)
+	}
+	if readerOnly(req.GetVolumeCapability().GetAccessMode().GetMode()) {
+		for i := range acl {
+			if acl[i].Access != "NONE" {
+				acl[i].Access = "READ"
+			}
+		}
+	}
+	smb.fileSystemID = volproto.ObjectID
+	share, err := smb.share(req.GetVolumeContext()[SMBShareName])
+	if err != nil {
+		return nil, err
+	}
+	if err = smb.setSharePermissions(*share, acl); err != nil {
+		log.FromContext(ctx).Errorf("fail to set permissions of share %s: %v", share.Name, err)
+		return nil, status.Errorf(codes.Internal, "fail to set permissions of share %s: %v", share.Name, err)
+	}
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+//ControllerUnpublishVolume share permissions are given to accounts, not nodes, so nothing is removed
+func (smb *smbstorage) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
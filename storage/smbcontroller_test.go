@@ -0,0 +1,157 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"errors"
+	"infinibox-csi-driver/api"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const everyoneSID = "S-1-1-0"
+const usersSID = "S-1-5-21-1004336348-1177238915-682003330-513"
+
+type SMBControllerSuite struct {
+	suite.Suite
+	api *api.MockApiService
+	cs  *commonservice
+}
+
+func TestSMBControllerSuite(t *testing.T) {
+	suite.Run(t, new(SMBControllerSuite))
+}
+
+func (suite *SMBControllerSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+	suite.cs = &commonservice{api: suite.api}
+}
+
+func (suite *SMBControllerSuite) service() *smbstorage {
+	return &smbstorage{nfsstorage: nfsstorage{cs: *suite.cs}}
+}
+
+func getSMBCreateVolumeParameter() map[string]string {
+	return map[string]string{"pool_name": "pool_name1", "network_space": "network_space1", "storage_protocol": "smb",
+		SMBSharePermissions: "[{'sid':'" + usersSID + "','access':'change'}]"}
+}
+
+func (suite *SMBControllerSuite) mockCreateFileSystem() {
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	suite.api.On("OneTimeValidation", mock.Anything, mock.Anything).Return("network_space1", nil)
+	suite.api.On("GetFileSystemCount").Return(40, nil)
+	suite.api.On("GetStoragePoolIDByName", "pool_name1").Return(100, nil)
+	suite.api.On("CreateFilesystem", mock.MatchedBy(func(request map[string]interface{}) bool {
+		return request["security_style"] == "WINDOWS"
+	})).Return(getFileSystem(), nil)
+}
+
+func (suite *SMBControllerSuite) Test_CreateVolume_parameterValidation_Fail() {
+	for _, invalid := range []map[string]string{{SMBSharePermissions: ""}, {SMBSharePermissions: "[{'sid':'S-1-1-0','access':'WRITE'}]"},
+		{SMBSharePermissions: "[{'access':'READ'}]"}, {SMBSharePermissions: "[]"}, {SecurityStyle: "NTFS"}} {
+		parameterMap := getSMBCreateVolumeParameter()
+		for key, value := range invalid {
+			parameterMap[key] = value
+		}
+		_, err := suite.service().CreateVolume(context.Background(), getNFSCreateVolumeRequest("PVName", parameterMap))
+		assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err), "invalid %v", invalid)
+	}
+}
+
+func (suite *SMBControllerSuite) Test_CreateVolume_success() {
+	suite.mockCreateFileSystem()
+	share := api.SMBShare{ID: 10, Name: "volumeName", FilesystemID: 1, Permissions: []api.SMBSharePermission{{ID: 7, SID: everyoneSID, Access: "FULLCONTROL"}}}
+	suite.api.On("CreateSMBShare", api.SMBShare{Name: "volumeName", FilesystemID: 1, InnerPath: "/"}).Return(share, nil)
+	suite.api.On("AddSMBSharePermission", int64(10), usersSID, "CHANGE").Return(api.SMBSharePermission{ID: 8}, nil)
+	suite.api.On("DeleteSMBSharePermission", int64(10), int64(7)).Return(nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, nil)
+
+	resp, err := suite.service().CreateVolume(context.Background(), getNFSCreateVolumeRequest("PVName", getSMBCreateVolumeParameter()))
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "1$$smb", resp.GetVolume().GetVolumeId())
+	assert.Equal(suite.T(), "volumeName", resp.GetVolume().GetVolumeContext()[SMBShareName])
+	assert.Equal(suite.T(), "10.20.20.50", resp.GetVolume().GetVolumeContext()["ipAddress"])
+	suite.api.AssertCalled(suite.T(), "DeleteSMBSharePermission", int64(10), int64(7))
+}
+
+func (suite *SMBControllerSuite) Test_CreateVolume_Permission_Rollback() {
+	suite.mockCreateFileSystem()
+	suite.api.On("CreateSMBShare", mock.Anything).Return(api.SMBShare{ID: 10, Name: "volumeName"}, nil)
+	suite.api.On("AddSMBSharePermission", int64(10), usersSID, "CHANGE").Return(nil, errors.New("SID_NOT_FOUND"))
+	suite.api.On("DeleteSMBShare", int64(10)).Return(nil)
+	suite.api.On("DeleteFileSystem", int64(1)).Return(nil, nil)
+
+	_, err := suite.service().CreateVolume(context.Background(), getNFSCreateVolumeRequest("PVName", getSMBCreateVolumeParameter()))
+	assert.NotNil(suite.T(), err)
+	suite.api.AssertCalled(suite.T(), "DeleteSMBShare", int64(10))
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystem", int64(1))
+}
+
+func (suite *SMBControllerSuite) Test_CreateVolume_Exists() {
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(getFileSystem(), nil)
+	suite.api.On("GetSMBSharesByFileSystem", int64(1)).Return([]api.SMBShare{{ID: 10, Name: "volumeName"}}, nil)
+
+	resp, err := suite.service().CreateVolume(context.Background(), getNFSCreateVolumeRequest("PVName", getSMBCreateVolumeParameter()))
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "volumeName", resp.GetVolume().GetVolumeContext()[SMBShareName])
+}
+
+func (suite *SMBControllerSuite) Test_ControllerPublishVolume_ReaderOnly() {
+	share := api.SMBShare{ID: 10, Name: "pvc-1", Permissions: []api.SMBSharePermission{{ID: 8, SID: usersSID, Access: "CHANGE"}}}
+	suite.api.On("GetSMBSharesByFileSystem", int64(1)).Return([]api.SMBShare{share}, nil)
+	suite.api.On("UpdateSMBSharePermission", int64(10), int64(8), "READ").Return(nil)
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "1$$smb",
+		NodeId:           "worker-1$$10.20.20.51",
+		VolumeContext:    map[string]string{SMBShareName: "pvc-1", SMBSharePermissions: getSMBCreateVolumeParameter()[SMBSharePermissions]},
+		VolumeCapability: &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY}},
+	}
+	_, err := suite.service().ControllerPublishVolume(context.Background(), req)
+	assert.Nil(suite.T(), err)
+	suite.api.AssertCalled(suite.T(), "UpdateSMBSharePermission", int64(10), int64(8), "READ")
+
+	req.VolumeCapability.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+	_, err = suite.service().ControllerPublishVolume(context.Background(), req)
+	assert.Nil(suite.T(), err, "permissions already match")
+	suite.api.AssertNumberOfCalls(suite.T(), "UpdateSMBSharePermission", 1)
+}
+
+func (suite *SMBControllerSuite) Test_DeleteVolume() {
+	suite.api.On("GetSMBSharesByFileSystem", int64(1)).Return([]api.SMBShare{{ID: 10, Name: "pvc-1"}}, nil)
+	suite.api.On("DeleteSMBShare", int64(10)).Return(nil)
+	suite.api.On("GetFileSystemByID", int64(1)).Return(getFileSystem(), nil)
+	suite.api.On("FileSystemHasChild", int64(1)).Return(false)
+	suite.api.On("GetParentID", int64(1)).Return(int64(0))
+	suite.api.On("DeleteFileSystemComplete", int64(1)).Return(nil)
+
+	_, err := suite.service().DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "1$$smb"})
+	assert.Nil(suite.T(), err)
+	suite.api.AssertCalled(suite.T(), "DeleteSMBShare", int64(10))
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystemComplete", int64(1))
+}
+
+func (suite *SMBControllerSuite) Test_DeleteVolume_Share_Error() {
+	suite.api.On("GetSMBSharesByFileSystem", int64(1)).Return([]api.SMBShare{{ID: 10, Name: "pvc-1"}}, nil)
+	suite.api.On("DeleteSMBShare", int64(10)).Return(errors.New("some error"))
+
+	_, err := suite.service().DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "1$$smb"})
+	assert.NotNil(suite.T(), err)
+	suite.api.AssertNotCalled(suite.T(), "DeleteFileSystemComplete", int64(1))
+}
@@ -0,0 +1,105 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"infinibox-csi-driver/helper/driverconfig"
+	"infinibox-csi-driver/helper/hostexec"
+	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//keys of the node-publish secret of smb volumes
+const (
+	SMBUsername = "smb_username"
+	SMBPassword = "smb_password"
+	SMBDomain   = "smb_domain"
+)
+
+//smbCredentialsFile name of the file mount.cifs reads the credentials from, next to the target path and removed after the mount
+const smbCredentialsFile = ".smb-credentials"
+
+//NodePublishVolume mount share of volume with cifs, as the account of smb_username and smb_password of the node-publish secret
+func (smb *smbstorage) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	log.FromContext(ctx).Debug("smb NodePublishVolume")
+	secrets := req.GetSecrets()
+	if secrets[SMBUsername] == "" || secrets[SMBPassword] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "node-publish secret of volume %s has no %s and %s", req.GetVolumeId(), SMBUsername, SMBPassword)
+	}
+	targetPath := req.GetTargetPath()
+	notMnt, err := smb.mounter.IsNotMountPoint(targetPath)
+	if err != nil {
+		if smb.osHelper.IsNotExist(err) {
+			if err := smb.osHelper.MkdirAll(targetPath, 0750); err != nil {
+				log.FromContext(ctx).Errorf("Error while mkdir %v", err)
+				return nil, err
+			}
+			notMnt = true
+		} else {
+			log.FromContext(ctx).Errorf("IsNotMountPoint method error  %v", err)
+			return nil, err
+		}
+	}
+	if !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	sourceIP, err := smb.cs.nfsMountIP(ctx, req.GetVolumeContext())
+	if err != nil {
+		metrics.MountFailure(SMB)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	source := fmt.Sprintf("//%s/%s", sourceIP, req.GetVolumeContext()[SMBShareName])
+
+	// the password is handed to mount.cifs in a file, mount options show up in logs and the process list
+	credentials := filepath.Join(filepath.Dir(targetPath), smbCredentialsFile)
+	content := fmt.Sprintf("username=%s\npassword=%s\n", secrets[SMBUsername], secrets[SMBPassword])
+	if secrets[SMBDomain] != "" {
+		content += fmt.Sprintf("domain=%s\n", secrets[SMBDomain])
+	}
+	if err = hostexec.Get().WriteFile(credentials, []byte(content), 0600); err != nil {
+		return nil, status.Errorf(codes.Internal, "fail to write smb credentials of %s: %v", targetPath, err)
+	}
+	defer func() {
+		if err := hostexec.Get().RemoveAll(credentials); err != nil {
+			log.FromContext(ctx).Warnf("fail to remove smb credentials of %s: %v", targetPath, err)
+		}
+	}()
+
+	mountOptions := smbMountOptions(req.GetVolumeContext(), credentials, readOnlyPublish(req.GetReadonly(), req.GetVolumeCapability()))
+	log.FromContext(ctx).Debugf("Mount sourcePath %v, tagetPath %v", source, targetPath)
+	if err = smb.mounter.Mount(source, targetPath, "cifs", mountOptions); err != nil {
+		metrics.MountFailure(SMB)
+		log.FromContext(ctx).Errorf("fail to mount source path '%s' : %s", source, err)
+		return nil, status.Errorf(codes.Internal, "Failed to mount target path '%s': %s", targetPath, err)
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+//smbMountOptions smb_mount_options or smb.mountOptions, the credentials file and ro
+func smbMountOptions(volumeContext map[string]string, credentials string, readOnly bool) []string {
+	configMountOptions := volumeContext["smb_mount_options"]
+	if configMountOptions == "" {
+		configMountOptions = driverconfig.Get().SMB.MountOptions
+	}
+	mountOptions := append(splitMountOptions(configMountOptions), "credentials="+credentials)
+	if readOnly {
+		mountOptions = append(mountOptions, "ro")
+	}
+	return mountOptions
+}
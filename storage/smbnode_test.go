@@ -0,0 +1,104 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"errors"
+	"infinibox-csi-driver/helper/hostexec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type SMBNodeSuite struct {
+	suite.Suite
+	root     string
+	previous hostexec.Executor
+	mounter  *MockNfsMounter
+}
+
+func TestSMBNodeSuite(t *testing.T) {
+	suite.Run(t, new(SMBNodeSuite))
+}
+
+func (suite *SMBNodeSuite) SetupTest() {
+	root, err := ioutil.TempDir("", "smbnode")
+	suite.Require().NoError(err)
+	suite.root = root
+	suite.previous = hostexec.Get()
+	hostexec.Set(hostexec.NewFake(root))
+	suite.mounter = new(MockNfsMounter)
+}
+
+func (suite *SMBNodeSuite) TearDownTest() {
+	hostexec.Set(suite.previous)
+	os.RemoveAll(suite.root)
+}
+
+func getSMBNodePublishVolumeRequest() *csi.NodePublishVolumeRequest {
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:      "1$$smb",
+		TargetPath:    "/var/lib/kubelet/pods/1/volumes/kubernetes.io~csi/pvc-1/mount",
+		VolumeContext: map[string]string{"ipAddress": "10.2.2.112", SMBShareName: "pvc-1", "smb_mount_options": "vers=3.1.1"},
+		Secrets:       map[string]string{"hostname": "ibox", "username": "admin", "password": "secret", SMBUsername: "svc-k8s", SMBPassword: "p,ss=word", SMBDomain: "CORP"},
+	}
+}
+
+func (suite *SMBNodeSuite) Test_NodePublishVolume_NoCredentials() {
+	service := smbstorage{nfsstorage: nfsstorage{mounter: suite.mounter}}
+	req := getSMBNodePublishVolumeRequest()
+	delete(req.Secrets, SMBPassword)
+	_, err := service.NodePublishVolume(context.Background(), req)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err))
+}
+
+func (suite *SMBNodeSuite) Test_NodePublishVolume_success() {
+	service := smbstorage{nfsstorage: nfsstorage{mounter: suite.mounter}}
+	req := getSMBNodePublishVolumeRequest()
+	credentials := filepath.Join(filepath.Dir(req.TargetPath), smbCredentialsFile)
+	suite.Require().NoError(hostexec.Get().MkdirAll(filepath.Dir(req.TargetPath), 0750))
+	var content string
+	suite.mounter.On("IsNotMountPoint", req.TargetPath).Return(true, nil)
+	suite.mounter.On("Mount", "//10.2.2.112/pvc-1", req.TargetPath, "cifs", []string{"vers=3.1.1", "credentials=" + credentials, "ro"}).Return(nil).Run(func(args mock.Arguments) {
+		data, _ := hostexec.Get().ReadFile(credentials)
+		content = string(data)
+	})
+	req.Readonly = true
+
+	_, err := service.NodePublishVolume(context.Background(), req)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "username=svc-k8s\npassword=p,ss=word\ndomain=CORP\n", content, "credentials are written for mount.cifs")
+	_, err = hostexec.Get().Stat(credentials)
+	assert.True(suite.T(), os.IsNotExist(err), "credentials are removed after the mount")
+}
+
+func (suite *SMBNodeSuite) Test_NodePublishVolume_MountFail() {
+	service := smbstorage{nfsstorage: nfsstorage{mounter: suite.mounter}}
+	req := getSMBNodePublishVolumeRequest()
+	credentials := filepath.Join(filepath.Dir(req.TargetPath), smbCredentialsFile)
+	suite.Require().NoError(hostexec.Get().MkdirAll(filepath.Dir(req.TargetPath), 0750))
+	suite.mounter.On("IsNotMountPoint", req.TargetPath).Return(true, nil)
+	suite.mounter.On("Mount", "//10.2.2.112/pvc-1", req.TargetPath, "cifs", []string{"vers=3.1.1", "credentials=" + credentials}).Return(errors.New("mount error(13): Permission denied"))
+
+	_, err := service.NodePublishVolume(context.Background(), req)
+	assert.Equal(suite.T(), codes.Internal, status.Code(err))
+	_, err = hostexec.Get().Stat(credentials)
+	assert.True(suite.T(), os.IsNotExist(err), "credentials are removed when the mount fails")
+}
@@ -0,0 +1,94 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	log "infinibox-csi-driver/helper/logger"
+)
+
+//stageRecordDir directory of the driver's records of staged volumes, empty when they are not kept
+var stageRecordDir string
+
+//SetStageRecordDir keep a record of every volume staged on node in dir, the node reconciler reads staged volumes from them
+func SetStageRecordDir(dir string) {
+	stageRecordDir = dir
+}
+
+//stageRecord copy of the disk file writeDiskConfig writes to StagingPath
+type stageRecord struct {
+	StagingPath string          `json:"stagingPath"`
+	Disk        json.RawMessage `json:"disk"`
+}
+
+//stageRecordFile record of volume staged at stagePath, named after the staging path as kubelet names them differently per version
+func stageRecordFile(dir, stagePath string) string {
+	sum := sha256.Sum256([]byte(path.Clean(stagePath)))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+//writeStageRecord record disk staged at stagePath in dir, a no-op when dir is empty
+func writeStageRecord(dir, stagePath string, disk []byte) error {
+	if dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(stageRecord{StagingPath: stagePath, Disk: disk})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file := stageRecordFile(dir, stagePath)
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+//removeStageRecord forget volume staged at stagePath once NodeUnstageVolume removed it
+func removeStageRecord(stagePath string) {
+	if stageRecordDir == "" {
+		return
+	}
+	if err := os.Remove(stageRecordFile(stageRecordDir, stagePath)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("failed to remove stage record of %s: %v", stagePath, err)
+	}
+}
+
+//readStageRecords records in dir
+func readStageRecords(dir string) ([]stageRecord, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	records := []stageRecord{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var record stageRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
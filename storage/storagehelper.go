@@ -11,14 +11,21 @@ limitations under the License.*/
 package storage
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"infinibox-csi-driver/api"
+	"path"
+	"strconv"
 	"strings"
 
+	"infinibox-csi-driver/helper/csiid"
+	"infinibox-csi-driver/helper/hostexec"
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/tracing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/kubernetes/pkg/util/mount"
 )
 
 const (
@@ -35,6 +42,35 @@ const (
 	bytesofGiB = kiBytesofGiB * bytesofKiB
 )
 
+//parameters passed by external-provisioner and external-snapshotter with --extra-create-metadata
+const (
+	extraCreateMetadataPrefix          = "csi.storage.k8s.io/"
+	ParameterPVCName                   = "csi.storage.k8s.io/pvc/name"
+	ParameterPVCNamespace              = "csi.storage.k8s.io/pvc/namespace"
+	ParameterPVName                    = "csi.storage.k8s.io/pv/name"
+	ParameterVolumeSnapshotName        = "csi.storage.k8s.io/volumesnapshot/name"
+	ParameterVolumeSnapshotNamespace   = "csi.storage.k8s.io/volumesnapshot/namespace"
+	ParameterVolumeSnapshotContentName = "csi.storage.k8s.io/volumesnapshotcontent/name"
+)
+
+//metadata keys attached to infinibox objects
+const (
+	MetadataPVName                    = "host.k8s.pvname"
+	MetadataPVCName                   = "host.k8s.pvcname"
+	MetadataPVCNamespace              = "host.k8s.pvcnamespace"
+	MetadataPVCUID                    = "host.k8s.pvcuid"
+	MetadataClusterID                 = "host.k8s.cluster_id"
+	MetadataCreatedBy                 = "host.created_by"
+	MetadataDriverVersion             = "host.driver_version"
+	MetadataFilesystemType            = "host.filesystem_type"
+	MetadataSnapshotName              = "host.k8s.snapshotname"
+	MetadataSourceVolumeID            = "host.k8s.source_volume_id"
+	MetadataVolumeSnapshotName        = "host.k8s.volumesnapshotname"
+	MetadataVolumeSnapshotNamespace   = "host.k8s.volumesnapshotnamespace"
+	MetadataVolumeSnapshotContentName = "host.k8s.volumesnapshotcontentname"
+	MetadataTreeqPrefix               = "host.k8s.treeq."
+)
+
 func verifyVolumeSize(caprange *csi.CapacityRange) (int64, error) {
 	requiredVolSize := int64(caprange.GetRequiredBytes())
 	allowedMaxVolSize := int64(caprange.GetLimitBytes())
@@ -67,7 +103,19 @@ func verifyVolumeSize(caprange *csi.CapacityRange) (int64, error) {
 	return sizeinByte, nil
 }
 
-func validateParametersFC(storageClassParams map[string]string) error {
+//storageClassParameters return required parameters defined in storage class, without optional and --extra-create-metadata ones
+func storageClassParameters(parameters map[string]string) map[string]string {
+	storageClassParams := make(map[string]string)
+	for key, val := range parameters {
+		if !strings.HasPrefix(key, extraCreateMetadataPrefix) && key != ParameterNameTemplate {
+			storageClassParams[key] = val
+		}
+	}
+	return storageClassParams
+}
+
+func validateParametersFC(parameters map[string]string) error {
+	storageClassParams := storageClassParameters(parameters)
 	reqParams := []string{
 		"fstype",
 		"pool_name",
@@ -89,7 +137,8 @@ func validateParametersFC(storageClassParams map[string]string) error {
 	return nil
 }
 
-func validateParametersiSCSI(storageClassParams map[string]string) error {
+func validateParametersiSCSI(parameters map[string]string) error {
+	storageClassParams := storageClassParameters(parameters)
 	reqParams := []string{
 		"useCHAP",
 		"fstype",
@@ -113,6 +162,30 @@ func validateParametersiSCSI(storageClassParams map[string]string) error {
 	return nil
 }
 
+func validateParametersNVMeTCP(parameters map[string]string) error {
+	storageClassParams := storageClassParameters(parameters)
+	reqParams := []string{
+		"fstype",
+		"pool_name",
+		"network_space",
+		"provision_type",
+		"storage_protocol",
+		"ssd_enabled",
+		"max_vols_per_host",
+	}
+	if len(reqParams) != len(storageClassParams) {
+		log.Error("Mismatch in provided parameters and required params")
+		return errors.New("Mismatch in provided parameters and required params")
+	}
+	for _, param := range reqParams {
+		if storageClassParams[param] == "" {
+			log.Errorf("Invalid value %s for required parameter %s", storageClassParams[param], param)
+			return fmt.Errorf("Invalid value %s for required parameter %s", storageClassParams[param], param)
+		}
+	}
+	return nil
+}
+
 func copyRequestParameters(parameters, out map[string]string) {
 	for key, val := range parameters {
 		if val != "" {
@@ -121,12 +194,101 @@ func copyRequestParameters(parameters, out map[string]string) {
 	}
 }
 
-func validateStorageType(str string) (volprotoconf api.VolumeProtocolConfig, err error) {
-	volproto := strings.Split(str, "$$")
-	if len(volproto) != 2 {
-		return volprotoconf, errors.New("volume Id and other details not found")
+//diskName name of staged disk config of volume, the InfiniBox volume id
+func diskName(volumeID string) string {
+	id, err := csiid.Parse(volumeID)
+	if err != nil {
+		return volumeID
 	}
-	volprotoconf.VolumeID = volproto[0]
-	volprotoconf.StorageType = volproto[1]
-	return volprotoconf, nil
+	return strconv.FormatInt(id.ObjectID, 10)
+}
+
+//readerOnly whether access mode lets nodes only read the volume
+func readerOnly(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY || mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+//readOnlyVolume whether every access mode requested for a new volume is read only, it is then created write protected
+func readOnlyVolume(caps []*csi.VolumeCapability) bool {
+	for _, volCap := range caps {
+		if !readerOnly(volCap.GetAccessMode().GetMode()) {
+			return false
+		}
+	}
+	return len(caps) > 0
+}
+
+//readOnlyPublish whether volume is published read only, by the readonly flag or a read only access mode
+func readOnlyPublish(readonly bool, volCap *csi.VolumeCapability) bool {
+	return readonly || readerOnly(volCap.GetAccessMode().GetMode())
+}
+
+//readOnlyMountOptions options of a read only mount of filesystem fsType. A read only mount of ext4 or xfs still replays
+//the journal, writing to the device; noload and norecovery skip that. FormatAndMount formats an empty fsType as ext4
+func readOnlyMountOptions(fsType string) []string {
+	switch strings.ToLower(fsType) {
+	case "xfs":
+		return []string{"ro", "norecovery"}
+	case "", "ext3", "ext4":
+		return []string{"ro", "noload"}
+	}
+	return []string{"ro"}
+}
+
+//blockAccessModeSupported whether access mode is supported for iSCSI and FC volumes, many writers are not
+func blockAccessModeSupported(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER || readerOnly(mode)
+}
+
+//hostPath path in the container of host path, such as a staging path
+func hostPath(p string) string {
+	return hostexec.Get().Path(p)
+}
+
+//fromHost host path of path in the container, such as a device found below /host/dev
+func fromHost(p string) string {
+	root := hostexec.Get().Path("/")
+	if root == "/" {
+		return p
+	}
+	return strings.TrimPrefix(p, root)
+}
+
+//hostExec mount.Exec running commands on host, in span of ctx
+func hostExec(ctx context.Context) mount.Exec {
+	return tracing.NewExec(ctx, hostexec.MountExec(ctx, hostexec.Get()))
+}
+
+//hostMounter mounter running mount and umount on host, in span of ctx
+func hostMounter(ctx context.Context) mount.Interface {
+	return tracing.NewMounter(ctx, hostexec.NewMounter(ctx, hostexec.Get()))
+}
+
+//writeDiskConfig record staged disk of volume as <stagePath>/<name>.json on host for unstage, and in a stage record for the node reconciler
+func writeDiskConfig(conf interface{}, stagePath, name string) error {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return fmt.Errorf("encode err: %v", err)
+	}
+	file := path.Join(stagePath, name+".json")
+	if err := hostexec.Get().WriteFile(file, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("create %s err %s", file, err)
+	}
+	if err := writeStageRecord(stageRecordDir, stagePath, data); err != nil {
+		return fmt.Errorf("record stage of %s err %s", stagePath, err)
+	}
+	return nil
+}
+
+//readDiskConfig read staged disk of volume written by writeDiskConfig
+func readDiskConfig(conf interface{}, stagePath, name string) error {
+	file := path.Join(stagePath, name+".json")
+	data, err := hostexec.Get().ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("open %s err %s", file, err)
+	}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return fmt.Errorf("decode err: %v", err)
+	}
+	return nil
 }
@@ -16,22 +16,24 @@ import (
 	"fmt"
 	"infinibox-csi-driver/api"
 	"infinibox-csi-driver/helper"
-	"io/ioutil"
 	"math/rand"
 	"os"
-	"os/exec"
-	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"infinibox-csi-driver/api/clientgo"
 
+	"infinibox-csi-driver/helper/csiid"
+	"infinibox-csi-driver/helper/driverconfig"
+	"infinibox-csi-driver/helper/hostexec"
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/tracing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	csictx "github.com/rexray/gocsi/context"
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/kubernetes/pkg/util/mount"
 )
 
@@ -55,12 +57,23 @@ type fcstorage struct {
 type iscsistorage struct {
 	cs commonservice
 }
+//nvmetcpstorage volumes attached over NVMe/TCP, volumes are deleted, snapshotted, expanded, unpublished and unmounted as those of fcstorage
+type nvmetcpstorage struct {
+	fcstorage
+}
 type treeqstorage struct {
 	csi.ControllerServer
 	csi.NodeServer
+	cs             commonservice
 	filesysService FileSystemInterface
 	osHelper       helper.OsHelper
 	mounter        mount.Interface
+	arraySerial    string
+}
+//smbstorage filesystems shared over SMB, filesystems are created, snapshotted, expanded and deleted as those of nfsstorage
+type smbstorage struct {
+	nfsstorage
+	shareName string
 }
 type nfsstorage struct {
 	uniqueID  int64
@@ -83,12 +96,23 @@ type commonservice struct {
 	api               api.Client
 	storagePoolIdName map[int64]string
 	driverversion     string
+	ctx               context.Context
+	// serial of the InfiniBox the request is for, empty when not known
+	arraySerial string
+	// addresses of the node, separated by commas, empty on the controller
+	nodeIPAddress string
 }
 
+//systemSerials serial of InfiniBox systems by hostname, looked up once per system
+var systemSerials sync.Map
+
 //NewStorageController : To return specific implementation of storage
-func NewStorageController(storageProtocol string, configparams ...map[string]string) (Storageoperations, error) {
-	comnserv, err := buildCommonService(configparams[0], configparams[1])
+func NewStorageController(ctx context.Context, storageProtocol string, configparams ...map[string]string) (Storageoperations, error) {
+	comnserv, err := buildCommonService(ctx, configparams[0], configparams[1])
 	if err == nil {
+		if comnserv.arraySerial == "" && comnserv.api != nil {
+			comnserv.arraySerial = lookupSystemSerial(ctx, comnserv.api, configparams[1]["hostname"])
+		}
 		storageProtocol = strings.TrimSpace(storageProtocol)
 		if storageProtocol == "fc" {
 			return &fcstorage{cs: comnserv}, nil
@@ -97,7 +121,11 @@ func NewStorageController(storageProtocol string, configparams ...map[string]str
 		} else if storageProtocol == "nfs" {
 			return &nfsstorage{cs: comnserv, mounter: mount.New(""), osHelper: helper.Service{}}, nil
 		} else if storageProtocol == "nfs_treeq" {
-			return &treeqstorage{filesysService: getFilesystemService(storageProtocol, comnserv), osHelper: helper.Service{}}, nil
+			return &treeqstorage{filesysService: getFilesystemService(storageProtocol, comnserv), osHelper: helper.Service{}, arraySerial: comnserv.arraySerial}, nil
+		} else if storageProtocol == SMB {
+			return &smbstorage{nfsstorage: nfsstorage{cs: comnserv, mounter: mount.New(""), osHelper: helper.Service{}}}, nil
+		} else if storageProtocol == NVMeTCP {
+			return &nvmetcpstorage{fcstorage: fcstorage{cs: comnserv}}, nil
 		}
 		return nil, errors.New("Error: Invalid storage protocol -" + storageProtocol)
 	}
@@ -105,8 +133,8 @@ func NewStorageController(storageProtocol string, configparams ...map[string]str
 }
 
 //NewStorageNode : To return specific implementation of storage
-func NewStorageNode(storageProtocol string, configparams ...map[string]string) (Storageoperations, error) {
-	comnserv, err := buildCommonService(configparams[0], configparams[1])
+func NewStorageNode(ctx context.Context, storageProtocol string, configparams ...map[string]string) (Storageoperations, error) {
+	comnserv, err := buildCommonService(ctx, configparams[0], configparams[1])
 	if err == nil {
 		storageProtocol = strings.TrimSpace(storageProtocol)
 		if storageProtocol == "fc" {
@@ -114,38 +142,86 @@ func NewStorageNode(storageProtocol string, configparams ...map[string]string) (
 		} else if storageProtocol == "iscsi" {
 			return &iscsistorage{cs: comnserv}, nil
 		} else if storageProtocol == "nfs" {
-			return &nfsstorage{cs: comnserv, mounter: mount.New(""), osHelper: helper.Service{}}, nil
+			return &nfsstorage{cs: comnserv, mounter: hostMounter(ctx), osHelper: helper.Service{}}, nil
 		} else if storageProtocol == "nfs_treeq" {
-			return &treeqstorage{filesysService: getFilesystemService(storageProtocol, comnserv), mounter: mount.New(""), osHelper: helper.Service{}}, nil
+			return &treeqstorage{cs: comnserv, filesysService: getFilesystemService(storageProtocol, comnserv), mounter: hostMounter(ctx), osHelper: helper.Service{}}, nil
+		} else if storageProtocol == SMB {
+			return &smbstorage{nfsstorage: nfsstorage{cs: comnserv, mounter: hostMounter(ctx), osHelper: helper.Service{}}}, nil
+		} else if storageProtocol == NVMeTCP {
+			return &nvmetcpstorage{fcstorage: fcstorage{cs: comnserv}}, nil
 		}
 		return nil, errors.New("Error: Invalid storage protocol -" + storageProtocol)
 	}
 	return nil, err
 }
 
-func buildCommonService(config map[string]string, secretMap map[string]string) (commonservice, error) {
-	commonserv := commonservice{}
+func buildCommonService(ctx context.Context, config map[string]string, secretMap map[string]string) (commonservice, error) {
+	commonserv := commonservice{ctx: ctx}
 	if config != nil {
 		if secretMap == nil || len(secretMap) < 3 {
-			log.Error("Api client cannot be initialized without proper secrets")
+			log.FromContext(ctx).Error("Api client cannot be initialized without proper secrets")
 			return commonserv, errors.New("secrets are missing or not valid")
 		}
 		commonserv = commonservice{
 			api: &api.ClientService{
 				SecretsMap: secretMap,
+				Context:    ctx,
 			},
+			ctx: ctx,
 		}
 		err := commonserv.verifyApiClient()
 		if err != nil {
-			log.Error("API client not initialized.", err)
+			log.FromContext(ctx).Error("API client not initialized.", err)
 			return commonserv, err
 		}
 		commonserv.driverversion = config["driverversion"]
+		commonserv.arraySerial = config["arrayserial"]
+		commonserv.nodeIPAddress = config["nodeIPAddress"]
 	}
-	log.Infoln("buildCommonService commonservice configuration done.")
+	log.FromContext(ctx).Infoln("buildCommonService commonservice configuration done.")
 	return commonserv, nil
 }
 
+//lookupSystemSerial serial of array at hostname, empty when it can not be read so IDs stay in legacy form
+func lookupSystemSerial(ctx context.Context, client api.Client, hostname string) string {
+	serial, err := systemSerial(client, hostname)
+	if err != nil {
+		log.FromContext(ctx).Warnf("failed to get serial of InfiniBox %s, volume IDs will not carry it: %v", hostname, err)
+		return ""
+	}
+	return serial
+}
+
+//systemSerial serial of array at hostname, read once per system
+func systemSerial(client api.Client, hostname string) (string, error) {
+	if serial, ok := systemSerials.Load(hostname); ok {
+		return serial.(string), nil
+	}
+	serial, err := client.GetSystemSerial()
+	if err != nil {
+		return "", err
+	}
+	systemSerials.Store(hostname, serial)
+	return serial, nil
+}
+
+//SystemSerial serial of InfiniBox system secrets give access to
+func SystemSerial(ctx context.Context, secrets map[string]string) (string, error) {
+	return systemSerial(&api.ClientService{SecretsMap: secrets, Context: ctx}, secrets["hostname"])
+}
+
+//newID ID of object created on the array of the request, bound to array serial when it is known
+func (cs *commonservice) newID(protocol string, objectType csiid.ObjectType, objectID int64) csiid.ID {
+	return withArray(csiid.New(protocol, objectType, objectID), cs.arraySerial)
+}
+
+func withArray(id csiid.ID, serial string) csiid.ID {
+	if serial == "" {
+		return id
+	}
+	return id.WithArray(serial)
+}
+
 func (cs *commonservice) verifyApiClient() error {
 	log.Info("verifying api client")
 	c, err := cs.api.NewClient()
@@ -158,10 +234,12 @@ func (cs *commonservice) verifyApiClient() error {
 	return nil
 }
 func (cs *commonservice) getIscsiInitiatorName() string {
-	if ep, ok := csictx.LookupEnv(context.Background(), "ISCSI_INITIATOR_NAME"); ok {
-		return ep
-	}
-	return ""
+	return driverconfig.Get().ISCSIInitiatorName
+}
+
+//multipathFlushTimeout milliseconds allowed for multipath -f
+func multipathFlushTimeout() int {
+	return int(driverconfig.Get().Timeouts.MultipathFlush.Duration / time.Millisecond)
 }
 func (cs *commonservice) getVolumeByID(id int) (*api.Volume, error) {
 
@@ -174,6 +252,25 @@ func (cs *commonservice) getVolumeByID(id int) (*api.Volume, error) {
 	return vols, nil
 }
 
+//publishContext publish context of volume mapped to host, the node finds the volume's devices by its WWID.
+//The WWID is left out when the array reports no serial, the node then finds devices by LUN.
+func (cs *commonservice) publishContext(volumeID int, host *api.Host, lun int, ports string) (map[string]string, error) {
+	volume, err := cs.getVolumeByID(volumeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get serial of volume %d: %v", volumeID, err)
+	}
+	volCtx := make(map[string]string)
+	volCtx["lun"] = strconv.Itoa(lun)
+	volCtx["hostID"] = strconv.Itoa(host.ID)
+	volCtx["hostPorts"] = ports
+	if volume.Serial != "" {
+		volCtx[publishContextWWID] = naaWWID(volume.Serial)
+	} else {
+		log.Warnf("volume %d has no serial, node will find it by LUN %d", volumeID, lun)
+	}
+	return volCtx, nil
+}
+
 func (cs *commonservice) mapVolumeTohost(volumeID int, hostID int) (luninfo api.LunInfo, err error) {
 	luninfo, err = cs.api.MapVolumeToHost(hostID, volumeID, -1)
 	if err != nil {
@@ -238,6 +335,9 @@ func (cs *commonservice) validateHost(hostName string) (*api.Host, error) {
 			log.Errorf("failed to create host with error %v", err)
 			return nil, err
 		}
+		if _, metadataErr := cs.api.AttachMetadataToObject(int64(host.ID), cs.getCSIMetadata()); metadataErr != nil {
+			log.Warnf("fail to attach metadata for host %s error %v", hostName, metadataErr)
+		}
 	}
 	return &host, nil
 }
@@ -250,7 +350,7 @@ func (cs *commonservice) deleteVolume(volumeID int) (err error) {
 	return nil
 }
 
-func (cs *commonservice) getCSIResponse(vol *api.Volume, req *csi.CreateVolumeRequest) *csi.Volume {
+func (cs *commonservice) getCSIResponse(vol *api.Volume, req *csi.CreateVolumeRequest, protocol string) *csi.Volume {
 	log.Infof("getCSIResponse called with vol %v", vol)
 	storagePoolName := vol.PoolName
 	log.Infof("getCSIResponse storagePoolName is %s", vol.PoolName)
@@ -267,7 +367,7 @@ func (cs *commonservice) getCSIResponse(vol *api.Volume, req *csi.CreateVolumeRe
 		"targetWWNs":      req.GetParameters()["targetWWNs"],
 	}
 	vi := &csi.Volume{
-		VolumeId:      strconv.Itoa(vol.ID),
+		VolumeId:      cs.newID(protocol, csiid.Volume, int64(vol.ID)).String(),
 		CapacityBytes: vol.Size,
 		VolumeContext: attributes,
 		ContentSource: req.GetVolumeContentSource(),
@@ -328,92 +428,175 @@ func getClusterVersion() string {
 	return version
 }
 
-/*
-func GetUnixPermission(unixPermission, defaultPermission string) (os.FileMode, error) {
-	var mode os.FileMode
-	if unixPermission == "" {
-		unixPermission = defaultPermission
+var (
+	kubeClient     clientgo.KubeClient
+	kubeClientOnce sync.Once
+	clusterID      string
+	clusterIDOnce  sync.Once
+)
+
+//getKubeClient return in-cluster client shared by metadata lookups, nil outside of a cluster
+func getKubeClient() clientgo.KubeClient {
+	kubeClientOnce.Do(func() {
+		cl, err := clientgo.BuildClient()
+		if err != nil {
+			log.Warnf("kubernetes client is not available, PVC uid and cluster id are not recorded: %v", err)
+			return
+		}
+		kubeClient = cl
+	})
+	return kubeClient
+}
+
+//getClusterID return identity of kubernetes cluster, looked up once
+func getClusterID() string {
+	clusterIDOnce.Do(func() {
+		cl := getKubeClient()
+		if cl == nil {
+			return
+		}
+		id, err := cl.GetClusterID()
+		if err != nil {
+			log.Warnf("failed to get cluster id: %v", err)
+			return
+		}
+		clusterID = id
+	})
+	return clusterID
+}
+
+func getPVCUID(claimName, nameSpace string) string {
+	if claimName == "" || nameSpace == "" {
+		return ""
 	}
-	i, err := strconv.ParseUint(unixPermission, 8, 32)
-	if err != nil {
-		log.Errorf("fail to cast unixPermission %v", err)
-		return mode, err
+	cl := getKubeClient()
+	if cl == nil {
+		return ""
 	}
-	mode = os.FileMode(i)
-	return mode, nil
-}*/
+	uid, _ := cl.GetPersistentVolumeClaimUID(claimName, nameSpace)
+	return uid
+}
 
-// detachFCDisk removes scsi device file such as /dev/sdX from the node.
-func detachDisk(devicePath string) error {
-	// Remove scsi device from the node.
-	if !strings.HasPrefix(devicePath, "/dev/") {
-		return fmt.Errorf("detach disk: invalid device name: %s", devicePath)
+//getCSIMetadata return metadata attached to every object created by driver
+func (cs *commonservice) getCSIMetadata() map[string]interface{} {
+	metadata := make(map[string]interface{})
+	metadata[MetadataCreatedBy] = cs.GetCreatedBy()
+	if cs.driverversion != "" {
+		metadata[MetadataDriverVersion] = cs.driverversion
 	}
-	arr := strings.Split(devicePath, "/")
-	dev := arr[len(arr)-1]
-	removeFromScsiSubsystem(dev)
-	return nil
+	if id := getClusterID(); id != "" {
+		metadata[MetadataClusterID] = id
+	}
+	return metadata
 }
 
-// Removes a scsi device based upon /dev/sdX name
-func removeFromScsiSubsystem(deviceName string) {
-	fileName := "/sys/block/" + deviceName + "/device/delete"
-	log.Debugf("remove device from scsi-subsystem: path: %s", fileName)
-	data := []byte("1")
-	ioutil.WriteFile(fileName, data, 0666)
+//getVolumeMetadata return metadata of volume or filesystem, including PVC details passed by external-provisioner --extra-create-metadata
+func (cs *commonservice) getVolumeMetadata(pvName string, parameters map[string]string) map[string]interface{} {
+	metadata := cs.getCSIMetadata()
+	if name := parameters[ParameterPVName]; name != "" {
+		pvName = name
+	}
+	metadata[MetadataPVName] = pvName
+	for key, value := range getPVCMetadata(parameters) {
+		metadata[key] = value
+	}
+	return metadata
 }
 
-//FindSlaveDevicesOnMultipath returns all slaves on the multipath device given the device path
-func findSlaveDevicesOnMultipath(dm string) []string {
-	var devices []string
-	// Split path /dev/dm-1 into "", "dev", "dm-1"
-	parts := strings.Split(dm, "/")
-	if len(parts) != 3 || !strings.HasPrefix(parts[1], "dev") {
-		return devices
+//getPVCMetadata return PVC namespace, name and uid from create parameters
+func getPVCMetadata(parameters map[string]string) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	claimName := parameters[ParameterPVCName]
+	nameSpace := parameters[ParameterPVCNamespace]
+	if claimName != "" {
+		metadata[MetadataPVCName] = claimName
 	}
-	disk := parts[2]
-	slavesPath := path.Join("/sys/block/", disk, "/slaves/")
-	if files, err := ioutil.ReadDir(slavesPath); err == nil {
-		for _, f := range files {
-			devices = append(devices, path.Join("/dev/", f.Name()))
-		}
+	if nameSpace != "" {
+		metadata[MetadataPVCNamespace] = nameSpace
+	}
+	if uid := getPVCUID(claimName, nameSpace); uid != "" {
+		metadata[MetadataPVCUID] = uid
 	}
-	return devices
+	return metadata
 }
 
-func (cs *commonservice) ExecuteWithTimeout(mSeconds int, command string, args []string) ([]byte, error) {
-	log.Debugf("Executing command : {%v} with args : {%v}. and timeout : {%v} mseconds", command, args, mSeconds)
+//getTreeqMetadata return PV and PVC metadata of treeq, kept on parent filesystem under per treeq keys
+func (cs *commonservice) getTreeqMetadata(treeqID int64, pvName string, parameters map[string]string) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	if name := parameters[ParameterPVName]; name != "" {
+		pvName = name
+	}
+	metadata[treeqMetadataKey(treeqID, MetadataPVName)] = pvName
+	for key, value := range getPVCMetadata(parameters) {
+		metadata[treeqMetadataKey(treeqID, key)] = value
+	}
+	return metadata
+}
 
-	// Create a new context and add a timeout to it
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(mSeconds)*time.Millisecond)
-	defer cancel() // The cancel should be deferred so resources are cleaned up
+//treeqMetadataKey return key of treeq metadata stored on parent filesystem, e.g. host.k8s.treeq.5.pvcname
+func treeqMetadataKey(treeqID int64, key string) string {
+	return MetadataTreeqPrefix + strconv.FormatInt(treeqID, 10) + "." + strings.TrimPrefix(key, "host.k8s.")
+}
 
-	// Create the command with our context
-	cmd := exec.CommandContext(ctx, command, args...)
+//treeqMetadataKeys return all keys which may be stored on filesystem for given treeq
+func treeqMetadataKeys(treeqID int64) []string {
+	keys := []string{}
+	for _, key := range []string{MetadataPVName, MetadataPVCName, MetadataPVCNamespace, MetadataPVCUID} {
+		keys = append(keys, treeqMetadataKey(treeqID, key))
+	}
+	return keys
+}
 
-	// This time we can simply use Output() to get the result.
-	out, err := cmd.Output()
+//getSnapshotMetadata return metadata of snapshot created from source volume
+func (cs *commonservice) getSnapshotMetadata(snapshotName, sourceVolumeID string, parameters map[string]string) map[string]interface{} {
+	metadata := cs.getCSIMetadata()
+	metadata[MetadataSnapshotName] = snapshotName
+	metadata[MetadataSourceVolumeID] = sourceVolumeID
+	if name := parameters[ParameterVolumeSnapshotName]; name != "" {
+		metadata[MetadataVolumeSnapshotName] = name
+	}
+	if nameSpace := parameters[ParameterVolumeSnapshotNamespace]; nameSpace != "" {
+		metadata[MetadataVolumeSnapshotNamespace] = nameSpace
+	}
+	if contentName := parameters[ParameterVolumeSnapshotContentName]; contentName != "" {
+		metadata[MetadataVolumeSnapshotContentName] = contentName
+	}
+	return metadata
+}
 
-	// We want to check the context error to see if the timeout was executed.
-	// The error returned by cmd.Output() will be OS specific based on what
-	// happens when a process is killed.
-	if ctx.Err() == context.DeadlineExceeded {
-		log.Debugf("Command %s timeout reached", command)
-		return nil, ctx.Err()
+/*
+func GetUnixPermission(unixPermission, defaultPermission string) (os.FileMode, error) {
+	var mode os.FileMode
+	if unixPermission == "" {
+		unixPermission = defaultPermission
 	}
+	i, err := strconv.ParseUint(unixPermission, 8, 32)
+	if err != nil {
+		log.Errorf("fail to cast unixPermission %v", err)
+		return mode, err
+	}
+	mode = os.FileMode(i)
+	return mode, nil
+}*/
+
+//ExecuteWithTimeout run command on host, it is killed after mSeconds
+func (cs *commonservice) ExecuteWithTimeout(mSeconds int, command string, args []string) (out []byte, err error) {
+	log.Debugf("Executing command : {%v} with args : {%v}. and timeout : {%v} mseconds", command, args, mSeconds)
 
-	// If there's no context error, we know the command completed (or errored).
+	_, span := tracing.StartSpan(cs.ctx, "exec "+command, attribute.String("exec.command", command), tracing.ArgsAttribute(args))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	out, err = hostexec.Get().Run(context.Background(), time.Duration(mSeconds)*time.Millisecond, command, args...)
 	log.Debugf("Output from command: %s", string(out))
 	if err != nil {
 		log.Debugf("Non-zero exit code: %s", err)
 	}
-
-	log.Debugf("Finished executing command")
 	return out, err
 }
 
+//pathExists host path exists
 func (cs *commonservice) pathExists(path string) (bool, error) {
-	_, err := os.Stat(path)
+	_, err := hostexec.Get().Stat(path)
 	if err == nil {
 		log.Debug("Path exists: ", path)
 		return true, nil
@@ -17,6 +17,8 @@ import (
 	"strconv"
 	"strings"
 
+	"infinibox-csi-driver/helper/csiid"
+	"infinibox-csi-driver/helper/lock"
 	log "infinibox-csi-driver/helper/logger"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -28,31 +30,47 @@ func (treeq *treeqstorage) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	var treeqVolumeMap map[string]string
 	config := req.GetParameters()
 	pvName := req.GetName()
-	log.Debugf("Creating fileystem %s of nfs_treeq protocol ", pvName)
+	log.FromContext(ctx).Debugf("Creating fileystem %s of nfs_treeq protocol ", pvName)
 
 	//Validating the reqired parameters
 	validationStatus, validationStatusMap := treeq.filesysService.validateTreeqParameters(config)
 	if !validationStatus {
-		log.Errorf("Fail to validate parameter for nfs_treeq protocol %v ", validationStatusMap)
+		log.FromContext(ctx).Errorf("Fail to validate parameter for nfs_treeq protocol %v ", validationStatusMap)
 		return nil, status.Error(codes.InvalidArgument, "Fail to validate parameter for nfs_treeq protocol")
 	}
+	if err = validateNFSVersion(config); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	pvName, err = getObjectName(pvName, config)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
 	if capacity < gib {
 		capacity = gib
-		log.Warn("Volume Minimum capacity should be greater 1 GB")
+		log.FromContext(ctx).Warn("Volume Minimum capacity should be greater 1 GB")
 	}
 	treeqVolumeMap, err = treeq.filesysService.IsTreeqAlreadyExist(config["pool_name"], strings.Trim(config["network_space"], ""), pvName)
 	if len(treeqVolumeMap) == 0 && err == nil {
 		treeqVolumeMap, err = treeq.filesysService.CreateTreeqVolume(config, capacity, pvName)
 	} 
 	if err != nil {
-		log.Errorf("fail to create volume %v", err)
+		log.FromContext(ctx).Errorf("fail to create volume %v", err)
 		return &csi.CreateVolumeResponse{}, err
 	}
+	filesystemID, err := strconv.ParseInt(treeqVolumeMap["ID"], 10, 64)
+	if err != nil {
+		return &csi.CreateVolumeResponse{}, status.Errorf(codes.Internal, "invalid filesystem id %q", treeqVolumeMap["ID"])
+	}
+	treeqID, err := strconv.ParseInt(treeqVolumeMap["TREEQID"], 10, 64)
+	if err != nil {
+		return &csi.CreateVolumeResponse{}, status.Errorf(codes.Internal, "invalid treeq id %q", treeqVolumeMap["TREEQID"])
+	}
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      treeqVolumeMap["ID"] + "#" + treeqVolumeMap["TREEQID"] + "#" + config[MAXFILESYSTEMSIZE],
+			VolumeId:      withArray(csiid.NewTreeq(filesystemID, treeqID, config[MAXFILESYSTEMSIZE]), treeq.arraySerial).String(),
 			CapacityBytes: capacity,
 			VolumeContext: treeqVolumeMap,
 			ContentSource: req.GetVolumeContentSource(),
@@ -61,15 +79,15 @@ func (treeq *treeqstorage) CreateVolume(ctx context.Context, req *csi.CreateVolu
 }
 
 func getVolumeIDs(volumeID string) (filesystemID, treeqID int64, size string, err error) {
-	volproto := strings.Split(volumeID, "#")
-	if len(volproto) != 3 {
+	id, err := csiid.Parse(volumeID)
+	if err != nil {
+		return
+	}
+	if id.Type != csiid.Treeq {
 		err = errors.New("volume Id and other details not found")
 		return
 	}
-	filesystemID, err = strconv.ParseInt(volproto[0], 10, 64)
-	treeqID, err = strconv.ParseInt(volproto[1], 10, 64)
-	size = volproto[2]
-	return
+	return id.ObjectID, id.SubID, id.Attribute(csiid.AttrMaxFileSystemSize), nil
 }
 
 func (treeq *treeqstorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
@@ -79,18 +97,18 @@ func (treeq *treeqstorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolu
 
 	filesystemID, treeqID, _, err := getVolumeIDs(req.GetVolumeId())
 	if err != nil {
-		log.Errorf("Invalid Volume ID %v", err)
+		log.FromContext(ctx).Errorf("Invalid Volume ID %v", err)
 		return nil, status.Error(codes.InvalidArgument, "Invalid volume ID")
 	}
 	nfsDeleteErr := treeq.filesysService.DeleteTreeqVolume(filesystemID, treeqID)
 	if nfsDeleteErr != nil {
 		if strings.Contains(nfsDeleteErr.Error(), "FILESYSTEM_NOT_FOUND") {
-			log.Error("treeq already delete from infinibox")
+			log.FromContext(ctx).Error("treeq already delete from infinibox")
 			return &csi.DeleteVolumeResponse{}, nil
 		}
 		return &csi.DeleteVolumeResponse{}, nfsDeleteErr
 	}
-	log.Infof("treeq ID %s successfully deleted", req.GetVolumeId())
+	log.FromContext(ctx).Infof("treeq ID %s successfully deleted", req.GetVolumeId())
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -121,15 +139,22 @@ func (treeq *treeqstorage) ControllerExpandVolume(ctx context.Context, req *csi.
 
 	filesystemID, treeqID, maxSize, err := getVolumeIDs(req.GetVolumeId())
 	if err != nil {
-		log.Errorf("Invalid Volume ID %v", err)
+		log.FromContext(ctx).Errorf("Invalid Volume ID %v", err)
 		return nil, status.Error(codes.InvalidArgument, "Invalid volume ID")
 	}
 
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
 	if capacity < gib {
 		capacity = gib
-		log.Warn("Volume Minimum capacity should be greater 1 GB")
+		log.FromContext(ctx).Warn("Volume Minimum capacity should be greater 1 GB")
+	}
+
+	// filesystem size is shared by its treeqs
+	ctx, unlock, err := lock.Get().Lock(ctx, lock.FileSystemKey(filesystemID))
+	if err != nil {
+		return nil, status.Error(codes.Aborted, err.Error())
 	}
+	defer lock.Release(unlock, &err)
 
 	err = treeq.filesysService.UpdateTreeqVolume(filesystemID, treeqID, capacity, maxSize)
 	if err != nil {
@@ -68,7 +68,7 @@ func (suite *TreeqControllerSuite) Test_CreateVolume_Success() {
 	assert.Nil(suite.T(), err, "empty error")
 	val := result.GetVolume()
 	fmt.Println("val", val.GetVolumeId())
-	assert.Equal(suite.T(), "100#200#", val.GetVolumeId(), "ID shoulde be equal")
+	assert.Equal(suite.T(), "100#200#$$nfs_treeq", val.GetVolumeId(), "ID shoulde be equal")
 }
 
 func (suite *TreeqControllerSuite) Test_DeleteVolume_VolumeID_empty() {
@@ -95,7 +95,7 @@ func (suite *TreeqControllerSuite) Test_DeleteVolume_Error() {
 
 func (suite *TreeqControllerSuite) Test_DeleteVolume_Error_filenotfound() {
 	service := treeqstorage{filesysService: suite.filesystem}
-	volumeID := "100#200#"
+	volumeID := "100#200#$$nfs_treeq"
 	expectedErr := errors.New("FILESYSTEM_NOT_FOUND error")
 	var filesytemID, treeqID int64 = 100, 200
 	suite.filesystem.On("DeleteTreeqVolume", filesytemID, treeqID).Return(expectedErr)
@@ -105,7 +105,7 @@ func (suite *TreeqControllerSuite) Test_DeleteVolume_Error_filenotfound() {
 
 func (suite *TreeqControllerSuite) Test_DeleteVolume_success() {
 	service := treeqstorage{filesysService: suite.filesystem}
-	volumeID := "100#200#"
+	volumeID := "100#200#$$nfs_treeq"
 	var filesytemID, treeqID int64 = 100, 200
 	suite.filesystem.On("DeleteTreeqVolume", filesytemID, treeqID).Return(nil)
 	resp, err := service.DeleteVolume(context.Background(), getDeleteVolumeRequest(volumeID))
@@ -138,7 +138,7 @@ func (suite *TreeqControllerSuite) Test_ControllerExpandVolume_Error() {
 
 func (suite *TreeqControllerSuite) Test_ControllerExpandVolume_Error_filenotfound() {
 	service := treeqstorage{filesysService: suite.filesystem}
-	volumeID := "100#200#"
+	volumeID := "100#200#$$nfs_treeq"
 	var filesytemID, treeqID, capacity int64 = 100, 200, 1073741824
 	var maxSize = ""
 	suite.filesystem.On("UpdateTreeqVolume", filesytemID, treeqID, capacity, maxSize).Return(nil)
@@ -148,7 +148,7 @@ func (suite *TreeqControllerSuite) Test_ControllerExpandVolume_Error_filenotfoun
 
 func (suite *TreeqControllerSuite) Test_ControllerExpandVolume_success() {
 	service := treeqstorage{filesysService: suite.filesystem}
-	volumeID := "100#200#"
+	volumeID := "100#200#$$nfs_treeq"
 	var filesytemID, treeqID, capacity int64 = 100, 200, 1073741824
 	var maxSize = ""
 	suite.filesystem.On("UpdateTreeqVolume", filesytemID, treeqID, capacity, maxSize).Return(nil)
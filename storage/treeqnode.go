@@ -13,9 +13,9 @@ package storage
 import (
 	"context"
 	"fmt"
-	"strings"
 
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/metrics"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -23,56 +23,49 @@ import (
 )
 
 func (treeq *treeqstorage) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	log.Debug("treeq NodePublishVolume")
+	log.FromContext(ctx).Debug("treeq NodePublishVolume")
 	targetPath := req.GetTargetPath()
 	notMnt, err := treeq.mounter.IsNotMountPoint(targetPath)
 	if err != nil {
 		if treeq.osHelper.IsNotExist(err) {
 			if err := treeq.osHelper.MkdirAll(targetPath, 0750); err != nil {
-				log.Errorf("Error while mkdir %v", err)
+				log.FromContext(ctx).Errorf("Error while mkdir %v", err)
 				return nil, err
 			}
 			notMnt = true
 		} else {
-			log.Errorf("IsNotMountPoint method error  %v", err)
+			log.FromContext(ctx).Errorf("IsNotMountPoint method error  %v", err)
 			return nil, err
 		}
 	}
 	if !notMnt {
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
-	mountOptions := []string{}
-	configMountOptions := req.GetVolumeContext()["nfs_mount_options"]
-	if configMountOptions == "" {
-		configMountOptions = MountOptions
-	}
-	for _, option := range strings.Split(configMountOptions, ",") {
-		if option != "" {
-			mountOptions = append(mountOptions, option)
-		}
-	}
-	if req.GetReadonly() {
-		mountOptions = append(mountOptions, "ro")
+	mountOptions := nfsMountOptions(ctx, req.GetVolumeContext(), readOnlyPublish(req.GetReadonly(), req.GetVolumeCapability()))
+	sourceIP, err := treeq.cs.nfsMountIP(ctx, req.GetVolumeContext())
+	if err != nil {
+		metrics.MountFailure("nfs_treeq")
+		return nil, status.Error(codes.Unavailable, err.Error())
 	}
-	sourceIP := req.GetVolumeContext()["ipAddress"]
 	ep := req.GetVolumeContext()["volumePath"]
 	source := fmt.Sprintf("%s:%s", sourceIP, ep)
-	log.Debugf("Mount sourcePath %v, tagetPath %v", source, targetPath)
-	err = treeq.mounter.Mount(source, targetPath, "nfs", mountOptions)
+	log.FromContext(ctx).Debugf("Mount sourcePath %v, tagetPath %v", source, targetPath)
+	err = mountNFS(ctx, treeq.mounter, source, targetPath, mountOptions)
 	if err != nil {
-		log.Errorf("fail to mount source path '%s' : %s", source, err)
+		metrics.MountFailure("nfs_treeq")
+		log.FromContext(ctx).Errorf("fail to mount source path '%s' : %s", source, err)
 		return nil, status.Errorf(codes.Internal, "Failed to mount target path '%s': %s", targetPath, err)
 	}
-	log.Debugf("pod successfully mounted to volumeID %s", req.GetVolumeId())
+	log.FromContext(ctx).Debugf("pod successfully mounted to volumeID %s", req.GetVolumeId())
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 func (treeq *treeqstorage) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	log.Debug("treeq NodeUnpublishVolume")
+	log.FromContext(ctx).Debug("treeq NodeUnpublishVolume")
 	targetPath := req.GetTargetPath()
 	notMnt, err := treeq.mounter.IsNotMountPoint(targetPath)
 	if err != nil {
 		if treeq.osHelper.IsNotExist(err) {
-			log.Warnf("mount point '%s' already doesn't exist: '%s', return OK", targetPath, err)
+			log.FromContext(ctx).Warnf("mount point '%s' already doesn't exist: '%s', return OK", targetPath, err)
 			return &csi.NodeUnpublishVolumeResponse{}, nil
 		}
 		return nil, err
@@ -85,7 +78,7 @@ func (treeq *treeqstorage) NodeUnpublishVolume(ctx context.Context, req *csi.Nod
 	if err := treeq.osHelper.Remove(targetPath); err != nil && !treeq.osHelper.IsNotExist(err) {
 		return nil, status.Errorf(codes.Internal, "Cannot remove unmounted target path '%s': %s", targetPath, err)
 	}
-	log.Debugf("pod successfully unmounted from volumeID %s", req.GetVolumeId())
+	log.FromContext(ctx).Debugf("pod successfully unmounted from volumeID %s", req.GetVolumeId())
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 